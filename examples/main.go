@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-
+	"errors"
 	"fmt"
 	"log"
 	"math"
@@ -14,16 +14,20 @@ import (
 
 func main() {
 	cfg := config.InitializeViperConfig("config", "yaml", ".")
+	if err := cfg.Validate("ollama.host", "ollama.model"); err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
 
 	// OLLAMA Example
 	ollamaBackend := backend.NewOllamaBackend(cfg.Get("ollama.host"), cfg.Get("ollama.model"))
+	defer ollamaBackend.Close()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
 	ollamaResponse, err := ollamaBackend.Generate(ctx, "Hello, how are you?")
 	if err != nil {
-		if err == context.DeadlineExceeded {
+		if errors.Is(err, context.DeadlineExceeded) {
 			log.Fatal("timeout while waiting for Ollama response")
 		}
 		log.Fatalf("failed to generate response: %v", err)
@@ -40,33 +44,26 @@ func main() {
 
 	// OpenAI Example
 	openaiBackend := backend.NewOpenAIBackend(cfg.Get("openai.api_key"), cfg.Get("openai.model"))
+	defer openaiBackend.Close()
 
 	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
 	openAIResponse, err := openaiBackend.Generate(ctx, "Hello, how are you?")
 	if err != nil {
-		if err == context.DeadlineExceeded {
+		if errors.Is(err, context.DeadlineExceeded) {
 			log.Fatal("Timeout while waiting for OpenAI response")
 		}
 		log.Fatalf("Failed to generate response from OpenAI: %v", err)
 	}
 
 	fmt.Printf("Model: %s\n", openAIResponse.Model)
-	fmt.Printf("Created At: %d\n", openAIResponse.Created)
-	fmt.Printf("ID: %s\n", openAIResponse.ID)
-	fmt.Printf("Object: %s\n", openAIResponse.Object)
-
-	if len(openAIResponse.Choices) > 0 {
-		fmt.Printf("Choice Index: %d\n", openAIResponse.Choices[0].Index)
-		fmt.Printf("Message Role: %s\n", openAIResponse.Choices[0].Message.Role)
-		fmt.Printf("Message Content: %s\n", openAIResponse.Choices[0].Message.Content)
-		fmt.Printf("Finish Reason: %s\n", openAIResponse.Choices[0].FinishReason)
-	}
-
-	fmt.Printf("Prompt Tokens: %d\n", openAIResponse.Usage.PromptTokens)
-	fmt.Printf("Completion Tokens: %d\n", openAIResponse.Usage.CompletionTokens)
-	fmt.Printf("Total Tokens: %d\n", openAIResponse.Usage.TotalTokens)
+	fmt.Printf("Created At: %s\n", openAIResponse.CreatedAt)
+	fmt.Printf("Message Role: %s\n", openAIResponse.Message.Role)
+	fmt.Printf("Message Content: %s\n", openAIResponse.Message.Content)
+	fmt.Printf("Finish Reason: %s\n", openAIResponse.DoneReason)
+	fmt.Printf("Prompt Tokens: %d\n", openAIResponse.PromptEvalCount)
+	fmt.Printf("Completion Tokens: %d\n", openAIResponse.EvalCount)
 
 	// Create a context with a timeout
 	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
@@ -0,0 +1,65 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+)
+
+// RunAgent runs the agent loop: it sends messages to be, runs the tool calls the
+// model requests with dispatcher, sends the results back and repeats until the
+// model replies without tool calls, which is its final answer. Tools advertises
+// the tools to the model; if it is nil, the tools added to dispatcher with
+// RegisterTool are advertised. Opts apply to every Chat request.
+//
+// At most maxIterations Chat requests are sent, so that a model that keeps
+// calling tools cannot loop forever; a maxIterations below one is treated as one.
+// If the reply to the last of them still requests tool calls, those are not run
+// and an error matching ErrMaxIterations is returned together with the history
+// and that reply.
+//
+// The returned messages are the input messages followed by every message of the
+// loop: the assistant messages, the tool results and the final answer, so that
+// they can be used to continue the conversation. If a request or a tool call
+// fails, the error is returned with the history up to the failure.
+func RunAgent(ctx context.Context, be Backend, messages []Message, tools []Tool, dispatcher *ToolDispatcher, maxIterations int, opts ...CallOption) ([]Message, *Response, error) {
+	if tools == nil {
+		tools = dispatcher.Tools()
+	}
+	maxIterations = max(maxIterations, 1)
+
+	history := make([]Message, 0, len(messages)+1)
+	history = append(history, messages...)
+	for iteration := 1; ; iteration++ {
+		resp, err := be.Chat(ctx, history, tools, opts...)
+		if err != nil {
+			return history, nil, fmt.Errorf("failed to run iteration %d: %w", iteration, err)
+		}
+		history = append(history, resp.Message)
+		if len(resp.Message.ToolCalls) == 0 {
+			return history, resp, nil
+		}
+		if iteration == maxIterations {
+			return history, resp, fmt.Errorf("%w: the model still requested tool calls after %d iterations", ErrMaxIterations, maxIterations)
+		}
+
+		results, err := dispatcher.toolResults(ctx, be, resp.Message.ToolCalls, 1)
+		if err != nil {
+			return history, resp, err
+		}
+		history = append(history, results...)
+	}
+}
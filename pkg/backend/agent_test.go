@@ -0,0 +1,116 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// toolCallingBackend requests a call of the counter tool until it has seen
+// rounds tool results, then answers with the last result.
+func toolCallingBackend(rounds int) *fakeBackend {
+	return &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			last := messages[len(messages)-1]
+			seen := 0
+			for _, msg := range messages {
+				if msg.Role == RoleTool {
+					seen++
+				}
+			}
+			if seen < rounds {
+				call := ToolCall{ID: fmt.Sprintf("call_%d", seen), Function: FunctionCall{Name: "counter"}}
+				return &Response{Message: Message{Role: RoleAssistant, ToolCalls: []ToolCall{call}}}, nil
+			}
+			return &Response{Message: AssistantMessage("Done at " + last.Content)}, nil
+		},
+	}
+}
+
+func counterDispatcher() *ToolDispatcher {
+	d := NewToolDispatcher()
+	count := 0
+	d.Register("counter", func(map[string]any) (string, error) {
+		count++
+		return fmt.Sprint(count), nil
+	})
+	return d
+}
+
+func TestRunAgent(t *testing.T) {
+	be := toolCallingBackend(2)
+	tools := []Tool{{"type": "function", "function": map[string]any{"name": "counter"}}}
+
+	history, resp, err := RunAgent(context.Background(), be, []Message{UserMessage("Count")}, tools, counterDispatcher(), 5)
+	if err != nil {
+		t.Fatalf("RunAgent returned error: %v", err)
+	}
+	if resp.Message.Content != "Done at 2" {
+		t.Errorf("Expected the final answer, got %q", resp.Message.Content)
+	}
+	roles := []string{RoleUser, RoleAssistant, RoleTool, RoleAssistant, RoleTool, RoleAssistant}
+	if len(history) != len(roles) {
+		t.Fatalf("Expected %d messages in the history, got %+v", len(roles), history)
+	}
+	for i, role := range roles {
+		if history[i].Role != role {
+			t.Errorf("Expected message %d to have role %s, got %s", i, role, history[i].Role)
+		}
+	}
+	if history[2].ToolCallID != "call_0" || history[4].ToolCallID != "call_1" {
+		t.Errorf("Expected the results to answer the calls, got %+v", history)
+	}
+	if len(be.received) != 3 {
+		t.Errorf("Expected 3 requests, got %d", len(be.received))
+	}
+}
+
+func TestRunAgentMaxIterations(t *testing.T) {
+	be := toolCallingBackend(10)
+
+	history, resp, err := RunAgent(context.Background(), be, []Message{UserMessage("Count")}, nil, counterDispatcher(), 3)
+	if !errors.Is(err, ErrMaxIterations) {
+		t.Fatalf("Expected ErrMaxIterations, got %v", err)
+	}
+	if len(be.received) != 3 {
+		t.Errorf("Expected 3 requests, got %d", len(be.received))
+	}
+	if resp == nil || len(resp.Message.ToolCalls) != 1 {
+		t.Errorf("Expected the last reply with its unanswered tool call, got %+v", resp)
+	}
+	// The user message, two rounds of calls and results and the last reply
+	if len(history) != 6 || history[5].Role != RoleAssistant {
+		t.Errorf("Expected the history up to the last reply, got %+v", history)
+	}
+}
+
+func TestRunAgentToolFailure(t *testing.T) {
+	be := toolCallingBackend(1)
+	d := NewToolDispatcher()
+	toolErr := errors.New("counter broken")
+	d.Register("counter", func(map[string]any) (string, error) {
+		return "", toolErr
+	})
+
+	history, _, err := RunAgent(context.Background(), be, []Message{UserMessage("Count")}, nil, d, 3)
+	if !errors.Is(err, toolErr) {
+		t.Errorf("Expected the tool error, got %v", err)
+	}
+	if len(history) != 2 {
+		t.Errorf("Expected the history up to the failed call, got %+v", history)
+	}
+}
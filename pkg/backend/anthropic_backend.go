@@ -0,0 +1,405 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAnthropicBaseURL   = "https://api.anthropic.com"
+	anthropicMessagesEndpoint = "/v1/messages"
+	anthropicModelsEndpoint   = "/v1/models"
+	anthropicVersion          = "2023-06-01"
+	// defaultAnthropicMaxTokens is sent as max_tokens, which the messages API requires.
+	defaultAnthropicMaxTokens = 4096
+	// anthropicJSONInstruction is added to the system prompt for WithJSONFormat,
+	// as the messages API has no dedicated JSON mode.
+	anthropicJSONInstruction = "Respond with a single valid JSON object and nothing else."
+)
+
+// AnthropicBackend represents a backend for interacting with the Anthropic messages API.
+// It holds the necessary credentials and configuration for making API requests.
+type AnthropicBackend struct {
+	APIKey     string
+	Model      string
+	HTTPClient *http.Client
+	BaseURL    string
+	// SystemPrompt is used for every conversation that has no system message.
+	SystemPrompt string
+	// RequestTimeout bounds every request that is not streamed. Zero means no limit
+	// other than the deadline of the context passed by the caller.
+	RequestTimeout time.Duration
+	// Headers are added to every request. They cannot replace the headers the
+	// backend sets itself, such as Content-Type and the API key.
+	Headers map[string]string
+	// UserAgent is sent in the User-Agent header of every request. Empty means
+	// DefaultUserAgent.
+	UserAgent string
+	// MaxRequestBytes is the size of the largest request body the backend sends.
+	// Zero means no limit.
+	MaxRequestBytes int
+	// Tokenizer counts the tokens of requests for the backend. Nil uses the
+	// counter EstimateTokens uses for the model.
+	Tokenizer Tokenizer
+	// UnsupportedOptions is what happens to call options the backend cannot
+	// honour, see WithUnsupportedOptions.
+	UnsupportedOptions UnsupportedOptionPolicy
+
+	// transport is the transport created for WithConnectionPool, if any.
+	transport *http.Transport
+}
+
+var (
+	_ Backend = (*AnthropicBackend)(nil)
+	_ Pinger  = (*AnthropicBackend)(nil)
+)
+
+// NewAnthropicBackend creates and returns a new AnthropicBackend instance.
+// It takes an API key and a Claude model name, e.g. "claude-3-5-sonnet-latest",
+// followed by optional settings such as WithBaseURL or WithHTTPClient.
+func NewAnthropicBackend(apiKey, model string, opts ...Option) *AnthropicBackend {
+	o := newOptions(opts)
+
+	baseURL := defaultAnthropicBaseURL
+	if o.baseURL != "" {
+		baseURL = o.baseURL
+	}
+
+	client, transport := newHTTPClient(o, 0)
+
+	return &AnthropicBackend{
+		APIKey:             apiKey,
+		Model:              model,
+		HTTPClient:         client,
+		BaseURL:            baseURL,
+		SystemPrompt:       o.systemPrompt,
+		RequestTimeout:     o.timeout,
+		Headers:            o.headers,
+		UserAgent:          o.userAgent,
+		MaxRequestBytes:    o.maxBodyBytes,
+		Tokenizer:          o.tokenizer,
+		UnsupportedOptions: o.unsupported,
+		transport:          transport,
+	}
+}
+
+// anthropicMessage is a chat message in the wire format of the messages API.
+type anthropicMessage struct {
+	Role    string                  `json:"role"`
+	Content []anthropicContentBlock `json:"content"`
+}
+
+// anthropicContentBlock is one block of the content of a message. The Type
+// decides which of the other fields are set.
+type anthropicContentBlock struct {
+	Type string `json:"type"`
+	// Text is set for "text" blocks.
+	Text string `json:"text,omitempty"`
+	// ID, Name and Input are set for "tool_use" blocks.
+	// Input is an interface so that an empty object is still sent.
+	ID    string `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Input any    `json:"input,omitempty"`
+	// ToolUseID and Content are set for "tool_result" blocks.
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+}
+
+// anthropicTool is a tool definition in the wire format of the messages API.
+type anthropicTool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	InputSchema any    `json:"input_schema"`
+}
+
+// AnthropicResponse represents the structure of the response received from the Anthropic messages API.
+type AnthropicResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []anthropicContentBlock `json:"content"`
+	StopReason   string                  `json:"stop_reason"`
+	StopSequence string                  `json:"stop_sequence"`
+	Usage        struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+// toAnthropicMessages translates messages into the wire format of the messages API.
+// System messages are returned separately, because Anthropic takes the system prompt
+// as a top-level field. Tool results are sent as tool_result blocks of a user message,
+// and consecutive results are merged because the API requires roles to alternate.
+func toAnthropicMessages(messages []Message) (string, []anthropicMessage) {
+	var system []string
+	var out []anthropicMessage
+	for _, msg := range messages {
+		switch msg.Role {
+		case RoleSystem:
+			system = append(system, msg.Content)
+		case RoleTool:
+			block := anthropicContentBlock{
+				Type:      "tool_result",
+				ToolUseID: msg.ToolCallID,
+				Content:   msg.Content,
+			}
+			if n := len(out); n > 0 && isToolResults(out[n-1]) {
+				out[n-1].Content = append(out[n-1].Content, block)
+				continue
+			}
+			out = append(out, anthropicMessage{Role: RoleUser, Content: []anthropicContentBlock{block}})
+		default:
+			var blocks []anthropicContentBlock
+			if msg.Content != "" {
+				blocks = append(blocks, anthropicContentBlock{Type: "text", Text: msg.Content})
+			}
+			for _, call := range msg.ToolCalls {
+				input := call.Function.Arguments
+				if input == nil {
+					// Anthropic requires the input of a tool_use block to be an object
+					input = map[string]any{}
+				}
+				blocks = append(blocks, anthropicContentBlock{
+					Type:  "tool_use",
+					ID:    call.ID,
+					Name:  call.Function.Name,
+					Input: input,
+				})
+			}
+			out = append(out, anthropicMessage{Role: msg.Role, Content: blocks})
+		}
+	}
+	return strings.Join(system, "\n\n"), out
+}
+
+// isToolResults reports whether msg is a user message carrying tool results.
+func isToolResults(msg anthropicMessage) bool {
+	return msg.Role == RoleUser && len(msg.Content) > 0 && msg.Content[0].Type == "tool_result"
+}
+
+// toAnthropicTools translates tool definitions in the Ollama and OpenAI
+// function format into the wire format of the messages API.
+func toAnthropicTools(tools []Tool) ([]anthropicTool, error) {
+	out := make([]anthropicTool, 0, len(tools))
+	for i, tool := range tools {
+		function, ok := tool["function"].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("tool %d has no function definition", i)
+		}
+		name, _ := function["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("tool %d has no name", i)
+		}
+		description, _ := function["description"].(string)
+
+		schema := function["parameters"]
+		if schema == nil {
+			schema = map[string]any{"type": "object", "properties": map[string]any{}}
+		}
+		out = append(out, anthropicTool{Name: name, Description: description, InputSchema: schema})
+	}
+	return out, nil
+}
+
+// Chat sends the conversation in messages to the Anthropic messages endpoint and returns the reply.
+// Tools use the same definitions as for Ollama. The text blocks of Claude's reply are
+// concatenated into the Content of the returned Message and its tool_use blocks are
+// available as ToolCalls.
+func (a *AnthropicBackend) Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	ctx, cancel := withRequestTimeout(ctx, a.RequestTimeout)
+	defer cancel()
+
+	callOpts, err := newModelCallOptions(a.Model, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := callOpts.checkSupported("Anthropic", a.UnsupportedOptions, anthropicUnsupportedOptions...); err != nil {
+		return nil, err
+	}
+
+	result, err := a.createMessage(ctx, messages, tools, callOpts)
+	if err != nil {
+		return dryRunResponse(a.Model, err)
+	}
+
+	return result.toResponse(), nil
+}
+
+// createMessage sends messages and tools to the messages endpoint and returns
+// the unmodified Anthropic response.
+func (a *AnthropicBackend) createMessage(ctx context.Context, messages []Message, tools []Tool, opts *Options) (*AnthropicResponse, error) {
+	messages, err := opts.withContextDocuments(a.Model, a.Tokenizer, withSystemPrompt(a.SystemPrompt, messages))
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.checkContext(a.Model, a.Tokenizer, messages); err != nil {
+		return nil, err
+	}
+	system, anthropicMessages := toAnthropicMessages(messages)
+	if opts.JSONFormat || opts.ResponseSchema != nil {
+		system = strings.TrimSpace(system + "\n\n" + anthropicJSONInstruction)
+	}
+
+	reqBody := map[string]interface{}{
+		"model":      a.Model,
+		"messages":   anthropicMessages,
+		"max_tokens": defaultAnthropicMaxTokens,
+	}
+	if system != "" {
+		reqBody["system"] = system
+	}
+	if opts.MaxTokens != nil {
+		reqBody["max_tokens"] = *opts.MaxTokens
+	}
+	if opts.Temperature != nil {
+		reqBody["temperature"] = *opts.Temperature
+	}
+	if opts.TopP != nil {
+		reqBody["top_p"] = *opts.TopP
+	}
+	if len(opts.StopSequences) > 0 {
+		reqBody["stop_sequences"] = opts.StopSequences
+	}
+	if err := opts.checkTools(tools); err != nil {
+		return nil, err
+	}
+	if len(tools) > 0 {
+		anthropicTools, err := toAnthropicTools(tools)
+		if err != nil {
+			return nil, err
+		}
+		reqBody["tools"] = anthropicTools
+		if choice := opts.ToolChoice; choice != nil {
+			if choice.Name == "" {
+				reqBody["tool_choice"] = map[string]string{"type": "none"}
+			} else {
+				reqBody["tool_choice"] = map[string]string{"type": "tool", "name": choice.Name}
+			}
+		}
+	}
+
+	if err := opts.dryRun(reqBody); err != nil {
+		return nil, err
+	}
+
+	resp, err := a.post(ctx, anthropicMessagesEndpoint, a.header(opts.Headers), reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate response from Anthropic: %w", err)
+	}
+
+	var result AnthropicResponse
+	if err := decodeResponse(ctx, resp, &result, opts); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// toResponse converts the Anthropic specific response into the backend-neutral Response.
+func (r *AnthropicResponse) toResponse() *Response {
+	var content strings.Builder
+	var toolCalls []ToolCall
+	for _, block := range r.Content {
+		switch block.Type {
+		case "text":
+			content.WriteString(block.Text)
+		case "tool_use":
+			args, _ := block.Input.(map[string]any)
+			toolCalls = append(toolCalls, ToolCall{
+				ID: block.ID,
+				Function: FunctionCall{
+					Name:      block.Name,
+					Arguments: args,
+				},
+			})
+		}
+	}
+
+	out := &Response{
+		Model:    r.Model,
+		Response: content.String(),
+		Message: Message{
+			Role:      r.Role,
+			Content:   content.String(),
+			ToolCalls: toolCalls,
+		},
+		Done:            true,
+		DoneReason:      r.StopReason,
+		Truncated:       r.StopReason == "max_tokens",
+		PromptEvalCount: r.Usage.InputTokens,
+		EvalCount:       r.Usage.OutputTokens,
+	}
+	out.setUsage(r.Usage.InputTokens, r.Usage.OutputTokens, 0)
+	out.setFinishReason(r.StopReason, anthropicFinishReasons)
+	return out
+}
+
+// anthropicUnsupportedOptions are the settings of Options Anthropic cannot honour.
+var anthropicUnsupportedOptions = append([]callOption{seedOption}, ollamaOnlyOptions...)
+
+// anthropicFinishReasons maps the stop reasons of Anthropic to the Finish constants.
+var anthropicFinishReasons = map[string]string{
+	"end_turn":      FinishStop,
+	"stop_sequence": FinishStop,
+	"max_tokens":    FinishLength,
+	"tool_use":      FinishToolCalls,
+	"refusal":       FinishContentFilter,
+}
+
+// Generate produces a response from the Anthropic API based on the given prompt.
+// The prompt is sent as a single user message to the messages endpoint.
+func (a *AnthropicBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	return a.Chat(ctx, []Message{UserMessage(prompt)}, nil, opts...)
+}
+
+// Close implements Backend. It works as OpenAIBackend.Close does.
+func (a *AnthropicBackend) Close() error {
+	return closeTransport(a.transport)
+}
+
+// Ping checks that the Anthropic API is reachable and accepts the API key by listing
+// the available models, which costs no tokens. It returns an error matching
+// ErrUnreachable if the server cannot be reached.
+func (a *AnthropicBackend) Ping(ctx context.Context) error {
+	ctx, cancel := withRequestTimeout(ctx, a.RequestTimeout)
+	defer cancel()
+
+	resp, err := getJSON(ctx, a.HTTPClient, a.BaseURL+anthropicModelsEndpoint, a.header(nil))
+	if err != nil {
+		return fmt.Errorf("failed to ping Anthropic: %w", unreachableError(a.BaseURL, err))
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// post sends body to the given Anthropic API endpoint with the given headers.
+func (a *AnthropicBackend) post(ctx context.Context, endpoint string, header http.Header, body any) (*http.Response, error) {
+	return postJSON(ctx, a.HTTPClient, a.BaseURL+endpoint, header, body, a.MaxRequestBytes)
+}
+
+// header returns the headers that authenticate a request and select the API version,
+// on top of the custom headers, including callHeaders set for the call.
+func (a *AnthropicBackend) header(callHeaders map[string]string) http.Header {
+	header := http.Header{}
+	header.Set("x-api-key", a.APIKey)
+	header.Set("anthropic-version", anthropicVersion)
+	return requestHeader(header, a.UserAgent, a.Headers, callHeaders)
+}
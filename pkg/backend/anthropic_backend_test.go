@@ -0,0 +1,287 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// anthropicRequest is the part of a messages API request the tests inspect.
+type anthropicRequest struct {
+	Model     string             `json:"model"`
+	System    string             `json:"system"`
+	MaxTokens int                `json:"max_tokens"`
+	Messages  []anthropicMessage `json:"messages"`
+	Tools     []anthropicTool    `json:"tools"`
+}
+
+func TestAnthropicChat(t *testing.T) {
+	received := make(chan anthropicRequest, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != anthropicMessagesEndpoint {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("x-api-key") != "test-api-key" {
+			t.Errorf("Expected x-api-key test-api-key, got %s", r.Header.Get("x-api-key"))
+		}
+		if r.Header.Get("anthropic-version") != anthropicVersion {
+			t.Errorf("Expected anthropic-version %s, got %s", anthropicVersion, r.Header.Get("anthropic-version"))
+		}
+
+		var reqBody anthropicRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"id": "msg_1",
+			"type": "message",
+			"role": "assistant",
+			"model": "claude-3-5-sonnet-latest",
+			"content": [
+				{"type": "text", "text": "Let me check. "},
+				{"type": "text", "text": "One moment."},
+				{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {"city": "Brno"}}
+			],
+			"stop_reason": "tool_use",
+			"usage": {"input_tokens": 12, "output_tokens": 7}
+		}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewAnthropicBackend("test-api-key", "claude-3-5-sonnet-latest", WithBaseURL(mockServer.URL))
+
+	messages := []Message{
+		SystemMessage("You are a weather bot."),
+		UserMessage("What's the weather in Brno?"),
+	}
+	tools := []Tool{{
+		"type": "function",
+		"function": map[string]any{
+			"name":        "get_weather",
+			"description": "Get the weather",
+			"parameters":  map[string]any{"type": "object"},
+		},
+	}}
+
+	response, err := backend.Chat(context.Background(), messages, tools)
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+
+	reqBody := <-received
+	if reqBody.System != "You are a weather bot." {
+		t.Errorf("Expected system prompt in the top-level field, got %q", reqBody.System)
+	}
+	if len(reqBody.Messages) != 1 || reqBody.Messages[0].Role != RoleUser {
+		t.Errorf("Expected only the user message, got %+v", reqBody.Messages)
+	}
+	if reqBody.MaxTokens != defaultAnthropicMaxTokens {
+		t.Errorf("Expected max_tokens %d, got %d", defaultAnthropicMaxTokens, reqBody.MaxTokens)
+	}
+	if len(reqBody.Tools) != 1 || reqBody.Tools[0].Name != "get_weather" || reqBody.Tools[0].Description != "Get the weather" {
+		t.Errorf("Unexpected tools: %+v", reqBody.Tools)
+	}
+
+	if response.Message.Content != "Let me check. One moment." {
+		t.Errorf("Expected flattened content, got %q", response.Message.Content)
+	}
+	if response.DoneReason != "tool_use" {
+		t.Errorf("Expected done reason tool_use, got %s", response.DoneReason)
+	}
+	if response.FinishReason != FinishToolCalls {
+		t.Errorf("Expected finish reason %s, got %s", FinishToolCalls, response.FinishReason)
+	}
+	if response.PromptEvalCount != 12 || response.EvalCount != 7 {
+		t.Errorf("Expected token counts 12 and 7, got %d and %d", response.PromptEvalCount, response.EvalCount)
+	}
+	if !response.UsageAvailable || response.Usage.PromptTokens != 12 || response.Usage.CompletionTokens != 7 {
+		t.Errorf("Unexpected usage: %+v", response.Usage)
+	}
+	if len(response.Message.ToolCalls) != 1 {
+		t.Fatalf("Expected 1 tool call, got %d", len(response.Message.ToolCalls))
+	}
+	call := response.Message.ToolCalls[0]
+	if call.ID != "toolu_1" || call.Function.Name != "get_weather" || call.Function.Arguments["city"] != "Brno" {
+		t.Errorf("Unexpected tool call: %+v", call)
+	}
+}
+
+func TestToAnthropicMessages(t *testing.T) {
+	messages := []Message{
+		SystemMessage("Be brief."),
+		UserMessage("Weather in Brno and Prague?"),
+		{
+			Role: RoleAssistant,
+			ToolCalls: []ToolCall{
+				{ID: "toolu_1", Function: FunctionCall{Name: "get_weather", Arguments: map[string]any{"city": "Brno"}}},
+				{ID: "toolu_2", Function: FunctionCall{Name: "get_weather"}},
+			},
+		},
+		ToolResultMessage("toolu_1", "get_weather", "sunny"),
+		ToolResultMessage("toolu_2", "get_weather", "rainy"),
+	}
+
+	system, out := toAnthropicMessages(messages)
+	if system != "Be brief." {
+		t.Errorf("Expected system prompt, got %q", system)
+	}
+	if len(out) != 3 {
+		t.Fatalf("Expected 3 messages, got %d: %+v", len(out), out)
+	}
+
+	assistant := out[1]
+	if len(assistant.Content) != 2 || assistant.Content[0].Type != "tool_use" || assistant.Content[0].ID != "toolu_1" {
+		t.Errorf("Unexpected assistant message: %+v", assistant)
+	}
+	encoded, err := json.Marshal(assistant.Content[1])
+	if err != nil {
+		t.Fatalf("Failed to marshal tool_use block: %v", err)
+	}
+	if !strings.Contains(string(encoded), `"input":{}`) {
+		t.Errorf("Expected empty input object for a call without arguments, got %s", encoded)
+	}
+
+	results := out[2]
+	if results.Role != RoleUser || len(results.Content) != 2 {
+		t.Fatalf("Expected one user message with both tool results, got %+v", results)
+	}
+	if results.Content[0].ToolUseID != "toolu_1" || results.Content[1].Content != "rainy" {
+		t.Errorf("Unexpected tool results: %+v", results.Content)
+	}
+}
+
+func TestAnthropicChatError(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"type": "error", "error": {"type": "rate_limit_error"}}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewAnthropicBackend("test-api-key", "claude-3-5-sonnet-latest", WithBaseURL(mockServer.URL))
+	_, err := backend.Generate(context.Background(), "Hi")
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Expected ErrRateLimited, got %v", err)
+	}
+}
+
+func TestAnthropicPing(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != anthropicModelsEndpoint {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("x-api-key") != "test-api-key" {
+			t.Errorf("Expected x-api-key test-api-key, got %s", r.Header.Get("x-api-key"))
+		}
+		w.Write([]byte(`{"data": []}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewAnthropicBackend("test-api-key", "claude-3-5-sonnet-latest", WithBaseURL(mockServer.URL))
+	if err := backend.Ping(context.Background()); err != nil {
+		t.Errorf("Ping returned error: %v", err)
+	}
+}
+
+func TestAnthropicToolChoice(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+		w.Write([]byte(`{"role": "assistant", "content": [{"type": "text", "text": "Hi"}], "stop_reason": "end_turn"}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewAnthropicBackend("test-api-key", "claude-3-5-sonnet-latest", WithBaseURL(mockServer.URL))
+	tools := []Tool{{"type": "function", "function": map[string]any{"name": "get_weather"}}}
+	messages := []Message{UserMessage("Weather?")}
+
+	if _, err := backend.Chat(context.Background(), messages, tools, WithToolChoice("get_weather")); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if choice, _ := (<-received)["tool_choice"].(map[string]any); choice["type"] != "tool" || choice["name"] != "get_weather" {
+		t.Errorf("Expected get_weather to be forced, got %v", choice)
+	}
+
+	if _, err := backend.Chat(context.Background(), messages, tools, WithToolChoiceNone()); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if choice, _ := (<-received)["tool_choice"].(map[string]any); choice["type"] != "none" {
+		t.Errorf("Expected tool_choice none, got %v", choice)
+	}
+
+	if _, err := backend.Chat(context.Background(), messages, tools); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if choice, ok := (<-received)["tool_choice"]; ok {
+		t.Errorf("Expected no tool_choice by default, got %v", choice)
+	}
+}
+
+func TestAnthropicUnsupportedOptions(t *testing.T) {
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"role": "assistant", "content": [{"type": "text", "text": "Hi"}], "stop_reason": "end_turn"}`))
+	}))
+	defer mockServer.Close()
+
+	var logged bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logged, nil)))
+
+	backend := NewAnthropicBackend("test-api-key", "claude-3-5-sonnet-latest", WithBaseURL(mockServer.URL))
+	if _, err := backend.Generate(context.Background(), "Hi", WithSeed(42)); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if logged.Len() != 0 {
+		t.Errorf("Expected the seed to be ignored silently, got %q", logged.String())
+	}
+
+	backend = NewAnthropicBackend("test-api-key", "claude-3-5-sonnet-latest", WithBaseURL(mockServer.URL),
+		WithUnsupportedOptions(WarnUnsupported))
+	if _, err := backend.Generate(context.Background(), "Hi", WithSeed(42), WithTemperature(0)); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if !strings.Contains(logged.String(), "level=WARN") || !strings.Contains(logged.String(), "option=seed") {
+		t.Errorf("Expected a warning about the seed, got %q", logged.String())
+	}
+
+	backend = NewAnthropicBackend("test-api-key", "claude-3-5-sonnet-latest", WithBaseURL(mockServer.URL),
+		WithUnsupportedOptions(RejectUnsupported))
+	if _, err := backend.Generate(context.Background(), "Hi", WithTemperature(0)); err != nil {
+		t.Fatalf("Generate returned error for a supported option: %v", err)
+	}
+	_, err := backend.Generate(context.Background(), "Hi", WithKeepAlive(time.Minute))
+	if !errors.Is(err, ErrUnsupportedOption) || !strings.Contains(err.Error(), "keep_alive") {
+		t.Errorf("Expected ErrUnsupportedOption for keep_alive, got %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("Expected the rejected request not to be sent, got %d requests", requests)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChatResult is the outcome of a request sent with ChatAsync.
+type ChatResult struct {
+	Response *Response
+	Err      error
+}
+
+// Progress reports how far a request sent with ChatAsync has got.
+type Progress struct {
+	// Content is the content of the reply received so far. It is only filled in
+	// as the reply arrives for backends that stream, see Streamer; for the others
+	// it is set once the request is done.
+	Content string
+	// Chunks is the number of streamed chunks with content received so far.
+	Chunks int
+	// Elapsed is the time since the request was sent, or the time it took once done.
+	Elapsed time.Duration
+	// Done is set once the request succeeded, failed or was canceled.
+	Done bool
+	// Usage is the usage of the request once it is done. It is only meaningful if
+	// UsageAvailable is set.
+	Usage Usage
+	// UsageAvailable is set if the backend reported usage for the request.
+	UsageAvailable bool
+}
+
+// RequestHandle is a request running in the background, returned by ChatAsync.
+// It lets an application that runs several requests at once, such as a chat UI,
+// follow and cancel each of them on its own. It is safe for concurrent use.
+type RequestHandle struct {
+	id      string
+	started time.Time
+	cancel  context.CancelFunc
+	result  chan ChatResult
+	done    chan struct{}
+
+	mu       sync.Mutex
+	content  strings.Builder
+	progress Progress
+	resp     *Response
+	err      error
+}
+
+// ChatAsync sends the conversation in messages to be in the background and
+// returns at once with a handle to the request. The request ends when it
+// completes, when ctx is done or when it is canceled with the Cancel method of
+// the handle, which only cancels this request.
+//
+// If be streams, see Streamer, the reply is streamed so that the Progress of the
+// handle reports the content as it arrives. Otherwise, and for wrappers around a
+// backend that does not stream, it is sent with Chat.
+func ChatAsync(ctx context.Context, be Backend, messages []Message, tools []Tool, opts ...CallOption) *RequestHandle {
+	ctx, cancel := context.WithCancel(ctx)
+	h := &RequestHandle{
+		id:      newRequestID(),
+		started: time.Now(),
+		cancel:  cancel,
+		result:  make(chan ChatResult, 1),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer cancel()
+		resp, err := h.run(ctx, be, messages, tools, opts)
+		h.finish(resp, err)
+	}()
+	return h
+}
+
+// ID returns an identifier of the request, unique within the process, e.g. to
+// tell requests apart in logs or to look up the handle of a request in a UI.
+func (h *RequestHandle) ID() string {
+	return h.id
+}
+
+// Cancel cancels the request. The request then fails with an error matching
+// ErrContextCanceled, unless it was already done. Cancel may be called several
+// times and after the request is done.
+func (h *RequestHandle) Cancel() {
+	h.cancel()
+}
+
+// Result returns a channel that receives the outcome of the request once it is
+// done and is then closed. The outcome is delivered only once; use Wait to get it
+// again.
+func (h *RequestHandle) Result() <-chan ChatResult {
+	return h.result
+}
+
+// Done returns a channel that is closed once the request is done.
+func (h *RequestHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait waits for the request to be done and returns its reply.
+func (h *RequestHandle) Wait() (*Response, error) {
+	<-h.done
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.resp, h.err
+}
+
+// Progress reports how far the request has got.
+func (h *RequestHandle) Progress() Progress {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p := h.progress
+	p.Content = h.content.String()
+	if !p.Done {
+		p.Elapsed = time.Since(h.started)
+	}
+	return p
+}
+
+// run sends the request, streaming the reply if be can.
+func (h *RequestHandle) run(ctx context.Context, be Backend, messages []Message, tools []Tool, opts []CallOption) (*Response, error) {
+	s, ok := be.(Streamer)
+	if !ok {
+		return be.Chat(ctx, messages, tools, opts...)
+	}
+	chunks, err := s.ChatStream(ctx, messages, tools, opts...)
+	if err != nil {
+		// A backend that answered, or a canceled request, fails for Chat as well
+		var backendErr *BackendError
+		if errors.As(err, &backendErr) || ctx.Err() != nil {
+			return nil, contextError(ctx, err)
+		}
+		return be.Chat(ctx, messages, tools, opts...)
+	}
+
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			return nil, contextError(ctx, chunk.Err)
+		}
+		if chunk.Content != "" && !chunk.Reasoning {
+			h.mu.Lock()
+			h.content.WriteString(chunk.Content)
+			h.progress.Chunks++
+			h.mu.Unlock()
+		}
+		if chunk.Done {
+			resp := chunk.Response
+			if resp == nil {
+				resp = assembleResponse(chunk, h.Progress().Content, "")
+			}
+			return resp, nil
+		}
+	}
+	return nil, contextError(ctx, fmt.Errorf("failed to read stream: %w", io.ErrUnexpectedEOF))
+}
+
+// finish records the outcome of the request and delivers it.
+func (h *RequestHandle) finish(resp *Response, err error) {
+	h.mu.Lock()
+	h.resp, h.err = resp, err
+	h.progress.Done = true
+	h.progress.Elapsed = time.Since(h.started)
+	if resp != nil {
+		h.content.Reset()
+		h.content.WriteString(resp.Content())
+		h.progress.Usage, h.progress.UsageAvailable = resp.Usage, resp.UsageAvailable
+	}
+	h.mu.Unlock()
+
+	h.result <- ChatResult{Response: resp, Err: err}
+	close(h.result)
+	close(h.done)
+}
+
+// newRequestID returns a random identifier for a request.
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return "req_" + hex.EncodeToString(b[:])
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChatAsyncStreamsProgress(t *testing.T) {
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoder := json.NewEncoder(w)
+		encoder.Encode(Response{Message: Message{Role: "assistant", Content: "Hello"}})
+		w.(http.Flusher).Flush()
+		<-release
+		encoder.Encode(Response{Message: Message{Role: "assistant", Content: ", world"}})
+		encoder.Encode(Response{Done: true, DoneReason: "stop", PromptEvalCount: 8, EvalCount: 3})
+	}))
+	defer mockServer.Close()
+	defer close(release)
+
+	backend := &OllamaBackend{Model: "test-model", Client: mockServer.Client(), BaseURL: mockServer.URL}
+	handle := ChatAsync(context.Background(), backend, []Message{UserMessage("Hi")}, nil)
+	if handle.ID() == "" {
+		t.Error("Expected the handle to have an ID")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for handle.Progress().Content != "Hello" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the first chunk in the progress, got %+v", handle.Progress())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if progress := handle.Progress(); progress.Done || progress.Chunks != 1 {
+		t.Errorf("Unexpected progress mid stream: %+v", progress)
+	}
+	release <- struct{}{}
+
+	result := <-handle.Result()
+	if result.Err != nil {
+		t.Fatalf("Request failed: %v", result.Err)
+	}
+	if result.Response.Message.Content != "Hello, world" {
+		t.Errorf("Expected Hello, world, got %q", result.Response.Message.Content)
+	}
+	progress := handle.Progress()
+	if !progress.Done || !progress.UsageAvailable || progress.Usage.CompletionTokens != 3 {
+		t.Errorf("Expected the usage once done, got %+v", progress)
+	}
+	if resp, err := handle.Wait(); err != nil || resp != result.Response {
+		t.Errorf("Expected Wait to return the result again, got %v, %v", resp, err)
+	}
+}
+
+func TestChatAsyncCancel(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices that the client went away once the body is read
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	defer mockServer.Close()
+
+	backend := &OllamaBackend{Model: "test-model", Client: mockServer.Client(), BaseURL: mockServer.URL}
+	first := ChatAsync(context.Background(), backend, []Message{UserMessage("Hi")}, nil)
+	second := ChatAsync(context.Background(), backend, []Message{UserMessage("Hi")}, nil)
+	if first.ID() == second.ID() {
+		t.Errorf("Expected distinct IDs, got %s twice", first.ID())
+	}
+
+	first.Cancel()
+	select {
+	case <-first.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Canceled request did not end")
+	}
+	if _, err := first.Wait(); !errors.Is(err, ErrContextCanceled) {
+		t.Errorf("Expected ErrContextCanceled, got %v", err)
+	}
+	select {
+	case <-second.Done():
+		t.Error("Canceling one request ended the other")
+	case <-time.After(50 * time.Millisecond):
+	}
+	second.Cancel()
+	<-second.Done()
+}
+
+func TestChatAsyncWithoutStreaming(t *testing.T) {
+	fake := &fakeBackend{chat: func([]Message) (*Response, error) {
+		resp := &Response{Message: Message{Role: RoleAssistant, Content: "done"}}
+		resp.setUsage(4, 2, 0)
+		return resp, nil
+	}}
+
+	// The cache streams only if the backend it wraps does, so it falls back to Chat
+	for _, be := range []Backend{fake, WithCache(fake, NewLRUCache(10))} {
+		resp, err := ChatAsync(context.Background(), be, []Message{UserMessage("Hi")}, nil).Wait()
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if resp.Message.Content != "done" {
+			t.Errorf("Expected done, got %q", resp.Message.Content)
+		}
+	}
+
+	handle := ChatAsync(context.Background(), fake, []Message{UserMessage("Hi")}, nil)
+	<-handle.Done()
+	if progress := handle.Progress(); progress.Content != "done" || progress.Usage.PromptTokens != 4 {
+		t.Errorf("Unexpected progress: %+v", progress)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"time"
+)
+
+// Backend is the interface implemented by every LLM backend in this package.
+// Application code should depend on Backend rather than on a concrete type so
+// that providers can be swapped, or replaced with a fake in tests.
+type Backend interface {
+	// Chat sends the conversation in messages to the model and returns its reply.
+	// The tools slice advertises functions the model may call; it may be nil.
+	Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error)
+
+	// Generate produces a single completion for the given prompt.
+	Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error)
+
+	// Close releases the resources held by the backend, such as connection pools
+	// or background goroutines. Call it once, at shutdown, after the last request;
+	// the backend must not be used afterwards. Wrappers such as WithRetry close
+	// the backend they wrap.
+	Close() error
+}
+
+// Streamer is implemented by backends that can stream the reply to a chat as it is generated.
+type Streamer interface {
+	// ChatStream works like Chat but delivers the reply in chunks. The channel is
+	// closed when the stream ends; a failure is delivered as a chunk with Err set.
+	ChatStream(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (<-chan StreamChunk, error)
+}
+
+// Pinger is implemented by backends that can check whether their server is
+// reachable, e.g. for a readiness probe.
+type Pinger interface {
+	// Ping returns nil if the backend server is reachable and accepts requests.
+	Ping(ctx context.Context) error
+}
+
+// Message is a single turn in a chat conversation.
+// It marshals to the JSON layout of a message in the Ollama chat API.
+type Message struct {
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallID links a "tool" role message to the ToolCall it answers.
+	// Backends that do not identify tool calls ignore it.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	// Name is the name of the tool that produced a "tool" role message, or of
+	// the participant who wrote another message, e.g. in a group chat. Only
+	// OpenAI tells the model who wrote a message; other backends ignore it.
+	Name string `json:"name,omitempty"`
+	// Images holds raw image data, e.g. the contents of a PNG or JPEG file, for
+	// vision models such as llava. It is base64 encoded in the JSON form, as
+	// expected by Ollama. Only the Ollama backend sends images; models without
+	// vision support ignore them or fail with a BackendError.
+	Images [][]byte `json:"images,omitempty"`
+}
+
+// Tool is a function definition advertised to the model, using the
+// JSON layout expected by the Ollama API, e.g.
+//
+//	{"type": "function", "function": {"name": ..., "description": ..., "parameters": {...}}}
+type Tool = map[string]any
+
+// ToolCall is a request from the model to invoke one of the advertised tools.
+type ToolCall struct {
+	// ID identifies the call for backends that require tool results to
+	// reference it, such as OpenAI. It is empty for Ollama.
+	ID       string       `json:"id,omitempty"`
+	Function FunctionCall `json:"function"`
+}
+
+// FunctionCall holds the name of the function the model wants to call and
+// the arguments it wants to call it with.
+type FunctionCall struct {
+	Name      string         `json:"name"`
+	Arguments map[string]any `json:"arguments"`
+}
+
+// Response represents the structure of the response received from a backend.
+// It mirrors the Ollama API: Generate populates Response, Chat populates Message,
+// and both carry model details and performance metrics where available.
+type Response struct {
+	Model              string  `json:"model"`
+	CreatedAt          string  `json:"created_at"`
+	Response           string  `json:"response"`
+	Message            Message `json:"message"`
+	Done               bool    `json:"done"`
+	DoneReason         string  `json:"done_reason"`
+	Context            []int   `json:"context"`
+	TotalDuration      int64   `json:"total_duration"`
+	LoadDuration       int64   `json:"load_duration"`
+	PromptEvalCount    int     `json:"prompt_eval_count"`
+	PromptEvalDuration int64   `json:"prompt_eval_duration"`
+	EvalCount          int     `json:"eval_count"`
+	EvalDuration       int64   `json:"eval_duration"`
+
+	// Usage reports the tokens and time consumed by the request, in the same
+	// form for every backend. It is only meaningful if UsageAvailable is set.
+	Usage Usage `json:"-"`
+	// UsageAvailable is set if the backend reported usage for the request.
+	UsageAvailable bool `json:"-"`
+	// Truncated is set if generation stopped because it reached the maximum
+	// number of tokens, e.g. set with WithMaxTokens, rather than at a natural end.
+	// The backend specific reason is in DoneReason.
+	Truncated bool `json:"-"`
+	// FinishReason is why generation ended, normalized to one of the Finish
+	// constants. It is empty if the backend did not report a reason.
+	FinishReason string `json:"-"`
+	// Reasoning is the reasoning of models such as DeepSeek-R1, which they emit
+	// wrapped in <think> tags before the answer. It is removed from the content of
+	// the reply, so Message.Content and Response only hold the answer.
+	Reasoning string `json:"-"`
+	// DryRunRequest is the JSON body that would have been sent for a request
+	// made with WithDryRun. It is only set for such requests, which are not sent,
+	// so the rest of the Response is empty but for Model.
+	DryRunRequest []byte `json:"-"`
+
+	// local is set for replies of a model run locally, which cost nothing.
+	local bool
+}
+
+// Normalized reasons for the end of generation, reported in Response.FinishReason.
+const (
+	// FinishStop means the model ended its reply naturally or at a stop sequence.
+	FinishStop = "stop"
+	// FinishLength means generation was cut off at the maximum number of tokens.
+	FinishLength = "length"
+	// FinishToolCalls means the model stopped to request tool calls.
+	FinishToolCalls = "tool_calls"
+	// FinishContentFilter means the reply was withheld or cut off by a content filter.
+	FinishContentFilter = "content_filter"
+	// FinishOther is reported for backend specific reasons without a normalized equivalent.
+	FinishOther = "other"
+)
+
+// Usage holds the resources consumed by a single request.
+// Fields a backend does not report are left zero.
+type Usage struct {
+	// PromptTokens is the number of tokens in the input.
+	PromptTokens int
+	// CompletionTokens is the number of tokens generated.
+	CompletionTokens int
+	// TotalDuration is the time the backend spent on the request.
+	TotalDuration time.Duration
+}
+
+// setUsage records the usage reported by the backend.
+func (r *Response) setUsage(promptTokens, completionTokens int, totalDuration time.Duration) {
+	r.Usage = Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalDuration:    totalDuration,
+	}
+	r.UsageAvailable = true
+}
+
+// setFinishReason sets FinishReason to the normalized form of the backend specific
+// reason, translated with reasons. Unknown reasons are reported as FinishOther. As
+// some backends report a natural stop even when the reply requests tool calls,
+// it must be called after Message is set.
+func (r *Response) setFinishReason(reason string, reasons map[string]string) {
+	switch normalized, ok := reasons[reason]; {
+	case reason == "":
+		r.FinishReason = ""
+	case ok:
+		r.FinishReason = normalized
+	default:
+		r.FinishReason = FinishOther
+	}
+	if r.FinishReason == FinishStop && len(r.Message.ToolCalls) > 0 {
+		r.FinishReason = FinishToolCalls
+	}
+}
+
+// StreamChunk is a single incremental piece of a streamed response.
+type StreamChunk struct {
+	// Content is the text generated since the previous chunk.
+	Content string
+	// Reasoning is set if Content is part of the reasoning of the model rather
+	// than of the answer, see Response.Reasoning. The <think> tags are removed.
+	Reasoning bool
+	// Done is set on the last chunk of a successful stream.
+	Done bool
+	// ToolCalls is set on the last chunk of a successful stream if the model
+	// requested tool calls. Calls whose arguments were streamed in fragments are
+	// only delivered once they are complete.
+	ToolCalls []ToolCall
+	// ToolCallReady is set on a chunk of its own, without content, as soon as the
+	// arguments of a tool call are complete, so that an agent can start running
+	// the call while the model goes on generating. Every call requested by the
+	// model is delivered this way once, in the order the model requested them and
+	// after the content generated before it, and always before the last chunk,
+	// whose ToolCalls still holds all of them.
+	ToolCallReady *ToolCall
+	// Usage is set on the last chunk of a successful stream to the token usage of
+	// the whole reply. It is only meaningful if UsageAvailable is set.
+	Usage Usage
+	// UsageAvailable is set if the backend reported usage for the stream.
+	UsageAvailable bool
+	// Response is set on the last chunk of a successful stream to the complete
+	// reply assembled from the stream, as Chat would have returned it: the full
+	// content and reasoning, the tool calls, the usage and the finish reason. It
+	// saves callers that persist replies from accumulating the chunks themselves.
+	Response *Response
+	// Err is set on the last chunk if the stream failed part way through.
+	Err error
+}
@@ -0,0 +1,223 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backendtest provides helpers for testing code that uses a backend.Backend
+// without running a model.
+package backendtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/stackloklabs/gollm/pkg/backend"
+)
+
+// ErrNoResponse is returned by MockBackend when it is called more often than
+// responses were queued.
+var ErrNoResponse = errors.New("no response queued")
+
+// Call records a single call made to a MockBackend.
+type Call struct {
+	// Messages holds the conversation passed to Chat, or nil for Generate.
+	Messages []backend.Message
+	// Tools holds the tools passed to Chat.
+	Tools []backend.Tool
+	// Prompt holds the prompt passed to Generate.
+	Prompt string
+	// Options holds the per-call options the call was made with.
+	Options *backend.Options
+}
+
+// reply is a queued result of a call.
+type reply struct {
+	resp *backend.Response
+	err  error
+}
+
+// MockBackend is a backend.Backend that returns canned responses in the order
+// they were queued and records the calls made to it. Chat and Generate share
+// the same queue. It is safe for concurrent use.
+type MockBackend struct {
+	mu       sync.Mutex
+	replies  []reply
+	failures map[int]error
+	calls    []Call
+	closed   int
+}
+
+var _ backend.Backend = (*MockBackend)(nil)
+
+// NewMockBackend creates and returns a MockBackend that replies with responses, in order.
+func NewMockBackend(responses ...*backend.Response) *MockBackend {
+	m := &MockBackend{failures: make(map[int]error)}
+	m.QueueResponse(responses...)
+	return m
+}
+
+// QueueResponse adds responses to the end of the queue.
+func (m *MockBackend) QueueResponse(responses ...*backend.Response) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, resp := range responses {
+		m.replies = append(m.replies, reply{resp: resp})
+	}
+}
+
+// QueueError adds a call that fails with err to the end of the queue.
+func (m *MockBackend) QueueError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.replies = append(m.replies, reply{err: err})
+}
+
+// QueueToolCalls scripts a tool calling turn: the next reply requests calls and
+// the one after it is the final answer with the given content.
+func (m *MockBackend) QueueToolCalls(final string, calls ...backend.ToolCall) {
+	m.QueueResponse(ToolCallResponse(calls...), TextResponse(final))
+}
+
+// FailOnCall makes the n-th call, counting from 1, fail with err. The failing
+// call does not consume a queued response, which makes it easy to test retries.
+func (m *MockBackend) FailOnCall(n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures[n] = err
+}
+
+// Calls returns the calls made so far, in order.
+func (m *MockBackend) Calls() []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Call(nil), m.calls...)
+}
+
+// CallCount returns the number of calls made so far.
+func (m *MockBackend) CallCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.calls)
+}
+
+// LastMessages returns the messages of the most recent Chat call, or nil if Chat was not called.
+func (m *MockBackend) LastMessages() []backend.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.calls) - 1; i >= 0; i-- {
+		if m.calls[i].Messages != nil {
+			return m.calls[i].Messages
+		}
+	}
+	return nil
+}
+
+// Chat records the call and returns the next queued reply.
+func (m *MockBackend) Chat(ctx context.Context, messages []backend.Message, tools []backend.Tool, opts ...backend.CallOption) (*backend.Response, error) {
+	return m.next(ctx, Call{
+		Messages: append([]backend.Message{}, messages...),
+		Tools:    tools,
+		Options:  callOptions(opts),
+	})
+}
+
+// Generate records the call and returns the next queued reply.
+func (m *MockBackend) Generate(ctx context.Context, prompt string, opts ...backend.CallOption) (*backend.Response, error) {
+	return m.next(ctx, Call{
+		Prompt:  prompt,
+		Options: callOptions(opts),
+	})
+}
+
+// Close records that the backend was closed, see Closed.
+func (m *MockBackend) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed++
+	return nil
+}
+
+// Closed returns the number of times Close was called, e.g. to check that the
+// code under test closes its backend exactly once at shutdown.
+func (m *MockBackend) Closed() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+// next records call and pops the reply for it.
+func (m *MockBackend) next(ctx context.Context, call Call) (*backend.Response, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.calls = append(m.calls, call)
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", backend.ErrContextCanceled, err)
+	}
+	if err := call.Options.Validate(); err != nil {
+		return nil, err
+	}
+	if err, ok := m.failures[len(m.calls)]; ok {
+		return nil, err
+	}
+	if len(m.replies) == 0 {
+		return nil, fmt.Errorf("call %d: %w", len(m.calls), ErrNoResponse)
+	}
+
+	r := m.replies[0]
+	m.replies = m.replies[1:]
+	return r.resp, r.err
+}
+
+// callOptions applies opts to empty Options. Like a real backend, the mock
+// fails calls with invalid options, see next.
+func callOptions(opts []backend.CallOption) *backend.Options {
+	o := &backend.Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// TextResponse returns a finished assistant reply with the given content.
+func TextResponse(content string) *backend.Response {
+	return &backend.Response{
+		Response:   content,
+		Message:    backend.AssistantMessage(content),
+		Done:       true,
+		DoneReason: "stop",
+	}
+}
+
+// ToolCallResponse returns an assistant reply that requests the given tool calls.
+func ToolCallResponse(calls ...backend.ToolCall) *backend.Response {
+	msg := backend.AssistantMessage("")
+	msg.ToolCalls = calls
+	return &backend.Response{
+		Message:    msg,
+		Done:       true,
+		DoneReason: "tool_calls",
+	}
+}
+
+// NewToolCall returns a call of the named tool with the given arguments.
+func NewToolCall(id, name string, args map[string]any) backend.ToolCall {
+	return backend.ToolCall{
+		ID: id,
+		Function: backend.FunctionCall{
+			Name:      name,
+			Arguments: args,
+		},
+	}
+}
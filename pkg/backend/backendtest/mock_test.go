@@ -0,0 +1,116 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backendtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stackloklabs/gollm/pkg/backend"
+)
+
+func TestMockBackendQueue(t *testing.T) {
+	mock := NewMockBackend(TextResponse("first"))
+	mock.QueueError(backend.ErrModelNotFound)
+
+	resp, err := mock.Chat(context.Background(), []backend.Message{backend.UserMessage("Hi")}, nil, backend.WithJSONFormat())
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if resp.Message.Content != "first" {
+		t.Errorf("Expected first, got %s", resp.Message.Content)
+	}
+
+	if _, err := mock.Generate(context.Background(), "again"); !errors.Is(err, backend.ErrModelNotFound) {
+		t.Errorf("Expected ErrModelNotFound, got %v", err)
+	}
+	if _, err := mock.Generate(context.Background(), "once more"); !errors.Is(err, ErrNoResponse) {
+		t.Errorf("Expected ErrNoResponse, got %v", err)
+	}
+
+	calls := mock.Calls()
+	if len(calls) != 3 {
+		t.Fatalf("Expected 3 calls, got %d", len(calls))
+	}
+	if calls[0].Messages[0].Content != "Hi" || !calls[0].Options.JSONFormat {
+		t.Errorf("Unexpected first call: %+v", calls[0])
+	}
+	if calls[1].Prompt != "again" {
+		t.Errorf("Expected prompt again, got %s", calls[1].Prompt)
+	}
+}
+
+func TestMockBackendFailOnCall(t *testing.T) {
+	mock := NewMockBackend(TextResponse("recovered"))
+	mock.FailOnCall(1, &backend.BackendError{StatusCode: 503, Retryable: true})
+
+	retried := backend.WithRetry(mock, backend.RetryConfig{MaxAttempts: 3})
+	resp, err := retried.Generate(context.Background(), "Hi")
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if resp.Message.Content != "recovered" {
+		t.Errorf("Expected recovered, got %s", resp.Message.Content)
+	}
+	if mock.CallCount() != 2 {
+		t.Errorf("Expected 2 calls, got %d", mock.CallCount())
+	}
+}
+
+func TestMockBackendToolCalls(t *testing.T) {
+	mock := NewMockBackend()
+	mock.QueueToolCalls("It is sunny in Brno.", NewToolCall("call_1", "get_weather", map[string]any{"city": "Brno"}))
+
+	dispatcher := backend.NewToolDispatcher()
+	dispatcher.Register("get_weather", func(args map[string]any) (string, error) {
+		return "sunny", nil
+	})
+
+	messages := []backend.Message{backend.UserMessage("Weather in Brno?")}
+	resp, err := mock.Chat(context.Background(), messages, nil)
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	_, final, err := dispatcher.RunToolCalls(context.Background(), mock, messages, resp, nil)
+	if err != nil {
+		t.Fatalf("RunToolCalls returned error: %v", err)
+	}
+	if final.Message.Content != "It is sunny in Brno." {
+		t.Errorf("Unexpected final answer: %s", final.Message.Content)
+	}
+
+	last := mock.LastMessages()
+	if len(last) != 3 || last[2].Role != backend.RoleTool || last[2].Content != "sunny" {
+		t.Errorf("Expected the tool result to be sent back, got %+v", last)
+	}
+}
+
+func TestMockBackendInvalidOption(t *testing.T) {
+	mock := NewMockBackend(TextResponse("unused"))
+	if _, err := mock.Generate(context.Background(), "Hi", backend.WithTemperature(3)); !errors.Is(err, backend.ErrInvalidOption) {
+		t.Errorf("Expected ErrInvalidOption, got %v", err)
+	}
+}
+
+func TestMockBackendClose(t *testing.T) {
+	mock := NewMockBackend()
+	be := backend.WithRetry(mock, backend.DefaultRetryConfig())
+	if err := be.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if mock.Closed() != 1 {
+		t.Errorf("Expected the mock to be closed once, got %d", mock.Closed())
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backendtest
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stackloklabs/gollm/pkg/backend"
+)
+
+// embeddingDimensions is the length of the vectors of the default embedder of a FakeOllama.
+const embeddingDimensions = 8
+
+// OllamaRequest is a request received by a FakeOllama, decoded from the JSON
+// layout of the Ollama API.
+type OllamaRequest struct {
+	// Method and Path are those of the HTTP request, e.g. POST and "/api/chat".
+	Method string
+	Path   string
+	// Header holds the headers of the HTTP request.
+	Header http.Header
+	// Body is the decoded JSON body, nil for requests without one.
+	Body map[string]any
+	// Model is the model the request is for.
+	Model string
+	// Messages holds the conversation of a chat request.
+	Messages []backend.Message
+	// Prompt is the prompt of a generate request.
+	Prompt string
+	// Input holds the texts of an embeddings request.
+	Input []string
+	// Stream is set if the reply is to be streamed.
+	Stream bool
+}
+
+// OllamaHandler scripts the reply of a FakeOllama to a chat or generate request.
+// An error fails the request: a *backend.BackendError with its status code and
+// body, an error matching backend.ErrModelNotFound or backend.ErrRateLimited with
+// 404 or 429, as Ollama would, and any other error with 500.
+type OllamaHandler func(req *OllamaRequest) (*backend.Response, error)
+
+// Replies returns an OllamaHandler that replies with responses in order and
+// fails the requests that follow with ErrNoResponse.
+func Replies(responses ...*backend.Response) OllamaHandler {
+	var mu sync.Mutex
+	return func(*OllamaRequest) (*backend.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(responses) == 0 {
+			return nil, ErrNoResponse
+		}
+		resp := responses[0]
+		responses = responses[1:]
+		return resp, nil
+	}
+}
+
+// FakeOllama is an in-process HTTP server that speaks enough of the Ollama API to
+// drive a backend.OllamaBackend in tests and benchmarks: chat and generate, both
+// streamed and not, embeddings, the list of models and the root endpoint that
+// Ping uses. It records every request it receives. It is safe for concurrent use;
+// the handler may be called concurrently.
+type FakeOllama struct {
+	*httptest.Server
+
+	handler OllamaHandler
+
+	mu       sync.Mutex
+	requests []OllamaRequest
+	models   []backend.ModelInfo
+	embedder func(text string) []float32
+}
+
+// NewFakeOllama starts and returns a FakeOllama that replies to chat and generate
+// requests with handler. Nil replies with an empty answer. Close the server once
+// done.
+func NewFakeOllama(handler OllamaHandler) *FakeOllama {
+	if handler == nil {
+		handler = func(*OllamaRequest) (*backend.Response, error) {
+			return TextResponse(""), nil
+		}
+	}
+	f := &FakeOllama{handler: handler, embedder: fakeEmbedding}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+// Backend returns an OllamaBackend for model that sends its requests to f.
+func (f *FakeOllama) Backend(model string, opts ...backend.Option) *backend.OllamaBackend {
+	return backend.NewOllamaBackend(f.URL, model, opts...)
+}
+
+// SetModels sets the models listed by the server. Once set, requests for other
+// models fail with 404, as with Ollama for a model that has not been pulled.
+func (f *FakeOllama) SetModels(models ...backend.ModelInfo) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.models = models
+}
+
+// SetEmbedder makes the server generate embeddings with embed. By default every
+// text gets a vector of 8 dimensions derived from a hash of the text, so equal
+// texts have equal embeddings.
+func (f *FakeOllama) SetEmbedder(embed func(text string) []float32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.embedder = embed
+}
+
+// Requests returns the requests received so far, in order.
+func (f *FakeOllama) Requests() []OllamaRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]OllamaRequest(nil), f.requests...)
+}
+
+// LastRequest returns the most recent request, or nil if none was received.
+func (f *FakeOllama) LastRequest() *OllamaRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.requests) == 0 {
+		return nil
+	}
+	req := f.requests[len(f.requests)-1]
+	return &req
+}
+
+// serveHTTP records the request and replies to it.
+func (f *FakeOllama) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeOllamaRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, *req)
+	known := f.knownModel(req.Model)
+	embed := f.embedder
+	f.mu.Unlock()
+
+	if req.Model != "" && !known {
+		writeError(w, http.StatusNotFound, "model '"+req.Model+"' not found")
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && req.Path == "/":
+		w.Write([]byte("Ollama is running"))
+	case r.Method == http.MethodGet && req.Path == "/api/tags":
+		f.mu.Lock()
+		models := append([]backend.ModelInfo{}, f.models...)
+		f.mu.Unlock()
+		writeJSON(w, map[string]any{"models": models})
+	case r.Method == http.MethodPost && (req.Path == "/api/chat" || req.Path == "/api/generate"):
+		f.reply(w, req)
+	case r.Method == http.MethodPost && req.Path == "/api/embeddings":
+		writeJSON(w, map[string]any{"embedding": embed(req.Prompt)})
+	case r.Method == http.MethodPost && req.Path == "/api/embed":
+		embeddings := make([][]float32, len(req.Input))
+		for i, input := range req.Input {
+			embeddings[i] = embed(input)
+		}
+		writeJSON(w, map[string]any{"model": req.Model, "embeddings": embeddings})
+	default:
+		writeError(w, http.StatusNotFound, "404 page not found")
+	}
+}
+
+// knownModel reports whether model is among the models set with SetModels, if
+// any were. A name without a tag refers to the "latest" tag. The caller must
+// hold mu.
+func (f *FakeOllama) knownModel(model string) bool {
+	if f.models == nil {
+		return true
+	}
+	for _, m := range f.models {
+		if withLatestTag(m.Name) == withLatestTag(model) {
+			return true
+		}
+	}
+	return false
+}
+
+// withLatestTag returns name with the "latest" tag appended if it has no tag.
+func withLatestTag(name string) string {
+	if strings.Contains(name, ":") {
+		return name
+	}
+	return name + ":latest"
+}
+
+// reply writes the reply of the handler to a chat or generate request.
+func (f *FakeOllama) reply(w http.ResponseWriter, req *OllamaRequest) {
+	resp, err := f.handler(req)
+	if err != nil {
+		var backendErr *backend.BackendError
+		switch {
+		case errors.As(err, &backendErr):
+			writeError(w, backendErr.StatusCode, backendErr.Body)
+		case errors.Is(err, backend.ErrModelNotFound):
+			writeError(w, http.StatusNotFound, err.Error())
+		case errors.Is(err, backend.ErrRateLimited):
+			writeError(w, http.StatusTooManyRequests, err.Error())
+		default:
+			writeError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	if resp == nil {
+		resp = TextResponse("")
+	}
+
+	out := *resp
+	if out.Model == "" {
+		out.Model = req.Model
+	}
+	if out.CreatedAt == "" {
+		out.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	if out.DoneReason == "" {
+		out.DoneReason = "stop"
+	}
+	out.Done = true
+	chat := req.Path == "/api/chat"
+	if chat {
+		if out.Message.Role == "" {
+			out.Message.Role = backend.RoleAssistant
+		}
+		if out.Message.Content == "" {
+			out.Message.Content = out.Response
+		}
+		out.Response = ""
+	} else {
+		if out.Response == "" {
+			out.Response = out.Message.Content
+		}
+		out.Message = backend.Message{}
+	}
+
+	if !req.Stream {
+		writeJSON(w, out)
+		return
+	}
+
+	// Stream the content word by word, one JSON object per line, as Ollama does,
+	// with the tool calls, metrics and done reason on the last line.
+	content := out.Response
+	if chat {
+		content = out.Message.Content
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	for _, word := range strings.SplitAfter(content, " ") {
+		if word == "" {
+			continue
+		}
+		part := backend.Response{Model: out.Model, CreatedAt: out.CreatedAt}
+		if chat {
+			part.Message = backend.Message{Role: backend.RoleAssistant, Content: word}
+		} else {
+			part.Response = word
+		}
+		if err := encoder.Encode(part); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if chat {
+		out.Message.Content = ""
+	} else {
+		out.Response = ""
+	}
+	encoder.Encode(out)
+}
+
+// decodeOllamaRequest decodes the body of r, if any.
+func decodeOllamaRequest(r *http.Request) (*OllamaRequest, error) {
+	req := &OllamaRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone()}
+	if r.Method != http.MethodPost {
+		return req, nil
+	}
+
+	var body struct {
+		Model    string            `json:"model"`
+		Messages []backend.Message `json:"messages"`
+		Prompt   string            `json:"prompt"`
+		Input    json.RawMessage   `json:"input"`
+		Stream   *bool             `json:"stream"`
+	}
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &req.Body); err != nil {
+		return nil, err
+	}
+	req.Model, req.Messages, req.Prompt = body.Model, body.Messages, body.Prompt
+	// Ollama streams unless told otherwise
+	req.Stream = body.Stream == nil || *body.Stream
+	if len(body.Input) > 0 {
+		var single string
+		if err := json.Unmarshal(body.Input, &single); err == nil {
+			req.Input = []string{single}
+		} else if err := json.Unmarshal(body.Input, &req.Input); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// writeJSON writes v as the JSON body of a successful response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error response in the layout of Ollama.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// fakeEmbedding returns a vector derived from a hash of text.
+func fakeEmbedding(text string) []float32 {
+	vector := make([]float32, embeddingDimensions)
+	for i := range vector {
+		h := fnv.New32a()
+		h.Write([]byte{byte(i)})
+		h.Write([]byte(text))
+		vector[i] = float32(h.Sum32())/float32(1<<32)*2 - 1
+	}
+	return vector
+}
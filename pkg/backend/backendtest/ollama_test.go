@@ -0,0 +1,230 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backendtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stackloklabs/gollm/pkg/backend"
+)
+
+func TestFakeOllamaChat(t *testing.T) {
+	server := NewFakeOllama(Replies(
+		TextResponse("Hello there"),
+		ToolCallResponse(NewToolCall("", "get_weather", map[string]any{"city": "Brno"})),
+	))
+	defer server.Close()
+	be := server.Backend("llama3", backend.WithHeaders(map[string]string{"X-Test": "yes"}))
+
+	resp, err := be.Chat(context.Background(), []backend.Message{backend.UserMessage("Hi")}, nil, backend.WithTemperature(0.2))
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if resp.Message.Content != "Hello there" || resp.Model != "llama3" {
+		t.Errorf("Unexpected reply: %+v", resp)
+	}
+
+	resp, err = be.Chat(context.Background(), []backend.Message{backend.UserMessage("Weather?")}, nil)
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if len(resp.Message.ToolCalls) != 1 || resp.Message.ToolCalls[0].Function.Arguments["city"] != "Brno" {
+		t.Errorf("Expected a tool call, got %+v", resp.Message)
+	}
+
+	if _, err := be.Chat(context.Background(), []backend.Message{backend.UserMessage("More")}, nil); err == nil {
+		t.Error("Expected an error once the replies are exhausted")
+	}
+
+	requests := server.Requests()
+	if len(requests) != 3 {
+		t.Fatalf("Expected 3 requests, got %d", len(requests))
+	}
+	first := requests[0]
+	if first.Path != "/api/chat" || first.Model != "llama3" || first.Stream {
+		t.Errorf("Unexpected request: %+v", first)
+	}
+	if len(first.Messages) != 1 || first.Messages[0].Content != "Hi" {
+		t.Errorf("Unexpected messages: %+v", first.Messages)
+	}
+	if options, _ := first.Body["options"].(map[string]any); options["temperature"] != 0.2 {
+		t.Errorf("Expected temperature 0.2 in the body, got %v", first.Body["options"])
+	}
+	if first.Header.Get("X-Test") != "yes" {
+		t.Errorf("Expected the custom header, got %v", first.Header)
+	}
+}
+
+func TestFakeOllamaGenerate(t *testing.T) {
+	server := NewFakeOllama(func(req *OllamaRequest) (*backend.Response, error) {
+		return TextResponse("echo: " + req.Prompt), nil
+	})
+	defer server.Close()
+
+	resp, err := server.Backend("llama3").Generate(context.Background(), "ping")
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if resp.Response != "echo: ping" {
+		t.Errorf("Expected echo: ping, got %q", resp.Response)
+	}
+	if req := server.LastRequest(); req == nil || req.Path != "/api/generate" || req.Prompt != "ping" {
+		t.Errorf("Unexpected request: %+v", req)
+	}
+}
+
+func TestFakeOllamaChatStream(t *testing.T) {
+	reply := ToolCallResponse(NewToolCall("", "get_weather", map[string]any{"city": "Brno"}))
+	reply.Message.Content = "It is sunny in Brno"
+	server := NewFakeOllama(Replies(reply))
+	defer server.Close()
+
+	chunks, err := server.Backend("llama3").ChatStream(context.Background(), []backend.Message{backend.UserMessage("Hi")}, nil)
+	if err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+	var content strings.Builder
+	var parts int
+	var last backend.StreamChunk
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			t.Fatalf("Stream failed: %v", chunk.Err)
+		}
+		if chunk.Content != "" {
+			parts++
+			content.WriteString(chunk.Content)
+		}
+		last = chunk
+	}
+	if content.String() != "It is sunny in Brno" {
+		t.Errorf("Unexpected content %q", content.String())
+	}
+	if parts != 5 {
+		t.Errorf("Expected the content in 5 chunks, got %d", parts)
+	}
+	if !last.Done || len(last.ToolCalls) != 1 {
+		t.Errorf("Expected the tool call on the last chunk, got %+v", last)
+	}
+	if !server.LastRequest().Stream {
+		t.Error("Expected a streamed request")
+	}
+}
+
+func TestFakeOllamaErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		target error
+		status int
+	}{
+		{name: "rate limited", err: backend.ErrRateLimited, target: backend.ErrRateLimited, status: http.StatusTooManyRequests},
+		{name: "server error", err: errors.New("boom"), status: http.StatusInternalServerError},
+		{name: "backend error", err: &backend.BackendError{StatusCode: http.StatusServiceUnavailable, Body: "overloaded"}, status: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewFakeOllama(func(*OllamaRequest) (*backend.Response, error) {
+				return nil, tt.err
+			})
+			defer server.Close()
+
+			_, err := server.Backend("llama3").Generate(context.Background(), "Hi")
+			var backendErr *backend.BackendError
+			if !errors.As(err, &backendErr) || backendErr.StatusCode != tt.status {
+				t.Fatalf("Expected a BackendError with status %d, got %v", tt.status, err)
+			}
+			if tt.target != nil && !errors.Is(err, tt.target) {
+				t.Errorf("Expected %v, got %v", tt.target, err)
+			}
+		})
+	}
+}
+
+func TestFakeOllamaModels(t *testing.T) {
+	server := NewFakeOllama(nil)
+	defer server.Close()
+	server.SetModels(backend.ModelInfo{Name: "llama3:latest"})
+
+	be := server.Backend("llama3")
+	if err := be.Ping(context.Background()); err != nil {
+		t.Errorf("Ping returned error: %v", err)
+	}
+	models, err := be.ListModels(context.Background())
+	if err != nil {
+		t.Fatalf("ListModels returned error: %v", err)
+	}
+	if len(models) != 1 || models[0].Name != "llama3:latest" {
+		t.Errorf("Unexpected models: %+v", models)
+	}
+	if _, err := be.Chat(context.Background(), []backend.Message{backend.UserMessage("Hi")}, nil); err != nil {
+		t.Errorf("Chat returned error: %v", err)
+	}
+
+	_, err = server.Backend("mistral").Generate(context.Background(), "Hi")
+	if !errors.Is(err, backend.ErrModelNotFound) {
+		t.Errorf("Expected ErrModelNotFound for an unknown model, got %v", err)
+	}
+}
+
+func TestFakeOllamaEmbeddings(t *testing.T) {
+	server := NewFakeOllama(nil)
+	defer server.Close()
+	be := server.Backend("nomic-embed-text")
+
+	single, err := be.Embed(context.Background(), "hello")
+	if err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	batch, err := be.EmbedBatch(context.Background(), []string{"hello", "world"})
+	if err != nil {
+		t.Fatalf("EmbedBatch returned error: %v", err)
+	}
+	if len(single) != embeddingDimensions || len(batch) != 2 {
+		t.Fatalf("Unexpected embeddings: %v, %v", single, batch)
+	}
+	if fmt.Sprint(single) != fmt.Sprint(batch[0]) || fmt.Sprint(batch[0]) == fmt.Sprint(batch[1]) {
+		t.Errorf("Expected equal texts to have equal embeddings, got %v and %v", single, batch)
+	}
+	if got := server.LastRequest().Input; len(got) != 2 || got[1] != "world" {
+		t.Errorf("Unexpected input %v", got)
+	}
+
+	server.SetEmbedder(func(string) []float32 { return []float32{1, 0} })
+	if vector, err := be.Embed(context.Background(), "hello"); err != nil || len(vector) != 2 {
+		t.Errorf("Expected the custom embedding, got %v, %v", vector, err)
+	}
+}
+
+func BenchmarkFakeOllamaChat(b *testing.B) {
+	server := NewFakeOllama(nil)
+	defer server.Close()
+	be := server.Backend("llama3")
+	defer be.Close()
+	messages := []backend.Message{backend.UserMessage("Hi")}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := be.Chat(context.Background(), messages, nil); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
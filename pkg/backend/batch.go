@@ -0,0 +1,123 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ChatRequest is a single Chat request of a batch.
+type ChatRequest struct {
+	Messages []Message
+	Tools    []Tool
+	Options  []CallOption
+}
+
+// BatchOption configures a BatchChat call.
+type BatchOption func(*batchOptions)
+
+// batchOptions holds the settings of a BatchChat call.
+type batchOptions struct {
+	fatal func(error) bool
+}
+
+// WithFailFast stops a batch as soon as a request fails with an error for which
+// fatal returns true, e.g. an authentication failure after which every other
+// request would fail too. Requests that fail with other errors, such as rate
+// limits, do not stop the batch. The requests that were not sent yet fail with
+// an error matching ErrBatchAborted that wraps the fatal error; requests in
+// flight at that time are completed.
+func WithFailFast(fatal func(error) bool) BatchOption {
+	return func(o *batchOptions) {
+		o.fatal = fatal
+	}
+}
+
+// BatchChat sends the requests to be with at most concurrency requests in flight
+// and returns their responses and errors, both in the order of requests. A failed
+// request leaves its response nil and does not affect the others, unless
+// WithFailFast says the error is fatal. Once ctx is done no more requests are
+// sent; the requests that were not sent fail with an error matching
+// ErrContextCanceled. A concurrency below one is treated as one.
+func BatchChat(ctx context.Context, be Backend, requests []ChatRequest, concurrency int, opts ...BatchOption) ([]*Response, []error) {
+	var o batchOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	responses := make([]*Response, len(requests))
+	errs := make([]error, len(requests))
+
+	// aborted is closed once a request failed with fatalErr
+	var abortOnce sync.Once
+	var fatalErr error
+	aborted := make(chan struct{})
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(concurrency, len(requests)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				req := requests[i]
+				responses[i], errs[i] = be.Chat(ctx, req.Messages, req.Tools, req.Options...)
+				if errs[i] != nil && o.fatal != nil && o.fatal(errs[i]) {
+					abortOnce.Do(func() {
+						fatalErr = errs[i]
+						close(aborted)
+					})
+				}
+			}
+		}()
+	}
+
+	next := 0
+	abort := false
+dispatch:
+	for ; next < len(requests); next++ {
+		// A fatal error takes precedence over a free worker
+		select {
+		case <-aborted:
+			abort = true
+			break dispatch
+		default:
+		}
+		select {
+		case indexes <- next:
+		case <-aborted:
+			abort = true
+			break dispatch
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	for i := next; i < len(requests); i++ {
+		if abort {
+			errs[i] = fmt.Errorf("%w: %w", ErrBatchAborted, fatalErr)
+		} else {
+			errs[i] = fmt.Errorf("%w: %w", ErrContextCanceled, ctx.Err())
+		}
+	}
+	return responses, errs
+}
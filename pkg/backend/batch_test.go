@@ -0,0 +1,157 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoBackend is a Backend that replies with the content of the last message and
+// fails for messages with the content "fail". It is safe for concurrent use.
+type echoBackend struct {
+	inFlight, maxInFlight atomic.Int32
+	delay                 time.Duration
+}
+
+func (e *echoBackend) Chat(ctx context.Context, messages []Message, _ []Tool, _ ...CallOption) (*Response, error) {
+	n := e.inFlight.Add(1)
+	defer e.inFlight.Add(-1)
+	for {
+		current := e.maxInFlight.Load()
+		if n <= current || e.maxInFlight.CompareAndSwap(current, n) {
+			break
+		}
+	}
+
+	time.Sleep(e.delay)
+	content := messages[len(messages)-1].Content
+	if content == "fail" {
+		return nil, errors.New("failed")
+	}
+	return &Response{Message: AssistantMessage(content)}, nil
+}
+
+func (e *echoBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	return e.Chat(ctx, []Message{UserMessage(prompt)}, nil, opts...)
+}
+
+func (e *echoBackend) Close() error {
+	return nil
+}
+
+func TestBatchChat(t *testing.T) {
+	be := &echoBackend{delay: 10 * time.Millisecond}
+	var requests []ChatRequest
+	for i := 0; i < 20; i++ {
+		content := fmt.Sprint(i)
+		if i == 7 {
+			content = "fail"
+		}
+		requests = append(requests, ChatRequest{Messages: []Message{UserMessage(content)}})
+	}
+
+	responses, errs := BatchChat(context.Background(), be, requests, 4)
+	if len(responses) != 20 || len(errs) != 20 {
+		t.Fatalf("Expected 20 results, got %d responses and %d errors", len(responses), len(errs))
+	}
+	for i := range requests {
+		if i == 7 {
+			if errs[i] == nil || responses[i] != nil {
+				t.Errorf("Expected request 7 to fail, got %v and %v", responses[i], errs[i])
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Errorf("Request %d returned error: %v", i, errs[i])
+		} else if responses[i].Message.Content != fmt.Sprint(i) {
+			t.Errorf("Expected the response to request %d in place, got %s", i, responses[i].Message.Content)
+		}
+	}
+	if peak := be.maxInFlight.Load(); peak > 4 {
+		t.Errorf("Expected at most 4 requests in flight, got %d", peak)
+	}
+}
+
+func TestBatchChatContextCanceled(t *testing.T) {
+	be := &echoBackend{delay: 20 * time.Millisecond}
+	requests := make([]ChatRequest, 10)
+	for i := range requests {
+		requests[i] = ChatRequest{Messages: []Message{UserMessage("hi")}}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	responses, errs := BatchChat(ctx, be, requests, 1)
+
+	if errs[0] != nil || responses[0] == nil {
+		t.Errorf("Expected the first request to succeed, got %v", errs[0])
+	}
+	if !errors.Is(errs[9], ErrContextCanceled) || !errors.Is(errs[9], context.DeadlineExceeded) {
+		t.Errorf("Expected the last request not to be sent, got %v", errs[9])
+	}
+}
+
+func TestBatchChatFailFast(t *testing.T) {
+	unauthorized := &BackendError{StatusCode: http.StatusUnauthorized, Body: "invalid api key"}
+	tooMany := &BackendError{StatusCode: http.StatusTooManyRequests}
+	fatal := func(err error) bool {
+		var backendErr *BackendError
+		return errors.As(err, &backendErr) && backendErr.StatusCode == http.StatusUnauthorized
+	}
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			switch messages[0].Content {
+			case "401":
+				return nil, unauthorized
+			case "429":
+				return nil, tooMany
+			}
+			return &Response{Message: AssistantMessage("ok")}, nil
+		},
+	}
+	requests := []ChatRequest{
+		{Messages: []Message{UserMessage("hi")}},
+		{Messages: []Message{UserMessage("429")}},
+		{Messages: []Message{UserMessage("hi")}},
+		{Messages: []Message{UserMessage("401")}},
+		{Messages: []Message{UserMessage("hi")}},
+		{Messages: []Message{UserMessage("hi")}},
+	}
+
+	responses, errs := BatchChat(context.Background(), be, requests, 1, WithFailFast(fatal))
+
+	if errs[0] != nil || responses[0] == nil || errs[2] != nil || responses[2] == nil {
+		t.Errorf("Expected the requests before the fatal error to succeed, got %v and %v", errs[0], errs[2])
+	}
+	if !errors.Is(errs[1], tooMany) || errors.Is(errs[1], ErrBatchAborted) {
+		t.Errorf("Expected the non fatal error to be returned unchanged, got %v", errs[1])
+	}
+	if !errors.Is(errs[3], unauthorized) || errors.Is(errs[3], ErrBatchAborted) {
+		t.Errorf("Expected the fatal error to be returned, got %v", errs[3])
+	}
+	for _, i := range []int{4, 5} {
+		if !errors.Is(errs[i], ErrBatchAborted) || !errors.Is(errs[i], unauthorized) || responses[i] != nil {
+			t.Errorf("Expected request %d to be aborted with the fatal error, got %v", i, errs[i])
+		}
+	}
+	if len(be.received) != 4 {
+		t.Errorf("Expected 4 requests to be sent, got %d", len(be.received))
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Cache stores responses by key. Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the response stored for key, if any and not expired.
+	Get(key string) (Response, bool)
+	// Set stores resp for key. A ttl of zero means the entry does not expire.
+	Set(key string, resp Response, ttl time.Duration)
+}
+
+// cachingBackend is a Backend that answers repeated requests of the wrapped one from a cache.
+type cachingBackend struct {
+	be        Backend
+	cache     Cache
+	ttl       time.Duration
+	namespace string
+}
+
+// CacheOption configures a backend wrapped with WithCache.
+type CacheOption func(*cachingBackend)
+
+// WithCacheTTL sets how long responses are cached. By default they do not expire,
+// although the cache may still evict them, e.g. when an LRUCache is full.
+func WithCacheTTL(ttl time.Duration) CacheOption {
+	return func(c *cachingBackend) {
+		c.ttl = ttl
+	}
+}
+
+// WithCacheNamespace sets the namespace that is part of every cache key. Backends
+// sharing a cache must use different namespaces unless they are interchangeable.
+// By default the namespace is derived from the type and model of the backend.
+func WithCacheNamespace(namespace string) CacheOption {
+	return func(c *cachingBackend) {
+		c.namespace = namespace
+	}
+}
+
+// WithCache wraps be so that successful Chat and Generate responses are stored in
+// cache and identical requests are answered from it without calling be. Requests are
+// identical if their messages, tools and call options, such as the temperature, are
+// equal. Failed requests are not cached. ChatStream, if supported by be, always
+// bypasses the cache.
+func WithCache(be Backend, cache Cache, opts ...CacheOption) Backend {
+	c := &cachingBackend{
+		be:        be,
+		cache:     cache,
+		namespace: fmt.Sprintf("%T:%s", be, backendModel(be)),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// backendModel returns the model of the backends in this package, or an empty string.
+func backendModel(be Backend) string {
+	switch b := be.(type) {
+	case *OllamaBackend:
+		return b.Model
+	case *OpenAIBackend:
+		return b.Model
+	case *AnthropicBackend:
+		return b.Model
+	case *GeminiBackend:
+		return b.Model
+	case *CohereBackend:
+		return b.Model
+	case *MistralBackend:
+		return b.Model
+	}
+	return ""
+}
+
+// backendTokenizer returns the Tokenizer set with WithTokenizer for one of the
+// backends of this package, nil for other backends.
+func backendTokenizer(be Backend) Tokenizer {
+	switch b := be.(type) {
+	case *OllamaBackend:
+		return b.Tokenizer
+	case *OpenAIBackend:
+		return b.Tokenizer
+	case *AnthropicBackend:
+		return b.Tokenizer
+	case *GeminiBackend:
+		return b.Tokenizer
+	case *CohereBackend:
+		return b.Tokenizer
+	case *MistralBackend:
+		return b.Tokenizer
+	}
+	return nil
+}
+
+// cacheKeyInput is hashed to derive a cache key.
+type cacheKeyInput struct {
+	Namespace string    `json:"namespace"`
+	Method    string    `json:"method"`
+	Messages  []Message `json:"messages,omitempty"`
+	Tools     []Tool    `json:"tools,omitempty"`
+	Prompt    string    `json:"prompt,omitempty"`
+	Options   *Options  `json:"options"`
+}
+
+// key returns the cache key of a request.
+func (c *cachingBackend) key(input cacheKeyInput) (string, error) {
+	input.Namespace = c.namespace
+	return hashCanonical(input)
+}
+
+// Chat implements Backend.
+func (c *cachingBackend) Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	callOpts, err := newCallOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(cacheKeyInput{Method: "chat", Messages: messages, Tools: tools, Options: callOpts}, func() (*Response, error) {
+		return c.be.Chat(ctx, messages, tools, opts...)
+	})
+}
+
+// Generate implements Backend.
+func (c *cachingBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	callOpts, err := newCallOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(cacheKeyInput{Method: "generate", Prompt: prompt, Options: callOpts}, func() (*Response, error) {
+		return c.be.Generate(ctx, prompt, opts...)
+	})
+}
+
+// Close implements Backend by closing the wrapped backend. The cache is left
+// alone, as it may be shared with other backends.
+func (c *cachingBackend) Close() error {
+	return c.be.Close()
+}
+
+// ChatStream passes the request to the wrapped backend without using the cache.
+func (c *cachingBackend) ChatStream(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (<-chan StreamChunk, error) {
+	streamer, ok := c.be.(Streamer)
+	if !ok {
+		return nil, errors.New("backend does not support streaming")
+	}
+	return streamer.ChatStream(ctx, messages, tools, opts...)
+}
+
+// do returns the cached response for input, or calls fn and caches its response.
+func (c *cachingBackend) do(input cacheKeyInput, fn func() (*Response, error)) (*Response, error) {
+	key, err := c.key(input)
+	if err != nil {
+		return nil, err
+	}
+	if resp, ok := c.cache.Get(key); ok {
+		return &resp, nil
+	}
+
+	resp, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	if resp != nil {
+		c.cache.Set(key, *resp, c.ttl)
+	}
+	return resp, nil
+}
+
+// LRUCache is an in-memory Cache that evicts the least recently used entry
+// once it holds its maximum number of entries.
+type LRUCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+	now      func() time.Time
+}
+
+// lruEntry is an entry of an LRUCache.
+type lruEntry struct {
+	key       string
+	resp      Response
+	expiresAt time.Time
+}
+
+var _ Cache = (*LRUCache)(nil)
+
+// NewLRUCache creates and returns an LRUCache holding at most capacity entries.
+// A capacity below one is treated as one.
+func NewLRUCache(capacity int) *LRUCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &LRUCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		now:      time.Now,
+	}
+}
+
+// Get implements Cache.
+func (l *LRUCache) Get(key string) (Response, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	elem, ok := l.entries[key]
+	if !ok {
+		return Response{}, false
+	}
+	entry := elem.Value.(*lruEntry)
+	if !entry.expiresAt.IsZero() && l.now().After(entry.expiresAt) {
+		l.order.Remove(elem)
+		delete(l.entries, key)
+		return Response{}, false
+	}
+
+	l.order.MoveToFront(elem)
+	return entry.resp, true
+}
+
+// Set implements Cache.
+func (l *LRUCache) Set(key string, resp Response, ttl time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = l.now().Add(ttl)
+	}
+
+	if elem, ok := l.entries[key]; ok {
+		elem.Value = &lruEntry{key: key, resp: resp, expiresAt: expiresAt}
+		l.order.MoveToFront(elem)
+		return
+	}
+
+	l.entries[key] = l.order.PushFront(&lruEntry{key: key, resp: resp, expiresAt: expiresAt})
+	if l.order.Len() > l.capacity {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// Len returns the number of entries in the cache, including expired ones not yet removed.
+func (l *LRUCache) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
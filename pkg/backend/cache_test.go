@@ -0,0 +1,136 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWithCache(t *testing.T) {
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return &Response{Message: AssistantMessage("benign")}, nil
+		},
+	}
+	cached := WithCache(be, NewLRUCache(10))
+	messages := []Message{UserMessage("Classify package foo")}
+
+	for i := 0; i < 3; i++ {
+		resp, err := cached.Chat(context.Background(), messages, nil, WithTemperature(0))
+		if err != nil {
+			t.Fatalf("Chat returned error: %v", err)
+		}
+		if resp.Message.Content != "benign" {
+			t.Errorf("Unexpected reply: %s", resp.Message.Content)
+		}
+	}
+	if len(be.received) != 1 {
+		t.Errorf("Expected the backend to be called once, got %d", len(be.received))
+	}
+
+	// Different options, messages or methods must not share an entry
+	if _, err := cached.Chat(context.Background(), messages, nil, WithTemperature(1)); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if _, err := cached.Chat(context.Background(), []Message{UserMessage("Classify package bar")}, nil); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if _, err := cached.Generate(context.Background(), "Classify package foo"); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if len(be.received) != 4 {
+		t.Errorf("Expected 4 backend calls, got %d", len(be.received))
+	}
+}
+
+func TestWithCacheDoesNotCacheErrors(t *testing.T) {
+	calls := 0
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			calls++
+			if calls == 1 {
+				return nil, ErrRateLimited
+			}
+			return &Response{Message: AssistantMessage("ok")}, nil
+		},
+	}
+	cached := WithCache(be, NewLRUCache(10))
+
+	if _, err := cached.Generate(context.Background(), "Hi"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Expected ErrRateLimited, got %v", err)
+	}
+	if _, err := cached.Generate(context.Background(), "Hi"); err != nil {
+		t.Errorf("Expected the second call to reach the backend, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected 2 backend calls, got %d", calls)
+	}
+}
+
+func TestWithCacheStreamBypassesCache(t *testing.T) {
+	be := &fakeBackend{}
+	cached := WithCache(be, NewLRUCache(10))
+
+	streamer, ok := cached.(Streamer)
+	if !ok {
+		t.Fatalf("Expected the caching backend to implement Streamer")
+	}
+	if _, err := streamer.ChatStream(context.Background(), nil, nil); err == nil {
+		t.Errorf("Expected an error for a backend that cannot stream")
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	cache := NewLRUCache(2)
+	cache.Set("a", Response{Response: "A"}, 0)
+	cache.Set("b", Response{Response: "B"}, 0)
+
+	// Using a makes b the least recently used entry
+	if resp, ok := cache.Get("a"); !ok || resp.Response != "A" {
+		t.Errorf("Expected A, got %v %v", resp.Response, ok)
+	}
+	cache.Set("c", Response{Response: "C"}, 0)
+
+	if _, ok := cache.Get("b"); ok {
+		t.Errorf("Expected b to be evicted")
+	}
+	if _, ok := cache.Get("a"); !ok {
+		t.Errorf("Expected a to be kept")
+	}
+	if cache.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", cache.Len())
+	}
+}
+
+func TestLRUCacheTTL(t *testing.T) {
+	now := time.Now()
+	cache := NewLRUCache(2)
+	cache.now = func() time.Time { return now }
+
+	cache.Set("a", Response{Response: "A"}, time.Minute)
+	if _, ok := cache.Get("a"); !ok {
+		t.Errorf("Expected a before it expires")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := cache.Get("a"); ok {
+		t.Errorf("Expected a to expire")
+	}
+	if cache.Len() != 0 {
+		t.Errorf("Expected the expired entry to be removed, got %d entries", cache.Len())
+	}
+}
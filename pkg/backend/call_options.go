@@ -0,0 +1,512 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+	"time"
+)
+
+// Options holds the settings of a single Chat or Generate request.
+// Each backend translates them into its own wire format.
+type Options struct {
+	// JSONFormat asks the model to reply with valid JSON only.
+	JSONFormat bool
+	// ResponseSchema is the JSON schema the reply must match, see WithResponseSchema.
+	ResponseSchema map[string]any
+	// Temperature controls the randomness of the output. Nil uses the model default.
+	Temperature *float64
+	// TopP limits sampling to the most likely tokens whose probabilities add up to TopP.
+	// Nil uses the model default.
+	TopP *float64
+	// StopSequences makes the model stop generating when it produces any of them.
+	StopSequences []string
+	// MaxTokens is a hard cap on the number of tokens generated. Nil uses the
+	// backend default.
+	MaxTokens *int
+	// Seed makes sampling reproducible: the same seed and prompt give the same output.
+	// Nil uses a random seed.
+	Seed *int
+	// ToolChoice controls whether and which tool the model calls. Nil leaves
+	// the choice to the model.
+	ToolChoice *ToolChoice
+	// KeepAlive is how long Ollama keeps the model loaded after the request.
+	// Negative keeps it loaded until the server stops, zero unloads it at once.
+	// Nil uses the server default.
+	KeepAlive *time.Duration
+	// Raw sends the prompt of an Ollama Generate request without applying the
+	// prompt template of the model.
+	Raw bool
+	// Mirostat enables Mirostat sampling in Ollama: 0 disables it, 1 selects
+	// Mirostat and 2 Mirostat 2.0. Nil uses the model default.
+	Mirostat *int
+	// MirostatTau is the target entropy of Mirostat sampling in Ollama. Nil uses
+	// the model default.
+	MirostatTau *float64
+	// MirostatEta is the learning rate of Mirostat sampling in Ollama. Nil uses
+	// the model default.
+	MirostatEta *float64
+	// RepeatPenalty is how strongly Ollama penalizes repetitions. Nil uses the
+	// model default.
+	RepeatPenalty *float64
+	// TFSZ is the parameter of tail free sampling in Ollama. Nil uses the model
+	// default.
+	TFSZ *float64
+	// ModelOptions are added as they are to the options object of an Ollama
+	// request, overriding the settings above with the same key.
+	ModelOptions map[string]any
+	// ContextLimit makes a request fail with a *ContextOverflowError instead of
+	// being sent when its messages are estimated to exceed it. Zero uses the
+	// ModelContextLimit of the model. Nil disables the check.
+	ContextLimit *int
+	// TokenCounter estimates the tokens of a request checked against ContextLimit.
+	// Nil uses the counter EstimateTokens uses for the model.
+	TokenCounter TokenCounter `json:"-"`
+	// RawResponse is called with the raw body of the response, before it is decoded.
+	RawResponse func(body []byte) `json:"-"`
+	// StopOnDelta ends a stream once it returns true for the content streamed so far.
+	StopOnDelta func(accumulated string) bool `json:"-"`
+	// Headers are added to the HTTP request, on top of those set with WithHeaders.
+	Headers map[string]string
+	// SkipToolValidation sends the tools of a request without checking them
+	// with ValidateTools first.
+	SkipToolValidation bool
+	// DryRun builds the request but does not send it; see WithDryRun.
+	DryRun bool
+	// ContextDocuments are added to the conversation, see WithContextDocuments.
+	ContextDocuments *ContextDocuments
+}
+
+// ToolChoice restricts the tool calls of the model.
+type ToolChoice struct {
+	// Name is the tool the model must call. Empty means the model must not call any tool.
+	Name string
+}
+
+// UnsupportedOptionPolicy is what a backend does with a CallOption that does not
+// apply to it, see WithUnsupportedOptions.
+type UnsupportedOptionPolicy int
+
+const (
+	// IgnoreUnsupported sends the request without the option. It is the default.
+	IgnoreUnsupported UnsupportedOptionPolicy = iota
+	// WarnUnsupported sends the request without the option and logs a warning
+	// with the default slog logger.
+	WarnUnsupported
+	// RejectUnsupported fails the request with an error matching
+	// ErrUnsupportedOption instead of sending it.
+	RejectUnsupported
+)
+
+// callOption identifies a setting of Options that not every backend supports.
+type callOption struct {
+	name string
+	set  func(o *Options) bool
+}
+
+// The settings of Options some backends cannot honour.
+var (
+	seedOption      = callOption{"seed", func(o *Options) bool { return o.Seed != nil }}
+	keepAliveOption = callOption{"keep_alive", func(o *Options) bool { return o.KeepAlive != nil }}
+	rawOption       = callOption{"raw", func(o *Options) bool { return o.Raw }}
+)
+
+// ollamaOnlyOptions are the settings of Options only Ollama supports.
+var ollamaOnlyOptions = []callOption{
+	keepAliveOption,
+	rawOption,
+	{"mirostat", func(o *Options) bool { return o.Mirostat != nil || o.MirostatTau != nil || o.MirostatEta != nil }},
+	{"repeat_penalty", func(o *Options) bool { return o.RepeatPenalty != nil }},
+	{"tfs_z", func(o *Options) bool { return o.TFSZ != nil }},
+	{"model options", func(o *Options) bool { return len(o.ModelOptions) > 0 }},
+}
+
+// checkSupported applies policy to the settings among unsupported that are set
+// in the options of a request to the named backend.
+func (o *Options) checkSupported(backend string, policy UnsupportedOptionPolicy, unsupported ...callOption) error {
+	for _, option := range unsupported {
+		if !option.set(o) {
+			continue
+		}
+		switch policy {
+		case WarnUnsupported:
+			slog.Warn("ignoring option not supported by the backend", "backend", backend, "option", option.name)
+		case RejectUnsupported:
+			return fmt.Errorf("%w: %s is not supported by %s", ErrUnsupportedOption, option.name, backend)
+		}
+	}
+	return nil
+}
+
+// CallOption configures a single Chat or Generate request.
+type CallOption func(*Options)
+
+// newCallOptions applies opts on top of the defaults and returns the result.
+// It returns an error matching ErrInvalidOption if a value is out of range.
+func newCallOptions(opts []CallOption) (*Options, error) {
+	o := &Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Validate checks that the options are within their valid ranges and returns
+// an error matching ErrInvalidOption if they are not.
+func (o *Options) Validate() error {
+	if o.Temperature != nil && (*o.Temperature < 0 || *o.Temperature > 2) {
+		return fmt.Errorf("%w: temperature %v is not between 0 and 2", ErrInvalidOption, *o.Temperature)
+	}
+	if o.TopP != nil && (*o.TopP < 0 || *o.TopP > 1) {
+		return fmt.Errorf("%w: top_p %v is not between 0 and 1", ErrInvalidOption, *o.TopP)
+	}
+	if o.MaxTokens != nil && *o.MaxTokens < 1 {
+		return fmt.Errorf("%w: max tokens %d is not positive", ErrInvalidOption, *o.MaxTokens)
+	}
+	if o.Mirostat != nil && (*o.Mirostat < 0 || *o.Mirostat > 2) {
+		return fmt.Errorf("%w: mirostat %d is not 0, 1 or 2", ErrInvalidOption, *o.Mirostat)
+	}
+	for _, option := range []struct {
+		name  string
+		value *float64
+	}{
+		{"mirostat_tau", o.MirostatTau},
+		{"mirostat_eta", o.MirostatEta},
+		{"repeat_penalty", o.RepeatPenalty},
+		{"tfs_z", o.TFSZ},
+	} {
+		if option.value != nil && *option.value < 0 {
+			return fmt.Errorf("%w: %s %v is negative", ErrInvalidOption, option.name, *option.value)
+		}
+	}
+	if o.ContextLimit != nil && *o.ContextLimit < 0 {
+		return fmt.Errorf("%w: context limit %d is negative", ErrInvalidOption, *o.ContextLimit)
+	}
+	for _, stop := range o.StopSequences {
+		if stop == "" {
+			return fmt.Errorf("%w: empty stop sequence", ErrInvalidOption)
+		}
+	}
+	if o.ResponseSchema != nil {
+		if field, reason := checkSchema(o.ResponseSchema, "response_schema"); field != "" {
+			return fmt.Errorf("%w: %s: %s", ErrInvalidOption, field, reason)
+		}
+	}
+	if o.ContextDocuments != nil {
+		return o.ContextDocuments.validate()
+	}
+	return nil
+}
+
+// checkTools returns a *ToolDefinitionError if one of tools is malformed, unless
+// the options skip tool validation, and an error matching ErrInvalidOption if
+// the options force a tool that is not among tools.
+func (o *Options) checkTools(tools []Tool) error {
+	if !o.SkipToolValidation {
+		if err := ValidateTools(tools); err != nil {
+			return err
+		}
+	}
+	if o.ToolChoice == nil || o.ToolChoice.Name == "" {
+		return nil
+	}
+	for _, tool := range tools {
+		if toolName(tool) == o.ToolChoice.Name {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: tool choice %s is not one of the tools of the request", ErrInvalidOption, o.ToolChoice.Name)
+}
+
+// checkContext returns a *ContextOverflowError if the options set a context limit
+// and messages are estimated to exceed it in the context window of model. The
+// estimate uses the TokenCounter of the options, else tokenizer if it is not nil.
+func (o *Options) checkContext(model string, tokenizer Tokenizer, messages []Message) error {
+	if o.ContextLimit == nil {
+		return nil
+	}
+	limit := *o.ContextLimit
+	if limit == 0 {
+		limit = ModelContextLimit(model)
+	}
+	count := o.TokenCounter
+	if count == nil {
+		count = tokenCounter(model, tokenizer)
+	}
+	if estimated := countMessageTokens(count, messages); estimated > limit {
+		return &ContextOverflowError{Estimated: estimated, Limit: limit}
+	}
+	return nil
+}
+
+// WithJSONFormat asks the model to reply with valid JSON only. It maps to
+// "format": "json" for Ollama and to a json_object response format for OpenAI.
+// Most models still need to be told in the prompt what JSON to produce.
+func WithJSONFormat() CallOption {
+	return func(o *Options) {
+		o.JSONFormat = true
+	}
+}
+
+// WithResponseSchema asks the model to reply with JSON matching schema. The schema
+// is either a JSON schema, as a map[string]any, or a Go value, such as a struct or
+// a pointer to one, whose type it is derived from as RegisterTool derives the
+// parameters of a tool.
+//
+// OpenAI and Mistral get a json_schema response format. They only enforce it in
+// strict mode, which is used if every object in the schema sets additionalProperties
+// to false and requires all its properties; otherwise the schema guides the model
+// without guaranteeing a match. Ollama gets a format object, which needs Ollama 0.5
+// or later, and Gemini a response schema without the keywords it does not accept.
+// The other backends only get JSON mode, as with WithJSONFormat. ChatStructured
+// checks that the reply matches the schema and asks the model once more if it does not.
+func WithResponseSchema(schema any) CallOption {
+	return func(o *Options) {
+		o.ResponseSchema = responseSchema(schema)
+	}
+}
+
+// responseSchema returns the JSON schema given to WithResponseSchema.
+func responseSchema(schema any) map[string]any {
+	switch s := schema.(type) {
+	case nil:
+		return nil
+	case map[string]any:
+		return s
+	case reflect.Type:
+		return typeSchema(s)
+	}
+	return typeSchema(reflect.TypeOf(schema))
+}
+
+// WithTemperature sets the sampling temperature, between 0 and 2. Lower values
+// make the output more focused and deterministic, higher values make it more varied.
+func WithTemperature(temperature float64) CallOption {
+	return func(o *Options) {
+		o.Temperature = &temperature
+	}
+}
+
+// WithTopP enables nucleus sampling: only the most likely tokens whose
+// probabilities add up to topP, between 0 and 1, are considered.
+func WithTopP(topP float64) CallOption {
+	return func(o *Options) {
+		o.TopP = &topP
+	}
+}
+
+// WithStopSequences makes the model stop generating as soon as it produces any
+// of the given sequences. The stop sequence itself is not part of the output.
+func WithStopSequences(stop ...string) CallOption {
+	return func(o *Options) {
+		o.StopSequences = stop
+	}
+}
+
+// WithSeed fixes the seed of the random number generator used for sampling, so
+// that the same request produces the same output. This is useful in tests.
+// Anthropic does not support seeds and ignores it, see WithUnsupportedOptions.
+func WithSeed(seed int) CallOption {
+	return func(o *Options) {
+		o.Seed = &seed
+	}
+}
+
+// WithMaxTokens caps the reply at maxTokens tokens. The cap is enforced by the
+// backend, which stops generating once it is reached, even in the middle of a
+// sentence; Response.Truncated reports whether that happened. It maps to
+// num_predict for Ollama and to max_tokens for OpenAI and Anthropic.
+func WithMaxTokens(maxTokens int) CallOption {
+	return func(o *Options) {
+		o.MaxTokens = &maxTokens
+	}
+}
+
+// WithToolChoice makes the model call the tool with the given name, which must be
+// one of the tools of the request. It maps to tool_choice for OpenAI and Anthropic
+// and to a function calling config for Gemini. Ollama has no equivalent: only the
+// chosen tool is advertised and the model is instructed to call it, which most
+// models that support tools follow but is not guaranteed.
+func WithToolChoice(name string) CallOption {
+	return func(o *Options) {
+		o.ToolChoice = &ToolChoice{Name: name}
+	}
+}
+
+// WithToolChoiceNone makes the model reply with text only, even if tools are
+// advertised, e.g. to let it summarize earlier tool results. Ollama does not send
+// the tools in that case.
+func WithToolChoiceNone() CallOption {
+	return func(o *Options) {
+		o.ToolChoice = &ToolChoice{}
+	}
+}
+
+// WithKeepAlive sets how long Ollama keeps the model in memory after the request,
+// which avoids the latency of loading it again for the next one. A negative
+// duration maps to keep_alive -1 and keeps the model loaded until the server
+// stops; zero maps to keep_alive 0 and unloads it as soon as the request is done.
+// Other backends ignore it.
+func WithKeepAlive(d time.Duration) CallOption {
+	return func(o *Options) {
+		o.KeepAlive = &d
+	}
+}
+
+// WithRaw makes Ollama's Generate send the prompt to the model exactly as given,
+// e.g. for prompt engineering with special tokens. In raw mode no prompt template
+// is applied and the backend's system prompt is not sent, so the caller is
+// responsible for formatting the whole prompt the way the model expects. Chat and
+// other backends ignore it.
+func WithRaw() CallOption {
+	return func(o *Options) {
+		o.Raw = true
+	}
+}
+
+// WithMirostat enables Mirostat sampling in Ollama, which keeps the perplexity
+// of the output at a target instead of sampling from a fixed set of tokens:
+// mode 1 selects Mirostat, 2 Mirostat 2.0 and 0 disables it. Tune it with
+// WithMirostatTau and WithMirostatEta. Other backends ignore it.
+func WithMirostat(mode int) CallOption {
+	return func(o *Options) {
+		o.Mirostat = &mode
+	}
+}
+
+// WithMirostatTau sets the target entropy of Mirostat sampling, 5.0 by default in
+// Ollama. Lower values give more focused and coherent output.
+func WithMirostatTau(tau float64) CallOption {
+	return func(o *Options) {
+		o.MirostatTau = &tau
+	}
+}
+
+// WithMirostatEta sets how quickly Mirostat sampling responds to the generated
+// text, 0.1 by default in Ollama. Lower values adjust more slowly.
+func WithMirostatEta(eta float64) CallOption {
+	return func(o *Options) {
+		o.MirostatEta = &eta
+	}
+}
+
+// WithRepeatPenalty sets how strongly Ollama penalizes repeated tokens, 1.1 by
+// default. Higher values make repetitions less likely, 1 disables the penalty.
+// Other backends ignore it.
+func WithRepeatPenalty(penalty float64) CallOption {
+	return func(o *Options) {
+		o.RepeatPenalty = &penalty
+	}
+}
+
+// WithTFSZ sets the parameter of tail free sampling in Ollama, which reduces
+// the impact of unlikely tokens: 1 disables it, higher values reduce the impact
+// more. Other backends ignore it.
+func WithTFSZ(z float64) CallOption {
+	return func(o *Options) {
+		o.TFSZ = &z
+	}
+}
+
+// WithOption sets key to value in the options object of an Ollama request, e.g.
+// WithOption("num_ctx", 8192), for parameters without an option of their own.
+// The value is sent as it is, without validation, and takes precedence over an
+// option of this package for the same key. Other backends ignore it.
+func WithOption(key string, value any) CallOption {
+	return func(o *Options) {
+		if o.ModelOptions == nil {
+			o.ModelOptions = map[string]any{}
+		}
+		o.ModelOptions[key] = value
+	}
+}
+
+// WithContextGuard makes the request fail fast with an error matching
+// ErrContextOverflow if its messages are estimated to take up more than limit
+// tokens, instead of letting the server truncate the prompt silently, as Ollama
+// does. A limit of zero uses the ModelContextLimit of the model. To trim the
+// conversation instead, use TruncateMessages.
+//
+// The estimate uses the same counter as EstimateTokens unless another one is set
+// with WithTokenCounter.
+func WithContextGuard(limit int) CallOption {
+	return func(o *Options) {
+		o.ContextLimit = &limit
+	}
+}
+
+// WithTokenCounter sets the counter used by WithContextGuard to estimate the size
+// of the request, e.g. a precise tokenizer for the model.
+func WithTokenCounter(counter TokenCounter) CallOption {
+	return func(o *Options) {
+		o.TokenCounter = counter
+	}
+}
+
+// WithRawResponseCapture calls fn with the exact body the backend returned for a
+// Chat or Generate request, before it is decoded, e.g. to log it when a new model
+// version changes the shape of its output. fn is also called if the body cannot be
+// decoded. The body of an error response is available in the BackendError instead.
+// Streamed responses are not captured.
+func WithRawResponseCapture(fn func(body []byte)) CallOption {
+	return func(o *Options) {
+		o.RawResponse = fn
+	}
+}
+
+// WithStopOnDelta ends a ChatStream as soon as stop returns true for the content
+// streamed so far, e.g. once the model emits a marker such as "</answer>". The chunk
+// that completed the match is delivered as the last one, with Done set, and the
+// HTTP request is aborted so that the model stops generating. Text the model
+// generated after the marker within that chunk is not removed.
+func WithStopOnDelta(stop func(accumulated string) bool) CallOption {
+	return func(o *Options) {
+		o.StopOnDelta = stop
+	}
+}
+
+// WithRequestHeaders adds headers to the HTTP request, e.g. to propagate a trace
+// ID. They take precedence over headers set with WithHeaders, but cannot replace
+// the headers the backend sets itself, such as Content-Type and the API key.
+func WithRequestHeaders(headers map[string]string) CallOption {
+	return func(o *Options) {
+		o.Headers = headers
+	}
+}
+
+// WithoutToolValidation sends the tools of a Chat request as they are, without
+// checking them with ValidateTools first, e.g. for a server that accepts schema
+// extensions the check does not know about.
+func WithoutToolValidation() CallOption {
+	return func(o *Options) {
+		o.SkipToolValidation = true
+	}
+}
+
+// WithDryRun makes Chat and Generate return the request they would send instead
+// of sending it, e.g. to snapshot test how messages and tools are translated for
+// a backend without a running model. The Response holds the JSON body of the
+// request, byte for byte, in DryRunRequest. A ChatStream made with WithDryRun
+// delivers that Response in a single chunk.
+func WithDryRun() CallOption {
+	return func(o *Options) {
+		o.DryRun = true
+	}
+}
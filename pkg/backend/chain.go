@@ -0,0 +1,54 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+// Middleware wraps a Backend to add behaviour to it, e.g. a closure around
+// WithRetry or WithLogging.
+type Middleware func(Backend) Backend
+
+// Chain wraps be with middlewares, the first one being the outermost: a call
+// passes through the middlewares in the order they are given before it reaches
+// be, so Chain(be, a, b, c) is a(b(c(be))). Nil middlewares are skipped.
+//
+// The wrappers in this package forward ChatStream to the backend they wrap, so a
+// chain of them implements Streamer if be does; streams are only reported by the
+// metrics and log once they end, and are neither retried nor cached.
+//
+// The recommended order, from the outermost, is:
+//
+//   - WithMetrics and WithTracing, so that they report the latency the caller sees, retries included;
+//   - WithResponseFilter, so that the log below it shows the unfiltered replies;
+//   - WithLogging, to log each call once with its final outcome;
+//   - WithCircuitBreaker, to fail fast without waiting for retries while the server is down;
+//   - WithSingleFlight, so that coalesced calls share the retries below it;
+//   - WithRetry, so that the wrappers below it see every attempt;
+//   - WithRateLimit, so that every attempt, including the retries, is throttled;
+//   - WithCache, innermost, so that the wrappers above cover cache hits as well.
+//
+// For example:
+//
+//	be := backend.Chain(ollamaBackend,
+//		func(be backend.Backend) backend.Backend { return backend.WithMetrics(be, registry) },
+//		func(be backend.Backend) backend.Backend { return backend.WithRetry(be, backend.DefaultRetryConfig()) },
+//		func(be backend.Backend) backend.Backend { return backend.WithCache(be, backend.NewLRUCache(1000)) },
+//	)
+func Chain(be Backend, middlewares ...Middleware) Backend {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		if middlewares[i] != nil {
+			be = middlewares[i](be)
+		}
+	}
+	return be
+}
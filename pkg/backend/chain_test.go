@@ -0,0 +1,137 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// recordingBackend is a Backend wrapper that records its name when called.
+type recordingBackend struct {
+	Backend
+	name  string
+	order *[]string
+}
+
+func (r *recordingBackend) Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	*r.order = append(*r.order, r.name)
+	return r.Backend.Chat(ctx, messages, tools, opts...)
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	record := func(name string) Middleware {
+		return func(be Backend) Backend {
+			return &recordingBackend{Backend: be, name: name, order: &order}
+		}
+	}
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			order = append(order, "backend")
+			return &Response{Message: AssistantMessage("Hi")}, nil
+		},
+	}
+
+	chained := Chain(be, record("outer"), nil, record("middle"), record("inner"))
+	if _, err := chained.Chat(context.Background(), []Message{UserMessage("Hello")}, nil); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+
+	want := []string{"outer", "middle", "inner", "backend"}
+	if len(order) != len(want) {
+		t.Fatalf("Expected calls %v, got %v", want, order)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Errorf("Expected calls %v, got %v", want, order)
+			break
+		}
+	}
+
+	if Chain(be) != Backend(be) {
+		t.Error("Expected Chain without middlewares to return the backend itself")
+	}
+}
+
+func TestWrappersClose(t *testing.T) {
+	be := &fakeBackend{}
+	wrapped := Chain(be,
+		func(be Backend) Backend { return WithMetrics(be, prometheus.NewRegistry()) },
+		func(be Backend) Backend { return WithTracing(be, noop.NewTracerProvider().Tracer("test")) },
+		func(be Backend) Backend { return WithResponseFilter(be, redactDarn) },
+		func(be Backend) Backend { return WithLogging(be, slog.New(slog.NewTextHandler(io.Discard, nil))) },
+		func(be Backend) Backend { return WithCircuitBreaker(be, DefaultCircuitConfig()) },
+		WithSingleFlight,
+		func(be Backend) Backend { return WithRetry(be, DefaultRetryConfig()) },
+		func(be Backend) Backend { return WithRateLimit(be, 10, 1) },
+		func(be Backend) Backend { return WithCache(be, NewLRUCache(10)) },
+	)
+
+	if err := wrapped.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if be.closed != 1 {
+		t.Errorf("Expected the wrapped backend to be closed once, got %d", be.closed)
+	}
+}
+
+func TestChainStreams(t *testing.T) {
+	be := &streamingFakeBackend{
+		stream: func(messages []Message) ([]StreamChunk, bool) {
+			return []StreamChunk{
+				{Content: "Hel"},
+				{Content: "lo"},
+				{Done: true, Response: &Response{Model: "test-model"}},
+			}, false
+		},
+	}
+	wrapped := Chain(be,
+		func(be Backend) Backend { return WithMetrics(be, prometheus.NewRegistry()) },
+		func(be Backend) Backend { return WithTracing(be, noop.NewTracerProvider().Tracer("test")) },
+		func(be Backend) Backend { return WithResponseFilter(be, redactDarn) },
+		func(be Backend) Backend { return WithLogging(be, slog.New(slog.NewTextHandler(io.Discard, nil))) },
+		func(be Backend) Backend { return WithCircuitBreaker(be, DefaultCircuitConfig()) },
+		WithSingleFlight,
+		func(be Backend) Backend { return WithRetry(be, DefaultRetryConfig()) },
+		func(be Backend) Backend { return WithRateLimit(be, 10, 1) },
+		func(be Backend) Backend { return WithCache(be, NewLRUCache(10)) },
+	)
+
+	streamer, ok := wrapped.(Streamer)
+	if !ok {
+		t.Fatalf("Expected the chain to support streaming")
+	}
+	chunks, err := streamer.ChatStream(context.Background(), []Message{UserMessage("Hi")}, nil)
+	if err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+	var content string
+	var done bool
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			t.Fatalf("Unexpected stream error: %v", chunk.Err)
+		}
+		content += chunk.Content
+		done = done || chunk.Done
+	}
+	if content != "Hello" || !done {
+		t.Errorf("Expected the complete stream through the chain, got %q (done %v)", content, done)
+	}
+}
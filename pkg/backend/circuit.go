@@ -0,0 +1,206 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// CircuitConfig controls when a backend wrapped with WithCircuitBreaker stops
+// sending requests.
+type CircuitConfig struct {
+	// FailureThreshold is the number of consecutive failures that opens the circuit.
+	FailureThreshold int
+	// Cooldown is how long the circuit stays open before a single request is let
+	// through to probe whether the backend has recovered.
+	Cooldown time.Duration
+}
+
+// DefaultCircuitConfig returns a CircuitConfig suitable for most backends.
+func DefaultCircuitConfig() CircuitConfig {
+	return CircuitConfig{
+		FailureThreshold: 5,
+		Cooldown:         30 * time.Second,
+	}
+}
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets all requests through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails all requests with ErrCircuitOpen until the cooldown has passed.
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe request through; its outcome closes or
+	// reopens the circuit.
+	CircuitHalfOpen
+)
+
+// String returns the name of the state, e.g. for a health check.
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreaker is a Backend that stops sending requests to the wrapped one after
+// it failed repeatedly, so that callers fail fast instead of piling up timeouts
+// while the server is down. It is safe for concurrent use.
+type CircuitBreaker struct {
+	be  Backend
+	cfg CircuitConfig
+	now func() time.Time
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// WithCircuitBreaker wraps be so that the circuit opens after cfg.FailureThreshold
+// consecutive failures. While it is open, Chat, Generate and ChatStream fail with
+// ErrCircuitOpen without contacting the backend. Once cfg.Cooldown has passed, the
+// next request is sent as a probe: if it succeeds the circuit closes, otherwise it
+// opens again for another cooldown.
+//
+// Failures are the errors IsRetryable reports, such as 5xx responses and connection
+// errors, and request timeouts of the backend. Errors that show the server is up,
+// such as a 400 response, and requests canceled by the caller do not count. For
+// ChatStream only errors returned when starting the stream are taken into account.
+func WithCircuitBreaker(be Backend, cfg CircuitConfig) *CircuitBreaker {
+	if cfg.FailureThreshold < 1 {
+		cfg.FailureThreshold = 1
+	}
+	return &CircuitBreaker{be: be, cfg: cfg, now: time.Now}
+}
+
+// Chat implements Backend.
+func (c *CircuitBreaker) Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	if err := c.allow(); err != nil {
+		return nil, err
+	}
+	resp, err := c.be.Chat(ctx, messages, tools, opts...)
+	c.record(ctx, err)
+	return resp, err
+}
+
+// Generate implements Backend.
+func (c *CircuitBreaker) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	if err := c.allow(); err != nil {
+		return nil, err
+	}
+	resp, err := c.be.Generate(ctx, prompt, opts...)
+	c.record(ctx, err)
+	return resp, err
+}
+
+// Close implements Backend by closing the wrapped backend.
+func (c *CircuitBreaker) Close() error {
+	return c.be.Close()
+}
+
+// ChatStream passes the request to the wrapped backend unless the circuit is open.
+func (c *CircuitBreaker) ChatStream(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (<-chan StreamChunk, error) {
+	streamer, ok := c.be.(Streamer)
+	if !ok {
+		return nil, errors.New("backend does not support streaming")
+	}
+	if err := c.allow(); err != nil {
+		return nil, err
+	}
+	chunks, err := streamer.ChatStream(ctx, messages, tools, opts...)
+	c.record(ctx, err)
+	return chunks, err
+}
+
+// State returns the current state of the circuit, e.g. to report it in a health check.
+func (c *CircuitBreaker) State() CircuitState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == CircuitOpen && c.cooledDown() {
+		return CircuitHalfOpen
+	}
+	return c.state
+}
+
+// allow returns ErrCircuitOpen if the request must not be sent. Once the cooldown
+// has passed, it lets a single probe request through.
+func (c *CircuitBreaker) allow() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == CircuitOpen && c.cooledDown() {
+		c.state = CircuitHalfOpen
+	}
+	switch c.state {
+	case CircuitOpen:
+		return ErrCircuitOpen
+	case CircuitHalfOpen:
+		if c.probing {
+			return ErrCircuitOpen
+		}
+		c.probing = true
+	}
+	return nil
+}
+
+// record updates the circuit with the outcome of a request that was sent.
+func (c *CircuitBreaker) record(ctx context.Context, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probing = false
+
+	switch {
+	case isCircuitFailure(ctx, err):
+		c.failures++
+		if c.state == CircuitHalfOpen || c.failures >= c.cfg.FailureThreshold {
+			c.state = CircuitOpen
+			c.openedAt = c.now()
+		}
+	case err != nil && ctx.Err() != nil:
+		// The caller gave up, which says nothing about the backend
+	default:
+		c.state = CircuitClosed
+		c.failures = 0
+	}
+}
+
+// cooledDown reports whether the circuit has been open for the cooldown. The
+// caller must hold mu.
+func (c *CircuitBreaker) cooledDown() bool {
+	return c.now().Sub(c.openedAt) >= c.cfg.Cooldown
+}
+
+// isCircuitFailure reports whether err, returned for a request made with ctx,
+// means that the backend is unhealthy.
+func isCircuitFailure(ctx context.Context, err error) bool {
+	if IsRetryable(err) {
+		return true
+	}
+	// A request that timed out while the caller was still waiting hit the
+	// timeout of the backend
+	return errors.Is(err, ErrContextCanceled) && ctx.Err() == nil
+}
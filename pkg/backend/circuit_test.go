@@ -0,0 +1,133 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// failingBackend is a Backend that fails every request with err while err is set.
+type failingBackend struct {
+	err   error
+	calls int
+}
+
+func (f *failingBackend) Chat(context.Context, []Message, []Tool, ...CallOption) (*Response, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &Response{}, nil
+}
+
+func (f *failingBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	return f.Chat(ctx, nil, nil, opts...)
+}
+
+func (f *failingBackend) Close() error {
+	return nil
+}
+
+func TestWithCircuitBreaker(t *testing.T) {
+	be := &failingBackend{err: newBackendError(http.StatusServiceUnavailable, "down")}
+	breaker := WithCircuitBreaker(be, CircuitConfig{FailureThreshold: 3, Cooldown: time.Minute})
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, err := breaker.Generate(context.Background(), "Hi"); errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("Expected the circuit to be closed after %d failures", i)
+		}
+	}
+	if state := breaker.State(); state != CircuitOpen {
+		t.Fatalf("Expected the circuit to open after 3 failures, got %s", state)
+	}
+
+	// While open, requests fail fast
+	if _, err := breaker.Generate(context.Background(), "Hi"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected ErrCircuitOpen, got %v", err)
+	}
+	if be.calls != 3 {
+		t.Errorf("Expected no request while the circuit is open, got %d calls", be.calls)
+	}
+
+	// After the cooldown a failed probe opens the circuit again
+	now = now.Add(time.Minute)
+	if state := breaker.State(); state != CircuitHalfOpen {
+		t.Fatalf("Expected the circuit to be half-open after the cooldown, got %s", state)
+	}
+	if _, err := breaker.Generate(context.Background(), "Hi"); errors.Is(err, ErrCircuitOpen) || be.calls != 4 {
+		t.Fatalf("Expected a probe request, got %v", err)
+	}
+	if state := breaker.State(); state != CircuitOpen {
+		t.Fatalf("Expected a failed probe to reopen the circuit, got %s", state)
+	}
+
+	// A successful probe closes it
+	now = now.Add(time.Minute)
+	be.err = nil
+	if _, err := breaker.Generate(context.Background(), "Hi"); err != nil {
+		t.Fatalf("Expected the probe to succeed, got %v", err)
+	}
+	if state := breaker.State(); state != CircuitClosed {
+		t.Errorf("Expected a successful probe to close the circuit, got %s", state)
+	}
+}
+
+func TestCircuitBreakerIgnoresClientErrors(t *testing.T) {
+	be := &failingBackend{err: newBackendError(http.StatusBadRequest, "bad request")}
+	breaker := WithCircuitBreaker(be, CircuitConfig{FailureThreshold: 1, Cooldown: time.Minute})
+
+	breaker.Generate(context.Background(), "Hi")
+	if state := breaker.State(); state != CircuitClosed {
+		t.Errorf("Expected a 400 response to keep the circuit closed, got %s", state)
+	}
+
+	// A request canceled by the caller says nothing about the backend
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	be.err = ErrContextCanceled
+	breaker.Generate(ctx, "Hi")
+	if state := breaker.State(); state != CircuitClosed {
+		t.Errorf("Expected a canceled request to keep the circuit closed, got %s", state)
+	}
+
+	// A timeout of the backend itself does
+	breaker.Generate(context.Background(), "Hi")
+	if state := breaker.State(); state != CircuitOpen {
+		t.Errorf("Expected a backend timeout to open the circuit, got %s", state)
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	be := &failingBackend{err: newBackendError(http.StatusBadGateway, "down")}
+	breaker := WithCircuitBreaker(be, CircuitConfig{FailureThreshold: 1, Cooldown: time.Minute})
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+
+	breaker.Generate(context.Background(), "Hi")
+	now = now.Add(time.Minute)
+
+	// The first request after the cooldown is the probe, others fail fast meanwhile
+	if err := breaker.allow(); err != nil {
+		t.Fatalf("Expected the probe to be allowed, got %v", err)
+	}
+	if err := breaker.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected ErrCircuitOpen while the probe is in flight, got %v", err)
+	}
+}
@@ -0,0 +1,458 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCohereBaseURL = "https://api.cohere.com"
+	cohereChatEndpoint   = "/v1/chat"
+	cohereModelsEndpoint = "/v1/models"
+)
+
+// Roles of the participants in a Cohere conversation.
+const (
+	cohereRoleUser    = "USER"
+	cohereRoleChatbot = "CHATBOT"
+	cohereRoleTool    = "TOOL"
+)
+
+// CohereBackend represents a backend for interacting with the Cohere chat API.
+// It holds the necessary credentials and configuration for making API requests.
+type CohereBackend struct {
+	APIKey     string
+	Model      string
+	HTTPClient *http.Client
+	BaseURL    string
+	// SystemPrompt is used for every conversation that has no system message.
+	SystemPrompt string
+	// RequestTimeout bounds every request. Zero means no limit other than the
+	// deadline of the context passed by the caller.
+	RequestTimeout time.Duration
+	// Headers are added to every request. They cannot replace the headers the
+	// backend sets itself, such as Content-Type and the API key.
+	Headers map[string]string
+	// UserAgent is sent in the User-Agent header of every request. Empty means
+	// DefaultUserAgent.
+	UserAgent string
+	// MaxRequestBytes is the size of the largest request body the backend sends.
+	// Zero means no limit.
+	MaxRequestBytes int
+	// Tokenizer counts the tokens of requests for the backend. Nil uses the
+	// counter EstimateTokens uses for the model.
+	Tokenizer Tokenizer
+	// UnsupportedOptions is what happens to call options the backend cannot
+	// honour, see WithUnsupportedOptions.
+	UnsupportedOptions UnsupportedOptionPolicy
+
+	// transport is the transport created for WithConnectionPool, if any.
+	transport *http.Transport
+}
+
+var (
+	_ Backend = (*CohereBackend)(nil)
+	_ Pinger  = (*CohereBackend)(nil)
+)
+
+// NewCohereBackend creates and returns a new CohereBackend instance.
+// It takes an API key and a Cohere model name, e.g. "command-r-plus",
+// followed by optional settings such as WithBaseURL or WithHTTPClient.
+func NewCohereBackend(apiKey, model string, opts ...Option) *CohereBackend {
+	o := newOptions(opts)
+
+	baseURL := defaultCohereBaseURL
+	if o.baseURL != "" {
+		baseURL = o.baseURL
+	}
+
+	client, transport := newHTTPClient(o, 0)
+
+	return &CohereBackend{
+		APIKey:             apiKey,
+		Model:              model,
+		HTTPClient:         client,
+		BaseURL:            baseURL,
+		SystemPrompt:       o.systemPrompt,
+		RequestTimeout:     o.timeout,
+		Headers:            o.headers,
+		UserAgent:          o.userAgent,
+		MaxRequestBytes:    o.maxBodyBytes,
+		Tokenizer:          o.tokenizer,
+		UnsupportedOptions: o.unsupported,
+		transport:          transport,
+	}
+}
+
+// cohereMessage is an entry of the chat_history of a Cohere chat request.
+type cohereMessage struct {
+	Role        string             `json:"role"`
+	Message     string             `json:"message,omitempty"`
+	ToolCalls   []cohereToolCall   `json:"tool_calls,omitempty"`
+	ToolResults []cohereToolResult `json:"tool_results,omitempty"`
+}
+
+// cohereToolCall is a tool call in the wire format of the Cohere chat API.
+type cohereToolCall struct {
+	Name       string         `json:"name"`
+	Parameters map[string]any `json:"parameters"`
+}
+
+// cohereToolResult is the result of a tool call in the wire format of the Cohere chat API.
+type cohereToolResult struct {
+	Call    cohereToolCall   `json:"call"`
+	Outputs []map[string]any `json:"outputs"`
+}
+
+// cohereTool is a tool definition in the wire format of the Cohere chat API.
+type cohereTool struct {
+	Name                 string                         `json:"name"`
+	Description          string                         `json:"description"`
+	ParameterDefinitions map[string]cohereParameterSpec `json:"parameter_definitions,omitempty"`
+}
+
+// cohereParameterSpec describes a parameter of a Cohere tool.
+type cohereParameterSpec struct {
+	Description string `json:"description,omitempty"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required"`
+}
+
+// cohereChat is a conversation in the form of a Cohere chat request: the system
+// prompt goes into the preamble, the last user turn into message, or the trailing
+// tool results into tool_results, and all turns before into chat_history.
+type cohereChat struct {
+	Preamble    string
+	ChatHistory []cohereMessage
+	Message     string
+	ToolResults []cohereToolResult
+}
+
+// CohereResponse represents the structure of the response received from the Cohere chat API.
+type CohereResponse struct {
+	ResponseID   string           `json:"response_id"`
+	Text         string           `json:"text"`
+	GenerationID string           `json:"generation_id"`
+	FinishReason string           `json:"finish_reason"`
+	ToolCalls    []cohereToolCall `json:"tool_calls"`
+	Meta         struct {
+		BilledUnits struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"billed_units"`
+	} `json:"meta"`
+}
+
+// toCohereChat translates messages into a Cohere chat request. Tool results are
+// paired with the calls they answer, using the ToolCallID if set and the tool name
+// otherwise, because Cohere requires each result to repeat its call.
+func toCohereChat(messages []Message) cohereChat {
+	var chat cohereChat
+	var system []string
+	var history []cohereMessage
+	calls := map[string]cohereToolCall{}
+
+	for _, msg := range messages {
+		switch msg.Role {
+		case RoleSystem:
+			system = append(system, msg.Content)
+		case RoleAssistant:
+			entry := cohereMessage{Role: cohereRoleChatbot, Message: msg.Content}
+			for _, call := range msg.ToolCalls {
+				cohereCall := cohereToolCall{Name: call.Function.Name, Parameters: call.Function.Arguments}
+				if cohereCall.Parameters == nil {
+					cohereCall.Parameters = map[string]any{}
+				}
+				entry.ToolCalls = append(entry.ToolCalls, cohereCall)
+				if call.ID != "" {
+					calls[call.ID] = cohereCall
+				}
+				calls[call.Function.Name] = cohereCall
+			}
+			history = append(history, entry)
+		case RoleTool:
+			call, ok := calls[msg.ToolCallID]
+			if !ok {
+				call = calls[msg.Name]
+			}
+			if call.Name == "" {
+				call = cohereToolCall{Name: msg.Name, Parameters: map[string]any{}}
+			}
+			result := cohereToolResult{Call: call, Outputs: []map[string]any{{"result": msg.Content}}}
+			if n := len(history); n > 0 && history[n-1].Role == cohereRoleTool {
+				history[n-1].ToolResults = append(history[n-1].ToolResults, result)
+				continue
+			}
+			history = append(history, cohereMessage{Role: cohereRoleTool, ToolResults: []cohereToolResult{result}})
+		default:
+			history = append(history, cohereMessage{Role: cohereRoleUser, Message: msg.Content})
+		}
+	}
+
+	// The last turn is sent outside of the history
+	if n := len(history); n > 0 {
+		switch last := history[n-1]; last.Role {
+		case cohereRoleUser:
+			chat.Message = last.Message
+			history = history[:n-1]
+		case cohereRoleTool:
+			chat.ToolResults = last.ToolResults
+			history = history[:n-1]
+		}
+	}
+
+	chat.Preamble = strings.Join(system, "\n\n")
+	chat.ChatHistory = history
+	return chat
+}
+
+// toCohereTools translates tool definitions in the Ollama and OpenAI function format
+// into the wire format of the Cohere chat API, which describes each parameter with
+// a flat specification instead of a JSON schema.
+func toCohereTools(tools []Tool) ([]cohereTool, error) {
+	out := make([]cohereTool, 0, len(tools))
+	for i, tool := range tools {
+		function, ok := tool["function"].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("tool %d has no function definition", i)
+		}
+		name, _ := function["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("tool %d has no name", i)
+		}
+		description, _ := function["description"].(string)
+
+		schema, _ := function["parameters"].(map[string]any)
+		properties, _ := schema["properties"].(map[string]any)
+		required := stringList(schema["required"])
+
+		var definitions map[string]cohereParameterSpec
+		for param, raw := range properties {
+			property, _ := raw.(map[string]any)
+			propertyType, _ := property["type"].(string)
+			propertyDescription, _ := property["description"].(string)
+			if definitions == nil {
+				definitions = make(map[string]cohereParameterSpec)
+			}
+			definitions[param] = cohereParameterSpec{
+				Description: propertyDescription,
+				Type:        cohereParameterType(propertyType),
+				Required:    slices.Contains(required, param),
+			}
+		}
+
+		out = append(out, cohereTool{Name: name, Description: description, ParameterDefinitions: definitions})
+	}
+	return out, nil
+}
+
+// cohereParameterType translates a JSON schema type into the Python type name Cohere expects.
+func cohereParameterType(schemaType string) string {
+	switch schemaType {
+	case "string":
+		return "str"
+	case "integer":
+		return "int"
+	case "number":
+		return "float"
+	case "boolean":
+		return "bool"
+	case "array":
+		return "list"
+	case "object":
+		return "dict"
+	}
+	return schemaType
+}
+
+// Chat sends the conversation in messages to the Cohere chat endpoint and returns the
+// reply. Tools use the same definitions as for Ollama. Tool calls requested by the
+// model are available in the ToolCalls of the returned Message; Cohere does not
+// identify them, so their ID is empty.
+func (c *CohereBackend) Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	ctx, cancel := withRequestTimeout(ctx, c.RequestTimeout)
+	defer cancel()
+
+	callOpts, err := newModelCallOptions(c.Model, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := callOpts.checkSupported("Cohere", c.UnsupportedOptions, ollamaOnlyOptions...); err != nil {
+		return nil, err
+	}
+
+	result, err := c.chat(ctx, messages, tools, callOpts)
+	if err != nil {
+		return dryRunResponse(c.Model, err)
+	}
+
+	return result.toResponse(c.Model), nil
+}
+
+// chat sends messages and tools to the chat endpoint and returns the unmodified
+// Cohere response.
+func (c *CohereBackend) chat(ctx context.Context, messages []Message, tools []Tool, opts *Options) (*CohereResponse, error) {
+	messages, err := opts.withContextDocuments(c.Model, c.Tokenizer, withSystemPrompt(c.SystemPrompt, messages))
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.checkContext(c.Model, c.Tokenizer, messages); err != nil {
+		return nil, err
+	}
+	chat := toCohereChat(messages)
+
+	reqBody := map[string]interface{}{
+		"model":   c.Model,
+		"message": chat.Message,
+	}
+	if chat.Preamble != "" {
+		reqBody["preamble"] = chat.Preamble
+	}
+	if len(chat.ChatHistory) > 0 {
+		reqBody["chat_history"] = chat.ChatHistory
+	}
+	if len(chat.ToolResults) > 0 {
+		reqBody["tool_results"] = chat.ToolResults
+	}
+
+	if err := opts.checkTools(tools); err != nil {
+		return nil, err
+	}
+	if choice := opts.ToolChoice; choice != nil && len(tools) > 0 {
+		// The chat API has no tool choice, so only the chosen tool is advertised
+		tools = chosenTools(choice, tools)
+	}
+	if len(tools) > 0 {
+		cohereTools, err := toCohereTools(tools)
+		if err != nil {
+			return nil, err
+		}
+		reqBody["tools"] = cohereTools
+	}
+
+	if opts.JSONFormat || opts.ResponseSchema != nil {
+		reqBody["response_format"] = map[string]string{"type": "json_object"}
+	}
+	if opts.Temperature != nil {
+		reqBody["temperature"] = *opts.Temperature
+	}
+	if opts.TopP != nil {
+		reqBody["p"] = *opts.TopP
+	}
+	if len(opts.StopSequences) > 0 {
+		reqBody["stop_sequences"] = opts.StopSequences
+	}
+	if opts.Seed != nil {
+		reqBody["seed"] = *opts.Seed
+	}
+	if opts.MaxTokens != nil {
+		reqBody["max_tokens"] = *opts.MaxTokens
+	}
+
+	if err := opts.dryRun(reqBody); err != nil {
+		return nil, err
+	}
+
+	resp, err := postJSON(ctx, c.HTTPClient, c.BaseURL+cohereChatEndpoint, c.header(opts.Headers), reqBody, c.MaxRequestBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate response from Cohere: %w", err)
+	}
+
+	var result CohereResponse
+	if err := decodeResponse(ctx, resp, &result, opts); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// toResponse converts the Cohere specific response into the backend-neutral Response.
+func (r *CohereResponse) toResponse(model string) *Response {
+	var toolCalls []ToolCall
+	for _, call := range r.ToolCalls {
+		toolCalls = append(toolCalls, ToolCall{
+			Function: FunctionCall{
+				Name:      call.Name,
+				Arguments: call.Parameters,
+			},
+		})
+	}
+
+	out := &Response{
+		Model:    model,
+		Response: r.Text,
+		Message: Message{
+			Role:      RoleAssistant,
+			Content:   r.Text,
+			ToolCalls: toolCalls,
+		},
+		Done:            true,
+		DoneReason:      r.FinishReason,
+		Truncated:       r.FinishReason == "MAX_TOKENS",
+		PromptEvalCount: r.Meta.BilledUnits.InputTokens,
+		EvalCount:       r.Meta.BilledUnits.OutputTokens,
+	}
+	out.setUsage(r.Meta.BilledUnits.InputTokens, r.Meta.BilledUnits.OutputTokens, 0)
+	out.setFinishReason(r.FinishReason, cohereFinishReasons)
+	return out
+}
+
+// cohereFinishReasons maps the finish reasons of Cohere to the Finish constants.
+var cohereFinishReasons = map[string]string{
+	"COMPLETE":      FinishStop,
+	"STOP_SEQUENCE": FinishStop,
+	"MAX_TOKENS":    FinishLength,
+	"ERROR_TOXIC":   FinishContentFilter,
+}
+
+// Generate produces a response from the Cohere API based on the given prompt.
+// The prompt is sent as the message of a chat without history.
+func (c *CohereBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	return c.Chat(ctx, []Message{UserMessage(prompt)}, nil, opts...)
+}
+
+// Close implements Backend. It works as OpenAIBackend.Close does.
+func (c *CohereBackend) Close() error {
+	return closeTransport(c.transport)
+}
+
+// Ping checks that the Cohere API is reachable and accepts the API key by listing
+// the available models, which costs no tokens. It returns an error matching
+// ErrUnreachable if the server cannot be reached.
+func (c *CohereBackend) Ping(ctx context.Context) error {
+	ctx, cancel := withRequestTimeout(ctx, c.RequestTimeout)
+	defer cancel()
+
+	resp, err := getJSON(ctx, c.HTTPClient, c.BaseURL+cohereModelsEndpoint, c.header(nil))
+	if err != nil {
+		return fmt.Errorf("failed to ping Cohere: %w", unreachableError(c.BaseURL, err))
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// header returns the headers that authenticate a request with the API key, on top
+// of the custom headers, including callHeaders set for the call.
+func (c *CohereBackend) header(callHeaders map[string]string) http.Header {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+c.APIKey)
+	return requestHeader(header, c.UserAgent, c.Headers, callHeaders)
+}
@@ -0,0 +1,193 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// cohereRequest is the part of a Cohere chat request the tests inspect.
+type cohereRequest struct {
+	Model       string             `json:"model"`
+	Message     string             `json:"message"`
+	Preamble    string             `json:"preamble"`
+	ChatHistory []cohereMessage    `json:"chat_history"`
+	ToolResults []cohereToolResult `json:"tool_results"`
+	Tools       []cohereTool       `json:"tools"`
+	Temperature *float64           `json:"temperature"`
+	P           *float64           `json:"p"`
+	MaxTokens   *int               `json:"max_tokens"`
+}
+
+func TestCohereChat(t *testing.T) {
+	received := make(chan cohereRequest, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != cohereChatEndpoint {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer test-api-key" {
+			t.Errorf("Expected bearer authorization, got %s", r.Header.Get("Authorization"))
+		}
+
+		var reqBody cohereRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"response_id": "resp_1",
+			"text": "Let me check.",
+			"finish_reason": "COMPLETE",
+			"tool_calls": [{"name": "get_weather", "parameters": {"city": "Brno"}}],
+			"meta": {"billed_units": {"input_tokens": 12, "output_tokens": 7}}
+		}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewCohereBackend("test-api-key", "command-r-plus", WithBaseURL(mockServer.URL))
+
+	messages := []Message{
+		SystemMessage("You are a weather bot."),
+		UserMessage("Hi"),
+		AssistantMessage("Hello! How can I help?"),
+		UserMessage("What's the weather in Brno?"),
+	}
+	tools := []Tool{{
+		"type": "function",
+		"function": map[string]any{
+			"name":        "get_weather",
+			"description": "Get the weather",
+			"parameters": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"city": map[string]any{"type": "string", "description": "Name of the city"},
+					"days": map[string]any{"type": "integer"},
+				},
+				"required": []any{"city"},
+			},
+		},
+	}}
+
+	response, err := backend.Chat(context.Background(), messages, tools, WithTemperature(0.3), WithTopP(0.8), WithMaxTokens(100))
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+
+	reqBody := <-received
+	if reqBody.Model != "command-r-plus" || reqBody.Preamble != "You are a weather bot." {
+		t.Errorf("Unexpected model or preamble: %+v", reqBody)
+	}
+	if reqBody.Message != "What's the weather in Brno?" {
+		t.Errorf("Expected the last user message as message, got %q", reqBody.Message)
+	}
+	if len(reqBody.ChatHistory) != 2 || reqBody.ChatHistory[0].Role != "USER" || reqBody.ChatHistory[1].Role != "CHATBOT" {
+		t.Errorf("Expected the earlier turns in the chat history, got %+v", reqBody.ChatHistory)
+	}
+	if reqBody.Temperature == nil || *reqBody.Temperature != 0.3 || reqBody.P == nil || *reqBody.P != 0.8 {
+		t.Errorf("Expected temperature 0.3 and p 0.8, got %v and %v", reqBody.Temperature, reqBody.P)
+	}
+	if reqBody.MaxTokens == nil || *reqBody.MaxTokens != 100 {
+		t.Errorf("Expected max_tokens 100, got %v", reqBody.MaxTokens)
+	}
+	if len(reqBody.Tools) != 1 {
+		t.Fatalf("Expected 1 tool, got %+v", reqBody.Tools)
+	}
+	params := reqBody.Tools[0].ParameterDefinitions
+	if city := params["city"]; city.Type != "str" || !city.Required || city.Description != "Name of the city" {
+		t.Errorf("Unexpected city parameter: %+v", city)
+	}
+	if days := params["days"]; days.Type != "int" || days.Required {
+		t.Errorf("Unexpected days parameter: %+v", days)
+	}
+
+	if response.Message.Content != "Let me check." || response.Message.Role != RoleAssistant {
+		t.Errorf("Unexpected message: %+v", response.Message)
+	}
+	if !response.UsageAvailable || response.Usage.PromptTokens != 12 || response.Usage.CompletionTokens != 7 {
+		t.Errorf("Unexpected usage: %+v", response.Usage)
+	}
+	if len(response.Message.ToolCalls) != 1 {
+		t.Fatalf("Expected 1 tool call, got %d", len(response.Message.ToolCalls))
+	}
+	if call := response.Message.ToolCalls[0]; call.Function.Name != "get_weather" || call.Function.Arguments["city"] != "Brno" {
+		t.Errorf("Unexpected tool call: %+v", call)
+	}
+}
+
+func TestToCohereChatToolResults(t *testing.T) {
+	messages := []Message{
+		UserMessage("Weather and time in Brno?"),
+		{Role: RoleAssistant, ToolCalls: []ToolCall{
+			{Function: FunctionCall{Name: "get_weather", Arguments: map[string]any{"city": "Brno"}}},
+			{Function: FunctionCall{Name: "get_time"}},
+		}},
+		ToolMessage("get_weather", "sunny"),
+		ToolMessage("get_time", "noon"),
+	}
+
+	chat := toCohereChat(messages)
+	if chat.Message != "" {
+		t.Errorf("Expected no message when answering tool calls, got %q", chat.Message)
+	}
+	if len(chat.ChatHistory) != 2 || len(chat.ChatHistory[1].ToolCalls) != 2 {
+		t.Fatalf("Expected the user message and the tool calls in the history, got %+v", chat.ChatHistory)
+	}
+	if len(chat.ToolResults) != 2 {
+		t.Fatalf("Expected 2 tool results, got %+v", chat.ToolResults)
+	}
+	weather := chat.ToolResults[0]
+	if weather.Call.Name != "get_weather" || weather.Call.Parameters["city"] != "Brno" || weather.Outputs[0]["result"] != "sunny" {
+		t.Errorf("Unexpected weather result: %+v", weather)
+	}
+	if chat.ToolResults[1].Call.Name != "get_time" || chat.ToolResults[1].Outputs[0]["result"] != "noon" {
+		t.Errorf("Unexpected time result: %+v", chat.ToolResults[1])
+	}
+}
+
+func TestCohereTruncated(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"text": "Once upon a", "finish_reason": "MAX_TOKENS"}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewCohereBackend("test-api-key", "command-r-plus", WithBaseURL(mockServer.URL))
+	response, err := backend.Generate(context.Background(), "Tell me a story.", WithMaxTokens(3))
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if !response.Truncated || response.Response != "Once upon a" || response.FinishReason != FinishLength {
+		t.Errorf("Expected a truncated response, got %+v", response)
+	}
+}
+
+func TestCohereChatError(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "invalid api token"}`, http.StatusUnauthorized)
+	}))
+	defer mockServer.Close()
+
+	backend := NewCohereBackend("bad-key", "command-r-plus", WithBaseURL(mockServer.URL))
+	_, err := backend.Generate(context.Background(), "Hi")
+	var backendErr *BackendError
+	if !errors.As(err, &backendErr) || backendErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a BackendError with status 401, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+)
+
+// continuationPrompt asks the model to go on with a reply cut off at the token limit.
+const continuationPrompt = "Your reply was cut off. Continue exactly where you left off, without repeating anything you already wrote."
+
+// ChatWithContinuation sends messages to be like Chat, but when the reply is cut
+// off at the maximum number of tokens, see Response.Truncated, the model is sent
+// the reply so far and asked to continue it, up to maxContinuations times. The
+// parts are concatenated into the content of the returned reply, e.g. to generate
+// documents longer than the output limit of the model.
+//
+// The returned reply is the last one received, with the stitched content and
+// the usage of all the requests added up. It reports true if the reply was still
+// cut off after the last continuation; it is then Truncated as well. Continuation
+// stops early if the model requests tool calls, which are left to the caller.
+// If a continuation fails, its error is returned together with the reply so far.
+func ChatWithContinuation(ctx context.Context, be Backend, messages []Message, tools []Tool, maxContinuations int, opts ...CallOption) (*Response, bool, error) {
+	resp, err := be.Chat(ctx, messages, tools, opts...)
+	if err != nil {
+		return nil, false, err
+	}
+
+	stitched := *resp
+	for i := 0; i < maxContinuations && stitched.Truncated && len(stitched.Message.ToolCalls) == 0; i++ {
+		continuation := make([]Message, 0, len(messages)+2)
+		continuation = append(continuation, messages...)
+		continuation = append(continuation, AssistantMessage(stitched.Message.Content), UserMessage(continuationPrompt))
+
+		next, err := be.Chat(ctx, continuation, tools, opts...)
+		if err != nil {
+			return &stitched, true, err
+		}
+		stitched = stitchResponses(&stitched, next)
+	}
+	return &stitched, stitched.Truncated && len(stitched.Message.ToolCalls) == 0, nil
+}
+
+// stitchResponses returns next with the content of prev prepended and the usage
+// of both added up.
+func stitchResponses(prev, next *Response) Response {
+	out := *next
+	out.Message.Content = prev.Message.Content + next.Message.Content
+	out.Response = prev.Response + next.Response
+	if prev.Reasoning != "" {
+		out.Reasoning = joinContent(prev.Reasoning, next.Reasoning)
+	}
+	out.PromptEvalCount += prev.PromptEvalCount
+	out.EvalCount += prev.EvalCount
+	out.TotalDuration += prev.TotalDuration
+	if prev.UsageAvailable || next.UsageAvailable {
+		out.setUsage(
+			prev.Usage.PromptTokens+next.Usage.PromptTokens,
+			prev.Usage.CompletionTokens+next.Usage.CompletionTokens,
+			prev.Usage.TotalDuration+next.Usage.TotalDuration,
+		)
+	}
+	return out
+}
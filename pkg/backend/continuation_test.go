@@ -0,0 +1,102 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// truncatingBackend returns a fakeBackend replying with parts, one per request,
+// all but the last one cut off at the token limit.
+func truncatingBackend(parts ...string) *fakeBackend {
+	calls := 0
+	return &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			part := parts[calls]
+			calls++
+			resp := &Response{Message: AssistantMessage(part), FinishReason: FinishStop}
+			if calls < len(parts) {
+				resp.Truncated, resp.FinishReason = true, FinishLength
+			}
+			resp.setUsage(10, 5, 0)
+			return resp, nil
+		},
+	}
+}
+
+func TestChatWithContinuation(t *testing.T) {
+	be := truncatingBackend("Once upon ", "a time there ", "was a gopher.")
+
+	resp, capped, err := ChatWithContinuation(context.Background(), be, []Message{UserMessage("Tell me a story.")}, nil, 5)
+	if err != nil {
+		t.Fatalf("ChatWithContinuation returned error: %v", err)
+	}
+	if capped || resp.Truncated || resp.FinishReason != FinishStop {
+		t.Errorf("Expected the reply to end naturally, got capped %v and %+v", capped, resp)
+	}
+	if resp.Message.Content != "Once upon a time there was a gopher." {
+		t.Errorf("Unexpected content: %q", resp.Message.Content)
+	}
+	if resp.Usage.PromptTokens != 30 || resp.Usage.CompletionTokens != 15 {
+		t.Errorf("Expected the usage of all requests, got %+v", resp.Usage)
+	}
+
+	// Every continuation carries the reply so far
+	if len(be.received) != 3 {
+		t.Fatalf("Expected 3 requests, got %d", len(be.received))
+	}
+	last := be.received[2]
+	if len(last) != 3 || last[1].Role != RoleAssistant || last[1].Content != "Once upon a time there " || last[2].Content != continuationPrompt {
+		t.Errorf("Unexpected continuation request: %+v", last)
+	}
+}
+
+func TestChatWithContinuationCap(t *testing.T) {
+	be := truncatingBackend(strings.Split("a b c d ", " ")...)
+
+	resp, capped, err := ChatWithContinuation(context.Background(), be, []Message{UserMessage("Count.")}, nil, 2)
+	if err != nil {
+		t.Fatalf("ChatWithContinuation returned error: %v", err)
+	}
+	if !capped || !resp.Truncated {
+		t.Errorf("Expected the cap to be reached")
+	}
+	if resp.Message.Content != "abc" || len(be.received) != 3 {
+		t.Errorf("Expected 3 parts, got %q from %d requests", resp.Message.Content, len(be.received))
+	}
+}
+
+func TestChatWithContinuationError(t *testing.T) {
+	calls := 0
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			calls++
+			if calls > 1 {
+				return nil, ErrUnreachable
+			}
+			return &Response{Message: AssistantMessage("Once upon"), Truncated: true}, nil
+		},
+	}
+
+	resp, _, err := ChatWithContinuation(context.Background(), be, []Message{UserMessage("Tell me a story.")}, nil, 3)
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Expected ErrUnreachable, got %v", err)
+	}
+	if resp == nil || resp.Message.Content != "Once upon" {
+		t.Errorf("Expected the reply so far, got %+v", resp)
+	}
+}
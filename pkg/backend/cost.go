@@ -0,0 +1,125 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import "sync"
+
+// ModelPrice is the price of a model in US dollars per million tokens.
+type ModelPrice struct {
+	// Input is the price of a million tokens of the prompt.
+	Input float64
+	// Output is the price of a million generated tokens.
+	Output float64
+}
+
+// defaultPrices maps model name prefixes of hosted models to their list price
+// as published by the providers in early 2025. Prices change; override them
+// with SetPrice rather than relying on these for billing.
+var defaultPrices = map[string]ModelPrice{
+	"gpt-4o":            {Input: 2.50, Output: 10},
+	"gpt-4o-mini":       {Input: 0.15, Output: 0.60},
+	"gpt-4.1":           {Input: 2, Output: 8},
+	"gpt-4.1-mini":      {Input: 0.40, Output: 1.60},
+	"gpt-4.1-nano":      {Input: 0.10, Output: 0.40},
+	"gpt-4-turbo":       {Input: 10, Output: 30},
+	"gpt-3.5-turbo":     {Input: 0.50, Output: 1.50},
+	"o1":                {Input: 15, Output: 60},
+	"o1-mini":           {Input: 1.10, Output: 4.40},
+	"o3-mini":           {Input: 1.10, Output: 4.40},
+	"claude-opus-4":     {Input: 15, Output: 75},
+	"claude-sonnet-4":   {Input: 3, Output: 15},
+	"claude-3-7-sonnet": {Input: 3, Output: 15},
+	"claude-3-5-sonnet": {Input: 3, Output: 15},
+	"claude-3-5-haiku":  {Input: 0.80, Output: 4},
+	"claude-3-opus":     {Input: 15, Output: 75},
+	"claude-3-haiku":    {Input: 0.25, Output: 1.25},
+	"gemini-2.0-flash":  {Input: 0.10, Output: 0.40},
+	"gemini-1.5-pro":    {Input: 1.25, Output: 5},
+	"gemini-1.5-flash":  {Input: 0.075, Output: 0.30},
+	"command-r":         {Input: 0.15, Output: 0.60},
+	"command-r-plus":    {Input: 2.50, Output: 10},
+	"mistral-large":     {Input: 2, Output: 6},
+	"mistral-small":     {Input: 0.20, Output: 0.60},
+}
+
+// DefaultCostEstimator is the CostEstimator used by Response.EstimatedCost. It
+// starts with the list prices of common hosted models.
+var DefaultCostEstimator = NewCostEstimator(DefaultPrices())
+
+// DefaultPrices returns a copy of the built-in prices of hosted models, keyed by
+// model name prefix, e.g. to start a CostEstimator of one's own from them.
+func DefaultPrices() map[string]ModelPrice {
+	prices := make(map[string]ModelPrice, len(defaultPrices))
+	for prefix, price := range defaultPrices {
+		prices[prefix] = price
+	}
+	return prices
+}
+
+// CostEstimator estimates the cost of requests from the tokens they used and a
+// table of prices. A model is priced by the longest prefix of its name in the
+// table, so "gpt-4o" prices "gpt-4o-2024-08-06" as well, and a more specific
+// prefix such as "gpt-4o-mini" takes precedence. It is safe for concurrent use.
+type CostEstimator struct {
+	mu     sync.RWMutex
+	prices map[string]ModelPrice
+}
+
+// NewCostEstimator returns a CostEstimator with prices, keyed by model name
+// prefix. The map is copied.
+func NewCostEstimator(prices map[string]ModelPrice) *CostEstimator {
+	e := &CostEstimator{prices: make(map[string]ModelPrice, len(prices))}
+	for prefix, price := range prices {
+		e.prices[prefix] = price
+	}
+	return e
+}
+
+// SetPrice sets the price of the models whose name starts with prefix, e.g. when
+// a provider changes its prices or for a negotiated rate.
+func (e *CostEstimator) SetPrice(prefix string, price ModelPrice) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.prices[prefix] = price
+}
+
+// Price returns the price of model and whether the estimator has one.
+func (e *CostEstimator) Price(model string) (ModelPrice, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return longestPrefixMatch(e.prices, baseModelName(model))
+}
+
+// Estimate returns the cost of the request that produced resp in US dollars. It
+// is zero for replies of Ollama, which runs models locally, for replies without
+// usage, see Response.UsageAvailable, and for models the estimator has no price
+// for.
+func (e *CostEstimator) Estimate(resp *Response) float64 {
+	if resp == nil || resp.local || !resp.UsageAvailable {
+		return 0
+	}
+	price, ok := e.Price(resp.Model)
+	if !ok {
+		return 0
+	}
+	return (float64(resp.Usage.PromptTokens)*price.Input + float64(resp.Usage.CompletionTokens)*price.Output) / 1e6
+}
+
+// EstimatedCost returns the cost of the request that produced r in US dollars,
+// estimated by DefaultCostEstimator. Use a CostEstimator of your own for other
+// prices, e.g. per tenant.
+func (r *Response) EstimatedCost() float64 {
+	return DefaultCostEstimator.Estimate(r)
+}
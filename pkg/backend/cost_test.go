@@ -0,0 +1,95 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCostEstimator(t *testing.T) {
+	estimator := NewCostEstimator(DefaultPrices())
+	usage := func(model string, prompt, completion int) *Response {
+		resp := &Response{Model: model}
+		resp.setUsage(prompt, completion, 0)
+		return resp
+	}
+
+	tests := []struct {
+		name string
+		resp *Response
+		want float64
+	}{
+		{name: "priced model", resp: usage("gpt-4o", 1000, 500), want: 0.0075},
+		{name: "dated version", resp: usage("gpt-4o-2024-08-06", 1000, 500), want: 0.0075},
+		{name: "more specific prefix", resp: usage("gpt-4o-mini", 1000000, 0), want: 0.15},
+		{name: "unknown model", resp: usage("my-finetune", 1000, 500), want: 0},
+		{name: "no usage", resp: &Response{Model: "gpt-4o"}, want: 0},
+		{name: "nil response", resp: nil, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimator.Estimate(tt.resp); math.Abs(got-tt.want) > 1e-12 {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	estimator.SetPrice("my-finetune", ModelPrice{Input: 1, Output: 2})
+	if got := estimator.Estimate(usage("my-finetune", 1000000, 1000000)); got != 3 {
+		t.Errorf("Expected the overridden price, got %v", got)
+	}
+	if _, ok := DefaultCostEstimator.Price("my-finetune"); ok {
+		t.Error("Expected the default estimator to be unaffected")
+	}
+}
+
+func TestEstimatedCost(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == chatEndpoint {
+			// A model that shares its name with a hosted one still costs nothing locally
+			w.Write([]byte(`{"model": "mistral-large", "message": {"role": "assistant", "content": "Hi!"}, "done": true, "prompt_eval_count": 1000, "eval_count": 1000}`))
+			return
+		}
+		w.Write([]byte(`{
+			"model": "gpt-4o-mini",
+			"choices": [{"index": 0, "message": {"role": "assistant", "content": "Hi!"}, "finish_reason": "stop"}],
+			"usage": {"prompt_tokens": 2000, "completion_tokens": 1000}
+		}`))
+	}))
+	defer mockServer.Close()
+	messages := []Message{UserMessage("Hello")}
+
+	openai := NewOpenAIBackend("test-api-key", "gpt-4o-mini", WithBaseURL(mockServer.URL))
+	resp, err := openai.Chat(context.Background(), messages, nil)
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if got, want := resp.EstimatedCost(), 0.0009; math.Abs(got-want) > 1e-12 {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	ollama := NewOllamaBackend(mockServer.URL, "mistral-large")
+	resp, err = ollama.Chat(context.Background(), messages, nil)
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if !resp.UsageAvailable || resp.EstimatedCost() != 0 {
+		t.Errorf("Expected no cost for Ollama, got %v", resp.EstimatedCost())
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Document is a piece of context retrieved for a request, e.g. a chunk returned by
+// a vector search, to be sent to the model with WithContextDocuments.
+type Document struct {
+	// ID identifies the document, e.g. its path or the key of the chunk.
+	ID string `json:"id,omitempty"`
+	// Content is the text of the document.
+	Content string `json:"content"`
+	// Score is the relevance of the document to the request; higher is more
+	// relevant. The least relevant documents are dropped first to fit a budget.
+	Score float64 `json:"score,omitempty"`
+	// Metadata holds further details of the document, e.g. its title or source.
+	// The default template does not render it.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// DocumentReport tells which documents of WithContextDocuments were sent with a
+// request, e.g. to debug retrieval.
+type DocumentReport struct {
+	// Included are the documents sent, in the order they were given.
+	Included []Document
+	// Dropped are the documents left out to fit the token budget, the least
+	// relevant first.
+	Dropped []Document
+	// Tokens is the estimated size of the context added to the request.
+	Tokens int
+}
+
+// ContextDocuments holds the settings of WithContextDocuments.
+type ContextDocuments struct {
+	// Documents are the documents to send.
+	Documents []Document `json:"documents"`
+	// Header introduces the documents. Empty uses a default telling the model to
+	// answer from them.
+	Header string `json:"header,omitempty"`
+	// Template is the text/template each document is rendered with. It is
+	// executed with the fields of the Document and its Index, starting at 1. Empty
+	// uses a template that wraps the content in <document> tags.
+	Template string `json:"template,omitempty"`
+	// MaxTokens is the budget of the documents, header included. Zero means no limit.
+	MaxTokens int `json:"max_tokens,omitempty"`
+	// Role is where the documents go: RoleSystem, the default, for a system message
+	// after the leading system messages, or RoleUser to put them before the content
+	// of the last user message.
+	Role string `json:"role,omitempty"`
+	// Report is called with the documents that were sent and dropped.
+	Report func(DocumentReport) `json:"-"`
+}
+
+// DocumentOption configures WithContextDocuments.
+type DocumentOption func(*ContextDocuments)
+
+// The defaults of ContextDocuments.
+const (
+	defaultDocumentHeader   = "Answer using the following documents where they are relevant. If they do not contain the answer, say so."
+	defaultDocumentTemplate = `<document index="{{.Index}}"{{with .ID}} id="{{.}}"{{end}}>` + "\n{{.Content}}\n</document>"
+)
+
+// WithDocumentHeader replaces the text that introduces the documents.
+func WithDocumentHeader(header string) DocumentOption {
+	return func(c *ContextDocuments) {
+		c.Header = header
+	}
+}
+
+// WithDocumentTemplate renders each document with the text/template tmpl, which is
+// executed with the fields of the Document and its Index, e.g.
+//
+//	[{{.Index}}] {{.Metadata.title}}: {{.Content}}
+//
+// A template that does not parse fails the request with an error matching
+// ErrInvalidOption.
+func WithDocumentTemplate(tmpl string) DocumentOption {
+	return func(c *ContextDocuments) {
+		c.Template = tmpl
+	}
+}
+
+// WithDocumentBudget limits the documents to about maxTokens, estimated as for
+// WithContextGuard. The least relevant documents, by Score, are dropped until
+// the rest fit.
+func WithDocumentBudget(maxTokens int) DocumentOption {
+	return func(c *ContextDocuments) {
+		c.MaxTokens = maxTokens
+	}
+}
+
+// WithDocumentRole sets where the documents go, RoleSystem or RoleUser; see
+// ContextDocuments.Role.
+func WithDocumentRole(role string) DocumentOption {
+	return func(c *ContextDocuments) {
+		c.Role = role
+	}
+}
+
+// WithDocumentReport calls report with the documents that were sent and those
+// dropped to fit the budget, before the request is sent.
+func WithDocumentReport(report func(DocumentReport)) DocumentOption {
+	return func(c *ContextDocuments) {
+		c.Report = report
+	}
+}
+
+// WithContextDocuments adds docs to the conversation of the request, e.g. the
+// documents retrieved for the question of the user in retrieval augmented
+// generation. By default they are rendered in a system message that follows the
+// system prompt; opts change the header, the template, the role and the token
+// budget. The context guard of WithContextGuard counts them. An Ollama Generate
+// request with WithRaw is sent without them, as its prompt is sent as it is.
+func WithContextDocuments(docs []Document, opts ...DocumentOption) CallOption {
+	c := &ContextDocuments{Documents: docs}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return func(o *Options) {
+		o.ContextDocuments = c
+	}
+}
+
+// validate checks the settings and returns an error matching ErrInvalidOption
+// if they are not valid.
+func (c *ContextDocuments) validate() error {
+	if c.MaxTokens < 0 {
+		return fmt.Errorf("%w: document budget %d is negative", ErrInvalidOption, c.MaxTokens)
+	}
+	if c.Role != "" && c.Role != RoleSystem && c.Role != RoleUser {
+		return fmt.Errorf("%w: document role %q is not %q or %q", ErrInvalidOption, c.Role, RoleSystem, RoleUser)
+	}
+	if _, err := c.template(); err != nil {
+		return fmt.Errorf("%w: document template: %w", ErrInvalidOption, err)
+	}
+	return nil
+}
+
+// template returns the parsed template of the documents.
+func (c *ContextDocuments) template() (*template.Template, error) {
+	text := c.Template
+	if text == "" {
+		text = defaultDocumentTemplate
+	}
+	return template.New("document").Option("missingkey=zero").Parse(text)
+}
+
+// withContextDocuments returns messages with the context documents of the options
+// added, trimmed to their budget as estimated for model with tokenizer, unless
+// the options of the request have none.
+func (o *Options) withContextDocuments(model string, tokenizer Tokenizer, messages []Message) ([]Message, error) {
+	c := o.ContextDocuments
+	if c == nil {
+		return messages, nil
+	}
+	tmpl, err := c.template()
+	if err != nil {
+		return nil, fmt.Errorf("%w: document template: %w", ErrInvalidOption, err)
+	}
+	header := c.Header
+	if header == "" {
+		header = defaultDocumentHeader
+	}
+
+	rendered := make([]string, len(c.Documents))
+	for i, doc := range c.Documents {
+		var b strings.Builder
+		data := struct {
+			Document
+			Index int
+		}{doc, i + 1}
+		if err := tmpl.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("failed to render document %d: %w", i+1, err)
+		}
+		rendered[i] = b.String()
+	}
+
+	// Drop the least relevant documents until the rest fit the budget
+	byRelevance := make([]int, len(c.Documents))
+	for i := range byRelevance {
+		byRelevance[i] = i
+	}
+	sort.SliceStable(byRelevance, func(a, b int) bool {
+		return c.Documents[byRelevance[a]].Score > c.Documents[byRelevance[b]].Score
+	})
+	included := make([]bool, len(c.Documents))
+	for _, i := range byRelevance {
+		included[i] = true
+	}
+	count := o.TokenCounter
+	if count == nil {
+		count = tokenCounter(model, tokenizer)
+	}
+	content := func() string {
+		parts := []string{header}
+		for i, ok := range included {
+			if ok {
+				parts = append(parts, rendered[i])
+			}
+		}
+		return strings.Join(parts, "\n\n")
+	}
+	var report DocumentReport
+	text := content()
+	for kept := len(byRelevance); c.MaxTokens > 0 && kept > 0 && count(text) > c.MaxTokens; kept-- {
+		dropped := byRelevance[kept-1]
+		included[dropped] = false
+		report.Dropped = append(report.Dropped, c.Documents[dropped])
+		text = content()
+	}
+	for i, ok := range included {
+		if ok {
+			report.Included = append(report.Included, c.Documents[i])
+		}
+	}
+	if len(report.Included) > 0 {
+		report.Tokens = count(text)
+	}
+	if c.Report != nil {
+		c.Report(report)
+	}
+	if len(report.Included) == 0 {
+		return messages, nil
+	}
+
+	out := make([]Message, 0, len(messages)+1)
+	if c.Role == RoleUser {
+		last := -1
+		for i, msg := range messages {
+			if msg.Role == RoleUser {
+				last = i
+			}
+		}
+		out = append(out, messages...)
+		if last < 0 {
+			return append(out, UserMessage(text)), nil
+		}
+		out[last].Content = joinContent(text, out[last].Content)
+		return out, nil
+	}
+
+	leading := 0
+	for leading < len(messages) && messages[leading].Role == RoleSystem {
+		leading++
+	}
+	out = append(out, messages[:leading]...)
+	out = append(out, SystemMessage(text))
+	return append(out, messages[leading:]...), nil
+}
+
+// splitPrompt returns the contents of the system messages of messages, joined,
+// and the content of the last user message, for endpoints that take a system
+// prompt and a prompt rather than a conversation.
+func splitPrompt(messages []Message) (system, prompt string) {
+	for _, msg := range messages {
+		switch msg.Role {
+		case RoleSystem:
+			system = joinContent(system, msg.Content)
+		case RoleUser:
+			prompt = msg.Content
+		}
+	}
+	return system, prompt
+}
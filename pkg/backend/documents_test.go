@@ -0,0 +1,123 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithContextDocuments(t *testing.T) {
+	docs := []Document{
+		{ID: "a", Content: "one two three four five", Score: 0.9},
+		{ID: "b", Content: "six seven eight nine ten", Score: 0.2},
+		{ID: "c", Content: "eleven twelve thirteen fourteen fifteen", Score: 0.5},
+	}
+	words := func(text string) int { return len(strings.Fields(text)) }
+	messages := []Message{SystemMessage("Be brief."), UserMessage("Question?")}
+
+	var report DocumentReport
+	opts, err := newCallOptions([]CallOption{
+		WithTokenCounter(words),
+		WithContextDocuments(docs,
+			WithDocumentHeader("Context:"),
+			WithDocumentTemplate("[{{.Index}} {{.ID}}] {{.Content}}"),
+			WithDocumentBudget(15),
+			WithDocumentReport(func(r DocumentReport) { report = r })),
+	})
+	if err != nil {
+		t.Fatalf("Invalid options: %v", err)
+	}
+	out, err := opts.withContextDocuments("test-model", nil, messages)
+	if err != nil {
+		t.Fatalf("Failed to add documents: %v", err)
+	}
+
+	// The budget only fits two documents, so the least relevant one is dropped
+	want := "Context:\n\n[1 a] one two three four five\n\n[3 c] eleven twelve thirteen fourteen fifteen"
+	if len(out) != 3 || out[0].Content != "Be brief." || out[1].Role != RoleSystem || out[1].Content != want || out[2].Content != "Question?" {
+		t.Fatalf("Unexpected messages: %+v", out)
+	}
+	if len(report.Included) != 2 || report.Included[0].ID != "a" || report.Included[1].ID != "c" {
+		t.Errorf("Unexpected included documents: %+v", report.Included)
+	}
+	if len(report.Dropped) != 1 || report.Dropped[0].ID != "b" || report.Tokens != 15 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	if messages[1].Content != "Question?" || len(messages) != 2 {
+		t.Errorf("Expected the messages of the caller to be unchanged, got %+v", messages)
+	}
+
+	opts, _ = newCallOptions([]CallOption{WithContextDocuments(docs[:1], WithDocumentRole(RoleUser))})
+	out, err = opts.withContextDocuments("test-model", nil, messages)
+	if err != nil {
+		t.Fatalf("Failed to add documents: %v", err)
+	}
+	if len(out) != 2 || !strings.HasPrefix(out[1].Content, defaultDocumentHeader) || !strings.HasSuffix(out[1].Content, "\n</document>\n\nQuestion?") {
+		t.Errorf("Expected the documents before the question, got %+v", out)
+	}
+	if !strings.Contains(out[1].Content, `<document index="1" id="a">`) {
+		t.Errorf("Expected the default template, got %q", out[1].Content)
+	}
+}
+
+func TestWithContextDocumentsInvalid(t *testing.T) {
+	for name, opt := range map[string]DocumentOption{
+		"template": WithDocumentTemplate("{{.Content"),
+		"budget":   WithDocumentBudget(-1),
+		"role":     WithDocumentRole(RoleAssistant),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := newCallOptions([]CallOption{WithContextDocuments([]Document{{Content: "x"}}, opt)})
+			if !errors.Is(err, ErrInvalidOption) {
+				t.Errorf("Expected ErrInvalidOption, got %v", err)
+			}
+		})
+	}
+}
+
+func TestContextDocumentsOnTheWire(t *testing.T) {
+	var bodies []map[string]any
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+		w.Write([]byte(`{"message": {"role": "assistant", "content": "ok"}, "response": "ok", "done": true}`))
+	}))
+	defer mockServer.Close()
+
+	be := NewOllamaBackend(mockServer.URL, "test-model", WithSystemPrompt("Be brief."))
+	docs := WithContextDocuments([]Document{{Content: "Brno is in Moravia."}}, WithDocumentHeader("Context:"), WithDocumentTemplate("{{.Content}}"))
+	if _, err := be.Chat(context.Background(), []Message{UserMessage("Where is Brno?")}, nil, docs); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if _, err := be.Generate(context.Background(), "Where is Brno?", docs); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+
+	// Ollama gets a single system message with the system prompt and the documents
+	messages, _ := bodies[0]["messages"].([]any)
+	system, _ := messages[0].(map[string]any)
+	if len(messages) != 2 || system["content"] != "Be brief.\n\nContext:\n\nBrno is in Moravia." {
+		t.Errorf("Unexpected chat messages: %v", messages)
+	}
+	if bodies[1]["system"] != "Be brief.\n\nContext:\n\nBrno is in Moravia." || bodies[1]["prompt"] != "Where is Brno?" {
+		t.Errorf("Unexpected generate request: %v", bodies[1])
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// dryRunRequest is returned as an error by the code building a request when it
+// is made with WithDryRun, to stop before the request is sent. The Chat and
+// Generate methods turn it into a Response with dryRunResponse; it never
+// reaches the caller.
+type dryRunRequest struct {
+	body []byte
+}
+
+// Error implements the error interface.
+func (d *dryRunRequest) Error() string {
+	return "dry run: request not sent"
+}
+
+// dryRun returns a *dryRunRequest holding body, marshaled exactly as postJSON
+// would send it, if the request is made with WithDryRun, and nil otherwise.
+func (o *Options) dryRun(body any) error {
+	if !o.DryRun {
+		return nil
+	}
+	raw, err := marshalRequest(body)
+	if err != nil {
+		return err
+	}
+	return &dryRunRequest{body: raw}
+}
+
+// dryRunResponse returns the Response of a dry run of model if err is a
+// *dryRunRequest, and err otherwise.
+func dryRunResponse(model string, err error) (*Response, error) {
+	var dryRun *dryRunRequest
+	if !errors.As(err, &dryRun) {
+		return nil, err
+	}
+	return &Response{Model: model, DryRunRequest: dryRun.body}, nil
+}
+
+// dryRunStream returns a stream holding the Response of a dry run of model as
+// its only chunk if err is a *dryRunRequest, and err otherwise.
+func dryRunStream(model string, err error) (<-chan StreamChunk, error) {
+	resp, err := dryRunResponse(model, err)
+	if err != nil {
+		return nil, err
+	}
+	chunks := make(chan StreamChunk, 1)
+	chunks <- StreamChunk{Done: true, Response: resp}
+	close(chunks)
+	return chunks, nil
+}
+
+// marshalRequest returns the JSON body of a request.
+func marshalRequest(body any) ([]byte, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+	return raw, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	var sent []byte
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent, _ = io.ReadAll(r.Body)
+		w.Write([]byte(`{}`))
+	}))
+	defer mockServer.Close()
+
+	backends := map[string]Backend{
+		"ollama":    NewOllamaBackend(mockServer.URL, "llama3"),
+		"openai":    NewOpenAIBackend("key", "gpt-4o-mini", WithBaseURL(mockServer.URL)),
+		"anthropic": NewAnthropicBackend("key", "claude-3-5-haiku-latest", WithBaseURL(mockServer.URL)),
+		"gemini":    NewGeminiBackend("key", "gemini-1.5-flash", WithBaseURL(mockServer.URL)),
+		"cohere":    NewCohereBackend("key", "command-r", WithBaseURL(mockServer.URL)),
+		"mistral":   NewMistralBackend("key", "mistral-small-latest", WithBaseURL(mockServer.URL)),
+	}
+	messages := []Message{SystemMessage("Be brief."), UserMessage("What is the weather in Brno?")}
+	tools := []Tool{{
+		"type": "function",
+		"function": map[string]any{
+			"name":        "get_weather",
+			"description": "Get the weather",
+			"parameters": map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"city": map[string]any{"type": "string"}},
+				"required":   []string{"city"},
+			},
+		},
+	}}
+
+	for name, be := range backends {
+		t.Run(name, func(t *testing.T) {
+			sent = nil
+			resp, err := be.Chat(context.Background(), messages, tools, WithDryRun(), WithTemperature(0.2))
+			if err != nil {
+				t.Fatalf("Chat returned error: %v", err)
+			}
+			if sent != nil {
+				t.Fatalf("Expected no request to be sent, got %s", sent)
+			}
+			if len(resp.DryRunRequest) == 0 || resp.Model != backendModel(be) {
+				t.Fatalf("Expected the request in the response, got %+v", resp)
+			}
+
+			// The request is sent exactly as in the dry run
+			be.Chat(context.Background(), messages, tools, WithTemperature(0.2))
+			if !bytes.Equal(resp.DryRunRequest, sent) {
+				t.Errorf("Expected the dry run request\n%s\nto match the request sent\n%s", resp.DryRunRequest, sent)
+			}
+		})
+	}
+}
+
+func TestDryRunStream(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Expected no request to be sent")
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "llama3")
+	chunks, err := backend.ChatStream(context.Background(), []Message{UserMessage("Hi")}, nil, WithDryRun())
+	if err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+
+	var received []StreamChunk
+	for chunk := range chunks {
+		received = append(received, chunk)
+	}
+	if len(received) != 1 || !received[0].Done || received[0].Response == nil {
+		t.Fatalf("Expected a single done chunk with the response, got %+v", received)
+	}
+	if !bytes.Contains(received[0].Response.DryRunRequest, []byte(`"stream":true`)) {
+		t.Errorf("Expected the streaming request, got %s", received[0].Response.DryRunRequest)
+	}
+}
+
+func TestDryRunValidatesRequest(t *testing.T) {
+	backend := NewOllamaBackend("http://localhost:11434", "llama3")
+	_, err := backend.Chat(context.Background(), []Message{UserMessage("Hi")}, []Tool{{"type": "function"}}, WithDryRun())
+	if !errors.Is(err, ErrInvalidTool) {
+		t.Errorf("Expected ErrInvalidTool, got %v", err)
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrRateLimited is matched by a BackendError for an HTTP 429 response.
+	ErrRateLimited = errors.New("rate limited")
+	// ErrModelNotFound is matched by a BackendError for an HTTP 404 response,
+	// which is what Ollama returns for a model that has not been pulled.
+	ErrModelNotFound = errors.New("model not found")
+	// ErrContextCanceled is returned when a request is aborted because its
+	// context was canceled or its deadline was exceeded. The context error is
+	// wrapped as well, so errors.Is(err, context.DeadlineExceeded) also works.
+	ErrContextCanceled = errors.New("request canceled")
+	// ErrEmbeddingsNotSupported is returned when the model cannot generate embeddings.
+	ErrEmbeddingsNotSupported = errors.New("model does not support embeddings")
+	// ErrUnreachable is returned when the backend server cannot be reached at all,
+	// e.g. because it is not running or the URL is wrong.
+	ErrUnreachable = errors.New("backend unreachable")
+	// ErrInvalidOption is returned before a request is sent when a CallOption
+	// has a value outside of its valid range.
+	ErrInvalidOption = errors.New("invalid option")
+	// ErrCircuitOpen is returned without sending the request while the circuit of
+	// a backend wrapped with WithCircuitBreaker is open.
+	ErrCircuitOpen = errors.New("circuit open")
+	// ErrPullIncomplete is matched by a PullIncompleteError.
+	ErrPullIncomplete = errors.New("pull incomplete")
+	// ErrContextOverflow is matched by a ContextOverflowError.
+	ErrContextOverflow = errors.New("context window exceeded")
+	// ErrRequestTooLarge is matched by a RequestTooLargeError.
+	ErrRequestTooLarge = errors.New("request too large")
+	// ErrSchemaMismatch is returned by ChatStructured when the reply does not match
+	// the schema set with WithResponseSchema.
+	ErrSchemaMismatch = errors.New("reply does not match the response schema")
+	// ErrNoJSON is returned by Response.ExtractJSON when the reply holds no valid JSON.
+	ErrNoJSON = errors.New("no JSON found in response")
+	// ErrInvalidTool is matched by a ToolDefinitionError.
+	ErrInvalidTool = errors.New("invalid tool definition")
+	// ErrBatchAborted is returned by BatchChat for the requests it did not send
+	// after a request failed with an error deemed fatal by WithFailFast.
+	ErrBatchAborted = errors.New("batch aborted")
+	// ErrUnsupportedOption is returned before a request is sent when a CallOption
+	// does not apply to the backend and the backend was created with
+	// WithUnsupportedOptions(RejectUnsupported).
+	ErrUnsupportedOption = errors.New("unsupported option")
+	// ErrContentRejected is returned by a backend wrapped with WithResponseFilter
+	// when the filter rejects the content of the reply. The error of the filter
+	// is wrapped as well.
+	ErrContentRejected = errors.New("content rejected")
+	// ErrStreamIdle is returned in the last chunk of a stream that was aborted
+	// because no data arrived for the time set with WithStreamIdleTimeout.
+	ErrStreamIdle = errors.New("stream idle")
+	// ErrMaxIterations is returned by RunAgent when the model still requests tool
+	// calls after the maximum number of iterations.
+	ErrMaxIterations = errors.New("maximum iterations reached")
+)
+
+// BackendError is returned when a backend replies with a non-2xx status code.
+// Use errors.As to inspect it, or errors.Is with ErrRateLimited and ErrModelNotFound.
+type BackendError struct {
+	StatusCode int
+	Body       string
+	// Retryable reports whether the same request may succeed if sent again,
+	// e.g. after a 429 or a 5xx response.
+	Retryable bool
+	// RetryAfter is how long the server asked to wait before sending the request
+	// again, parsed from the Retry-After header of the response. It is zero if the
+	// response had no such header. WithRetry waits exactly that long.
+	RetryAfter time.Duration
+}
+
+// newBackendError creates a BackendError for the given status code and response body.
+func newBackendError(statusCode int, body string) *BackendError {
+	return &BackendError{
+		StatusCode: statusCode,
+		Body:       body,
+		Retryable:  isRetryableStatus(statusCode),
+	}
+}
+
+// parseRetryAfter returns the delay requested by the headers of a response, in
+// either form of Retry-After: a number of seconds or an HTTP date, relative to
+// now. The retry-after-ms header some providers, such as OpenAI, send takes
+// precedence as it is more precise. It returns zero if no valid delay is set.
+func parseRetryAfter(header http.Header, now time.Time) time.Duration {
+	if ms, err := strconv.ParseFloat(header.Get("Retry-After-Ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0)
+	}
+	return 0
+}
+
+// Error implements the error interface.
+func (e *BackendError) Error() string {
+	return fmt.Sprintf("status code %d, response: %s", e.StatusCode, e.Body)
+}
+
+// Is makes errors.Is match the sentinel error corresponding to the status code.
+func (e *BackendError) Is(target error) bool {
+	switch target {
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrModelNotFound:
+		return e.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// ContextOverflowError is returned before a request is sent when its messages are
+// estimated to exceed the limit set with WithContextGuard.
+type ContextOverflowError struct {
+	// Estimated is the estimated number of tokens of the request.
+	Estimated int
+	// Limit is the context limit the request was checked against.
+	Limit int
+}
+
+// Error implements the error interface.
+func (e *ContextOverflowError) Error() string {
+	return fmt.Sprintf("%s: request is estimated at %d tokens, the limit is %d", ErrContextOverflow, e.Estimated, e.Limit)
+}
+
+// Is makes errors.Is match ErrContextOverflow.
+func (e *ContextOverflowError) Is(target error) bool {
+	return target == ErrContextOverflow
+}
+
+// RequestTooLargeError is returned before a request is sent when its body is
+// larger than the limit set with WithMaxRequestBytes.
+type RequestTooLargeError struct {
+	// Size is the size of the body of the request in bytes.
+	Size int
+	// Limit is the largest body the backend sends, in bytes.
+	Limit int
+}
+
+// Error implements the error interface.
+func (e *RequestTooLargeError) Error() string {
+	return fmt.Sprintf("%s: request body is %d bytes, the limit is %d", ErrRequestTooLarge, e.Size, e.Limit)
+}
+
+// Is makes errors.Is match ErrRequestTooLarge.
+func (e *RequestTooLargeError) Is(target error) bool {
+	return target == ErrRequestTooLarge
+}
+
+// PullIncompleteError is returned by PullModel when a pull is canceled or fails
+// after part of the model was downloaded. Pulling the model again resumes from
+// where it stopped.
+type PullIncompleteError struct {
+	// Model is the name of the model being pulled.
+	Model string
+	// Last is the last progress update of a layer download before the pull stopped.
+	Last ProgressUpdate
+	// Err is the reason the pull stopped, e.g. an error matching ErrContextCanceled.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *PullIncompleteError) Error() string {
+	return fmt.Sprintf("%s: %d of %d bytes of layer %s downloaded: %v", ErrPullIncomplete, e.Last.Completed, e.Last.Total, e.Last.Digest, e.Err)
+}
+
+// Unwrap returns the reason the pull stopped.
+func (e *PullIncompleteError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is match ErrPullIncomplete.
+func (e *PullIncompleteError) Is(target error) bool {
+	return target == ErrPullIncomplete
+}
+
+// ToolCallValidationError is returned when the arguments the model chose for a tool
+// call do not match the parameters declared for the tool. Its message is meant to be
+// sent back to the model, so that it can correct the call.
+type ToolCallValidationError struct {
+	// Tool is the name of the tool that was called.
+	Tool string
+	// Missing lists the required arguments that were not given.
+	Missing []string
+	// Invalid maps the arguments with a wrong type or value to what was expected.
+	Invalid map[string]string
+}
+
+// Error implements the error interface.
+func (e *ToolCallValidationError) Error() string {
+	var problems []string
+	for _, name := range e.Missing {
+		problems = append(problems, fmt.Sprintf("missing required argument %s", name))
+	}
+	names := make([]string, 0, len(e.Invalid))
+	for name := range e.Invalid {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		problems = append(problems, fmt.Sprintf("argument %s: %s", name, e.Invalid[name]))
+	}
+	return fmt.Sprintf("invalid arguments for tool %s: %s", e.Tool, strings.Join(problems, "; "))
+}
+
+// ToolDefinitionError is returned by ValidateTools, and by Chat before the request
+// is sent, for a malformed tool definition.
+type ToolDefinitionError struct {
+	// Index is the position of the tool in the list of tools.
+	Index int
+	// Tool is the name of the tool, or empty if the definition has no name.
+	Tool string
+	// Field is the path of the offending field, e.g. "function.parameters.type".
+	Field string
+	// Reason describes what is wrong with the field.
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *ToolDefinitionError) Error() string {
+	tool := e.Tool
+	if tool == "" {
+		tool = fmt.Sprintf("#%d", e.Index)
+	}
+	return fmt.Sprintf("invalid definition of tool %s: %s: %s", tool, e.Field, e.Reason)
+}
+
+// Is makes errors.Is match ErrInvalidTool.
+func (e *ToolDefinitionError) Is(target error) bool {
+	return target == ErrInvalidTool
+}
+
+// isRetryableStatus reports whether a response with the status code is worth retrying.
+func isRetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return statusCode >= http.StatusInternalServerError
+}
+
+// IsRetryable reports whether a request that failed with err may succeed if sent again.
+// This is the case for a BackendError with Retryable set and for transport failures
+// such as connection resets, but not for requests aborted by their context.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, ErrContextCanceled) {
+		return false
+	}
+
+	var backendErr *BackendError
+	if errors.As(err, &backendErr) {
+		return backendErr.Retryable
+	}
+
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// embeddingError adds ErrEmbeddingsNotSupported to err if the backend rejected
+// the request because the model cannot generate embeddings.
+func embeddingError(err error) error {
+	var backendErr *BackendError
+	if errors.As(err, &backendErr) && strings.Contains(backendErr.Body, "does not support embeddings") {
+		return fmt.Errorf("%w: %w", ErrEmbeddingsNotSupported, err)
+	}
+	return err
+}
+
+// unreachableError adds ErrUnreachable to err if the request failed because the
+// server at baseURL could not be reached, as opposed to replying with an error.
+func unreachableError(baseURL string, err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && !errors.Is(err, ErrContextCanceled) {
+		return fmt.Errorf("%w at %s: %w", ErrUnreachable, baseURL, err)
+	}
+	return err
+}
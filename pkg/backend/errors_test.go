@@ -0,0 +1,199 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBackendErrorStatusCodes(t *testing.T) {
+	statusCode := http.StatusNotFound
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statusCode)
+		w.Write([]byte(`{"error":"model 'missing' not found"}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "missing")
+
+	// A missing model is a 404 which must not be retried
+	_, err := backend.Chat(context.Background(), []Message{{Role: "user", Content: "Hi"}}, nil)
+	if !errors.Is(err, ErrModelNotFound) {
+		t.Errorf("Expected ErrModelNotFound, got %v", err)
+	}
+	if errors.Is(err, ErrRateLimited) {
+		t.Errorf("Did not expect ErrRateLimited for a 404")
+	}
+
+	var backendErr *BackendError
+	if !errors.As(err, &backendErr) {
+		t.Fatalf("Expected a BackendError, got %T", err)
+	}
+	if backendErr.StatusCode != http.StatusNotFound || backendErr.Retryable {
+		t.Errorf("Unexpected BackendError: %+v", backendErr)
+	}
+	if backendErr.Body != `{"error":"model 'missing' not found"}` {
+		t.Errorf("Unexpected body: %s", backendErr.Body)
+	}
+
+	// A 429 is a retryable rate limit
+	statusCode = http.StatusTooManyRequests
+	_, err = backend.Generate(context.Background(), "Hi")
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Expected ErrRateLimited, got %v", err)
+	}
+	if !errors.As(err, &backendErr) || !backendErr.Retryable {
+		t.Errorf("Expected a retryable BackendError, got %v", err)
+	}
+}
+
+func TestBackendErrorRetryable(t *testing.T) {
+	retryable := map[int]bool{
+		http.StatusBadRequest:          false,
+		http.StatusUnauthorized:        false,
+		http.StatusRequestTimeout:      true,
+		http.StatusTooManyRequests:     true,
+		http.StatusInternalServerError: true,
+		http.StatusBadGateway:          true,
+		http.StatusServiceUnavailable:  true,
+	}
+	for statusCode, expected := range retryable {
+		if got := newBackendError(statusCode, "").Retryable; got != expected {
+			t.Errorf("Expected Retryable %v for status %d, got %v", expected, statusCode, got)
+		}
+	}
+}
+
+func TestBackendErrorRetryAfter(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer mockServer.Close()
+
+	_, err := NewOllamaBackend(mockServer.URL, "test-model").Generate(context.Background(), "Hi")
+
+	var backendErr *BackendError
+	if !errors.As(err, &backendErr) {
+		t.Fatalf("Expected a BackendError, got %v", err)
+	}
+	if backendErr.RetryAfter != 7*time.Second {
+		t.Errorf("Expected RetryAfter 7s, got %v", backendErr.RetryAfter)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"none", http.Header{}, 0},
+		{"seconds", http.Header{"Retry-After": {"30"}}, 30 * time.Second},
+		{"date", http.Header{"Retry-After": {now.Add(90 * time.Second).Format(http.TimeFormat)}}, 90 * time.Second},
+		{"date in the past", http.Header{"Retry-After": {now.Add(-time.Minute).Format(http.TimeFormat)}}, 0},
+		{"negative", http.Header{"Retry-After": {"-5"}}, 0},
+		{"invalid", http.Header{"Retry-After": {"soon"}}, 0},
+		{"milliseconds", http.Header{"Retry-After": {"2"}, "Retry-After-Ms": {"1500"}}, 1500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.header, now); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestErrContextCanceled(t *testing.T) {
+	// The handler blocks until the test returns; release is closed before Close
+	// so that the server never waits on a handler that is still running.
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer mockServer.Close()
+	defer close(release)
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := backend.Generate(ctx, "Hi")
+	if !errors.Is(err, ErrContextCanceled) {
+		t.Errorf("Expected ErrContextCanceled, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the error to wrap context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestErrContextCanceledWhileReadingBody(t *testing.T) {
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Send the headers and part of the body, then stall like a slow generation
+		w.Write([]byte(`{"model":"test-model",`))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer mockServer.Close()
+	defer close(release)
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := backend.Generate(ctx, "Hi")
+	if !errors.Is(err, ErrContextCanceled) {
+		t.Errorf("Expected ErrContextCanceled, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the error to wrap context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestNon200SuccessStatus(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"response":"ok","done":true}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+
+	response, err := backend.Generate(context.Background(), "Hi")
+	if err != nil {
+		t.Fatalf("Expected a 2xx status to succeed, got %v", err)
+	}
+	if response.Response != "ok" {
+		t.Errorf("Expected response ok, got %s", response.Response)
+	}
+}
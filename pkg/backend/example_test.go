@@ -0,0 +1,45 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/stackloklabs/gollm/pkg/backend"
+)
+
+// summarize depends only on the Backend interface, so callers can pass any
+// provider, or a fake one in tests.
+func summarize(ctx context.Context, be backend.Backend, text string) (string, error) {
+	resp, err := be.Chat(ctx, []backend.Message{
+		{Role: "system", Content: "Summarize the user's text in one sentence."},
+		{Role: "user", Content: text},
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	return resp.Message.Content, nil
+}
+
+func ExampleBackend() {
+	var be backend.Backend = backend.NewOllamaBackend("http://localhost:11434", "qwen2.5")
+
+	summary, err := summarize(context.Background(), be, "Gollm is a Go library for talking to LLMs.")
+	if err != nil {
+		log.Fatalf("failed to summarize: %v", err)
+	}
+	fmt.Println(summary)
+}
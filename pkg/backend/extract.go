@@ -0,0 +1,125 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// CodeBlock is a fenced code block in the text of a response.
+type CodeBlock struct {
+	// Language is the info string after the opening fence, e.g. "go" or "json".
+	// It is empty if the fence does not name a language.
+	Language string
+	// Content is the text between the fences, without the fences themselves.
+	Content string
+}
+
+// ExtractCodeBlocks returns the markdown code blocks fenced with ``` or ~~~ in
+// the text of the response, in the order they appear. As in markdown, a block
+// is only closed by a fence at least as long as the one that opened it, so a
+// block opened with ```` may contain ``` lines. A block that is never closed,
+// e.g. in a truncated reply, runs to the end of the text.
+func (r *Response) ExtractCodeBlocks() []CodeBlock {
+	var blocks []CodeBlock
+	var open *CodeBlock
+	var fence string
+	var content []string
+
+	for _, line := range strings.Split(r.Content(), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if open == nil {
+			if f := codeFence(trimmed); f != "" {
+				open = &CodeBlock{Language: strings.TrimSpace(trimmed[len(f):])}
+				fence = f
+				content = nil
+			}
+			continue
+		}
+		if f := codeFence(trimmed); f != "" && f[0] == fence[0] && len(f) >= len(fence) && f == trimmed {
+			open.Content = strings.Join(content, "\n")
+			blocks = append(blocks, *open)
+			open = nil
+			continue
+		}
+		content = append(content, line)
+	}
+	if open != nil {
+		open.Content = strings.Join(content, "\n")
+		blocks = append(blocks, *open)
+	}
+	return blocks
+}
+
+// ExtractJSON returns the JSON payload of the response, for models asked for
+// structured output without JSON mode, which tend to wrap it in a markdown code
+// block or in prose. It returns, in order of preference:
+//
+//  1. the content of the first code block labeled json that is valid JSON;
+//  2. the content of the first other code block that is valid JSON;
+//  3. the whole text of the response if it is valid JSON;
+//  4. the first JSON object or array embedded in the text.
+//
+// It returns ErrNoJSON if none is found.
+func (r *Response) ExtractJSON() (string, error) {
+	blocks := r.ExtractCodeBlocks()
+	for _, block := range blocks {
+		if strings.EqualFold(block.Language, "json") && json.Valid([]byte(block.Content)) {
+			return strings.TrimSpace(block.Content), nil
+		}
+	}
+	for _, block := range blocks {
+		if json.Valid([]byte(block.Content)) {
+			return strings.TrimSpace(block.Content), nil
+		}
+	}
+
+	text := strings.TrimSpace(r.Content())
+	if json.Valid([]byte(text)) {
+		return text, nil
+	}
+	for i, c := range text {
+		if c != '{' && c != '[' {
+			continue
+		}
+		var raw json.RawMessage
+		if err := json.NewDecoder(strings.NewReader(text[i:])).Decode(&raw); err == nil {
+			return string(raw), nil
+		}
+	}
+	return "", ErrNoJSON
+}
+
+// codeFence returns the run of three or more backticks or tildes that line
+// starts with, or "" if line is not a code fence.
+func codeFence(line string) string {
+	if line == "" || (line[0] != '`' && line[0] != '~') {
+		return ""
+	}
+	n := 0
+	for n < len(line) && line[n] == line[0] {
+		n++
+	}
+	if n < 3 {
+		return ""
+	}
+	// An info string after a backtick fence may not contain backticks,
+	// which tells a fence apart from inline code such as ```x```.
+	if line[0] == '`' && strings.Contains(line[n:], "`") {
+		return ""
+	}
+	return line[:n]
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExtractCodeBlocks(t *testing.T) {
+	content := "Here you go:\n\n```go\nfmt.Println(\"hi\")\n```\n\nAnd the readme:\n\n" +
+		"````markdown\nRun it:\n```sh\ngo run .\n```\n````\n\n~~~\nplain\n~~~\n\nInline ```code``` is not a block.\n\n```python\nprint(1)"
+	resp := &Response{Message: Message{Content: content}}
+
+	blocks := resp.ExtractCodeBlocks()
+	want := []CodeBlock{
+		{Language: "go", Content: "fmt.Println(\"hi\")"},
+		{Language: "markdown", Content: "Run it:\n```sh\ngo run .\n```"},
+		{Language: "", Content: "plain"},
+		{Language: "python", Content: "print(1)"},
+	}
+	if len(blocks) != len(want) {
+		t.Fatalf("Expected %d blocks, got %+v", len(want), blocks)
+	}
+	for i := range want {
+		if blocks[i] != want[i] {
+			t.Errorf("Block %d: expected %+v, got %+v", i, want[i], blocks[i])
+		}
+	}
+}
+
+func TestExtractJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"json block", "Sure:\n```json\n{\"city\": \"Brno\"}\n```", `{"city": "Brno"}`},
+		{"json block preferred", "```\n[1, 2]\n```\n```JSON\n{\"a\": 1}\n```", `{"a": 1}`},
+		{"unlabeled block", "```text\nnot json\n```\n```\n[1, 2]\n```", `[1, 2]`},
+		{"bare JSON", "  {\"a\": [1, 2]}\n", `{"a": [1, 2]}`},
+		{"embedded in prose", "The answer is {\"a\": \"}\"} as requested.", `{"a": "}"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := (&Response{Message: Message{Content: tt.content}}).ExtractJSON()
+			if err != nil {
+				t.Fatalf("ExtractJSON returned error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	generated := &Response{Response: "```json\n{\"ok\": true}\n```"}
+	if got, err := generated.ExtractJSON(); err != nil || got != `{"ok": true}` {
+		t.Errorf("Expected the JSON of a Generate response, got %q, %v", got, err)
+	}
+
+	_, err := (&Response{Message: Message{Content: "No JSON {here"}}).ExtractJSON()
+	if !errors.Is(err, ErrNoJSON) {
+		t.Errorf("Expected ErrNoJSON, got %v", err)
+	}
+}
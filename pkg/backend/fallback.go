@@ -0,0 +1,180 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// fallbackBackend is a Backend that sends a request to a second backend when the
+// first one fails.
+type fallbackBackend struct {
+	be             Backend
+	fallback       Backend
+	shouldFallback func(ctx context.Context, err error) bool
+}
+
+// WithFallback returns a Backend that sends every request to primary and, if it
+// fails with an error for which shouldFallback returns true, sends it again to
+// fallback, e.g. a local Ollama to fall back to during an outage of a hosted
+// provider. A nil shouldFallback falls back on the errors that show primary is
+// unhealthy: those IsRetryable reports, timeouts of primary and ErrCircuitOpen,
+// so that the request is not sent to primary at all while a circuit breaker
+// around it is open. Requests canceled by the caller never fall back.
+//
+// The fallback is only tried for requests that failed on primary, so a request
+// is never answered, and charged for, twice. If it fails on fallback as well, the
+// returned error wraps both errors. The Model of the Response tells which backend
+// answered.
+//
+// ChatStream, if supported by both backends, falls back if the stream of
+// primary cannot be started or fails before delivering any chunk, so it only
+// returns once the first chunk has arrived. Once a chunk has been delivered, a
+// failure ends the stream as usual. Close closes both backends.
+func WithFallback(primary, fallback Backend, shouldFallback func(error) bool) Backend {
+	f := &fallbackBackend{
+		be:             primary,
+		fallback:       fallback,
+		shouldFallback: isCircuitFailureOrOpen,
+	}
+	if shouldFallback != nil {
+		f.shouldFallback = func(_ context.Context, err error) bool { return shouldFallback(err) }
+	}
+	return f
+}
+
+// isCircuitFailureOrOpen reports whether err, returned for a request made with
+// ctx, means that the backend is unhealthy or that its circuit breaker is open.
+func isCircuitFailureOrOpen(ctx context.Context, err error) bool {
+	return isCircuitFailure(ctx, err) || errors.Is(err, ErrCircuitOpen)
+}
+
+// Chat implements Backend.
+func (f *fallbackBackend) Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	resp, err := f.be.Chat(ctx, messages, tools, opts...)
+	if !f.fallsBack(ctx, err) {
+		return resp, err
+	}
+	resp, fallbackErr := f.fallback.Chat(ctx, messages, tools, opts...)
+	if fallbackErr != nil {
+		return nil, fallbackError(err, fallbackErr)
+	}
+	return resp, nil
+}
+
+// Generate implements Backend.
+func (f *fallbackBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	resp, err := f.be.Generate(ctx, prompt, opts...)
+	if !f.fallsBack(ctx, err) {
+		return resp, err
+	}
+	resp, fallbackErr := f.fallback.Generate(ctx, prompt, opts...)
+	if fallbackErr != nil {
+		return nil, fallbackError(err, fallbackErr)
+	}
+	return resp, nil
+}
+
+// Close implements Backend by closing both backends.
+func (f *fallbackBackend) Close() error {
+	return errors.Join(f.be.Close(), f.fallback.Close())
+}
+
+// ChatStream streams the reply of primary, or of fallback if primary fails
+// before delivering any chunk.
+func (f *fallbackBackend) ChatStream(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (<-chan StreamChunk, error) {
+	primary, ok := f.be.(Streamer)
+	if !ok {
+		return nil, errors.New("backend does not support streaming")
+	}
+	fallback, ok := f.fallback.(Streamer)
+	if !ok {
+		return nil, errors.New("fallback backend does not support streaming")
+	}
+
+	chunks, err := primary.ChatStream(ctx, messages, tools, opts...)
+	if err != nil {
+		if !f.fallsBack(ctx, err) {
+			return nil, err
+		}
+		chunks, fallbackErr := fallback.ChatStream(ctx, messages, tools, opts...)
+		if fallbackErr != nil {
+			return nil, fallbackError(err, fallbackErr)
+		}
+		return chunks, nil
+	}
+
+	// Wait for the first chunk, which tells whether the stream of primary works
+	first, ok := <-chunks
+	if !ok || first.Err == nil || !f.fallsBack(ctx, first.Err) {
+		return prependChunk(ctx, first, ok, chunks), nil
+	}
+	for range chunks {
+	}
+	fallbackChunks, fallbackErr := fallback.ChatStream(ctx, messages, tools, opts...)
+	if fallbackErr != nil {
+		return nil, fallbackError(first.Err, fallbackErr)
+	}
+	return fallbackChunks, nil
+}
+
+// prependChunk returns a channel that delivers first, if ok is set, followed by
+// the rest of chunks.
+func prependChunk(ctx context.Context, first StreamChunk, ok bool, chunks <-chan StreamChunk) <-chan StreamChunk {
+	out := make(chan StreamChunk)
+	go func() {
+		defer close(out)
+		// The wrapped stream ends as well once ctx is done, as it watches ctx
+		defer func() {
+			for range chunks {
+			}
+		}()
+		if !ok {
+			return
+		}
+
+		send := func(chunk StreamChunk) bool {
+			select {
+			case out <- chunk:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if !send(first) {
+			return
+		}
+		for chunk := range chunks {
+			if !send(chunk) {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// fallsBack reports whether a request to primary that failed with err, if any,
+// is sent to the fallback.
+func (f *fallbackBackend) fallsBack(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() == nil && f.shouldFallback(ctx, err)
+}
+
+// fallbackError returns the error of a request that failed with err on primary
+// and with fallbackErr on the fallback.
+func fallbackError(err, fallbackErr error) error {
+	return fmt.Errorf("fallback failed: %w, after primary failed: %w", fallbackErr, err)
+}
@@ -0,0 +1,139 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestWithFallback(t *testing.T) {
+	unavailable := newBackendError(http.StatusServiceUnavailable, "down")
+	badRequest := newBackendError(http.StatusBadRequest, "invalid request")
+	cases := []struct {
+		name           string
+		primaryErr     error
+		shouldFallback func(error) bool
+		fallbackCalls  int
+	}{
+		{"success", nil, nil, 0},
+		{"outage", unavailable, nil, 1},
+		{"circuit open", ErrCircuitOpen, nil, 1},
+		{"client error", badRequest, nil, 0},
+		{"predicate", badRequest, func(err error) bool { return errors.Is(err, badRequest) }, 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			primary := &failingBackend{err: tc.primaryErr}
+			fallback := &fakeBackend{chat: func([]Message) (*Response, error) {
+				return &Response{Model: "fallback"}, nil
+			}}
+			be := WithFallback(primary, fallback, tc.shouldFallback)
+
+			resp, err := be.Chat(context.Background(), []Message{UserMessage("Hi")}, nil)
+			if primary.calls != 1 || len(fallback.received) != tc.fallbackCalls {
+				t.Errorf("Expected 1 call to primary and %d to fallback, got %d and %d", tc.fallbackCalls, primary.calls, len(fallback.received))
+			}
+			switch {
+			case tc.fallbackCalls == 1 && (err != nil || resp.Model != "fallback"):
+				t.Errorf("Expected the reply of the fallback, got %+v, %v", resp, err)
+			case tc.fallbackCalls == 0 && !errors.Is(err, tc.primaryErr) && tc.primaryErr != nil:
+				t.Errorf("Expected the error of primary, got %v", err)
+			}
+
+			if _, err := be.Generate(context.Background(), "Hi"); tc.fallbackCalls == 1 && err != nil {
+				t.Errorf("Expected Generate to fall back, got %v", err)
+			}
+		})
+	}
+}
+
+func TestWithFallbackBothFail(t *testing.T) {
+	primaryErr := newBackendError(http.StatusServiceUnavailable, "down")
+	fallbackErr := newBackendError(http.StatusBadGateway, "also down")
+	be := WithFallback(&failingBackend{err: primaryErr}, &failingBackend{err: fallbackErr}, nil)
+
+	_, err := be.Chat(context.Background(), []Message{UserMessage("Hi")}, nil)
+	if !errors.Is(err, primaryErr) || !errors.Is(err, fallbackErr) {
+		t.Errorf("Expected both errors, got %v", err)
+	}
+}
+
+func TestWithFallbackCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	primary := &fakeBackend{chat: func([]Message) (*Response, error) {
+		cancel()
+		return nil, contextError(ctx, errors.New("canceled"))
+	}}
+	fallback := &failingBackend{}
+	be := WithFallback(primary, fallback, func(error) bool { return true })
+
+	if _, err := be.Chat(ctx, []Message{UserMessage("Hi")}, nil); !errors.Is(err, ErrContextCanceled) {
+		t.Errorf("Expected ErrContextCanceled, got %v", err)
+	}
+	if fallback.calls != 0 {
+		t.Errorf("Expected a canceled request not to fall back")
+	}
+}
+
+func TestWithFallbackStream(t *testing.T) {
+	streamErr := newBackendError(http.StatusServiceUnavailable, "down")
+	newStreamer := func(chunks ...StreamChunk) *streamingFakeBackend {
+		return &streamingFakeBackend{stream: func([]Message) ([]StreamChunk, bool) {
+			return chunks, false
+		}}
+	}
+	collect := func(be Backend) []StreamChunk {
+		t.Helper()
+		chunks, err := be.(Streamer).ChatStream(context.Background(), []Message{UserMessage("Hi")}, nil)
+		if err != nil {
+			t.Fatalf("ChatStream returned error: %v", err)
+		}
+		var out []StreamChunk
+		for chunk := range chunks {
+			out = append(out, chunk)
+		}
+		return out
+	}
+	fallback := newStreamer(StreamChunk{Content: "from fallback", Done: true})
+
+	// A stream that fails right away falls back
+	got := collect(WithFallback(newStreamer(StreamChunk{Err: streamErr}), fallback, nil))
+	if len(got) != 1 || got[0].Content != "from fallback" {
+		t.Errorf("Expected the stream of the fallback, got %+v", got)
+	}
+
+	// Once a chunk was delivered, the stream is not started again
+	got = collect(WithFallback(newStreamer(StreamChunk{Content: "Hel"}, StreamChunk{Err: streamErr}), fallback, nil))
+	if len(got) != 2 || got[0].Content != "Hel" || !errors.Is(got[1].Err, streamErr) {
+		t.Errorf("Expected the stream of primary with its error, got %+v", got)
+	}
+
+	got = collect(WithFallback(newStreamer(StreamChunk{Content: "Hello"}, StreamChunk{Content: "!", Done: true}), fallback, nil))
+	if len(got) != 2 || got[0].Content != "Hello" || !got[1].Done {
+		t.Errorf("Expected the stream of primary, got %+v", got)
+	}
+}
+
+func TestWithFallbackClose(t *testing.T) {
+	primary, fallback := &fakeBackend{}, &fakeBackend{}
+	if err := WithFallback(primary, fallback, nil).Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if primary.closed != 1 || fallback.closed != 1 {
+		t.Errorf("Expected both backends to be closed once, got %d and %d", primary.closed, fallback.closed)
+	}
+}
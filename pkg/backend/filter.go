@@ -0,0 +1,187 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ResponseFilter inspects the content of a reply before it is returned to the
+// caller. It returns the content to return instead, e.g. with profanity
+// redacted, or an error to reject the reply altogether.
+type ResponseFilter func(ctx context.Context, content string) (string, error)
+
+// filterBackend is a Backend that passes the replies of the wrapped one through a filter.
+type filterBackend struct {
+	be     Backend
+	filter ResponseFilter
+	chunks bool
+}
+
+// FilterOption configures a backend wrapped with WithResponseFilter.
+type FilterOption func(*filterBackend)
+
+// WithChunkFiltering makes ChatStream pass the content of every chunk through the
+// filter as it arrives, instead of holding the reply back until it is complete.
+// The filter then only ever sees part of the reply, which suits filters that look
+// at words, such as a profanity filter, but not a moderation model.
+func WithChunkFiltering() FilterOption {
+	return func(f *filterBackend) {
+		f.chunks = true
+	}
+}
+
+// WithResponseFilter wraps be so that the content of every reply is passed
+// through filter before it is returned, e.g. to redact it or to have it checked
+// by a moderation model. If filter fails, Chat and Generate fail with an error
+// matching ErrContentRejected that wraps the error of filter. Replies without
+// content, such as those with only tool calls, and the reasoning of the model
+// are not filtered.
+//
+// ChatStream, if supported by be, holds the content back until the stream is done
+// and delivers the filtered reply in its last chunk, unless WithChunkFiltering is
+// given. A rejected stream ends with a chunk whose Err matches ErrContentRejected.
+func WithResponseFilter(be Backend, filter ResponseFilter, opts ...FilterOption) Backend {
+	f := &filterBackend{
+		be:     be,
+		filter: filter,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// Chat implements Backend.
+func (f *filterBackend) Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	resp, err := f.be.Chat(ctx, messages, tools, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return f.filterResponse(ctx, resp)
+}
+
+// Generate implements Backend.
+func (f *filterBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	resp, err := f.be.Generate(ctx, prompt, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return f.filterResponse(ctx, resp)
+}
+
+// Close implements Backend.
+func (f *filterBackend) Close() error {
+	return f.be.Close()
+}
+
+// filterResponse returns a copy of resp with its content filtered.
+func (f *filterBackend) filterResponse(ctx context.Context, resp *Response) (*Response, error) {
+	filtered := *resp
+	var err error
+	if filtered.Message.Content, err = f.apply(ctx, resp.Message.Content); err != nil {
+		return nil, err
+	}
+	if filtered.Response, err = f.apply(ctx, resp.Response); err != nil {
+		return nil, err
+	}
+	return &filtered, nil
+}
+
+// apply passes content through the filter unless it is empty.
+func (f *filterBackend) apply(ctx context.Context, content string) (string, error) {
+	if content == "" {
+		return "", nil
+	}
+	filtered, err := f.filter(ctx, content)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrContentRejected, err)
+	}
+	return filtered, nil
+}
+
+// ChatStream passes the reply streamed by the wrapped backend through the filter.
+func (f *filterBackend) ChatStream(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (<-chan StreamChunk, error) {
+	streamer, ok := f.be.(Streamer)
+	if !ok {
+		return nil, errors.New("backend does not support streaming")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	in, err := streamer.ChatStream(ctx, messages, tools, opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	out := make(chan StreamChunk)
+	go func() {
+		defer close(out)
+		defer func() {
+			// Stop the wrapped stream and wait for it to end
+			cancel()
+			for range in {
+			}
+		}()
+
+		send := func(chunk StreamChunk) bool {
+			select {
+			case out <- chunk:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		var content strings.Builder
+		for chunk := range in {
+			if chunk.Err != nil || chunk.Reasoning || chunk.ToolCallReady != nil {
+				if !send(chunk) || chunk.Err != nil {
+					return
+				}
+				continue
+			}
+
+			if !f.chunks {
+				// Hold the content back until the reply is complete
+				content.WriteString(chunk.Content)
+				if !chunk.Done {
+					continue
+				}
+				chunk.Content = content.String()
+				content.Reset()
+			}
+			var err error
+			if chunk.Content, err = f.apply(ctx, chunk.Content); err != nil {
+				send(StreamChunk{Err: err})
+				return
+			}
+			content.WriteString(chunk.Content)
+
+			if chunk.Done && chunk.Response != nil {
+				resp := *chunk.Response
+				resp.Message.Content = content.String()
+				chunk.Response = &resp
+			}
+			if !send(chunk) || chunk.Done {
+				return
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// redactDarn replaces "darn" with asterisks and rejects content mentioning secrets.
+func redactDarn(_ context.Context, content string) (string, error) {
+	if strings.Contains(content, "secret") {
+		return "", errors.New("mentions a secret")
+	}
+	return strings.ReplaceAll(content, "darn", "****"), nil
+}
+
+func streamFiltered(t *testing.T, be Backend) ([]StreamChunk, error) {
+	t.Helper()
+	chunks, err := be.(Streamer).ChatStream(context.Background(), []Message{UserMessage("Hi")}, nil)
+	if err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+	var received []StreamChunk
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			return received, chunk.Err
+		}
+		received = append(received, chunk)
+	}
+	return received, nil
+}
+
+func TestWithResponseFilter(t *testing.T) {
+	reply := "Hello"
+	be := WithResponseFilter(&fakeBackend{
+		chat: func([]Message) (*Response, error) {
+			return &Response{Message: AssistantMessage(reply), Response: reply}, nil
+		},
+	}, redactDarn)
+
+	reply = "Oh darn, it rains"
+	resp, err := be.Chat(context.Background(), []Message{UserMessage("Weather?")}, nil)
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if resp.Message.Content != "Oh ****, it rains" {
+		t.Errorf("Expected the content to be redacted, got %q", resp.Message.Content)
+	}
+
+	resp, err = be.Generate(context.Background(), "Weather?")
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if resp.Response != "Oh ****, it rains" {
+		t.Errorf("Expected the response to be redacted, got %q", resp.Response)
+	}
+
+	reply = "The secret is 42"
+	_, err = be.Chat(context.Background(), []Message{UserMessage("Secret?")}, nil)
+	if !errors.Is(err, ErrContentRejected) || !strings.Contains(err.Error(), "mentions a secret") {
+		t.Errorf("Expected ErrContentRejected, got %v", err)
+	}
+}
+
+func TestWithResponseFilterSkipsToolCalls(t *testing.T) {
+	called := false
+	filter := func(_ context.Context, content string) (string, error) {
+		called = true
+		return content, nil
+	}
+	be := WithResponseFilter(&fakeBackend{
+		chat: func([]Message) (*Response, error) {
+			return &Response{Message: Message{Role: RoleAssistant, ToolCalls: []ToolCall{{Function: FunctionCall{Name: "get_weather"}}}}}, nil
+		},
+	}, filter)
+
+	resp, err := be.Chat(context.Background(), []Message{UserMessage("Weather?")}, nil)
+	if err != nil || len(resp.Message.ToolCalls) != 1 {
+		t.Fatalf("Expected the tool call to be returned, got %v, %v", resp, err)
+	}
+	if called {
+		t.Errorf("Expected a reply without content not to be filtered")
+	}
+}
+
+func TestWithResponseFilterStream(t *testing.T) {
+	inner := &streamingFakeBackend{stream: func([]Message) ([]StreamChunk, bool) {
+		return []StreamChunk{
+			{Content: "Thinking", Reasoning: true},
+			{Content: "Oh da"},
+			{ToolCallReady: &ToolCall{Function: FunctionCall{Name: "umbrella"}}},
+			{Content: "rn, it rains", Done: true, Response: &Response{Model: "test-model", FinishReason: FinishStop}},
+		}, false
+	}}
+
+	received, err := streamFiltered(t, WithResponseFilter(inner, redactDarn))
+	if err != nil {
+		t.Fatalf("Stream failed: %v", err)
+	}
+	if len(received) != 3 || !received[0].Reasoning || received[1].ToolCallReady == nil {
+		t.Fatalf("Expected the reasoning, the tool call and the held back reply, got %+v", received)
+	}
+	last := received[2]
+	if !last.Done || last.Content != "Oh ****, it rains" {
+		t.Errorf("Expected the whole reply to be filtered, got %+v", last)
+	}
+	if last.Response == nil || last.Response.Message.Content != "Oh ****, it rains" || last.Response.Model != "test-model" {
+		t.Errorf("Expected the filtered reply in the Response, got %+v", last.Response)
+	}
+}
+
+func TestWithResponseFilterStreamChunks(t *testing.T) {
+	inner := &streamingFakeBackend{stream: func([]Message) ([]StreamChunk, bool) {
+		return []StreamChunk{
+			{Content: "Oh darn"},
+			{Content: ", darn", Done: true, Response: &Response{}},
+		}, false
+	}}
+
+	received, err := streamFiltered(t, WithResponseFilter(inner, redactDarn, WithChunkFiltering()))
+	if err != nil {
+		t.Fatalf("Stream failed: %v", err)
+	}
+	if len(received) != 2 || received[0].Content != "Oh ****" || received[1].Content != ", ****" {
+		t.Fatalf("Expected every chunk to be filtered, got %+v", received)
+	}
+	if got := received[1].Response.Message.Content; got != "Oh ****, ****" {
+		t.Errorf("Expected the filtered reply in the Response, got %q", got)
+	}
+}
+
+func TestWithResponseFilterStreamRejected(t *testing.T) {
+	inner := &streamingFakeBackend{stream: func([]Message) ([]StreamChunk, bool) {
+		// The stream does not end until it is stopped
+		return []StreamChunk{{Content: "The secret"}, {Content: " is 42"}}, true
+	}}
+
+	received, err := streamFiltered(t, WithResponseFilter(inner, redactDarn, WithChunkFiltering()))
+	if !errors.Is(err, ErrContentRejected) {
+		t.Errorf("Expected ErrContentRejected, got %v", err)
+	}
+	if len(received) != 0 {
+		t.Errorf("Expected no content to be delivered, got %+v", received)
+	}
+
+	received, err = streamFiltered(t, WithResponseFilter(&streamingFakeBackend{stream: func([]Message) ([]StreamChunk, bool) {
+		return []StreamChunk{{Content: "The sec"}, {Content: "ret is 42", Done: true}}, false
+	}}, redactDarn))
+	if !errors.Is(err, ErrContentRejected) || len(received) != 0 {
+		t.Errorf("Expected the held back reply to be rejected, got %+v, %v", received, err)
+	}
+}
@@ -0,0 +1,446 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultGeminiBaseURL = "https://generativelanguage.googleapis.com"
+	geminiModelsEndpoint = "/v1beta/models"
+	// geminiModelRole is the role Gemini uses for messages of the model.
+	geminiModelRole = "model"
+)
+
+// GeminiBackend represents a backend for interacting with the Google Gemini API.
+// It holds the necessary credentials and configuration for making API requests.
+type GeminiBackend struct {
+	APIKey     string
+	Model      string
+	HTTPClient *http.Client
+	BaseURL    string
+	// SystemPrompt is used for every conversation that has no system message.
+	SystemPrompt string
+	// RequestTimeout bounds every request. Zero means no limit other than the
+	// deadline of the context passed by the caller.
+	RequestTimeout time.Duration
+	// MaxOutputTokens caps the length of every reply that is not capped with
+	// WithMaxTokens. Zero uses the model default.
+	MaxOutputTokens int
+	// Headers are added to every request. They cannot replace the headers the
+	// backend sets itself, such as Content-Type and the API key.
+	Headers map[string]string
+	// UserAgent is sent in the User-Agent header of every request. Empty means
+	// DefaultUserAgent.
+	UserAgent string
+	// MaxRequestBytes is the size of the largest request body the backend sends.
+	// Zero means no limit.
+	MaxRequestBytes int
+	// Tokenizer counts the tokens of requests for the backend. Nil uses the
+	// counter EstimateTokens uses for the model.
+	Tokenizer Tokenizer
+	// UnsupportedOptions is what happens to call options the backend cannot
+	// honour, see WithUnsupportedOptions.
+	UnsupportedOptions UnsupportedOptionPolicy
+
+	// transport is the transport created for WithConnectionPool, if any.
+	transport *http.Transport
+}
+
+var _ Backend = (*GeminiBackend)(nil)
+
+// NewGeminiBackend creates and returns a new GeminiBackend instance.
+// It takes an API key and a Gemini model name, e.g. "gemini-1.5-flash",
+// followed by optional settings such as WithBaseURL or WithHTTPClient.
+func NewGeminiBackend(apiKey, model string, opts ...Option) *GeminiBackend {
+	o := newOptions(opts)
+
+	baseURL := defaultGeminiBaseURL
+	if o.baseURL != "" {
+		baseURL = o.baseURL
+	}
+
+	client, transport := newHTTPClient(o, 0)
+
+	return &GeminiBackend{
+		APIKey:             apiKey,
+		Model:              model,
+		HTTPClient:         client,
+		BaseURL:            baseURL,
+		SystemPrompt:       o.systemPrompt,
+		RequestTimeout:     o.timeout,
+		Headers:            o.headers,
+		UserAgent:          o.userAgent,
+		MaxRequestBytes:    o.maxBodyBytes,
+		Tokenizer:          o.tokenizer,
+		UnsupportedOptions: o.unsupported,
+		transport:          transport,
+	}
+}
+
+// geminiContent is a message in the wire format of the Gemini API.
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+// geminiPart is one part of the content of a message. Exactly one field is set.
+type geminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+// geminiFunctionCall is a tool call in the wire format of the Gemini API.
+type geminiFunctionCall struct {
+	Name string         `json:"name"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+// geminiFunctionResponse is a tool result in the wire format of the Gemini API.
+type geminiFunctionResponse struct {
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+// geminiFunctionDeclaration is a tool definition in the wire format of the Gemini API.
+type geminiFunctionDeclaration struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Parameters  any    `json:"parameters,omitempty"`
+}
+
+// GeminiResponse represents the structure of the response received from the Gemini generateContent API.
+type GeminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+		TotalTokenCount      int `json:"totalTokenCount"`
+	} `json:"usageMetadata"`
+	ModelVersion string `json:"modelVersion"`
+}
+
+// toGeminiContents translates messages into the wire format of the Gemini API.
+// System messages are returned separately, as Gemini takes them as a system
+// instruction. Tool results are sent as functionResponse parts of a user message,
+// and consecutive results are merged so that they answer the calls of one turn.
+func toGeminiContents(messages []Message) (string, []geminiContent) {
+	var system []string
+	var out []geminiContent
+	for _, msg := range messages {
+		switch msg.Role {
+		case RoleSystem:
+			system = append(system, msg.Content)
+		case RoleTool:
+			part := geminiPart{FunctionResponse: &geminiFunctionResponse{
+				Name:     msg.Name,
+				Response: map[string]any{"content": msg.Content},
+			}}
+			if n := len(out); n > 0 && isFunctionResponses(out[n-1]) {
+				out[n-1].Parts = append(out[n-1].Parts, part)
+				continue
+			}
+			out = append(out, geminiContent{Role: RoleUser, Parts: []geminiPart{part}})
+		default:
+			role := msg.Role
+			if role == RoleAssistant {
+				role = geminiModelRole
+			}
+			var parts []geminiPart
+			if msg.Content != "" {
+				parts = append(parts, geminiPart{Text: msg.Content})
+			}
+			for _, call := range msg.ToolCalls {
+				parts = append(parts, geminiPart{FunctionCall: &geminiFunctionCall{
+					Name: call.Function.Name,
+					Args: call.Function.Arguments,
+				}})
+			}
+			out = append(out, geminiContent{Role: role, Parts: parts})
+		}
+	}
+	return strings.Join(system, "\n\n"), out
+}
+
+// isFunctionResponses reports whether content is a user message carrying tool results.
+func isFunctionResponses(content geminiContent) bool {
+	return content.Role == RoleUser && len(content.Parts) > 0 && content.Parts[0].FunctionResponse != nil
+}
+
+// toGeminiFunctionDeclarations translates tool definitions in the Ollama and
+// OpenAI function format into the wire format of the Gemini API.
+func toGeminiFunctionDeclarations(tools []Tool) ([]geminiFunctionDeclaration, error) {
+	out := make([]geminiFunctionDeclaration, 0, len(tools))
+	for i, tool := range tools {
+		function, ok := tool["function"].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("tool %d has no function definition", i)
+		}
+		name, _ := function["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("tool %d has no name", i)
+		}
+		description, _ := function["description"].(string)
+		out = append(out, geminiFunctionDeclaration{
+			Name:        name,
+			Description: description,
+			Parameters:  function["parameters"],
+		})
+	}
+	return out, nil
+}
+
+// Chat sends the conversation in messages to the Gemini generateContent endpoint and
+// returns the reply. Tools use the same definitions as for Ollama. The text parts of
+// the reply are concatenated into the Content of the returned Message and its
+// functionCall parts are available as ToolCalls.
+func (g *GeminiBackend) Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	ctx, cancel := withRequestTimeout(ctx, g.RequestTimeout)
+	defer cancel()
+
+	callOpts, err := newModelCallOptions(g.Model, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := callOpts.checkSupported("Gemini", g.UnsupportedOptions, ollamaOnlyOptions...); err != nil {
+		return nil, err
+	}
+
+	result, err := g.generateContent(ctx, messages, tools, callOpts)
+	if err != nil {
+		return dryRunResponse(g.Model, err)
+	}
+
+	return result.toResponse(g.Model), nil
+}
+
+// generateContent sends messages and tools to the generateContent endpoint and
+// returns the unmodified Gemini response.
+func (g *GeminiBackend) generateContent(ctx context.Context, messages []Message, tools []Tool, opts *Options) (*GeminiResponse, error) {
+	messages, err := opts.withContextDocuments(g.Model, g.Tokenizer, withSystemPrompt(g.SystemPrompt, messages))
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.checkContext(g.Model, g.Tokenizer, messages); err != nil {
+		return nil, err
+	}
+	system, contents := toGeminiContents(messages)
+
+	reqBody := map[string]interface{}{
+		"contents": contents,
+	}
+	if system != "" {
+		reqBody["systemInstruction"] = geminiContent{Parts: []geminiPart{{Text: system}}}
+	}
+	if err := opts.checkTools(tools); err != nil {
+		return nil, err
+	}
+	if len(tools) > 0 {
+		declarations, err := toGeminiFunctionDeclarations(tools)
+		if err != nil {
+			return nil, err
+		}
+		reqBody["tools"] = []map[string]any{{"functionDeclarations": declarations}}
+		if choice := opts.ToolChoice; choice != nil {
+			config := map[string]any{"mode": "NONE"}
+			if choice.Name != "" {
+				config = map[string]any{"mode": "ANY", "allowedFunctionNames": []string{choice.Name}}
+			}
+			reqBody["toolConfig"] = map[string]any{"functionCallingConfig": config}
+		}
+	}
+	if config := g.generationConfig(opts); len(config) > 0 {
+		reqBody["generationConfig"] = config
+	}
+
+	if err := opts.dryRun(reqBody); err != nil {
+		return nil, err
+	}
+
+	resp, err := g.post(ctx, opts.Headers, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate response from Gemini: %w", err)
+	}
+
+	var result GeminiResponse
+	if err := decodeResponse(ctx, resp, &result, opts); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// geminiSchemaKeywords are the JSON schema keywords a Gemini response schema,
+// a subset of the OpenAPI schema object, accepts.
+var geminiSchemaKeywords = []string{
+	"type", "format", "description", "nullable", "enum", "items", "minItems", "maxItems",
+	"properties", "required", "minimum", "maximum", "anyOf", "propertyOrdering",
+}
+
+// geminiSchema returns schema without the keywords Gemini rejects, such as
+// additionalProperties, which it does not enforce anyway.
+func geminiSchema(schema map[string]any) map[string]any {
+	out := make(map[string]any, len(schema))
+	for _, keyword := range geminiSchemaKeywords {
+		value, ok := schema[keyword]
+		if !ok {
+			continue
+		}
+		switch keyword {
+		case "items":
+			if items, ok := value.(map[string]any); ok {
+				value = geminiSchema(items)
+			}
+		case "properties":
+			if properties, ok := value.(map[string]any); ok {
+				converted := make(map[string]any, len(properties))
+				for name, property := range properties {
+					if sub, ok := property.(map[string]any); ok {
+						property = geminiSchema(sub)
+					}
+					converted[name] = property
+				}
+				value = converted
+			}
+		case "anyOf":
+			if variants, ok := value.([]any); ok {
+				converted := make([]any, len(variants))
+				for i, variant := range variants {
+					if sub, ok := variant.(map[string]any); ok {
+						variant = geminiSchema(sub)
+					}
+					converted[i] = variant
+				}
+				value = converted
+			}
+		}
+		out[keyword] = value
+	}
+	return out
+}
+
+// generationConfig translates the request options into a Gemini generation config.
+func (g *GeminiBackend) generationConfig(opts *Options) map[string]interface{} {
+	config := map[string]interface{}{}
+	if opts.MaxTokens != nil {
+		config["maxOutputTokens"] = *opts.MaxTokens
+	} else if g.MaxOutputTokens > 0 {
+		config["maxOutputTokens"] = g.MaxOutputTokens
+	}
+	if opts.JSONFormat || opts.ResponseSchema != nil {
+		config["responseMimeType"] = "application/json"
+	}
+	if opts.ResponseSchema != nil {
+		config["responseSchema"] = geminiSchema(opts.ResponseSchema)
+	}
+	if opts.Temperature != nil {
+		config["temperature"] = *opts.Temperature
+	}
+	if opts.TopP != nil {
+		config["topP"] = *opts.TopP
+	}
+	if len(opts.StopSequences) > 0 {
+		config["stopSequences"] = opts.StopSequences
+	}
+	if opts.Seed != nil {
+		config["seed"] = *opts.Seed
+	}
+	return config
+}
+
+// toResponse converts the Gemini specific response into the backend-neutral Response.
+func (r *GeminiResponse) toResponse(model string) *Response {
+	out := &Response{
+		Model:           model,
+		Done:            true,
+		PromptEvalCount: r.UsageMetadata.PromptTokenCount,
+		EvalCount:       r.UsageMetadata.CandidatesTokenCount,
+	}
+	if r.ModelVersion != "" {
+		out.Model = r.ModelVersion
+	}
+	out.setUsage(r.UsageMetadata.PromptTokenCount, r.UsageMetadata.CandidatesTokenCount, 0)
+	if len(r.Candidates) == 0 {
+		return out
+	}
+
+	candidate := r.Candidates[0]
+	var content strings.Builder
+	var toolCalls []ToolCall
+	for _, part := range candidate.Content.Parts {
+		content.WriteString(part.Text)
+		if part.FunctionCall != nil {
+			toolCalls = append(toolCalls, ToolCall{
+				Function: FunctionCall{
+					Name:      part.FunctionCall.Name,
+					Arguments: part.FunctionCall.Args,
+				},
+			})
+		}
+	}
+
+	out.Message = Message{
+		Role:      RoleAssistant,
+		Content:   content.String(),
+		ToolCalls: toolCalls,
+	}
+	out.Response = content.String()
+	out.DoneReason = candidate.FinishReason
+	out.Truncated = candidate.FinishReason == "MAX_TOKENS"
+	out.setFinishReason(candidate.FinishReason, geminiFinishReasons)
+	return out
+}
+
+// geminiFinishReasons maps the finish reasons of Gemini to the Finish constants.
+var geminiFinishReasons = map[string]string{
+	"STOP":               FinishStop,
+	"MAX_TOKENS":         FinishLength,
+	"SAFETY":             FinishContentFilter,
+	"RECITATION":         FinishContentFilter,
+	"BLOCKLIST":          FinishContentFilter,
+	"PROHIBITED_CONTENT": FinishContentFilter,
+	"SPII":               FinishContentFilter,
+}
+
+// Generate produces a response from the Gemini API based on the given prompt.
+// The prompt is sent as a single user message to the generateContent endpoint.
+func (g *GeminiBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	return g.Chat(ctx, []Message{UserMessage(prompt)}, nil, opts...)
+}
+
+// Close implements Backend. It works as OpenAIBackend.Close does.
+func (g *GeminiBackend) Close() error {
+	return closeTransport(g.transport)
+}
+
+// post sends body to the generateContent endpoint of the model, authenticated with
+// the API key, with the custom headers, including callHeaders set for the call.
+// Gemini takes the key as a query parameter; postJSON keeps the query out of the
+// errors it returns.
+func (g *GeminiBackend) post(ctx context.Context, callHeaders map[string]string, body any) (*http.Response, error) {
+	endpoint := g.BaseURL + geminiModelsEndpoint + "/" + url.PathEscape(g.Model) + ":generateContent"
+	query := url.Values{"key": {g.APIKey}}
+	return postJSON(ctx, g.HTTPClient, endpoint+"?"+query.Encode(), requestHeader(nil, g.UserAgent, g.Headers, callHeaders), body, g.MaxRequestBytes)
+}
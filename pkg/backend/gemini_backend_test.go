@@ -0,0 +1,200 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// geminiRequest is the part of a generateContent request the tests inspect.
+type geminiRequest struct {
+	Contents          []geminiContent `json:"contents"`
+	SystemInstruction *geminiContent  `json:"systemInstruction"`
+	Tools             []struct {
+		FunctionDeclarations []geminiFunctionDeclaration `json:"functionDeclarations"`
+	} `json:"tools"`
+	GenerationConfig map[string]any `json:"generationConfig"`
+}
+
+func TestGeminiChat(t *testing.T) {
+	received := make(chan geminiRequest, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1beta/models/gemini-1.5-flash:generateContent" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if key := r.URL.Query().Get("key"); key != "test-api-key" {
+			t.Errorf("Expected the API key in the query, got %q", key)
+		}
+
+		var reqBody geminiRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"candidates": [{
+				"content": {"role": "model", "parts": [
+					{"text": "Checking the weather."},
+					{"functionCall": {"name": "get_weather", "args": {"city": "Brno"}}}
+				]},
+				"finishReason": "STOP"
+			}],
+			"usageMetadata": {"promptTokenCount": 10, "candidatesTokenCount": 4, "totalTokenCount": 14},
+			"modelVersion": "gemini-1.5-flash-002"
+		}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewGeminiBackend("test-api-key", "gemini-1.5-flash", WithBaseURL(mockServer.URL))
+	backend.MaxOutputTokens = 256
+
+	messages := []Message{
+		SystemMessage("You are a weather bot."),
+		UserMessage("Weather in Brno?"),
+	}
+	tools := []Tool{{
+		"type": "function",
+		"function": map[string]any{
+			"name":       "get_weather",
+			"parameters": map[string]any{"type": "object"},
+		},
+	}}
+
+	response, err := backend.Chat(context.Background(), messages, tools, WithTemperature(0.5))
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+
+	reqBody := <-received
+	if reqBody.SystemInstruction == nil || reqBody.SystemInstruction.Parts[0].Text != "You are a weather bot." {
+		t.Errorf("Expected the system prompt as the system instruction, got %+v", reqBody.SystemInstruction)
+	}
+	if len(reqBody.Contents) != 1 || reqBody.Contents[0].Role != RoleUser {
+		t.Errorf("Expected only the user message, got %+v", reqBody.Contents)
+	}
+	if len(reqBody.Tools) != 1 || reqBody.Tools[0].FunctionDeclarations[0].Name != "get_weather" {
+		t.Errorf("Unexpected tools: %+v", reqBody.Tools)
+	}
+	if reqBody.GenerationConfig["temperature"] != 0.5 || reqBody.GenerationConfig["maxOutputTokens"] != float64(256) {
+		t.Errorf("Unexpected generation config: %v", reqBody.GenerationConfig)
+	}
+
+	if response.Message.Content != "Checking the weather." || response.Model != "gemini-1.5-flash-002" {
+		t.Errorf("Unexpected response: %+v", response)
+	}
+	if len(response.Message.ToolCalls) != 1 || response.Message.ToolCalls[0].Function.Arguments["city"] != "Brno" {
+		t.Errorf("Unexpected tool calls: %+v", response.Message.ToolCalls)
+	}
+	// Gemini reports STOP for replies with function calls
+	if response.FinishReason != FinishToolCalls {
+		t.Errorf("Expected finish reason %s, got %s", FinishToolCalls, response.FinishReason)
+	}
+	if !response.UsageAvailable || response.Usage.PromptTokens != 10 || response.Usage.CompletionTokens != 4 {
+		t.Errorf("Unexpected usage: %+v", response.Usage)
+	}
+}
+
+func TestToGeminiContents(t *testing.T) {
+	messages := []Message{
+		UserMessage("Weather in Brno and Prague?"),
+		{
+			Role: RoleAssistant,
+			ToolCalls: []ToolCall{
+				{Function: FunctionCall{Name: "get_weather", Arguments: map[string]any{"city": "Brno"}}},
+				{Function: FunctionCall{Name: "get_weather", Arguments: map[string]any{"city": "Prague"}}},
+			},
+		},
+		ToolMessage("get_weather", "sunny"),
+		ToolMessage("get_weather", "rainy"),
+		AssistantMessage("Sunny in Brno, rainy in Prague."),
+	}
+
+	_, contents := toGeminiContents(messages)
+	if len(contents) != 4 {
+		t.Fatalf("Expected 4 contents, got %d: %+v", len(contents), contents)
+	}
+	if contents[1].Role != geminiModelRole || len(contents[1].Parts) != 2 || contents[1].Parts[0].FunctionCall == nil {
+		t.Errorf("Unexpected model message: %+v", contents[1])
+	}
+	results := contents[2]
+	if results.Role != RoleUser || len(results.Parts) != 2 {
+		t.Fatalf("Expected one user message with both function responses, got %+v", results)
+	}
+	if results.Parts[1].FunctionResponse.Name != "get_weather" || results.Parts[1].FunctionResponse.Response["content"] != "rainy" {
+		t.Errorf("Unexpected function response: %+v", results.Parts[1].FunctionResponse)
+	}
+	if contents[3].Role != geminiModelRole {
+		t.Errorf("Expected the assistant role to be sent as model, got %s", contents[3].Role)
+	}
+}
+
+func TestGeminiErrorHidesAPIKey(t *testing.T) {
+	mockServer := httptest.NewServer(http.NotFoundHandler())
+	url := mockServer.URL
+	mockServer.Close()
+
+	backend := NewGeminiBackend("secret-api-key", "gemini-1.5-flash", WithBaseURL(url))
+	_, err := backend.Generate(context.Background(), "Hi")
+	if err == nil {
+		t.Fatalf("Expected an error for an unreachable server")
+	}
+	if strings.Contains(err.Error(), "secret-api-key") {
+		t.Errorf("Expected the API key to be removed from the error, got %v", err)
+	}
+}
+
+func TestGeminiToolChoice(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+		w.Write([]byte(`{"candidates": [{"content": {"role": "model", "parts": [{"text": "Hi"}]}, "finishReason": "STOP"}]}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewGeminiBackend("test-api-key", "gemini-1.5-flash", WithBaseURL(mockServer.URL))
+	tools := []Tool{{"type": "function", "function": map[string]any{"name": "get_weather"}}}
+	messages := []Message{UserMessage("Weather?")}
+
+	functionCallingConfig := func(reqBody map[string]any) map[string]any {
+		toolConfig, _ := reqBody["toolConfig"].(map[string]any)
+		config, _ := toolConfig["functionCallingConfig"].(map[string]any)
+		return config
+	}
+
+	if _, err := backend.Chat(context.Background(), messages, tools, WithToolChoice("get_weather")); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	config := functionCallingConfig(<-received)
+	if names, _ := config["allowedFunctionNames"].([]any); config["mode"] != "ANY" || len(names) != 1 || names[0] != "get_weather" {
+		t.Errorf("Expected get_weather to be forced, got %v", config)
+	}
+
+	if _, err := backend.Chat(context.Background(), messages, tools, WithToolChoiceNone()); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if config := functionCallingConfig(<-received); config["mode"] != "NONE" {
+		t.Errorf("Expected mode NONE, got %v", config)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// modulePath is the path of the module this package is part of.
+const modulePath = "github.com/stackloklabs/gollm"
+
+// DefaultUserAgent is sent in the User-Agent header of the requests of backends
+// created without WithUserAgent. It is "gollm/" followed by the version of this
+// module the program was built with, or "gollm/devel" if that is unknown.
+var DefaultUserAgent = "gollm/" + moduleVersion()
+
+// moduleVersion returns the version of this module recorded in the build
+// information of the program, without the leading "v".
+func moduleVersion() string {
+	version := ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == modulePath {
+			version = info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				version = dep.Version
+			}
+		}
+	}
+	if version == "" || version == "(devel)" {
+		return "devel"
+	}
+	return strings.TrimPrefix(version, "v")
+}
+
+// defaultMaxIdleConnsPerHost is the number of idle connections to its server a
+// backend keeps open by default. With the two of http.DefaultTransport, most of
+// the requests of a backend under concurrent load open a new connection.
+const defaultMaxIdleConnsPerHost = 32
+
+// defaultTransport is the transport of the backends created without an HTTP
+// client or a PoolConfig. It is shared, so that backends for the same server
+// reuse each other's connections.
+var defaultTransport = newTransport(PoolConfig{})
+
+// PoolConfig tunes the pool of HTTP connections of a backend, see WithConnectionPool.
+type PoolConfig struct {
+	// MaxIdleConns limits the idle connections kept open to all hosts. Zero
+	// means 100, as for http.DefaultTransport.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost limits the idle connections kept open to a host. Zero
+	// means 32.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits the connections to a host, including those in use.
+	// Requests wait for a connection beyond the limit. Zero means no limit.
+	MaxConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept open. Zero means
+	// 90 seconds, as for http.DefaultTransport.
+	IdleConnTimeout time.Duration
+}
+
+// newTransport returns a transport with the settings of http.DefaultTransport,
+// such as its proxy and dial timeouts, and the pool tuned with cfg.
+func newTransport(cfg PoolConfig) *http.Transport {
+	var t *http.Transport
+	if base, ok := http.DefaultTransport.(*http.Transport); ok {
+		t = base.Clone()
+	} else {
+		t = &http.Transport{Proxy: http.ProxyFromEnvironment, MaxIdleConns: 100, IdleConnTimeout: 90 * time.Second}
+	}
+	t.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	if cfg.MaxIdleConns > 0 {
+		t.MaxIdleConns = cfg.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	if cfg.MaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = cfg.MaxConnsPerHost
+	}
+	if cfg.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+	return t
+}
+
+// newHTTPClient returns the HTTP client of a backend created with o: the one given
+// with WithHTTPClient or else a client with timeout. The transport is returned as
+// well if it belongs to the backend, to be closed by Close, as it does for
+// WithConnectionPool and WithConnectTimeout.
+func newHTTPClient(o *backendOptions, timeout time.Duration) (*http.Client, *http.Transport) {
+	if o.httpClient != nil {
+		return o.httpClient, nil
+	}
+	if o.pool != nil || o.connectTimeout > 0 {
+		var cfg PoolConfig
+		if o.pool != nil {
+			cfg = *o.pool
+		}
+		t := newTransport(cfg)
+		if o.connectTimeout > 0 {
+			dialer := &net.Dialer{Timeout: o.connectTimeout, KeepAlive: 30 * time.Second}
+			t.DialContext = dialer.DialContext
+			// Each phase gets the whole timeout, see WithConnectTimeout
+			t.TLSHandshakeTimeout = o.connectTimeout
+		}
+		return &http.Client{Timeout: timeout, Transport: t}, t
+	}
+	return &http.Client{Timeout: timeout, Transport: defaultTransport}, nil
+}
+
+// closeTransport closes the idle connections of t, the transport a backend
+// created for WithConnectionPool, if any.
+func closeTransport(t *http.Transport) error {
+	if t != nil {
+		t.CloseIdleConnections()
+	}
+	return nil
+}
+
+// postJSON marshals body and POSTs it to url with the given extra headers.
+// It returns the response only if the server replied with a 2xx status code, in which
+// case the caller must close its body. Other status codes are returned as a *BackendError.
+// The query of url is left out of the errors returned for transport failures.
+// If maxBytes is positive, a body larger than maxBytes is not sent and a
+// *RequestTooLargeError is returned instead.
+func postJSON(ctx context.Context, client *http.Client, url string, header http.Header, body any, maxBytes int) (*http.Response, error) {
+	reqBodyBytes, err := marshalRequest(body)
+	if err != nil {
+		return nil, err
+	}
+	if maxBytes > 0 && len(reqBodyBytes) > maxBytes {
+		return nil, &RequestTooLargeError{Size: len(reqBodyBytes), Limit: maxBytes}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(reqBodyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return doRequest(ctx, client, req)
+}
+
+// getJSON sends a GET request to url with the given extra headers. Like postJSON,
+// it returns the response only for a 2xx status code and a *BackendError otherwise.
+func getJSON(ctx context.Context, client *http.Client, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Accept", "application/json")
+
+	return doRequest(ctx, client, req)
+}
+
+// requestHeader returns the headers of a request: the User-Agent, or
+// DefaultUserAgent if userAgent is empty, the custom headers, where later maps
+// take precedence, and the headers the backend sets itself, such as the API key.
+// Custom headers cannot replace the latter.
+func requestHeader(own http.Header, userAgent string, custom ...map[string]string) http.Header {
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	header := http.Header{"User-Agent": {userAgent}}
+	for _, headers := range custom {
+		for key, value := range headers {
+			header.Set(key, value)
+		}
+	}
+	for key, values := range own {
+		header[http.CanonicalHeaderKey(key)] = values
+	}
+	return header
+}
+
+// doRequest sends req and turns non-2xx responses into a *BackendError.
+func doRequest(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		// The query may carry credentials, e.g. the API key for Gemini
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL, _, _ = strings.Cut(urlErr.URL, "?")
+		}
+		return nil, contextError(ctx, fmt.Errorf("HTTP request failed: %w", err))
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		backendErr := newBackendError(resp.StatusCode, string(bodyBytes))
+		backendErr.RetryAfter = parseRetryAfter(resp.Header, time.Now())
+		return nil, backendErr
+	}
+
+	return resp, nil
+}
+
+// decodeJSON decodes the body of resp into out and closes it.
+func decodeJSON(ctx context.Context, resp *http.Response, out any) error {
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return contextError(ctx, fmt.Errorf("failed to decode response: %w", err))
+	}
+	return nil
+}
+
+// decodeResponse works like decodeJSON but also passes the raw body to the raw
+// response capture of opts, if any. The body is read only once, and captured even
+// if it cannot be decoded.
+func decodeResponse(ctx context.Context, resp *http.Response, out any, opts *Options) error {
+	if opts.RawResponse == nil {
+		return decodeJSON(ctx, resp, out)
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return contextError(ctx, fmt.Errorf("failed to read response: %w", err))
+	}
+	opts.RawResponse(body)
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// contextError returns err unchanged unless ctx is done, in which case the failure
+// was caused by the cancellation and ErrContextCanceled and the context error are returned.
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %w", ErrContextCanceled, ctx.Err())
+	}
+	return err
+}
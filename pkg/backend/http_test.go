@@ -0,0 +1,247 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUserAgent(t *testing.T) {
+	var userAgents []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		w.Write([]byte(`{}`))
+	}))
+	defer mockServer.Close()
+
+	newBackends := func(opts ...Option) map[string]Backend {
+		opts = append(opts, WithBaseURL(mockServer.URL))
+		return map[string]Backend{
+			"ollama":    NewOllamaBackend(mockServer.URL, "llama3", opts...),
+			"openai":    NewOpenAIBackend("key", "gpt-4o-mini", opts...),
+			"anthropic": NewAnthropicBackend("key", "claude-3-5-haiku-latest", opts...),
+			"gemini":    NewGeminiBackend("key", "gemini-1.5-flash", opts...),
+			"cohere":    NewCohereBackend("key", "command-r", opts...),
+			"mistral":   NewMistralBackend("key", "mistral-small-latest", opts...),
+		}
+	}
+	cases := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"default", nil, DefaultUserAgent},
+		{"custom", []Option{WithUserAgent("my-app/1.2")}, "my-app/1.2"},
+		{"custom header", []Option{WithUserAgent("my-app/1.2"), WithHeaders(map[string]string{"User-Agent": "gateway"})}, "gateway"},
+	}
+	for _, tc := range cases {
+		for name, be := range newBackends(tc.opts...) {
+			userAgents = nil
+			// The replies are empty, only the request matters here
+			be.Chat(context.Background(), []Message{UserMessage("Hi")}, nil)
+			if len(userAgents) != 1 || userAgents[0] != tc.want {
+				t.Errorf("%s, %s: expected User-Agent %s, got %v", tc.name, name, tc.want, userAgents)
+			}
+		}
+	}
+
+	if !strings.HasPrefix(DefaultUserAgent, "gollm/") || DefaultUserAgent == "gollm/" {
+		t.Errorf("Expected a default User-Agent with a version, got %s", DefaultUserAgent)
+	}
+}
+
+func TestMaxRequestBytes(t *testing.T) {
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{}`))
+	}))
+	defer mockServer.Close()
+
+	opts := []Option{WithBaseURL(mockServer.URL), WithMaxRequestBytes(200)}
+	backends := map[string]Backend{
+		"ollama":    NewOllamaBackend(mockServer.URL, "llama3", opts...),
+		"openai":    NewOpenAIBackend("key", "gpt-4o-mini", opts...),
+		"anthropic": NewAnthropicBackend("key", "claude-3-5-haiku-latest", opts...),
+		"gemini":    NewGeminiBackend("key", "gemini-1.5-flash", opts...),
+		"cohere":    NewCohereBackend("key", "command-r", opts...),
+		"mistral":   NewMistralBackend("key", "mistral-small-latest", opts...),
+	}
+	large := []Message{UserMessage(strings.Repeat("a", 300))}
+	for name, be := range backends {
+		_, err := be.Chat(context.Background(), large, nil)
+		var tooLarge *RequestTooLargeError
+		if !errors.Is(err, ErrRequestTooLarge) || !errors.As(err, &tooLarge) {
+			t.Fatalf("%s: expected ErrRequestTooLarge, got %v", name, err)
+		}
+		if tooLarge.Limit != 200 || tooLarge.Size <= 300 {
+			t.Errorf("%s: expected a size above 300 and a limit of 200, got %d and %d", name, tooLarge.Size, tooLarge.Limit)
+		}
+		if !strings.Contains(err.Error(), fmt.Sprintf("%d bytes, the limit is 200", tooLarge.Size)) {
+			t.Errorf("%s: expected the sizes in the error, got %v", name, err)
+		}
+
+		// Smaller requests are sent
+		be.Chat(context.Background(), []Message{UserMessage("Hi")}, nil)
+	}
+	if requests != len(backends) {
+		t.Errorf("Expected only the small requests to be sent, got %d requests", requests)
+	}
+}
+
+func TestConnectionPool(t *testing.T) {
+	var mu sync.Mutex
+	opened := 0
+	mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		json.NewEncoder(w).Encode(Response{Done: true})
+	}))
+	mockServer.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			opened++
+			mu.Unlock()
+		}
+	}
+	mockServer.Start()
+	defer mockServer.Close()
+
+	if be := NewOllamaBackend(mockServer.URL, "test-model"); be.Client.Transport != defaultTransport || defaultTransport.MaxIdleConnsPerHost != defaultMaxIdleConnsPerHost {
+		t.Errorf("Expected the shared pooled transport by default, got %v", be.Client.Transport)
+	}
+	client := &http.Client{}
+	if be := NewOpenAIBackend("key", "gpt-4o-mini", WithHTTPClient(client), WithConnectionPool(PoolConfig{MaxConnsPerHost: 1})); be.HTTPClient != client {
+		t.Errorf("Expected the HTTP client to take precedence over the pool")
+	}
+
+	be := NewOllamaBackend(mockServer.URL, "test-model", WithConnectionPool(PoolConfig{MaxConnsPerHost: 2, IdleConnTimeout: time.Minute}))
+	transport, _ := be.Client.Transport.(*http.Transport)
+	if transport == nil || transport == defaultTransport || transport.MaxConnsPerHost != 2 || transport.IdleConnTimeout != time.Minute {
+		t.Fatalf("Expected a transport of its own for the pool, got %+v", be.Client.Transport)
+	}
+	if be.Client.Timeout != defaultTimeout {
+		t.Errorf("Expected the default timeout, got %s", be.Client.Timeout)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := be.Chat(context.Background(), []Message{UserMessage("Hi")}, nil); err != nil {
+				t.Errorf("Chat returned error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if opened > 2 {
+		t.Errorf("Expected at most 2 connections, got %d", opened)
+	}
+	if err := be.Close(); err != nil {
+		t.Errorf("Close returned error: %v", err)
+	}
+}
+
+// BenchmarkConcurrentChat compares the connections opened by bursts of concurrent
+// requests with http.DefaultTransport, which keeps only two idle connections per
+// host, and with the pooled default transport of the backends. Each operation is a
+// burst of 16 requests.
+func BenchmarkConcurrentChat(b *testing.B) {
+	var opened atomic.Int64
+	mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Response{Message: AssistantMessage("Hello!"), Done: true})
+	}))
+	mockServer.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			opened.Add(1)
+		}
+	}
+	mockServer.Start()
+	defer mockServer.Close()
+
+	cases := []struct {
+		name string
+		opts []Option
+	}{
+		{"DefaultTransport", []Option{WithHTTPClient(&http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()})}},
+		{"Pooled", []Option{WithConnectionPool(PoolConfig{})}},
+	}
+	for _, tc := range cases {
+		b.Run(tc.name, func(b *testing.B) {
+			be := NewOllamaBackend(mockServer.URL, "test-model", tc.opts...)
+			defer be.Close()
+			opened.Store(0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				for j := 0; j < 16; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						if _, err := be.Chat(context.Background(), []Message{UserMessage("Hi")}, nil); err != nil {
+							b.Error(err)
+						}
+					}()
+				}
+				wg.Wait()
+			}
+			b.ReportMetric(float64(opened.Load())/float64(b.N), "conns/op")
+		})
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	// A server that accepts connections but never completes the TLS handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	be := NewOpenAIBackend("key", "gpt-4o-mini", WithBaseURL("https://"+listener.Addr().String()), WithConnectTimeout(100*time.Millisecond))
+	transport, _ := be.HTTPClient.Transport.(*http.Transport)
+	if transport == nil || transport == defaultTransport || transport.TLSHandshakeTimeout != 100*time.Millisecond {
+		t.Fatalf("Expected a transport of its own with the connect timeout, got %+v", be.HTTPClient.Transport)
+	}
+	defer be.Close()
+
+	start := time.Now()
+	_, err = be.Chat(context.Background(), []Message{UserMessage("Hi")}, nil)
+	if err == nil || !strings.Contains(err.Error(), "handshake timeout") {
+		t.Errorf("Expected a handshake timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the request to fail fast, took %s", elapsed)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// newSlowServer returns a server that writes body and then stalls until the
+// client goes away or the returned release function is called.
+func newSlowServer(t *testing.T, body string) (*httptest.Server, func()) {
+	t.Helper()
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	return server, func() { close(release) }
+}
+
+// streamLine encodes a single streamed chat chunk with the given content.
+func streamLine(t *testing.T, content string) string {
+	t.Helper()
+	line, err := json.Marshal(Response{Message: Message{Content: content}})
+	if err != nil {
+		t.Fatalf("failed to marshal stream chunk: %v", err)
+	}
+	return string(line) + "\n"
+}
+
+// waitForGoroutines fails the test unless the number of goroutines drops back
+// to at most baseline within a second.
+func waitForGoroutines(t *testing.T, baseline int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= baseline {
+			return
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("Expected at most %d goroutines, got %d:\n%s", baseline, n, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestChatStreamCancelDoesNotLeak(t *testing.T) {
+	server, release := newSlowServer(t, streamLine(t, "partial"))
+	defer server.Close()
+	defer release()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	backend := NewOllamaBackend(server.URL, "test-model", WithHTTPClient(client))
+	baseline := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	chunks, err := backend.ChatStream(ctx, []Message{UserMessage("Hi")}, nil)
+	if err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+	<-chunks
+	cancel()
+
+	for range chunks {
+	}
+
+	client.CloseIdleConnections()
+	waitForGoroutines(t, baseline)
+}
+
+func TestChatStreamAbandonedWithCancelDoesNotLeak(t *testing.T) {
+	server, release := newSlowServer(t, streamLine(t, "partial"))
+	defer server.Close()
+	defer release()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	backend := NewOllamaBackend(server.URL, "test-model", WithHTTPClient(client))
+	baseline := runtime.NumGoroutine()
+
+	// The caller never reads from the channel, but cancels the context
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := backend.ChatStream(ctx, []Message{UserMessage("Hi")}, nil); err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+	cancel()
+
+	client.CloseIdleConnections()
+	waitForGoroutines(t, baseline)
+}
+
+func TestChatCancelDoesNotLeak(t *testing.T) {
+	server, release := newSlowServer(t, `{"message": {"content": "part`)
+	defer server.Close()
+	defer release()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	backend := NewOllamaBackend(server.URL, "test-model", WithHTTPClient(client))
+	baseline := runtime.NumGoroutine()
+
+	// The server sends half a JSON object and stalls, so Chat is stuck decoding
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := backend.Chat(ctx, []Message{UserMessage("Hi")}, nil); !errors.Is(err, ErrContextCanceled) {
+		t.Errorf("Expected ErrContextCanceled, got %v", err)
+	}
+
+	client.CloseIdleConnections()
+	waitForGoroutines(t, baseline)
+}
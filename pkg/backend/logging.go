@@ -0,0 +1,184 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// redacted replaces content that is not logged at the configured level.
+const redacted = "[redacted]"
+
+// loggingBackend is a Backend that logs the requests of the wrapped one.
+type loggingBackend struct {
+	be           Backend
+	logger       *slog.Logger
+	contentLevel slog.Level
+}
+
+// LoggingOption configures a backend wrapped with WithLogging.
+type LoggingOption func(*loggingBackend)
+
+// WithContentLogLevel sets the level at which message and response content is logged.
+// When the logger is not enabled for that level the content is replaced with
+// "[redacted]". The default is slog.LevelDebug.
+func WithContentLogLevel(level slog.Level) LoggingOption {
+	return func(l *loggingBackend) {
+		l.contentLevel = level
+	}
+}
+
+// WithLogging wraps be so that every Chat, Generate and ChatStream request is logged
+// to logger, streams once they end.
+// A record is written at Info level for each successful request, and at Error level
+// for each failed one, with the method, model, HTTP status, latency and the number
+// of messages and tools. Message content, tool names and the reply are added only
+// if logger is enabled for the content level, see WithContentLogLevel.
+//
+// The wrapper only sees messages and responses, never HTTP headers, so credentials
+// such as API keys cannot end up in the log.
+func WithLogging(be Backend, logger *slog.Logger, opts ...LoggingOption) Backend {
+	l := &loggingBackend{
+		be:           be,
+		logger:       logger,
+		contentLevel: slog.LevelDebug,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Chat implements Backend.
+func (l *loggingBackend) Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	start := time.Now()
+	resp, err := l.be.Chat(ctx, messages, tools, opts...)
+	l.log(ctx, "chat", messages, tools, resp, err, time.Since(start))
+	return resp, err
+}
+
+// Generate implements Backend.
+func (l *loggingBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	start := time.Now()
+	resp, err := l.be.Generate(ctx, prompt, opts...)
+	l.log(ctx, "generate", []Message{UserMessage(prompt)}, nil, resp, err, time.Since(start))
+	return resp, err
+}
+
+// Close implements Backend by closing the wrapped backend.
+func (l *loggingBackend) Close() error {
+	return l.be.Close()
+}
+
+// ChatStream passes the request to the wrapped backend and logs it once the stream
+// ends, with the complete reply of the last chunk.
+func (l *loggingBackend) ChatStream(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (<-chan StreamChunk, error) {
+	streamer, ok := l.be.(Streamer)
+	if !ok {
+		return nil, errors.New("backend does not support streaming")
+	}
+	start := time.Now()
+	chunks, err := streamer.ChatStream(ctx, messages, tools, opts...)
+	if err != nil {
+		l.log(ctx, "chat_stream", messages, tools, nil, err, time.Since(start))
+		return nil, err
+	}
+	return observeStream(ctx, chunks, func(resp *Response, err error) {
+		l.log(ctx, "chat_stream", messages, tools, resp, err, time.Since(start))
+	}), nil
+}
+
+// log writes a single record describing a finished request.
+func (l *loggingBackend) log(ctx context.Context, method string, messages []Message, tools []Tool, resp *Response, err error, latency time.Duration) {
+	level := slog.LevelInfo
+	if err != nil {
+		level = slog.LevelError
+	}
+	if !l.logger.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("method", method),
+		slog.Int("status", statusCode(err)),
+		slog.Duration("latency", latency),
+		slog.Int("messages", len(messages)),
+		slog.Int("tools", len(tools)),
+	}
+	if resp != nil {
+		attrs = append(attrs, slog.String("model", resp.Model))
+	}
+
+	showContent := l.logger.Enabled(ctx, l.contentLevel)
+	attrs = append(attrs, slog.Any("request", l.requestContent(messages, tools, showContent)))
+	if resp != nil {
+		content := redacted
+		if showContent {
+			content = resp.Message.Content
+			if content == "" {
+				content = resp.Response
+			}
+		}
+		attrs = append(attrs, slog.String("response", content))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+
+	l.logger.LogAttrs(ctx, level, "LLM request", attrs...)
+}
+
+// requestContent returns the messages and tool names to log, with the content redacted unless show is set.
+func (l *loggingBackend) requestContent(messages []Message, tools []Tool, show bool) slog.Value {
+	logged := make([]map[string]string, 0, len(messages))
+	for _, msg := range messages {
+		content := redacted
+		if show {
+			content = msg.Content
+		}
+		logged = append(logged, map[string]string{"role": msg.Role, "content": content})
+	}
+
+	attrs := []slog.Attr{slog.Any("messages", logged)}
+	if show {
+		names := make([]string, 0, len(tools))
+		for _, tool := range tools {
+			if fn, ok := tool["function"].(map[string]any); ok {
+				if name, ok := fn["name"].(string); ok {
+					names = append(names, name)
+				}
+			}
+		}
+		attrs = append(attrs, slog.Any("tool_names", names))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// statusCode returns the HTTP status code a request finished with: 200 on success,
+// the status of a BackendError, or 0 if no response was received.
+func statusCode(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	var backendErr *BackendError
+	if errors.As(err, &backendErr) {
+		return backendErr.StatusCode
+	}
+	return 0
+}
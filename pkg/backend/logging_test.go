@@ -0,0 +1,127 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWithLoggingRedactsContent(t *testing.T) {
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return &Response{Model: "test-model", Message: Message{Content: "secret reply"}}, nil
+		},
+	}
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	logged := WithLogging(be, logger)
+
+	if _, err := logged.Chat(context.Background(), []Message{UserMessage("secret prompt")}, nil); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+
+	out := buf.String()
+	if strings.Contains(out, "secret") {
+		t.Errorf("Expected content to be redacted at info level, got %s", out)
+	}
+	for _, expected := range []string{"method=chat", "status=200", "model=test-model", "latency=", redacted} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in the log, got %s", expected, out)
+		}
+	}
+}
+
+func TestWithLoggingShowsContentAtDebug(t *testing.T) {
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return &Response{Model: "test-model", Message: Message{Content: "the reply"}}, nil
+		},
+	}
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	logged := WithLogging(be, logger)
+
+	tools := []Tool{{"type": "function", "function": map[string]any{"name": "weather"}}}
+	if _, err := logged.Chat(context.Background(), []Message{UserMessage("the prompt")}, tools); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+
+	out := buf.String()
+	for _, expected := range []string{"the prompt", "the reply", "weather"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in the log, got %s", expected, out)
+		}
+	}
+}
+
+func TestWithLoggingErrors(t *testing.T) {
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return nil, newBackendError(http.StatusTooManyRequests, "slow down")
+		},
+	}
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	logged := WithLogging(be, logger, WithContentLogLevel(slog.LevelInfo))
+
+	if _, err := logged.Generate(context.Background(), "Hi"); err == nil {
+		t.Fatalf("Expected an error")
+	}
+
+	out := buf.String()
+	for _, expected := range []string{"level=ERROR", "method=generate", "status=429", "slow down", "content:Hi"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in the log, got %s", expected, out)
+		}
+	}
+}
+
+func TestWithLoggingChatStream(t *testing.T) {
+	be := &streamingFakeBackend{
+		stream: func(messages []Message) ([]StreamChunk, bool) {
+			return []StreamChunk{
+				{Content: "Hi"},
+				{Done: true, Response: &Response{Model: "test-model", Message: Message{Content: "Hi"}}},
+			}, false
+		},
+	}
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	streamer, ok := WithLogging(be, logger).(Streamer)
+	if !ok {
+		t.Fatalf("Expected the wrapped backend to support streaming")
+	}
+	chunks, err := streamer.ChatStream(context.Background(), []Message{UserMessage("Hi")}, nil)
+	if err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+	for range chunks {
+	}
+
+	out := buf.String()
+	for _, expected := range []string{"method=chat_stream", "status=200", "model=test-model"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in the log, got %s", expected, out)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Roles of the participants in a conversation.
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	RoleTool      = "tool"
+)
+
+// SystemMessage returns a message with instructions for the model.
+func SystemMessage(content string) Message {
+	return Message{Role: RoleSystem, Content: content}
+}
+
+// UserMessage returns a message written by the user.
+func UserMessage(content string) Message {
+	return Message{Role: RoleUser, Content: content}
+}
+
+// NamedUserMessage returns a message written by the named participant of a
+// conversation with several users. See Message.Name for the backends that
+// pass the name on to the model.
+func NamedUserMessage(name, content string) Message {
+	return Message{Role: RoleUser, Name: name, Content: content}
+}
+
+// AssistantMessage returns a message written by the model.
+func AssistantMessage(content string) Message {
+	return Message{Role: RoleAssistant, Content: content}
+}
+
+// ImageMessage returns a user message with the images read from imagePaths attached,
+// for use with vision models. It fails if one of the files cannot be read.
+func ImageMessage(text string, imagePaths ...string) (Message, error) {
+	msg := UserMessage(text)
+	for _, path := range imagePaths {
+		image, err := os.ReadFile(path)
+		if err != nil {
+			return Message{}, fmt.Errorf("failed to read image: %w", err)
+		}
+		msg.Images = append(msg.Images, image)
+	}
+	return msg, nil
+}
+
+// ToolMessage returns a message carrying the result of the tool with the given name.
+// The result is sent as is if it is a string or a []byte, and as JSON otherwise,
+// so that a tool can return a struct without serializing it.
+func ToolMessage(name string, result any) Message {
+	return Message{Role: RoleTool, Name: name, Content: toolContent(result)}
+}
+
+// ToolResultMessage returns a message carrying the result of the tool call with the
+// given ID, which answers the ToolCall with that ID. Every backend translates it into
+// the shape its API expects: a "tool" role message for Ollama and OpenAI, a
+// tool_result block referencing the tool_use_id for Anthropic, a functionResponse
+// part for Gemini and a tool result for Cohere. Gemini and Cohere identify the call
+// by name instead of ID, so both should be given. The result is encoded as for
+// ToolMessage.
+func ToolResultMessage(toolCallID, name string, result any) Message {
+	return Message{Role: RoleTool, ToolCallID: toolCallID, Name: name, Content: toolContent(result)}
+}
+
+// toolContent returns the content of a message carrying result. A result that
+// cannot be encoded as JSON, such as a channel, is replaced with a JSON object
+// holding the error, so that the model learns that the tool failed.
+func toolContent(result any) string {
+	content, err := encodeToolResult(result)
+	if err != nil {
+		raw, _ := json.Marshal(map[string]string{"error": err.Error()})
+		return string(raw)
+	}
+	return content
+}
+
+// MessagesFromMaps converts messages in the map form used by the Ollama API, e.g.
+// {"role": "user", "content": "Hi"}, into Messages. Unknown keys, such as a
+// misspelled "role", are reported as errors instead of being silently dropped.
+func MessagesFromMaps(maps []map[string]any) ([]Message, error) {
+	messages := make([]Message, 0, len(maps))
+	for i, m := range maps {
+		raw, err := json.Marshal(m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal message %d: %w", i, err)
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+
+		var msg Message
+		if err := decoder.Decode(&msg); err != nil {
+			return nil, fmt.Errorf("invalid message %d: %w", i, err)
+		}
+		if msg.Role == "" {
+			return nil, fmt.Errorf("invalid message %d: missing role", i)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// NormalizeMessages returns messages with adjacent messages of the same role and
+// name merged into one, their contents separated by a blank line and their images
+// combined. The Anthropic and Gemini APIs expect user and assistant turns to
+// alternate, so conversations that e.g. send two user messages in a row should be
+// normalized before they are sent to them; Ollama, OpenAI and Cohere accept such
+// conversations as they are.
+//
+// Tool results and assistant messages with tool calls are never merged, so the
+// pairing of tool calls and their results is preserved. messages is not modified.
+func NormalizeMessages(messages []Message) []Message {
+	out := make([]Message, 0, len(messages))
+	for _, msg := range messages {
+		if n := len(out); n > 0 && mergeable(out[n-1], msg) {
+			last := &out[n-1]
+			last.Content = joinContent(last.Content, msg.Content)
+			if len(msg.Images) > 0 {
+				last.Images = append(append([][]byte(nil), last.Images...), msg.Images...)
+			}
+			continue
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+// mergeable reports whether NormalizeMessages may merge next into prev.
+func mergeable(prev, next Message) bool {
+	if prev.Role != next.Role || prev.Name != next.Name || prev.Role == RoleTool {
+		return false
+	}
+	return len(prev.ToolCalls) == 0 && len(next.ToolCalls) == 0
+}
+
+// joinContent joins the contents of two merged messages, skipping empty ones.
+func joinContent(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	}
+	return a + "\n\n" + b
+}
+
+// combineSystemMessages returns messages with all system messages merged into
+// the first one, their contents in the order they appear separated by a blank
+// line, for backends whose prompt templates expect a single system message.
+// messages is not modified.
+func combineSystemMessages(messages []Message) []Message {
+	count := 0
+	for _, msg := range messages {
+		if msg.Role == RoleSystem {
+			count++
+		}
+	}
+	if count < 2 {
+		return messages
+	}
+
+	out := make([]Message, 0, len(messages)-count+1)
+	system := -1
+	for _, msg := range messages {
+		switch {
+		case msg.Role != RoleSystem:
+			out = append(out, msg)
+		case system < 0:
+			system = len(out)
+			out = append(out, msg)
+		default:
+			out[system].Content = joinContent(out[system].Content, msg.Content)
+		}
+	}
+	return out
+}
+
+// withSystemPrompt returns messages with a system message containing prompt prepended,
+// unless prompt is empty or messages already contain a system message.
+func withSystemPrompt(prompt string, messages []Message) []Message {
+	if prompt == "" {
+		return messages
+	}
+	for _, msg := range messages {
+		if msg.Role == RoleSystem {
+			return messages
+		}
+	}
+
+	out := make([]Message, 0, len(messages)+1)
+	out = append(out, SystemMessage(prompt))
+	return append(out, messages...)
+}
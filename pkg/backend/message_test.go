@@ -0,0 +1,247 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMessageConstructors(t *testing.T) {
+	if msg := SystemMessage("be nice"); msg.Role != RoleSystem || msg.Content != "be nice" {
+		t.Errorf("Unexpected system message: %+v", msg)
+	}
+	if msg := UserMessage("hi"); msg.Role != RoleUser || msg.Content != "hi" {
+		t.Errorf("Unexpected user message: %+v", msg)
+	}
+	if msg := NamedUserMessage("alice", "hi"); msg.Role != RoleUser || msg.Name != "alice" || msg.Content != "hi" {
+		t.Errorf("Unexpected named user message: %+v", msg)
+	}
+	if msg := AssistantMessage("hello"); msg.Role != RoleAssistant || msg.Content != "hello" {
+		t.Errorf("Unexpected assistant message: %+v", msg)
+	}
+	if msg := ToolMessage("weather", "sunny"); msg.Role != RoleTool || msg.Name != "weather" || msg.Content != "sunny" {
+		t.Errorf("Unexpected tool message: %+v", msg)
+	}
+	if msg := ToolResultMessage("call_1", "weather", "sunny"); msg.Role != RoleTool || msg.ToolCallID != "call_1" || msg.Name != "weather" || msg.Content != "sunny" {
+		t.Errorf("Unexpected tool result message: %+v", msg)
+	}
+}
+
+func TestToolMessageStructuredResult(t *testing.T) {
+	type report struct {
+		Package string  `json:"package"`
+		Score   float64 `json:"score"`
+	}
+	cases := []struct {
+		name   string
+		result any
+		want   string
+	}{
+		{"string", "sunny", "sunny"},
+		{"bytes", []byte(`{"temp": 21}`), `{"temp": 21}`},
+		{"struct", report{Package: "requests", Score: 9.5}, `{"package":"requests","score":9.5}`},
+		{"map", map[string]int{"temp": 21}, `{"temp":21}`},
+		{"number", 42, "42"},
+		{"unencodable", make(chan int), `{"error":"failed to marshal tool result: json: unsupported type: chan int"}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ToolMessage("tool", tc.result).Content; got != tc.want {
+				t.Errorf("Expected ToolMessage content %s, got %s", tc.want, got)
+			}
+			if got := ToolResultMessage("call_1", "tool", tc.result).Content; got != tc.want {
+				t.Errorf("Expected ToolResultMessage content %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestMessageJSON(t *testing.T) {
+	// The wire format must stay exactly what Ollama expects
+	expected := []struct {
+		msg  Message
+		want string
+	}{
+		{UserMessage("hi"), `{"role":"user","content":"hi"}`},
+		{SystemMessage(""), `{"role":"system","content":""}`},
+		{ToolMessage("weather", "ok"), `{"role":"tool","content":"ok","name":"weather"}`},
+	}
+	for _, tc := range expected {
+		msg, want := tc.msg, tc.want
+		got, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Failed to marshal message: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+}
+
+func TestMessagesFromMaps(t *testing.T) {
+	messages, err := MessagesFromMaps([]map[string]any{
+		{"role": "user", "content": "weather?"},
+		{"role": "assistant", "content": "", "tool_calls": []map[string]any{
+			{"function": map[string]any{"name": "weather", "arguments": map[string]any{"city": "Brno"}}},
+		}},
+		{"role": "tool", "content": "sunny"},
+	})
+	if err != nil {
+		t.Fatalf("MessagesFromMaps returned error: %v", err)
+	}
+
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(messages))
+	}
+	if messages[0].Role != RoleUser || messages[0].Content != "weather?" {
+		t.Errorf("Unexpected first message: %+v", messages[0])
+	}
+	if call := messages[1].ToolCalls[0]; call.Function.Name != "weather" || call.Function.Arguments["city"] != "Brno" {
+		t.Errorf("Unexpected tool call: %+v", call)
+	}
+}
+
+func TestImageMessage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cat.png")
+	if err := os.WriteFile(path, []byte("\x89PNG"), 0o600); err != nil {
+		t.Fatalf("Failed to write image: %v", err)
+	}
+
+	msg, err := ImageMessage("What is in this picture?", path)
+	if err != nil {
+		t.Fatalf("ImageMessage returned error: %v", err)
+	}
+	if msg.Role != RoleUser || msg.Content != "What is in this picture?" {
+		t.Errorf("Unexpected message: %+v", msg)
+	}
+	if len(msg.Images) != 1 || !bytes.Equal(msg.Images[0], []byte("\x89PNG")) {
+		t.Errorf("Expected the image to be attached, got %v", msg.Images)
+	}
+
+	got, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Failed to marshal message: %v", err)
+	}
+	if want := `{"role":"user","content":"What is in this picture?","images":["iVBORw=="]}`; string(got) != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	if _, err := ImageMessage("Hi", filepath.Join(t.TempDir(), "missing.png")); err == nil {
+		t.Errorf("Expected an error for a missing image")
+	}
+}
+
+func TestMessagesFromMapsImages(t *testing.T) {
+	messages, err := MessagesFromMaps([]map[string]any{
+		{"role": "user", "content": "What is this?", "images": []string{"iVBORw=="}},
+	})
+	if err != nil {
+		t.Fatalf("MessagesFromMaps returned error: %v", err)
+	}
+	if images := messages[0].Images; len(images) != 1 || !bytes.Equal(images[0], []byte("\x89PNG")) {
+		t.Errorf("Expected the base64 image to be decoded, got %v", images)
+	}
+}
+
+func TestMessagesFromMapsRejectsTypos(t *testing.T) {
+	if _, err := MessagesFromMaps([]map[string]any{{"rloe": "user", "content": "hi"}}); err == nil {
+		t.Errorf("Expected an error for a misspelled key")
+	}
+	if _, err := MessagesFromMaps([]map[string]any{{"content": "hi"}}); err == nil {
+		t.Errorf("Expected an error for a missing role")
+	}
+}
+
+func TestWithSystemPrompt(t *testing.T) {
+	messages := []Message{UserMessage("hi")}
+
+	out := withSystemPrompt("be nice", messages)
+	if len(out) != 2 || out[0].Role != RoleSystem || out[0].Content != "be nice" {
+		t.Errorf("Expected the system prompt to be prepended, got %+v", out)
+	}
+	if len(messages) != 1 {
+		t.Errorf("Expected the input to be left untouched")
+	}
+
+	// An existing system message is never duplicated
+	withSystem := []Message{SystemMessage("be brief"), UserMessage("hi")}
+	if out := withSystemPrompt("be nice", withSystem); len(out) != 2 || out[0].Content != "be brief" {
+		t.Errorf("Expected the caller's system message to be kept, got %+v", out)
+	}
+
+	if out := withSystemPrompt("", messages); len(out) != 1 {
+		t.Errorf("Expected no system message for an empty prompt, got %+v", out)
+	}
+}
+
+func TestCombineSystemMessages(t *testing.T) {
+	messages := []Message{
+		SystemMessage("You are a travel agent."),
+		UserMessage("Hi"),
+		SystemMessage("The user prefers trains."),
+		AssistantMessage("Hello!"),
+		SystemMessage("Answer in Czech."),
+	}
+
+	out := combineSystemMessages(messages)
+	if len(out) != 3 || out[0].Role != RoleSystem || out[1].Content != "Hi" || out[2].Content != "Hello!" {
+		t.Fatalf("Expected a single system message before the turns, got %+v", out)
+	}
+	if want := "You are a travel agent.\n\nThe user prefers trains.\n\nAnswer in Czech."; out[0].Content != want {
+		t.Errorf("Expected %q, got %q", want, out[0].Content)
+	}
+	if messages[0].Content != "You are a travel agent." || len(messages) != 5 {
+		t.Errorf("Expected the input to be left untouched")
+	}
+
+	single := []Message{SystemMessage("Be brief."), UserMessage("Hi")}
+	if out := combineSystemMessages(single); len(out) != 2 || out[0].Content != "Be brief." {
+		t.Errorf("Expected a single system message to be kept, got %+v", out)
+	}
+}
+
+func TestNormalizeMessages(t *testing.T) {
+	call := ToolCall{Function: FunctionCall{Name: "weather"}}
+	messages := []Message{
+		SystemMessage("Be brief."),
+		UserMessage("Here is an article."),
+		{Role: RoleUser, Content: "Summarize it.", Images: [][]byte{[]byte("img")}},
+		{Role: RoleAssistant, ToolCalls: []ToolCall{call}},
+		ToolMessage("weather", "sunny"),
+		ToolMessage("weather", "rainy"),
+		AssistantMessage("It is sunny"),
+		AssistantMessage("and rainy."),
+	}
+
+	out := NormalizeMessages(messages)
+	if len(out) != 6 {
+		t.Fatalf("Expected 6 messages, got %+v", out)
+	}
+	if out[1].Content != "Here is an article.\n\nSummarize it." || len(out[1].Images) != 1 {
+		t.Errorf("Expected the user messages to be merged, got %+v", out[1])
+	}
+	if len(out[2].ToolCalls) != 1 || out[3].Content != "sunny" || out[4].Content != "rainy" {
+		t.Errorf("Expected the tool call and its results to be kept, got %+v", out[2:5])
+	}
+	if out[5].Content != "It is sunny\n\nand rainy." {
+		t.Errorf("Expected the assistant messages to be merged, got %+v", out[5])
+	}
+	if messages[1].Content != "Here is an article." {
+		t.Errorf("Expected the input to be left untouched")
+	}
+}
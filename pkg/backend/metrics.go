@@ -0,0 +1,200 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultMetricsPrefix is the prefix of the metric names unless WithMetricsPrefix is given.
+const defaultMetricsPrefix = "gollm"
+
+// metricsBackend is a Backend that records metrics about the requests of the wrapped one.
+type metricsBackend struct {
+	be       Backend
+	model    string
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	tokens   *prometheus.CounterVec
+}
+
+// metricsConfig holds the settings that can be changed with a MetricsOption.
+type metricsConfig struct {
+	prefix string
+	model  string
+}
+
+// MetricsOption configures a backend wrapped with WithMetrics.
+type MetricsOption func(*metricsConfig)
+
+// WithMetricsPrefix sets the prefix of the metric names, "gollm" by default.
+func WithMetricsPrefix(prefix string) MetricsOption {
+	return func(c *metricsConfig) {
+		c.prefix = prefix
+	}
+}
+
+// WithMetricsModel sets the value of the model label. By default the model reported
+// in each response is used, and "unknown" for requests that failed.
+func WithMetricsModel(model string) MetricsOption {
+	return func(c *metricsConfig) {
+		c.model = model
+	}
+}
+
+// WithMetrics wraps be so that Chat, Generate and ChatStream requests are recorded
+// in registry, the latter under the method chat_stream once the stream ends:
+//
+//   - <prefix>_requests_total: requests, by model and method
+//   - <prefix>_errors_total: failed requests, by model, method and error type
+//   - <prefix>_request_duration_seconds: latency histogram, by model and method
+//   - <prefix>_tokens_total: token usage, by model, method and kind (prompt or completion)
+//
+// Wrapping several backends with the same registry and prefix shares the metrics.
+// Like prometheus.MustRegister, it panics if the metrics conflict with ones already
+// registered under the same names.
+//
+// To count every attempt made by WithRetry, wrap the retrying backend's inner backend;
+// to count logical requests, wrap the retrying backend itself.
+func WithMetrics(be Backend, registry *prometheus.Registry, opts ...MetricsOption) Backend {
+	cfg := &metricsConfig{prefix: defaultMetricsPrefix}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	labels := []string{"model", "method"}
+	m := &metricsBackend{
+		be:    be,
+		model: cfg.model,
+		requests: register(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: cfg.prefix + "_requests_total",
+			Help: "Number of LLM requests.",
+		}, labels)),
+		errors: register(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: cfg.prefix + "_errors_total",
+			Help: "Number of failed LLM requests by error type.",
+		}, append(labels, "type"))),
+		latency: register(registry, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    cfg.prefix + "_request_duration_seconds",
+			Help:    "Latency of LLM requests.",
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+		}, labels)),
+		tokens: register(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: cfg.prefix + "_tokens_total",
+			Help: "Number of tokens used by LLM requests.",
+		}, append(labels, "kind"))),
+	}
+	return m
+}
+
+// register registers c with registry, or returns the equivalent collector if it was already registered.
+func register[C prometheus.Collector](registry *prometheus.Registry, c C) C {
+	if err := registry.Register(c); err != nil {
+		var alreadyRegistered prometheus.AlreadyRegisteredError
+		if errors.As(err, &alreadyRegistered) {
+			if existing, ok := alreadyRegistered.ExistingCollector.(C); ok {
+				return existing
+			}
+		}
+		panic(err)
+	}
+	return c
+}
+
+// Chat implements Backend.
+func (m *metricsBackend) Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	start := time.Now()
+	resp, err := m.be.Chat(ctx, messages, tools, opts...)
+	m.record("chat", resp, err, time.Since(start))
+	return resp, err
+}
+
+// Generate implements Backend.
+func (m *metricsBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	start := time.Now()
+	resp, err := m.be.Generate(ctx, prompt, opts...)
+	m.record("generate", resp, err, time.Since(start))
+	return resp, err
+}
+
+// Close implements Backend by closing the wrapped backend.
+func (m *metricsBackend) Close() error {
+	return m.be.Close()
+}
+
+// ChatStream passes the request to the wrapped backend and records it once the
+// stream ends, using the usage reported in the last chunk.
+func (m *metricsBackend) ChatStream(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (<-chan StreamChunk, error) {
+	streamer, ok := m.be.(Streamer)
+	if !ok {
+		return nil, errors.New("backend does not support streaming")
+	}
+	start := time.Now()
+	chunks, err := streamer.ChatStream(ctx, messages, tools, opts...)
+	if err != nil {
+		m.record("chat_stream", nil, err, time.Since(start))
+		return nil, err
+	}
+	return observeStream(ctx, chunks, func(resp *Response, err error) {
+		m.record("chat_stream", resp, err, time.Since(start))
+	}), nil
+}
+
+// record updates the metrics for a finished request.
+func (m *metricsBackend) record(method string, resp *Response, err error, latency time.Duration) {
+	model := m.model
+	if model == "" {
+		model = "unknown"
+		if resp != nil && resp.Model != "" {
+			model = resp.Model
+		}
+	}
+
+	m.requests.WithLabelValues(model, method).Inc()
+	m.latency.WithLabelValues(model, method).Observe(latency.Seconds())
+	if err != nil {
+		m.errors.WithLabelValues(model, method, errorType(err)).Inc()
+		return
+	}
+	if resp != nil {
+		m.tokens.WithLabelValues(model, method, "prompt").Add(float64(resp.PromptEvalCount))
+		m.tokens.WithLabelValues(model, method, "completion").Add(float64(resp.EvalCount))
+	}
+}
+
+// errorType classifies err for the type label of the errors metric.
+func errorType(err error) string {
+	var backendErr *BackendError
+	var urlErr *url.Error
+	switch {
+	case errors.Is(err, ErrContextCanceled):
+		return "canceled"
+	case errors.Is(err, ErrRateLimited):
+		return "rate_limited"
+	case errors.Is(err, ErrModelNotFound):
+		return "model_not_found"
+	case errors.As(err, &backendErr):
+		return "backend"
+	case errors.As(err, &urlErr):
+		return "transport"
+	}
+	return "other"
+}
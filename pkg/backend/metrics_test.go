@@ -0,0 +1,123 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWithMetrics(t *testing.T) {
+	fail := false
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			if fail {
+				return nil, newBackendError(http.StatusTooManyRequests, "slow down")
+			}
+			return &Response{Model: "test-model", PromptEvalCount: 10, EvalCount: 5}, nil
+		},
+	}
+
+	registry := prometheus.NewRegistry()
+	measured := WithMetrics(be, registry, WithMetricsPrefix("test"), WithMetricsModel("test-model"))
+
+	for i := 0; i < 2; i++ {
+		if _, err := measured.Chat(context.Background(), []Message{UserMessage("Hi")}, nil); err != nil {
+			t.Fatalf("Chat returned error: %v", err)
+		}
+	}
+	fail = true
+	if _, err := measured.Generate(context.Background(), "Hi"); err == nil {
+		t.Fatalf("Expected an error")
+	}
+
+	m := measured.(*metricsBackend)
+	if got := testutil.ToFloat64(m.requests.WithLabelValues("test-model", "chat")); got != 2 {
+		t.Errorf("Expected 2 chat requests, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.errors.WithLabelValues("test-model", "generate", "rate_limited")); got != 1 {
+		t.Errorf("Expected 1 rate limited error, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.tokens.WithLabelValues("test-model", "chat", "prompt")); got != 20 {
+		t.Errorf("Expected 20 prompt tokens, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.tokens.WithLabelValues("test-model", "chat", "completion")); got != 10 {
+		t.Errorf("Expected 10 completion tokens, got %v", got)
+	}
+	if got := testutil.CollectAndCount(m.latency, "test_request_duration_seconds"); got != 2 {
+		t.Errorf("Expected latency series for chat and generate, got %d", got)
+	}
+}
+
+func TestWithMetricsSharesRegistry(t *testing.T) {
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return &Response{Model: "test-model"}, nil
+		},
+	}
+
+	// Wrapping twice with the same registry must not panic and must share the counters
+	registry := prometheus.NewRegistry()
+	first := WithMetrics(be, registry)
+	second := WithMetrics(WithRetry(be, DefaultRetryConfig()), registry)
+
+	first.Chat(context.Background(), nil, nil)
+	second.Chat(context.Background(), nil, nil)
+
+	if got := testutil.ToFloat64(first.(*metricsBackend).requests.WithLabelValues("test-model", "chat")); got != 2 {
+		t.Errorf("Expected 2 requests across both wrappers, got %v", got)
+	}
+}
+
+func TestWithMetricsChatStream(t *testing.T) {
+	be := &streamingFakeBackend{
+		stream: func(messages []Message) ([]StreamChunk, bool) {
+			return []StreamChunk{
+				{Content: "Hi"},
+				{Done: true, Response: &Response{Model: "test-model", PromptEvalCount: 4, EvalCount: 2}},
+			}, false
+		},
+	}
+
+	registry := prometheus.NewRegistry()
+	measured := WithMetrics(be, registry)
+	streamer, ok := measured.(Streamer)
+	if !ok {
+		t.Fatalf("Expected the wrapped backend to support streaming")
+	}
+	chunks, err := streamer.ChatStream(context.Background(), []Message{UserMessage("Hi")}, nil)
+	if err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+	var content string
+	for chunk := range chunks {
+		content += chunk.Content
+	}
+	if content != "Hi" {
+		t.Errorf("Expected the streamed content, got %q", content)
+	}
+
+	// The stream is recorded once its channel is closed
+	m := measured.(*metricsBackend)
+	if got := testutil.ToFloat64(m.requests.WithLabelValues("test-model", "chat_stream")); got != 1 {
+		t.Errorf("Expected 1 chat_stream request, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.tokens.WithLabelValues("test-model", "chat_stream", "completion")); got != 2 {
+		t.Errorf("Expected 2 completion tokens, got %v", got)
+	}
+}
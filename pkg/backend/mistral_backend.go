@@ -0,0 +1,183 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultMistralBaseURL = "https://api.mistral.ai"
+	mistralChatEndpoint   = "/v1/chat/completions"
+	mistralModelsEndpoint = "/v1/models"
+)
+
+// MistralBackend represents a backend for interacting with Mistral's La Plateforme API.
+// The API follows the OpenAI chat completions format, so requests and responses are
+// translated the same way as for OpenAIBackend.
+type MistralBackend struct {
+	APIKey     string
+	Model      string
+	HTTPClient *http.Client
+	BaseURL    string
+	// SystemPrompt is prepended to every conversation that has no system message.
+	SystemPrompt string
+	// RequestTimeout bounds every request. Zero means no limit other than the
+	// deadline of the context passed by the caller.
+	RequestTimeout time.Duration
+	// Headers are added to every request. They cannot replace the headers the
+	// backend sets itself, such as Content-Type and the API key.
+	Headers map[string]string
+	// UserAgent is sent in the User-Agent header of every request. Empty means
+	// DefaultUserAgent.
+	UserAgent string
+	// MaxRequestBytes is the size of the largest request body the backend sends.
+	// Zero means no limit.
+	MaxRequestBytes int
+	// Tokenizer counts the tokens of requests for the backend. Nil uses the
+	// counter EstimateTokens uses for the model.
+	Tokenizer Tokenizer
+	// UnsupportedOptions is what happens to call options the backend cannot
+	// honour, see WithUnsupportedOptions.
+	UnsupportedOptions UnsupportedOptionPolicy
+
+	// transport is the transport created for WithConnectionPool, if any.
+	transport *http.Transport
+}
+
+var (
+	_ Backend = (*MistralBackend)(nil)
+	_ Pinger  = (*MistralBackend)(nil)
+)
+
+// NewMistralBackend creates and returns a new MistralBackend instance.
+// It takes an API key and a Mistral model name, e.g. "mistral-large-latest",
+// followed by optional settings such as WithBaseURL or WithHTTPClient.
+func NewMistralBackend(apiKey, model string, opts ...Option) *MistralBackend {
+	o := newOptions(opts)
+
+	baseURL := defaultMistralBaseURL
+	if o.baseURL != "" {
+		baseURL = o.baseURL
+	}
+
+	client, transport := newHTTPClient(o, 0)
+
+	return &MistralBackend{
+		APIKey:             apiKey,
+		Model:              model,
+		HTTPClient:         client,
+		BaseURL:            baseURL,
+		SystemPrompt:       o.systemPrompt,
+		RequestTimeout:     o.timeout,
+		Headers:            o.headers,
+		UserAgent:          o.userAgent,
+		MaxRequestBytes:    o.maxBodyBytes,
+		Tokenizer:          o.tokenizer,
+		UnsupportedOptions: o.unsupported,
+		transport:          transport,
+	}
+}
+
+// Chat sends the conversation in messages to the Mistral chat completions endpoint
+// and returns the reply. Tools use the same definitions as for Ollama. Tool calls
+// requested by the model are available in the ToolCalls of the returned Message.
+func (m *MistralBackend) Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	ctx, cancel := withRequestTimeout(ctx, m.RequestTimeout)
+	defer cancel()
+
+	callOpts, err := newModelCallOptions(m.Model, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := callOpts.checkSupported("Mistral", m.UnsupportedOptions, ollamaOnlyOptions...); err != nil {
+		return nil, err
+	}
+
+	reqBody, err := openAIChatRequest(m.Model, m.SystemPrompt, m.Tokenizer, messages, tools, callOpts)
+	if err != nil {
+		return nil, err
+	}
+	// Mistral rejects unknown fields and calls the seed random_seed
+	if seed, ok := reqBody["seed"]; ok {
+		delete(reqBody, "seed")
+		reqBody["random_seed"] = seed
+	}
+	// Nor does it take the names of participants
+	oaMessages := reqBody["messages"].([]openAIMessage)
+	for i := range oaMessages {
+		oaMessages[i].Name = ""
+	}
+	if err := callOpts.dryRun(reqBody); err != nil {
+		return dryRunResponse(m.Model, err)
+	}
+
+	resp, err := postJSON(ctx, m.HTTPClient, m.BaseURL+mistralChatEndpoint, m.header(callOpts.Headers), reqBody, m.MaxRequestBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate response from Mistral: %w", err)
+	}
+
+	var result OpenAIResponse
+	if err := decodeResponse(ctx, resp, &result, callOpts); err != nil {
+		return nil, err
+	}
+
+	return result.toResponse(mistralFinishReasons)
+}
+
+// mistralFinishReasons maps the finish reasons of Mistral to the Finish constants.
+var mistralFinishReasons = map[string]string{
+	"stop":         FinishStop,
+	"length":       FinishLength,
+	"model_length": FinishLength,
+	"tool_calls":   FinishToolCalls,
+}
+
+// Generate produces a response from the Mistral API based on the given prompt.
+// The prompt is sent as a single user message to the chat completions endpoint.
+func (m *MistralBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	return m.Chat(ctx, []Message{UserMessage(prompt)}, nil, opts...)
+}
+
+// Close implements Backend. It works as OpenAIBackend.Close does.
+func (m *MistralBackend) Close() error {
+	return closeTransport(m.transport)
+}
+
+// Ping checks that the Mistral API is reachable and accepts the API key by listing
+// the available models, which costs no tokens. It returns an error matching
+// ErrUnreachable if the server cannot be reached.
+func (m *MistralBackend) Ping(ctx context.Context) error {
+	ctx, cancel := withRequestTimeout(ctx, m.RequestTimeout)
+	defer cancel()
+
+	resp, err := getJSON(ctx, m.HTTPClient, m.BaseURL+mistralModelsEndpoint, m.header(nil))
+	if err != nil {
+		return fmt.Errorf("failed to ping Mistral: %w", unreachableError(m.BaseURL, err))
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// header returns the headers that authenticate a request with the API key, on top
+// of the custom headers, including callHeaders set for the call.
+func (m *MistralBackend) header(callHeaders map[string]string) http.Header {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+m.APIKey)
+	return requestHeader(header, m.UserAgent, m.Headers, callHeaders)
+}
@@ -0,0 +1,146 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMistralChat(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != mistralChatEndpoint {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer test-api-key" {
+			t.Errorf("Expected bearer authorization, got %s", r.Header.Get("Authorization"))
+		}
+
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"id": "cmpl-1",
+			"model": "mistral-large-latest",
+			"created": 1700000000,
+			"choices": [{
+				"index": 0,
+				"message": {
+					"role": "assistant",
+					"content": "",
+					"tool_calls": [{"id": "abc123", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\": \"Lyon\"}"}}]
+				},
+				"finish_reason": "tool_calls"
+			}],
+			"usage": {"prompt_tokens": 20, "completion_tokens": 9, "total_tokens": 29}
+		}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewMistralBackend("test-api-key", "mistral-large-latest",
+		WithBaseURL(mockServer.URL), WithSystemPrompt("You are a weather bot."))
+	tools := []Tool{{
+		"type": "function",
+		"function": map[string]any{
+			"name":       "get_weather",
+			"parameters": map[string]any{"type": "object"},
+		},
+	}}
+
+	response, err := backend.Chat(context.Background(), []Message{UserMessage("Weather in Lyon?")}, tools, WithSeed(7), WithTemperature(0.1))
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+
+	reqBody := <-received
+	if reqBody["model"] != "mistral-large-latest" || reqBody["temperature"] != 0.1 {
+		t.Errorf("Unexpected request: %v", reqBody)
+	}
+	if _, ok := reqBody["seed"]; ok || reqBody["random_seed"] != float64(7) {
+		t.Errorf("Expected the seed as random_seed, got %v", reqBody)
+	}
+	if messages, _ := reqBody["messages"].([]any); len(messages) != 2 {
+		t.Errorf("Expected the system prompt and the user message, got %v", reqBody["messages"])
+	}
+	if reqBody["tool_choice"] != "auto" {
+		t.Errorf("Expected tool_choice auto, got %v", reqBody["tool_choice"])
+	}
+
+	if !response.UsageAvailable || response.Usage.PromptTokens != 20 || response.Usage.CompletionTokens != 9 {
+		t.Errorf("Unexpected usage: %+v", response.Usage)
+	}
+	if response.FinishReason != FinishToolCalls {
+		t.Errorf("Expected finish reason %s, got %s", FinishToolCalls, response.FinishReason)
+	}
+	if len(response.Message.ToolCalls) != 1 {
+		t.Fatalf("Expected 1 tool call, got %d", len(response.Message.ToolCalls))
+	}
+	if call := response.Message.ToolCalls[0]; call.ID != "abc123" || call.Function.Arguments["city"] != "Lyon" {
+		t.Errorf("Unexpected tool call: %+v", call)
+	}
+}
+
+func TestMistralModelLength(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "Once upon"}, "finish_reason": "model_length"}]}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewMistralBackend("test-api-key", "open-mistral-7b", WithBaseURL(mockServer.URL))
+	response, err := backend.Generate(context.Background(), "Tell me a story.")
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if response.Response != "Once upon" || !response.Truncated || response.FinishReason != FinishLength {
+		t.Errorf("Expected a truncated response, got %+v", response)
+	}
+}
+
+func TestMistralChatError(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "Unauthorized"}`, http.StatusUnauthorized)
+	}))
+	defer mockServer.Close()
+
+	backend := NewMistralBackend("bad-key", "mistral-small-latest", WithBaseURL(mockServer.URL))
+	_, err := backend.Generate(context.Background(), "Hi")
+	var backendErr *BackendError
+	if !errors.As(err, &backendErr) || backendErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a BackendError with status 401, got %v", err)
+	}
+	if err := backend.Ping(context.Background()); !errors.As(err, &backendErr) {
+		t.Errorf("Expected Ping to fail with a BackendError, got %v", err)
+	}
+}
+
+func TestMistralDropsMessageNames(t *testing.T) {
+	backend := NewMistralBackend("test-api-key", "mistral-large-latest")
+	resp, err := backend.Chat(context.Background(), []Message{NamedUserMessage("alice", "Hi")}, nil, WithDryRun())
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if strings.Contains(string(resp.DryRunRequest), "alice") {
+		t.Errorf("Expected the name not to be sent, got %s", resp.DryRunRequest)
+	}
+}
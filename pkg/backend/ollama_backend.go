@@ -15,19 +15,26 @@
 package backend
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	generateEndpoint = "/api/generate"
-	embedEndpoint    = "/api/embeddings"
-	defaultTimeout   = 30 * time.Second
+	generateEndpoint   = "/api/generate"
+	chatEndpoint       = "/api/chat"
+	embedEndpoint      = "/api/embeddings"
+	embedBatchEndpoint = "/api/embed"
+	defaultTimeout     = 30 * time.Second
+
+	// ollamaBasePath is the prefix of the endpoints above, which BasePath replaces.
+	ollamaBasePath = "/api"
 )
 
 // OllamaBackend represents a backend for interacting with the Ollama API.
@@ -36,23 +43,41 @@ type OllamaBackend struct {
 	Model   string
 	Client  *http.Client
 	BaseURL string
-}
+	// BasePath is the path under BaseURL at which the API is served. Empty
+	// means "/api", where Ollama serves it unless a reverse proxy moves it.
+	BasePath string
+	// SystemPrompt is prepended to every conversation that has no system message.
+	SystemPrompt string
+	// RequestTimeout bounds every request that is not streamed. Zero means no limit
+	// other than the deadline of the context passed by the caller.
+	RequestTimeout time.Duration
+	// StreamIdleTimeout aborts a stream once no data arrived for that long, see
+	// WithStreamIdleTimeout. Zero means streams may stay silent indefinitely.
+	StreamIdleTimeout time.Duration
+	// Headers are added to every request. They cannot replace the headers the
+	// backend sets itself, such as Content-Type and the API key.
+	Headers map[string]string
+	// UserAgent is sent in the User-Agent header of every request. Empty means
+	// DefaultUserAgent.
+	UserAgent string
+	// MaxRequestBytes is the size of the largest request body the backend sends.
+	// Zero means no limit.
+	MaxRequestBytes int
+	// Tokenizer counts the tokens of requests for the backend. Nil uses the
+	// counter EstimateTokens uses for the model.
+	Tokenizer Tokenizer
+	// UnsupportedOptions is what happens to call options the backend cannot
+	// honour, see WithUnsupportedOptions.
+	UnsupportedOptions UnsupportedOptionPolicy
+
+	// transport is the transport created for WithConnectionPool, if any.
+	transport *http.Transport
+	// EmbeddingModel generates the embeddings instead of Model, if set. It is
+	// checked to be available on the server before it is first used.
+	EmbeddingModel string
 
-// Response represents the structure of the response received from the Ollama API.
-// It contains information about the generated content, model details, and performance metrics.
-type Response struct {
-	Model              string `json:"model"`
-	CreatedAt          string `json:"created_at"`
-	Response           string `json:"response"`
-	Done               bool   `json:"done"`
-	DoneReason         string `json:"done_reason"`
-	Context            []int  `json:"context"`
-	TotalDuration      int64  `json:"total_duration"`
-	LoadDuration       int64  `json:"load_duration"`
-	PromptEvalCount    int    `json:"prompt_eval_count"`
-	PromptEvalDuration int64  `json:"prompt_eval_duration"`
-	EvalCount          int    `json:"eval_count"`
-	EvalDuration       int64  `json:"eval_duration"`
+	// verifiedEmbeddingModel is the EmbeddingModel found on the server.
+	verifiedEmbeddingModel atomic.Pointer[string]
 }
 
 // OllamaEmbeddingResponse represents the structure of the response received from the Ollama API for embeddings.
@@ -60,92 +85,484 @@ type OllamaEmbeddingResponse struct {
 	Embedding []float32 `json:"embedding"`
 }
 
+// EmbeddingResult holds the embeddings generated for a batch of inputs.
+type EmbeddingResult struct {
+	// Model is the model that generated the embeddings.
+	Model string `json:"model"`
+	// Embeddings holds one vector per input, in the order of the inputs.
+	Embeddings [][]float32 `json:"embeddings"`
+	// Dimensions is the length of each vector, useful for sizing a vector store.
+	Dimensions int `json:"-"`
+}
+
+var (
+	_ Backend  = (*OllamaBackend)(nil)
+	_ Streamer = (*OllamaBackend)(nil)
+)
+
 // NewOllamaBackend creates and returns a new OllamaBackend instance.
-// It takes a base URL and a model name as parameters.
-func NewOllamaBackend(baseURL, model string) *OllamaBackend {
+// It takes a base URL and a model name as parameters, followed by optional settings.
+// Unless WithHTTPClient is given, requests use a client with a 30 second timeout.
+//
+// The base URL may include the path of the API, as in
+// http://proxy.example.com/ollama/api, in which case it is used as the base path
+// unless WithBasePath is given.
+func NewOllamaBackend(baseURL, model string, opts ...Option) *OllamaBackend {
+	o := newOptions(opts)
+
+	if o.baseURL != "" {
+		baseURL = o.baseURL
+	}
+	baseURL = strings.TrimRight(baseURL, "/")
+	basePath := ""
+	if trimmed, ok := strings.CutSuffix(baseURL, ollamaBasePath); ok {
+		baseURL, basePath = trimmed, ollamaBasePath
+	}
+	if o.basePath != "" {
+		basePath = "/" + strings.Trim(o.basePath, "/")
+	}
+
+	client, transport := newHTTPClient(o, defaultTimeout)
+
 	return &OllamaBackend{
-		BaseURL: baseURL,
-		Model:   model,
-		Client: &http.Client{
-			Timeout: defaultTimeout,
-		},
+		BaseURL:            baseURL,
+		BasePath:           basePath,
+		Model:              model,
+		Client:             client,
+		SystemPrompt:       o.systemPrompt,
+		RequestTimeout:     o.timeout,
+		StreamIdleTimeout:  o.streamIdleTimeout,
+		Headers:            o.headers,
+		UserAgent:          o.userAgent,
+		MaxRequestBytes:    o.maxBodyBytes,
+		Tokenizer:          o.tokenizer,
+		UnsupportedOptions: o.unsupported,
+		EmbeddingModel:     o.embedModel,
+		transport:          transport,
 	}
 }
 
 // Generate produces a response from the Ollama API based on the given prompt.
 // It sends a request to the Ollama generate endpoint and returns the response.
-func (o *OllamaBackend) Generate(ctx context.Context, prompt string) (*Response, error) {
-	url := o.BaseURL + generateEndpoint
+func (o *OllamaBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	ctx, cancel := withRequestTimeout(ctx, o.RequestTimeout)
+	defer cancel()
+
 	reqBody := map[string]interface{}{
 		"model":  o.Model,
 		"prompt": prompt,
 		"stream": false,
 	}
-
-	reqBodyBytes, err := json.Marshal(reqBody)
+	callOpts, err := newModelCallOptions(o.Model, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+		return nil, err
+	}
+	messages := []Message{UserMessage(prompt)}
+	if callOpts.Raw {
+		reqBody["raw"] = true
+	} else {
+		messages, err = callOpts.withContextDocuments(o.Model, o.Tokenizer, withSystemPrompt(o.SystemPrompt, messages))
+		if err != nil {
+			return nil, err
+		}
+		system, prompt := splitPrompt(messages)
+		if system != "" {
+			reqBody["system"] = system
+		}
+		reqBody["prompt"] = prompt
+	}
+	if err := callOpts.checkContext(o.Model, o.Tokenizer, messages); err != nil {
+		return nil, err
+	}
+	applyOllamaOptions(reqBody, callOpts)
+	if err := callOpts.dryRun(reqBody); err != nil {
+		return dryRunResponse(o.Model, err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(reqBodyBytes))
+	resp, err := o.post(ctx, generateEndpoint, o.header(callOpts.Headers), reqBody)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to generate response from Ollama: %w", err)
+	}
+
+	var result Response
+	if err := decodeResponse(ctx, resp, &result, callOpts); err != nil {
+		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	completeOllamaResponse(&result)
+	result.separateReasoning()
+
+	return &result, nil
+}
 
-	resp, err := o.Client.Do(req)
+// Close implements Backend. It closes the idle connections of the pool created for
+// WithConnectionPool, if any; an HTTP client given with WithHTTPClient belongs to
+// the caller.
+func (o *OllamaBackend) Close() error {
+	return closeTransport(o.transport)
+}
+
+// Chat sends the conversation in messages to the Ollama chat endpoint and returns the reply.
+// Any tool calls requested by the model are available in the ToolCalls of the returned Message.
+func (o *OllamaBackend) Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	ctx, cancel := withRequestTimeout(ctx, o.RequestTimeout)
+	defer cancel()
+
+	callOpts, err := newModelCallOptions(o.Model, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := callOpts.checkSupported("Ollama", o.UnsupportedOptions, rawOption); err != nil {
+		return nil, err
+	}
+	reqBody, err := o.chatRequest(messages, tools, false, callOpts)
 	if err != nil {
-		return nil, fmt.Errorf("HTTP request failed: %w", err)
+		return nil, err
+	}
+	if err := callOpts.dryRun(reqBody); err != nil {
+		return dryRunResponse(o.Model, err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to generate response from Ollama: status code %d, response: %s", resp.StatusCode, string(bodyBytes))
+	resp, err := o.post(ctx, chatEndpoint, o.header(callOpts.Headers), reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to chat with Ollama: %w", err)
 	}
 
 	var result Response
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	if err := decodeResponse(ctx, resp, &result, callOpts); err != nil {
+		return nil, err
 	}
+	completeOllamaResponse(&result)
+	result.separateReasoning()
 
 	return &result, nil
 }
 
-// Embed generates embeddings for the given input text using the Ollama API.
+// ChatStream works like Chat but streams the reply as it is generated.
+// The returned channel receives the content deltas in order and is closed when
+// the stream completes, fails or ctx is cancelled. A failure while reading the
+// stream is delivered as a final chunk with Err set. Tool calls requested by the
+// model are delivered with the final chunk.
+//
+// The overall Timeout of the HTTP client is not applied to streams, because it
+// also covers reading the body and would cut off long generations. Use ctx to
+// bound the duration of a stream. Once ctx is done the connection is closed and
+// the goroutine feeding the channel exits; callers that stop reading early must
+// cancel ctx to release it.
+func (o *OllamaBackend) ChatStream(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (<-chan StreamChunk, error) {
+	streamClient := *o.Client
+	streamClient.Timeout = 0
+
+	callOpts, err := newModelCallOptions(o.Model, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := callOpts.checkSupported("Ollama", o.UnsupportedOptions, rawOption); err != nil {
+		return nil, err
+	}
+	reqBody, err := o.chatRequest(messages, tools, true, callOpts)
+	if err != nil {
+		return nil, err
+	}
+	if err := callOpts.dryRun(reqBody); err != nil {
+		return dryRunStream(o.Model, err)
+	}
+
+	resp, err := postJSON(ctx, &streamClient, o.url(chatEndpoint), o.header(callOpts.Headers), reqBody, o.MaxRequestBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to chat with Ollama: %w", err)
+	}
+
+	resp.Body = idleTimeoutBody(resp.Body, o.StreamIdleTimeout)
+	return streamChunks(ctx, resp.Body, callOpts.StopOnDelta, func(send func(StreamChunk) bool) {
+		// Ollama streams one JSON object per line. Tool calls arrive complete,
+		// so they are delivered right away, but not necessarily with the last
+		// line, so they are collected too.
+		var toolCalls []ToolCall
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var part Response
+			if err := decoder.Decode(&part); err != nil {
+				send(StreamChunk{Err: contextError(ctx, fmt.Errorf("failed to decode stream: %w", err))})
+				return
+			}
+			for _, call := range part.Message.ToolCalls {
+				if !send(StreamChunk{ToolCallReady: &call}) {
+					return
+				}
+			}
+			toolCalls = append(toolCalls, part.Message.ToolCalls...)
+
+			chunk := StreamChunk{Content: part.Message.Content, Done: part.Done}
+			if part.Done {
+				chunk.ToolCalls = toolCalls
+				completeOllamaResponse(&part)
+				chunk.Usage, chunk.UsageAvailable = part.Usage, part.UsageAvailable
+				chunk.Response = &part
+			}
+			if !send(chunk) || part.Done {
+				return
+			}
+		}
+	}), nil
+}
+
+// ChatToWriter streams the reply to the conversation in messages and writes the content
+// to w as it arrives. It returns the complete reply once the stream ends; see the
+// package-level ChatToWriter for details.
+func (o *OllamaBackend) ChatToWriter(ctx context.Context, messages []Message, tools []Tool, w io.Writer, opts ...CallOption) (*Response, error) {
+	return ChatToWriter(ctx, o, messages, tools, w, opts...)
+}
+
+// chatRequest builds the body of a request to the chat endpoint.
+func (o *OllamaBackend) chatRequest(messages []Message, tools []Tool, stream bool, callOpts *Options) (map[string]interface{}, error) {
+	if err := callOpts.checkTools(tools); err != nil {
+		return nil, err
+	}
+
+	// The prompt templates of many models only render a single system message
+	messages, err := callOpts.withContextDocuments(o.Model, o.Tokenizer, withSystemPrompt(o.SystemPrompt, messages))
+	if err != nil {
+		return nil, err
+	}
+	messages = combineSystemMessages(messages)
+	if choice := callOpts.ToolChoice; choice != nil && len(tools) > 0 {
+		// Ollama has no tool_choice, so only the chosen tool is advertised
+		tools, messages = ollamaToolChoice(choice, tools, messages)
+	}
+	if err := callOpts.checkContext(o.Model, o.Tokenizer, messages); err != nil {
+		return nil, err
+	}
+
+	reqBody := map[string]interface{}{
+		"model":    o.Model,
+		"messages": messages,
+		"stream":   stream,
+	}
+	if len(tools) > 0 {
+		reqBody["tools"] = tools
+	}
+	applyOllamaOptions(reqBody, callOpts)
+	return reqBody, nil
+}
+
+// ollamaToolChoice returns the tools and messages to send to honour choice. With
+// no tool chosen, no tools are sent. Otherwise only the chosen tool is sent and an
+// instruction to call it is added to the first system message of messages, which
+// must already be combined, or sent as a system message of its own before them.
+func ollamaToolChoice(choice *ToolChoice, tools []Tool, messages []Message) ([]Tool, []Message) {
+	if choice.Name == "" {
+		return nil, messages
+	}
+
+	instruction := fmt.Sprintf("You must call the tool %s to answer.", choice.Name)
+	for i, msg := range messages {
+		if msg.Role == RoleSystem {
+			out := slices.Clone(messages)
+			out[i].Content = joinContent(msg.Content, instruction)
+			return chosenTools(choice, tools), out
+		}
+	}
+	return chosenTools(choice, tools), append([]Message{SystemMessage(instruction)}, messages...)
+}
+
+// completeOllamaResponse fills in the backend-neutral fields of resp from the
+// metrics and done reason Ollama reports with the final response.
+func completeOllamaResponse(resp *Response) {
+	resp.local = true
+	if resp.Done {
+		resp.setUsage(resp.PromptEvalCount, resp.EvalCount, time.Duration(resp.TotalDuration))
+		resp.Truncated = resp.DoneReason == "length"
+		resp.setFinishReason(resp.DoneReason, ollamaFinishReasons)
+	}
+}
+
+// ollamaFinishReasons maps the done reasons of Ollama to the Finish constants.
+var ollamaFinishReasons = map[string]string{
+	"stop":   FinishStop,
+	"length": FinishLength,
+}
+
+// applyOllamaOptions adds the request options to the body of a chat or generate request.
+// Sampling parameters go into the "options" object of the request.
+func applyOllamaOptions(reqBody map[string]interface{}, opts *Options) {
+	if opts.JSONFormat {
+		reqBody["format"] = "json"
+	}
+	if opts.ResponseSchema != nil {
+		reqBody["format"] = opts.ResponseSchema
+	}
+	if opts.KeepAlive != nil {
+		reqBody["keep_alive"] = ollamaKeepAlive(*opts.KeepAlive)
+	}
+
+	modelOptions := map[string]interface{}{}
+	if opts.Temperature != nil {
+		modelOptions["temperature"] = *opts.Temperature
+	}
+	if opts.TopP != nil {
+		modelOptions["top_p"] = *opts.TopP
+	}
+	if len(opts.StopSequences) > 0 {
+		modelOptions["stop"] = opts.StopSequences
+	}
+	if opts.Seed != nil {
+		modelOptions["seed"] = *opts.Seed
+	}
+	if opts.MaxTokens != nil {
+		modelOptions["num_predict"] = *opts.MaxTokens
+	}
+	if opts.Mirostat != nil {
+		modelOptions["mirostat"] = *opts.Mirostat
+	}
+	if opts.MirostatTau != nil {
+		modelOptions["mirostat_tau"] = *opts.MirostatTau
+	}
+	if opts.MirostatEta != nil {
+		modelOptions["mirostat_eta"] = *opts.MirostatEta
+	}
+	if opts.RepeatPenalty != nil {
+		modelOptions["repeat_penalty"] = *opts.RepeatPenalty
+	}
+	if opts.TFSZ != nil {
+		modelOptions["tfs_z"] = *opts.TFSZ
+	}
+	for key, value := range opts.ModelOptions {
+		modelOptions[key] = value
+	}
+	if len(modelOptions) > 0 {
+		reqBody["options"] = modelOptions
+	}
+}
+
+// ollamaKeepAlive translates d into the keep_alive of a request. Ollama takes
+// a negative number to keep the model loaded and zero to unload it immediately.
+func ollamaKeepAlive(d time.Duration) any {
+	switch {
+	case d < 0:
+		return -1
+	case d == 0:
+		return 0
+	}
+	return d.String()
+}
+
+// embeddingModel returns the model that generates embeddings, EmbeddingModel or
+// else Model. The first time EmbeddingModel is used, it fails with an error
+// matching ErrModelNotFound if the model is not available on the server, rather
+// than with the less obvious error Ollama replies with.
+func (o *OllamaBackend) embeddingModel(ctx context.Context) (string, error) {
+	model := o.EmbeddingModel
+	if model == "" {
+		return o.Model, nil
+	}
+	if verified := o.verifiedEmbeddingModel.Load(); verified != nil && *verified == model {
+		return model, nil
+	}
+
+	exists, err := o.ModelExists(ctx, model)
+	if err != nil {
+		return "", fmt.Errorf("failed to check embedding model %s: %w", model, err)
+	}
+	if !exists {
+		return "", fmt.Errorf("embedding model %s: %w", model, ErrModelNotFound)
+	}
+	o.verifiedEmbeddingModel.Store(&model)
+	return model, nil
+}
+
+// Embed generates embeddings for the given input text using the Ollama API,
+// with the EmbeddingModel if set. It returns an error matching
+// ErrEmbeddingsNotSupported if the model cannot generate embeddings.
 func (o *OllamaBackend) Embed(ctx context.Context, input string) ([]float32, error) {
-	url := o.BaseURL + embedEndpoint
+	ctx, cancel := withRequestTimeout(ctx, o.RequestTimeout)
+	defer cancel()
+
+	model, err := o.embeddingModel(ctx)
+	if err != nil {
+		return nil, err
+	}
 	reqBody := map[string]interface{}{
-		"model":  o.Model,
+		"model":  model,
 		"prompt": input,
 	}
 
-	reqBodyBytes, err := json.Marshal(reqBody)
+	resp, err := o.post(ctx, embedEndpoint, o.header(nil), reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate embeddings from Ollama: %w", embeddingError(err))
+	}
+
+	var result OllamaEmbeddingResponse
+	if err := decodeJSON(ctx, resp, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Embedding) == 0 {
+		return nil, fmt.Errorf("model %s returned no embedding: %w", model, ErrEmbeddingsNotSupported)
+	}
+
+	return result.Embedding, nil
+}
+
+// EmbedBatch generates embeddings for several inputs in a single request.
+// The returned vectors are in the order of the inputs.
+func (o *OllamaBackend) EmbedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	result, err := o.Embeddings(ctx, inputs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+		return nil, err
 	}
+	return result.Embeddings, nil
+}
+
+// Embeddings works like EmbedBatch but also reports the model and the dimensionality of the vectors.
+// It returns an error matching ErrEmbeddingsNotSupported if the model cannot generate embeddings.
+func (o *OllamaBackend) Embeddings(ctx context.Context, inputs []string) (*EmbeddingResult, error) {
+	ctx, cancel := withRequestTimeout(ctx, o.RequestTimeout)
+	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(reqBodyBytes))
+	model, err := o.embeddingModel(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, err
+	}
+	reqBody := map[string]interface{}{
+		"model": model,
+		"input": inputs,
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := o.Client.Do(req)
+	resp, err := o.post(ctx, embedBatchEndpoint, o.header(nil), reqBody)
 	if err != nil {
-		return nil, fmt.Errorf("HTTP request failed: %w", err)
+		return nil, fmt.Errorf("failed to generate embeddings from Ollama: %w", embeddingError(err))
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to generate embeddings from Ollama: status code %d, response: %s", resp.StatusCode, string(bodyBytes))
+	var result EmbeddingResult
+	if err := decodeJSON(ctx, resp, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Embeddings) != len(inputs) {
+		return nil, fmt.Errorf("expected %d embeddings from Ollama, got %d", len(inputs), len(result.Embeddings))
+	}
+	if len(result.Embeddings) > 0 {
+		result.Dimensions = len(result.Embeddings[0])
+		if result.Dimensions == 0 {
+			return nil, fmt.Errorf("model %s returned no embedding: %w", model, ErrEmbeddingsNotSupported)
+		}
 	}
 
-	var result OllamaEmbeddingResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	return &result, nil
+}
+
+// post sends body to the given Ollama API endpoint with the given headers.
+func (o *OllamaBackend) post(ctx context.Context, endpoint string, header http.Header, body any) (*http.Response, error) {
+	return postJSON(ctx, o.Client, o.url(endpoint), header, body, o.MaxRequestBytes)
+}
+
+// url returns the URL of the API endpoint, moved under BasePath if it is set.
+func (o *OllamaBackend) url(endpoint string) string {
+	if o.BasePath == "" {
+		return o.BaseURL + endpoint
 	}
+	return o.BaseURL + strings.TrimRight(o.BasePath, "/") + strings.TrimPrefix(endpoint, ollamaBasePath)
+}
 
-	return result.Embedding, nil
+// header returns the custom headers of a request, including callHeaders set for the call.
+func (o *OllamaBackend) header(callHeaders map[string]string) http.Header {
+	return requestHeader(nil, o.UserAgent, o.Headers, callHeaders)
 }
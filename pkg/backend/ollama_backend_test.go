@@ -16,8 +16,11 @@ package backend
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -156,3 +159,1091 @@ func TestOllamaEmbed(t *testing.T) {
 		}
 	}
 }
+
+func TestOllamaChat(t *testing.T) {
+	// Mock response from Ollama API, including a tool call
+	mockResponse := Response{
+		Model: "test-model",
+		Message: Message{
+			Role: "assistant",
+			ToolCalls: []ToolCall{
+				{
+					Function: FunctionCall{
+						Name:      "get_weather",
+						Arguments: map[string]any{"city": "Brno"},
+					},
+				},
+			},
+		},
+		Done: true,
+	}
+
+	// Create a mock server to simulate the Ollama API
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Validate the request
+		if r.Method != http.MethodPost || r.URL.Path != chatEndpoint {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+
+		// Decode the request body
+		var reqBody struct {
+			Model    string    `json:"model"`
+			Messages []Message `json:"messages"`
+			Tools    []Tool    `json:"tools"`
+			Stream   bool      `json:"stream"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+
+		if reqBody.Model != "test-model" {
+			t.Errorf("Expected model 'test-model', got '%v'", reqBody.Model)
+		}
+		if len(reqBody.Messages) != 1 || reqBody.Messages[0].Content != "What's the weather in Brno?" {
+			t.Errorf("Unexpected messages: %v", reqBody.Messages)
+		}
+		if len(reqBody.Tools) != 1 {
+			t.Errorf("Expected 1 tool, got %d", len(reqBody.Tools))
+		}
+		if reqBody.Stream {
+			t.Errorf("Expected stream false")
+		}
+
+		// Write the mock response
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mockResponse)
+	}))
+	defer mockServer.Close()
+
+	// Assign to the interface to make sure OllamaBackend implements it
+	var backend Backend = &OllamaBackend{
+		Model:   "test-model",
+		Client:  mockServer.Client(),
+		BaseURL: mockServer.URL,
+	}
+
+	messages := []Message{{Role: "user", Content: "What's the weather in Brno?"}}
+	tools := []Tool{
+		{
+			"type": "function",
+			"function": map[string]any{
+				"name": "get_weather",
+			},
+		},
+	}
+
+	response, err := backend.Chat(context.Background(), messages, tools)
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+
+	// Validate the response
+	if len(response.Message.ToolCalls) != 1 {
+		t.Fatalf("Expected 1 tool call, got %d", len(response.Message.ToolCalls))
+	}
+	call := response.Message.ToolCalls[0]
+	if call.Function.Name != "get_weather" {
+		t.Errorf("Expected function get_weather, got %s", call.Function.Name)
+	}
+	if call.Function.Arguments["city"] != "Brno" {
+		t.Errorf("Expected city argument Brno, got %v", call.Function.Arguments["city"])
+	}
+}
+
+func TestOllamaChatStream(t *testing.T) {
+	parts := []Response{
+		{Model: "test-model", Message: Message{Role: "assistant", Content: "Hello"}},
+		{Model: "test-model", Message: Message{Role: "assistant", Content: ", world"}},
+		{Model: "test-model", Message: Message{Role: "assistant"}, Done: true, DoneReason: "stop", PromptEvalCount: 8, EvalCount: 3, TotalDuration: 1500},
+	}
+
+	// Create a mock server that streams newline delimited JSON
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if reqBody["stream"] != true {
+			t.Errorf("Expected stream true, got '%v'", reqBody["stream"])
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		for _, part := range parts {
+			encoder.Encode(part)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer mockServer.Close()
+
+	backend := &OllamaBackend{
+		Model:   "test-model",
+		Client:  mockServer.Client(),
+		BaseURL: mockServer.URL,
+	}
+
+	chunks, err := backend.ChatStream(context.Background(), []Message{{Role: "user", Content: "Hi"}}, nil)
+	if err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+
+	var content string
+	var last StreamChunk
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			t.Fatalf("Unexpected stream error: %v", chunk.Err)
+		}
+		content += chunk.Content
+		last = chunk
+	}
+
+	if content != "Hello, world" {
+		t.Errorf("Expected content 'Hello, world', got '%s'", content)
+	}
+	if !last.Done {
+		t.Errorf("Expected the last chunk to be done")
+	}
+	if !last.UsageAvailable || last.Usage.PromptTokens != 8 || last.Usage.CompletionTokens != 3 || last.Usage.TotalDuration != 1500 {
+		t.Errorf("Expected the usage on the last chunk, got %+v", last.Usage)
+	}
+
+	resp := last.Response
+	if resp == nil {
+		t.Fatalf("Expected the complete reply on the last chunk")
+	}
+	if resp.Model != "test-model" || resp.Message.Role != RoleAssistant || resp.Message.Content != "Hello, world" {
+		t.Errorf("Unexpected reply: %+v", resp)
+	}
+	if resp.FinishReason != FinishStop || !resp.UsageAvailable || resp.Usage.PromptTokens != 8 {
+		t.Errorf("Expected the finish reason and usage in the reply, got %+v", resp)
+	}
+}
+
+func TestOllamaChatStreamDecodeError(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":{"content":"partial"}}` + "\n" + `{not json`))
+	}))
+	defer mockServer.Close()
+
+	backend := &OllamaBackend{
+		Model:   "test-model",
+		Client:  mockServer.Client(),
+		BaseURL: mockServer.URL,
+	}
+
+	chunks, err := backend.ChatStream(context.Background(), []Message{{Role: "user", Content: "Hi"}}, nil)
+	if err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+
+	var last StreamChunk
+	for chunk := range chunks {
+		last = chunk
+	}
+	if last.Err == nil {
+		t.Errorf("Expected the final chunk to carry a decode error")
+	}
+}
+
+// headerTransport is a RoundTripper that adds a header to every request.
+type headerTransport struct {
+	key, value string
+}
+
+func (h *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(h.key, h.value)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestNewOllamaBackendWithHTTPClient(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Trace-Id") != "trace-123" {
+			t.Errorf("Expected X-Trace-Id trace-123, got %s", r.Header.Get("X-Trace-Id"))
+		}
+		json.NewEncoder(w).Encode(Response{Response: "ok", Done: true})
+	}))
+	defer mockServer.Close()
+
+	client := &http.Client{Transport: &headerTransport{key: "X-Trace-Id", value: "trace-123"}}
+	backend := NewOllamaBackend(mockServer.URL, "test-model", WithHTTPClient(client))
+	if backend.Client != client {
+		t.Fatalf("Expected the supplied client to be used")
+	}
+
+	if _, err := backend.Generate(context.Background(), "Hello"); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+
+	// Without the option the default client is kept
+	if NewOllamaBackend(mockServer.URL, "test-model").Client.Timeout != defaultTimeout {
+		t.Errorf("Expected the default client to have a %v timeout", defaultTimeout)
+	}
+}
+
+func TestOllamaChatStreamOutlivesClientTimeout(t *testing.T) {
+	// Each part arrives well within the client timeout, but the whole stream takes longer
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoder := json.NewEncoder(w)
+		for i := 0; i < 4; i++ {
+			time.Sleep(50 * time.Millisecond)
+			encoder.Encode(Response{Message: Message{Content: "."}})
+			w.(http.Flusher).Flush()
+		}
+		encoder.Encode(Response{Done: true})
+	}))
+	defer mockServer.Close()
+
+	client := mockServer.Client()
+	client.Timeout = 100 * time.Millisecond
+	backend := NewOllamaBackend(mockServer.URL, "test-model", WithHTTPClient(client))
+
+	chunks, err := backend.ChatStream(context.Background(), []Message{{Role: "user", Content: "Hi"}}, nil)
+	if err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+
+	var content string
+	var done bool
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			t.Fatalf("Unexpected stream error: %v", chunk.Err)
+		}
+		content += chunk.Content
+		done = chunk.Done
+	}
+
+	if content != "...." || !done {
+		t.Errorf("Expected the full stream, got '%s' (done %v)", content, done)
+	}
+	if client.Timeout != 100*time.Millisecond {
+		t.Errorf("Expected the supplied client to be left untouched")
+	}
+}
+
+func TestOllamaChatStreamContextCanceled(t *testing.T) {
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Response{Message: Message{Content: "Hello"}})
+		w.(http.Flusher).Flush()
+		// Keep the stream open until the client goes away
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer mockServer.Close()
+	defer close(release)
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	chunks, err := backend.ChatStream(ctx, []Message{{Role: "user", Content: "Hi"}}, nil)
+	if err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+
+	if chunk := <-chunks; chunk.Content != "Hello" {
+		t.Fatalf("Expected first chunk 'Hello', got %+v", chunk)
+	}
+	cancel()
+
+	// The channel is closed by the streaming goroutine as the last thing it does
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				return
+			}
+			if chunk.Err != nil && !errors.Is(chunk.Err, ErrContextCanceled) {
+				t.Errorf("Expected ErrContextCanceled, got %v", chunk.Err)
+			}
+		case <-timeout:
+			t.Fatalf("Stream channel was not closed after the context was canceled")
+		}
+	}
+}
+
+func TestOllamaEmbedBatch(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != embedBatchEndpoint {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+
+		var reqBody struct {
+			Model string   `json:"model"`
+			Input []string `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if len(reqBody.Input) != 2 || reqBody.Input[0] != "first" {
+			t.Errorf("Unexpected inputs: %v", reqBody.Input)
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"model":      "test-model",
+			"embeddings": [][]float32{{0.1, 0.2, 0.3}, {0.4, 0.5, 0.6}},
+		})
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+
+	result, err := backend.Embeddings(context.Background(), []string{"first", "second"})
+	if err != nil {
+		t.Fatalf("Embeddings returned error: %v", err)
+	}
+	if result.Dimensions != 3 {
+		t.Errorf("Expected 3 dimensions, got %d", result.Dimensions)
+	}
+	if len(result.Embeddings) != 2 || result.Embeddings[1][0] != 0.4 {
+		t.Errorf("Unexpected embeddings: %v", result.Embeddings)
+	}
+
+	vectors, err := backend.EmbedBatch(context.Background(), []string{"first", "second"})
+	if err != nil {
+		t.Fatalf("EmbedBatch returned error: %v", err)
+	}
+	if len(vectors) != 2 {
+		t.Errorf("Expected 2 vectors, got %d", len(vectors))
+	}
+}
+
+func TestOllamaEmbedNotSupported(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"\"llava\" does not support embeddings"}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "llava")
+
+	_, err := backend.Embed(context.Background(), "text")
+	if !errors.Is(err, ErrEmbeddingsNotSupported) {
+		t.Errorf("Expected ErrEmbeddingsNotSupported, got %v", err)
+	}
+	var backendErr *BackendError
+	if !errors.As(err, &backendErr) {
+		t.Errorf("Expected the BackendError to be kept, got %v", err)
+	}
+
+	_, err = backend.EmbedBatch(context.Background(), []string{"text"})
+	if !errors.Is(err, ErrEmbeddingsNotSupported) {
+		t.Errorf("Expected ErrEmbeddingsNotSupported, got %v", err)
+	}
+}
+
+func TestOllamaEmbeddingModel(t *testing.T) {
+	var tagRequests int
+	var embedModels []any
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case tagsEndpoint:
+			tagRequests++
+			w.Write([]byte(`{"models": [{"name": "llama3:latest"}, {"name": "nomic-embed-text:latest"}]}`))
+		case embedBatchEndpoint:
+			var reqBody map[string]any
+			if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+				t.Errorf("Failed to decode request body: %v", err)
+			}
+			embedModels = append(embedModels, reqBody["model"])
+			w.Write([]byte(`{"model": "nomic-embed-text", "embeddings": [[0.1, 0.2]]}`))
+		default:
+			t.Errorf("Unexpected request: %s", r.URL.Path)
+		}
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "llama3", WithEmbeddingModel("nomic-embed-text"))
+	for i := 0; i < 2; i++ {
+		if _, err := backend.EmbedBatch(context.Background(), []string{"text"}); err != nil {
+			t.Fatalf("EmbedBatch returned error: %v", err)
+		}
+	}
+	if len(embedModels) != 2 || embedModels[0] != "nomic-embed-text" {
+		t.Errorf("Expected the embedding model in the requests, got %v", embedModels)
+	}
+	if tagRequests != 1 {
+		t.Errorf("Expected the embedding model to be checked once, got %d checks", tagRequests)
+	}
+
+	// A model missing from the server is reported before any embedding request
+	backend.EmbeddingModel = "mxbai-embed-large"
+	if _, err := backend.Embed(context.Background(), "text"); !errors.Is(err, ErrModelNotFound) {
+		t.Errorf("Expected ErrModelNotFound, got %v", err)
+	}
+	if len(embedModels) != 2 {
+		t.Errorf("Expected no request with a missing model")
+	}
+}
+
+func TestOllamaWithSystemPrompt(t *testing.T) {
+	received := make(chan map[string]any, 2)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+		json.NewEncoder(w).Encode(Response{Done: true})
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model", WithSystemPrompt("You are a security expert."))
+
+	if _, err := backend.Chat(context.Background(), []Message{UserMessage("Hi")}, nil); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	messages := (<-received)["messages"].([]any)
+	if len(messages) != 2 || messages[0].(map[string]any)["role"] != RoleSystem {
+		t.Errorf("Expected the system prompt as the first message, got %v", messages)
+	}
+
+	if _, err := backend.Generate(context.Background(), "Hi"); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if system := (<-received)["system"]; system != "You are a security expert." {
+		t.Errorf("Expected the system prompt in the generate request, got %v", system)
+	}
+}
+
+func TestOllamaCombinesSystemMessages(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+		json.NewEncoder(w).Encode(Response{Done: true})
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+	messages := []Message{SystemMessage("You are a travel agent."), SystemMessage("The user prefers trains."), UserMessage("Hi")}
+	if _, err := backend.Chat(context.Background(), messages, nil); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+
+	sent := (<-received)["messages"].([]any)
+	if len(sent) != 2 {
+		t.Fatalf("Expected a single system message, got %v", sent)
+	}
+	if content := sent[0].(map[string]any)["content"]; content != "You are a travel agent.\n\nThe user prefers trains." {
+		t.Errorf("Expected the system messages to be joined, got %q", content)
+	}
+}
+
+func TestOllamaUsage(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"model": "test-model",
+			"message": {"role": "assistant", "content": "Hi"},
+			"done": true,
+			"total_duration": 1500000000,
+			"prompt_eval_count": 26,
+			"eval_count": 290
+		}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+	response, err := backend.Chat(context.Background(), []Message{UserMessage("Hi")}, nil)
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+
+	if !response.UsageAvailable {
+		t.Fatalf("Expected usage to be available")
+	}
+	expected := Usage{PromptTokens: 26, CompletionTokens: 290, TotalDuration: 1500 * time.Millisecond}
+	if response.Usage != expected {
+		t.Errorf("Expected usage %+v, got %+v", expected, response.Usage)
+	}
+}
+
+func TestOllamaGenerateOptions(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+		json.NewEncoder(w).Encode(Response{Response: "Summary.", Done: true})
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+	response, err := backend.Generate(context.Background(), "Summarize this.",
+		WithTemperature(0.2), WithTopP(0.9), WithStopSequences("\n\n"))
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if response.Response != "Summary." {
+		t.Errorf("Expected Summary., got %s", response.Response)
+	}
+
+	options, ok := (<-received)["options"].(map[string]any)
+	if !ok {
+		t.Fatalf("Expected an options object in the request")
+	}
+	if options["temperature"] != 0.2 || options["top_p"] != 0.9 {
+		t.Errorf("Unexpected sampling options: %v", options)
+	}
+	if stop, _ := options["stop"].([]any); len(stop) != 1 || stop[0] != "\n\n" {
+		t.Errorf("Expected stop sequences [\\n\\n], got %v", options["stop"])
+	}
+}
+
+func TestOllamaSamplingOptions(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+		json.NewEncoder(w).Encode(Response{Message: Message{Role: "assistant", Content: "Hi"}, Done: true})
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+	_, err := backend.Chat(context.Background(), []Message{UserMessage("Hi")}, nil,
+		WithMirostat(2), WithMirostatTau(4), WithMirostatEta(0.2), WithRepeatPenalty(1.3), WithTFSZ(2),
+		WithOption("num_ctx", 8192), WithOption("repeat_penalty", 1.5))
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+
+	options, ok := (<-received)["options"].(map[string]any)
+	if !ok {
+		t.Fatalf("Expected an options object in the request")
+	}
+	expected := map[string]any{
+		"mirostat":     2.0,
+		"mirostat_tau": 4.0,
+		"mirostat_eta": 0.2,
+		"tfs_z":        2.0,
+		"num_ctx":      8192.0,
+		// WithOption takes precedence over WithRepeatPenalty
+		"repeat_penalty": 1.5,
+	}
+	for key, value := range expected {
+		if options[key] != value {
+			t.Errorf("Expected %s %v, got %v", key, value, options[key])
+		}
+	}
+}
+
+func TestOllamaChatImages(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+		json.NewEncoder(w).Encode(Response{Message: Message{Role: "assistant", Content: "A cat."}, Done: true})
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "llava")
+	msg := UserMessage("What is in this picture?")
+	msg.Images = [][]byte{[]byte("\x89PNG")}
+	if _, err := backend.Chat(context.Background(), []Message{msg}, nil); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+
+	messages, _ := (<-received)["messages"].([]any)
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message, got %v", messages)
+	}
+	images, _ := messages[0].(map[string]any)["images"].([]any)
+	if len(images) != 1 || images[0] != "iVBORw==" {
+		t.Errorf("Expected the image to be sent base64 encoded, got %v", images)
+	}
+}
+
+func TestOllamaToolChoice(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+		json.NewEncoder(w).Encode(Response{Message: AssistantMessage("Hi"), Done: true})
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+	tools := []Tool{
+		{"type": "function", "function": map[string]any{"name": "get_weather"}},
+		{"type": "function", "function": map[string]any{"name": "get_time"}},
+	}
+	messages := []Message{UserMessage("Weather?")}
+
+	if _, err := backend.Chat(context.Background(), messages, tools, WithToolChoice("get_time")); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	reqBody := <-received
+	sent, _ := reqBody["tools"].([]any)
+	if len(sent) != 1 || !strings.Contains(fmt.Sprint(sent[0]), "get_time") {
+		t.Errorf("Expected only get_time to be sent, got %v", sent)
+	}
+	sentMessages, _ := reqBody["messages"].([]any)
+	if len(sentMessages) != 2 || !strings.Contains(fmt.Sprint(sentMessages[0]), "get_time") {
+		t.Errorf("Expected a leading instruction to call get_time, got %v", sentMessages)
+	}
+
+	// The instruction joins the system prompt, as templates render a single system message
+	withSystem := []Message{SystemMessage("Be brief."), UserMessage("Weather?")}
+	if _, err := backend.Chat(context.Background(), withSystem, tools, WithToolChoice("get_time")); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	sentMessages, _ = (<-received)["messages"].([]any)
+	if len(sentMessages) != 2 || fmt.Sprint(sentMessages[0]) != fmt.Sprint(map[string]any{
+		"role":    "system",
+		"content": "Be brief.\n\nYou must call the tool get_time to answer.",
+	}) {
+		t.Errorf("Expected the instruction in the system message, got %v", sentMessages)
+	}
+	if withSystem[0].Content != "Be brief." {
+		t.Errorf("Expected the messages of the caller to be left unchanged, got %q", withSystem[0].Content)
+	}
+
+	if _, err := backend.Chat(context.Background(), messages, tools, WithToolChoiceNone()); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if sent, ok := (<-received)["tools"]; ok {
+		t.Errorf("Expected no tools to be sent, got %v", sent)
+	}
+
+	if _, err := backend.Chat(context.Background(), messages, tools, WithToolChoice("missing")); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Expected ErrInvalidOption for an unknown tool, got %v", err)
+	}
+}
+
+func TestOllamaKeepAlive(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+		json.NewEncoder(w).Encode(Response{Done: true})
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+	tests := []struct {
+		keepAlive time.Duration
+		want      any
+	}{
+		{10 * time.Minute, "10m0s"},
+		{-time.Second, float64(-1)},
+		{0, float64(0)},
+	}
+	for _, tc := range tests {
+		if _, err := backend.Generate(context.Background(), "Hi", WithKeepAlive(tc.keepAlive)); err != nil {
+			t.Fatalf("Generate returned error: %v", err)
+		}
+		if got := (<-received)["keep_alive"]; got != tc.want {
+			t.Errorf("Expected keep_alive %v for %s, got %v", tc.want, tc.keepAlive, got)
+		}
+	}
+}
+
+func TestOllamaRaw(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+		json.NewEncoder(w).Encode(Response{Done: true})
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model", WithSystemPrompt("Be brief."))
+	prompt := "[INST] Hi [/INST]"
+	if _, err := backend.Generate(context.Background(), prompt, WithRaw()); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	reqBody := <-received
+	if reqBody["raw"] != true || reqBody["prompt"] != prompt {
+		t.Errorf("Expected a raw request with the prompt as given, got %v", reqBody)
+	}
+	if _, ok := reqBody["system"]; ok {
+		t.Errorf("Expected no system prompt in raw mode, got %v", reqBody["system"])
+	}
+
+	if _, err := backend.Generate(context.Background(), "Hi"); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if reqBody := <-received; reqBody["raw"] != nil || reqBody["system"] != "Be brief." {
+		t.Errorf("Expected a templated request by default, got %v", reqBody)
+	}
+}
+
+func TestOllamaContextGuard(t *testing.T) {
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		json.NewEncoder(w).Encode(Response{Done: true})
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+	messages := []Message{UserMessage(strings.Repeat("word ", 100))}
+
+	_, err := backend.Chat(context.Background(), messages, nil, WithContextGuard(50))
+	var overflow *ContextOverflowError
+	if !errors.As(err, &overflow) || !errors.Is(err, ErrContextOverflow) {
+		t.Fatalf("Expected a ContextOverflowError, got %v", err)
+	}
+	if overflow.Limit != 50 || overflow.Estimated != messageOverheadTokens+125 {
+		t.Errorf("Unexpected estimate: %+v", overflow)
+	}
+	if _, err := backend.Generate(context.Background(), messages[0].Content, WithContextGuard(50)); !errors.Is(err, ErrContextOverflow) {
+		t.Errorf("Expected Generate to be guarded too, got %v", err)
+	}
+	if requests != 0 {
+		t.Errorf("Expected no request to be sent, got %d", requests)
+	}
+
+	// A precise tokenizer can be plugged in
+	oneToken := func(string) int { return 1 }
+	if _, err := backend.Chat(context.Background(), messages, nil, WithContextGuard(50), WithTokenCounter(oneToken)); err != nil {
+		t.Errorf("Expected the request to fit with the custom counter, got %v", err)
+	}
+	// Zero uses the context window of the model
+	if _, err := backend.Chat(context.Background(), messages, nil, WithContextGuard(0)); err != nil {
+		t.Errorf("Expected the request to fit the default context window, got %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", requests)
+	}
+	if _, err := backend.Chat(context.Background(), messages, nil, WithContextGuard(-1)); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Expected ErrInvalidOption for a negative limit, got %v", err)
+	}
+}
+
+func TestOllamaRawResponseCapture(t *testing.T) {
+	body := `{"model": "test-model", "message": {"role": "assistant", "content": "Hi!"}, "done": true}`
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+	var raw []byte
+	response, err := backend.Chat(context.Background(), []Message{UserMessage("Hi")}, nil, WithRawResponseCapture(func(b []byte) {
+		raw = b
+	}))
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if string(raw) != body {
+		t.Errorf("Expected the raw body %s, got %s", body, raw)
+	}
+	if response.Message.Content != "Hi!" {
+		t.Errorf("Expected the body to be decoded as well, got %+v", response.Message)
+	}
+
+	// A body that cannot be decoded is captured too
+	body = `{"model": "test-model", "message": `
+	raw = nil
+	_, err = backend.Generate(context.Background(), "Hi", WithRawResponseCapture(func(b []byte) {
+		raw = b
+	}))
+	if err == nil || string(raw) != body {
+		t.Errorf("Expected a decode error and the raw body, got %v and %s", err, raw)
+	}
+}
+
+func TestOllamaHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+		json.NewEncoder(w).Encode(Response{Done: true})
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model", WithHeaders(map[string]string{
+		"X-Tenant-ID":  "acme",
+		"X-Trace-ID":   "default",
+		"Content-Type": "text/plain",
+	}))
+	if _, err := backend.Generate(context.Background(), "Hi", WithRequestHeaders(map[string]string{"x-trace-id": "abc123"})); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+
+	header := <-received
+	if header.Get("X-Tenant-ID") != "acme" {
+		t.Errorf("Expected X-Tenant-ID acme, got %s", header.Get("X-Tenant-ID"))
+	}
+	if header.Get("X-Trace-ID") != "abc123" {
+		t.Errorf("Expected the per-call X-Trace-ID to take precedence, got %s", header.Values("X-Trace-ID"))
+	}
+	if header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected Content-Type application/json, got %s", header.Get("Content-Type"))
+	}
+
+	// The mock replies without an embedding, only the headers matter here
+	backend.Embed(context.Background(), "Hi")
+	if (<-received).Get("X-Tenant-ID") != "acme" {
+		t.Errorf("Expected the headers to be sent with embedding requests as well")
+	}
+}
+
+func TestOllamaNoOptions(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+		json.NewEncoder(w).Encode(Response{Done: true})
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+	if _, err := backend.Generate(context.Background(), "Hi"); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	reqBody := <-received
+	if options, ok := reqBody["options"]; ok {
+		t.Errorf("Expected no options object, got %v", options)
+	}
+	if keepAlive, ok := reqBody["keep_alive"]; ok {
+		t.Errorf("Expected no keep_alive, got %v", keepAlive)
+	}
+}
+
+func TestOllamaSeed(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+		json.NewEncoder(w).Encode(Response{Done: true})
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+	if _, err := backend.Chat(context.Background(), []Message{UserMessage("Hi")}, nil, WithSeed(42), WithTemperature(0)); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+
+	options, _ := (<-received)["options"].(map[string]any)
+	if options["seed"] != float64(42) || options["temperature"] != float64(0) {
+		t.Errorf("Expected seed 42 and temperature 0, got %v", options)
+	}
+}
+
+func TestOllamaInvalidOptions(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Expected no request to be sent")
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+	cases := []struct {
+		name string
+		opt  CallOption
+	}{
+		{"temperature too high", WithTemperature(2.5)},
+		{"negative temperature", WithTemperature(-0.1)},
+		{"top_p too high", WithTopP(1.5)},
+		{"empty stop sequence", WithStopSequences("")},
+		{"unknown mirostat", WithMirostat(3)},
+		{"negative mirostat_tau", WithMirostatTau(-1)},
+		{"negative repeat_penalty", WithRepeatPenalty(-0.5)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := backend.Chat(context.Background(), []Message{UserMessage("Hi")}, nil, tc.opt); !errors.Is(err, ErrInvalidOption) {
+				t.Errorf("Expected ErrInvalidOption from Chat, got %v", err)
+			}
+			if _, err := backend.Generate(context.Background(), "Hi", tc.opt); !errors.Is(err, ErrInvalidOption) {
+				t.Errorf("Expected ErrInvalidOption from Generate, got %v", err)
+			}
+		})
+	}
+}
+
+func TestOllamaRejectUnsupportedOptions(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == chatEndpoint {
+			t.Errorf("Expected no chat request to be sent")
+		}
+		w.Write([]byte(`{"model": "test-model", "response": "Hi", "done": true}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model", WithUnsupportedOptions(RejectUnsupported))
+	if _, err := backend.Chat(context.Background(), []Message{UserMessage("Hi")}, nil, WithRaw()); !errors.Is(err, ErrUnsupportedOption) {
+		t.Errorf("Expected ErrUnsupportedOption from Chat, got %v", err)
+	}
+	if _, err := backend.Generate(context.Background(), "Hi", WithRaw(), WithKeepAlive(time.Minute)); err != nil {
+		t.Errorf("Expected Generate to support raw and keep_alive, got %v", err)
+	}
+}
+
+func TestOllamaWithTimeout(t *testing.T) {
+	server, release := newSlowServer(t, "")
+	defer server.Close()
+	defer release()
+
+	backend := NewOllamaBackend(server.URL, "test-model", WithTimeout(50*time.Millisecond))
+	if backend.RequestTimeout != 50*time.Millisecond {
+		t.Errorf("Expected RequestTimeout 50ms, got %s", backend.RequestTimeout)
+	}
+
+	start := time.Now()
+	_, err := backend.Chat(context.Background(), []Message{UserMessage("Hi")}, nil)
+	if !errors.Is(err, ErrContextCanceled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected ErrContextCanceled and context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the request to time out after 50ms, took %s", elapsed)
+	}
+}
+
+func TestOllamaWithTimeoutHonorsEarlierDeadline(t *testing.T) {
+	server, release := newSlowServer(t, "")
+	defer server.Close()
+	defer release()
+
+	backend := NewOllamaBackend(server.URL, "test-model", WithTimeout(time.Minute))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := backend.Generate(ctx, "Hi"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the caller's deadline to apply, took %s", elapsed)
+	}
+}
+
+func TestOllamaChatStreamToolCalls(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message": {"role": "assistant", "content": "", "tool_calls": [{"function": {"name": "get_weather", "arguments": {"city": "Brno"}}}]}, "done": false}
+{"message": {"role": "assistant", "content": ""}, "done": true}
+`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+	chunks, err := backend.ChatStream(context.Background(), []Message{UserMessage("Weather in Brno?")}, nil)
+	if err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+
+	var ready []ToolCall
+	var last StreamChunk
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			t.Fatalf("Unexpected stream error: %v", chunk.Err)
+		}
+		if !chunk.Done && len(chunk.ToolCalls) > 0 {
+			t.Errorf("Expected tool calls only on the final chunk")
+		}
+		if chunk.ToolCallReady != nil {
+			ready = append(ready, *chunk.ToolCallReady)
+		}
+		last = chunk
+	}
+
+	if len(ready) != 1 || ready[0].Function.Name != "get_weather" {
+		t.Errorf("Expected the tool call to be delivered before the final chunk, got %+v", ready)
+	}
+	if len(last.ToolCalls) != 1 || last.ToolCalls[0].Function.Arguments["city"] != "Brno" {
+		t.Errorf("Expected the tool call on the final chunk, got %+v", last.ToolCalls)
+	}
+}
+
+func TestOllamaMaxTokens(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+		json.NewEncoder(w).Encode(Response{Response: "Once upon a", Done: true, DoneReason: "length"})
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+	response, err := backend.Generate(context.Background(), "Tell me a story.", WithMaxTokens(3))
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+
+	options, _ := (<-received)["options"].(map[string]any)
+	if options["num_predict"] != float64(3) {
+		t.Errorf("Expected num_predict 3, got %v", options["num_predict"])
+	}
+	if !response.Truncated {
+		t.Errorf("Expected the response to be truncated")
+	}
+	if response.FinishReason != FinishLength {
+		t.Errorf("Expected finish reason %s, got %s", FinishLength, response.FinishReason)
+	}
+
+	if _, err := backend.Generate(context.Background(), "Hi", WithMaxTokens(0)); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Expected ErrInvalidOption for zero max tokens, got %v", err)
+	}
+}
+
+func TestOllamaBasePath(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ollama/api/chat", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message": {"role": "assistant", "content": "Hi"}, "done": true}`))
+	})
+	mux.HandleFunc("/ollama/api/tags", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"models": [{"name": "llama3:latest"}]}`))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected request to %s", r.URL.Path)
+		http.NotFound(w, r)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	backends := map[string]*OllamaBackend{
+		"full base URL": NewOllamaBackend(server.URL+"/ollama/api/", "llama3"),
+		"WithBasePath":  NewOllamaBackend(server.URL, "llama3", WithBasePath("/ollama/api/")),
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			response, err := backend.Chat(context.Background(), []Message{UserMessage("Hello")}, nil)
+			if err != nil {
+				t.Fatalf("Chat returned error: %v", err)
+			}
+			if response.Message.Content != "Hi" {
+				t.Errorf("Unexpected reply: %+v", response.Message)
+			}
+			models, err := backend.ListModels(context.Background())
+			if err != nil || len(models) != 1 {
+				t.Errorf("Expected one model, got %v, %v", models, err)
+			}
+		})
+	}
+}
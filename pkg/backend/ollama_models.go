@@ -0,0 +1,190 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	rootEndpoint = "/"
+	tagsEndpoint = "/api/tags"
+	pullEndpoint = "/api/pull"
+	// defaultModelTag is the tag Ollama assumes when a model name has none.
+	defaultModelTag = "latest"
+)
+
+// ModelInfo describes a model available on an Ollama server.
+type ModelInfo struct {
+	// Name is the name of the model including its tag, e.g. "llama3:latest".
+	Name string `json:"name"`
+	// Size is the size of the model on disk in bytes.
+	Size int64 `json:"size"`
+	// ModifiedAt is the time the model was last pulled or changed.
+	ModifiedAt time.Time `json:"modified_at"`
+	// Digest identifies the exact version of the model.
+	Digest string `json:"digest"`
+}
+
+// listModelsResponse is the response of the Ollama tags endpoint.
+type listModelsResponse struct {
+	Models []ModelInfo `json:"models"`
+}
+
+var _ Pinger = (*OllamaBackend)(nil)
+
+// Ping checks that the Ollama server is running by requesting its root endpoint,
+// which needs no model to be loaded. It returns an error matching ErrUnreachable
+// if the server cannot be reached.
+func (o *OllamaBackend) Ping(ctx context.Context) error {
+	ctx, cancel := withRequestTimeout(ctx, o.RequestTimeout)
+	defer cancel()
+
+	resp, err := getJSON(ctx, o.Client, o.BaseURL+rootEndpoint, o.header(nil))
+	if err != nil {
+		return fmt.Errorf("failed to ping Ollama: %w", unreachableError(o.BaseURL, err))
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ListModels returns the models available on the Ollama server.
+// It returns an error matching ErrUnreachable if the server cannot be reached.
+func (o *OllamaBackend) ListModels(ctx context.Context) ([]ModelInfo, error) {
+	ctx, cancel := withRequestTimeout(ctx, o.RequestTimeout)
+	defer cancel()
+
+	resp, err := getJSON(ctx, o.Client, o.url(tagsEndpoint), o.header(nil))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Ollama models: %w", unreachableError(o.BaseURL, err))
+	}
+
+	var result listModelsResponse
+	if err := decodeJSON(ctx, resp, &result); err != nil {
+		return nil, err
+	}
+
+	return result.Models, nil
+}
+
+// ModelExists reports whether the named model is available on the Ollama server.
+// A name without a tag refers to the "latest" tag, as it does for Ollama.
+func (o *OllamaBackend) ModelExists(ctx context.Context, name string) (bool, error) {
+	models, err := o.ListModels(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	name = withDefaultTag(name)
+	for _, model := range models {
+		if withDefaultTag(model.Name) == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// withDefaultTag returns name with the default tag appended if it has no tag.
+func withDefaultTag(name string) string {
+	if strings.Contains(name, ":") {
+		return name
+	}
+	return name + ":" + defaultModelTag
+}
+
+// ProgressUpdate reports the progress of a PullModel call.
+type ProgressUpdate struct {
+	// Status describes the current step, e.g. "pulling manifest" or "success".
+	Status string `json:"status"`
+	// Digest identifies the layer being downloaded, if any.
+	Digest string `json:"digest,omitempty"`
+	// Completed is the number of bytes of the layer downloaded so far.
+	Completed int64 `json:"completed,omitempty"`
+	// Total is the size of the layer in bytes, or zero if not downloading.
+	Total int64 `json:"total,omitempty"`
+}
+
+// pullMessage is a line of the progress stream of the Ollama pull endpoint.
+type pullMessage struct {
+	ProgressUpdate
+	Error string `json:"error"`
+}
+
+// PullModel downloads the named model to the Ollama server and returns once the
+// pull succeeded, failed or ctx is done. If progress is not nil, it is called
+// with every progress update Ollama reports, in order.
+//
+// Like ChatStream, PullModel does not apply the Timeout of the HTTP client, as
+// downloading a model can take a long time. Use ctx to bound it. PullModel can be
+// canceled at any time; if part of the model was downloaded by then, or the
+// connection failed part way through, the returned error is a *PullIncompleteError
+// describing how far the pull got.
+//
+// Ollama keeps the layers it has partially downloaded, so calling PullModel again
+// after an interrupted pull resumes it instead of starting over. The progress of the
+// resumed pull counts the bytes downloaded before, so it does not restart at zero.
+func (o *OllamaBackend) PullModel(ctx context.Context, name string, progress func(ProgressUpdate)) error {
+	streamClient := *o.Client
+	streamClient.Timeout = 0
+
+	reqBody := map[string]interface{}{
+		"model":  name,
+		"stream": true,
+	}
+	resp, err := postJSON(ctx, &streamClient, o.url(pullEndpoint), o.header(nil), reqBody, o.MaxRequestBytes)
+	if err != nil {
+		return fmt.Errorf("failed to pull model %s: %w", name, unreachableError(o.BaseURL, err))
+	}
+	defer resp.Body.Close()
+
+	// Ollama streams one JSON object per line and ends with a "success" status
+	var last ProgressUpdate
+	incomplete := func(err error) error {
+		if last.Completed == 0 {
+			return err
+		}
+		return &PullIncompleteError{Model: name, Last: last, Err: err}
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg pullMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return incomplete(contextError(ctx, fmt.Errorf("failed to pull model %s: %w", name, err)))
+		}
+		if msg.Error != "" {
+			return incomplete(fmt.Errorf("failed to pull model %s: %s", name, msg.Error))
+		}
+
+		if msg.Completed > 0 {
+			last = msg.ProgressUpdate
+		}
+		if progress != nil {
+			progress(msg.ProgressUpdate)
+		}
+		if msg.Status == "success" {
+			return nil
+		}
+	}
+}
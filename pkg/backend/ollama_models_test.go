@@ -0,0 +1,268 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTagsServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != tagsEndpoint {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"models": [
+			{"name": "llama3:latest", "size": 4661224676, "modified_at": "2024-05-01T10:00:00Z", "digest": "abc"},
+			{"name": "qwen2.5:7b", "size": 4683087332, "modified_at": "2024-09-20T08:30:00Z", "digest": "def"}
+		]}`))
+	}))
+}
+
+func TestOllamaListModels(t *testing.T) {
+	mockServer := newTagsServer(t)
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "llama3")
+	models, err := backend.ListModels(context.Background())
+	if err != nil {
+		t.Fatalf("ListModels returned error: %v", err)
+	}
+
+	if len(models) != 2 {
+		t.Fatalf("Expected 2 models, got %d", len(models))
+	}
+	expected := ModelInfo{
+		Name:       "llama3:latest",
+		Size:       4661224676,
+		ModifiedAt: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		Digest:     "abc",
+	}
+	if models[0] != expected {
+		t.Errorf("Expected %+v, got %+v", expected, models[0])
+	}
+}
+
+func TestOllamaModelExists(t *testing.T) {
+	mockServer := newTagsServer(t)
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "llama3")
+	cases := []struct {
+		name     string
+		expected bool
+	}{
+		{"llama3", true},
+		{"llama3:latest", true},
+		{"qwen2.5:7b", true},
+		{"qwen2.5", false},
+		{"mistral", false},
+	}
+	for _, tc := range cases {
+		exists, err := backend.ModelExists(context.Background(), tc.name)
+		if err != nil {
+			t.Fatalf("ModelExists returned error: %v", err)
+		}
+		if exists != tc.expected {
+			t.Errorf("Expected ModelExists(%s) to be %v", tc.name, tc.expected)
+		}
+	}
+}
+
+func TestOllamaListModelsUnreachable(t *testing.T) {
+	mockServer := httptest.NewServer(http.NotFoundHandler())
+	url := mockServer.URL
+	mockServer.Close()
+
+	backend := NewOllamaBackend(url, "llama3")
+	if _, err := backend.ListModels(context.Background()); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Expected ErrUnreachable, got %v", err)
+	}
+}
+
+func TestOllamaPullModel(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != pullEndpoint {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if reqBody["model"] != "llama3" {
+			t.Errorf("Expected model llama3, got %v", reqBody["model"])
+		}
+
+		w.Write([]byte(`{"status": "pulling manifest"}
+{"status": "downloading", "digest": "sha256:abc", "total": 100, "completed": 40}
+{"status": "downloading", "digest": "sha256:abc", "total": 100, "completed": 100}
+{"status": "success"}
+`))
+	}))
+	defer mockServer.Close()
+
+	var updates []ProgressUpdate
+	backend := NewOllamaBackend(mockServer.URL, "llama3")
+	err := backend.PullModel(context.Background(), "llama3", func(update ProgressUpdate) {
+		updates = append(updates, update)
+	})
+	if err != nil {
+		t.Fatalf("PullModel returned error: %v", err)
+	}
+
+	if len(updates) != 4 {
+		t.Fatalf("Expected 4 progress updates, got %d", len(updates))
+	}
+	expected := ProgressUpdate{Status: "downloading", Digest: "sha256:abc", Completed: 40, Total: 100}
+	if updates[1] != expected {
+		t.Errorf("Expected %+v, got %+v", expected, updates[1])
+	}
+	if updates[3].Status != "success" {
+		t.Errorf("Expected the last update to be success, got %s", updates[3].Status)
+	}
+}
+
+func TestOllamaPullModelError(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "pulling manifest"}
+{"error": "pull model manifest: file does not exist"}
+`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "llama3")
+	err := backend.PullModel(context.Background(), "no-such-model", nil)
+	if err == nil || !strings.Contains(err.Error(), "file does not exist") {
+		t.Errorf("Expected the pull error to be reported, got %v", err)
+	}
+}
+
+func TestOllamaPullModelContextCanceled(t *testing.T) {
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "pulling manifest"}` + "\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer mockServer.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	backend := NewOllamaBackend(mockServer.URL, "llama3")
+	err := backend.PullModel(ctx, "llama3", func(ProgressUpdate) {
+		cancel()
+	})
+	if !errors.Is(err, ErrContextCanceled) {
+		t.Errorf("Expected ErrContextCanceled, got %v", err)
+	}
+}
+
+func TestOllamaPullModelResume(t *testing.T) {
+	pulls := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pulls++
+		if pulls == 1 {
+			// The connection drops part way through the download
+			w.Write([]byte(`{"status": "pulling manifest"}
+{"status": "downloading", "digest": "sha256:abc", "total": 100, "completed": 40}
+`))
+			return
+		}
+		// Ollama continues with the bytes it already has
+		w.Write([]byte(`{"status": "downloading", "digest": "sha256:abc", "total": 100, "completed": 40}
+{"status": "downloading", "digest": "sha256:abc", "total": 100, "completed": 100}
+{"status": "success"}
+`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "llama3")
+	err := backend.PullModel(context.Background(), "llama3", nil)
+	var incomplete *PullIncompleteError
+	if !errors.As(err, &incomplete) || !errors.Is(err, ErrPullIncomplete) {
+		t.Fatalf("Expected a PullIncompleteError, got %v", err)
+	}
+	if incomplete.Model != "llama3" || incomplete.Last.Digest != "sha256:abc" || incomplete.Last.Completed != 40 {
+		t.Errorf("Unexpected partial state: %+v", incomplete)
+	}
+
+	var updates []ProgressUpdate
+	err = backend.PullModel(context.Background(), "llama3", func(update ProgressUpdate) {
+		updates = append(updates, update)
+	})
+	if err != nil {
+		t.Fatalf("Expected the resumed pull to succeed, got %v", err)
+	}
+	if updates[0].Completed != 40 {
+		t.Errorf("Expected the resumed progress to start at 40 bytes, got %+v", updates[0])
+	}
+}
+
+func TestOllamaPullModelCanceledMidDownload(t *testing.T) {
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "downloading", "digest": "sha256:abc", "total": 100, "completed": 25}` + "\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer mockServer.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	backend := NewOllamaBackend(mockServer.URL, "llama3")
+	err := backend.PullModel(ctx, "llama3", func(ProgressUpdate) {
+		cancel()
+	})
+	var incomplete *PullIncompleteError
+	if !errors.As(err, &incomplete) || !errors.Is(err, ErrContextCanceled) {
+		t.Fatalf("Expected a canceled PullIncompleteError, got %v", err)
+	}
+	if incomplete.Last.Completed != 25 || incomplete.Last.Total != 100 {
+		t.Errorf("Unexpected partial state: %+v", incomplete.Last)
+	}
+}
+
+func TestOllamaPing(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != rootEndpoint {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		w.Write([]byte("Ollama is running"))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "llama3")
+	if err := backend.Ping(context.Background()); err != nil {
+		t.Errorf("Ping returned error: %v", err)
+	}
+
+	mockServer.Close()
+	if err := backend.Ping(context.Background()); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Expected ErrUnreachable, got %v", err)
+	}
+}
@@ -15,12 +15,29 @@
 package backend
 
 import (
-	"bytes"
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+const (
+	defaultOpenAIBaseURL    = "https://api.openai.com"
+	openAIChatEndpoint      = "/v1/chat/completions"
+	openAIEmbeddingEndpoint = "/v1/embeddings"
+	openAIModelsEndpoint    = "/v1/models"
+	// defaultOpenAIEmbeddingModel generates embeddings unless EmbeddingModel is set.
+	defaultOpenAIEmbeddingModel = "text-embedding-ada-002"
+	// maxSSELineSize is the longest line of a server-sent event stream that is accepted.
+	maxSSELineSize = 1024 * 1024
 )
 
 // OpenAIBackend represents a backend for interacting with the OpenAI API.
@@ -30,26 +47,101 @@ type OpenAIBackend struct {
 	Model      string
 	HTTPClient *http.Client
 	BaseURL    string
+	// APIKeyHeader is the header the API key is sent in. When empty the key is
+	// sent as a bearer token in the Authorization header.
+	APIKeyHeader string
+	// SystemPrompt is prepended to every conversation that has no system message.
+	SystemPrompt string
+	// RequestTimeout bounds every request that is not streamed. Zero means no limit
+	// other than the deadline of the context passed by the caller.
+	RequestTimeout time.Duration
+	// StreamIdleTimeout aborts a stream once no data arrived for that long, see
+	// WithStreamIdleTimeout. Zero means streams may stay silent indefinitely.
+	StreamIdleTimeout time.Duration
+	// Headers are added to every request. They cannot replace the headers the
+	// backend sets itself, such as Content-Type and the API key.
+	Headers map[string]string
+	// UserAgent is sent in the User-Agent header of every request. Empty means
+	// DefaultUserAgent.
+	UserAgent string
+	// MaxRequestBytes is the size of the largest request body the backend sends.
+	// Zero means no limit.
+	MaxRequestBytes int
+	// Tokenizer counts the tokens of requests for the backend. Nil uses the
+	// counter EstimateTokens uses for the model.
+	Tokenizer Tokenizer
+	// UnsupportedOptions is what happens to call options the backend cannot
+	// honour, see WithUnsupportedOptions.
+	UnsupportedOptions UnsupportedOptionPolicy
+
+	// transport is the transport created for WithConnectionPool, if any.
+	transport *http.Transport
+	// EmbeddingModel generates the embeddings, text-embedding-ada-002 if empty.
+	// It is checked to exist before it is first used.
+	EmbeddingModel string
+
+	// verifiedEmbeddingModel is the EmbeddingModel the API was found to serve.
+	verifiedEmbeddingModel atomic.Pointer[string]
 }
 
+var (
+	_ Backend  = (*OpenAIBackend)(nil)
+	_ Streamer = (*OpenAIBackend)(nil)
+	_ Pinger   = (*OpenAIBackend)(nil)
+)
+
 // NewOpenAIBackend creates and returns a new OpenAIBackend instance.
 // It takes an API key and a model name as parameters.
 //
 // Parameters:
 //   - apiKey: A string containing the OpenAI API key for authentication.
 //   - model: A string specifying the name of the OpenAI model to use.
+//   - opts: Optional settings, e.g. WithBaseURL to target an OpenAI-compatible gateway,
+//     WithAPIKeyHeader for Azure OpenAI or WithHTTPClient to use a custom HTTP client.
 //
 // Returns:
 //   - *OpenAIBackend: A pointer to the newly created OpenAIBackend instance.
-func NewOpenAIBackend(apiKey, model string) *OpenAIBackend {
+func NewOpenAIBackend(apiKey, model string, opts ...Option) *OpenAIBackend {
+	o := newOptions(opts)
+
+	baseURL := defaultOpenAIBaseURL
+	if o.baseURL != "" {
+		baseURL = o.baseURL
+	}
+
+	client, transport := newHTTPClient(o, 0)
+
 	return &OpenAIBackend{
-		APIKey:     apiKey,
-		Model:      model,
-		HTTPClient: http.DefaultClient,
-		BaseURL:    "https://api.openai.com",
+		APIKey:             apiKey,
+		Model:              model,
+		HTTPClient:         client,
+		BaseURL:            baseURL,
+		APIKeyHeader:       o.apiKeyHeader,
+		SystemPrompt:       o.systemPrompt,
+		RequestTimeout:     o.timeout,
+		StreamIdleTimeout:  o.streamIdleTimeout,
+		Headers:            o.headers,
+		UserAgent:          o.userAgent,
+		MaxRequestBytes:    o.maxBodyBytes,
+		Tokenizer:          o.tokenizer,
+		UnsupportedOptions: o.unsupported,
+		transport:          transport,
+		EmbeddingModel:     o.embedModel,
 	}
 }
 
+// NewOpenAICompatibleBackend creates an OpenAIBackend for a provider that exposes an
+// OpenAI-compatible chat completions API at baseURL, such as Groq, Together, vLLM or
+// LocalAI. baseURL may be given with or without the trailing "/v1" that providers
+// usually document, e.g. "https://api.groq.com/openai/v1". An empty apiKey sends no
+// authentication, for local servers that do not need any.
+func NewOpenAICompatibleBackend(baseURL, apiKey, model string, opts ...Option) *OpenAIBackend {
+	o := NewOpenAIBackend(apiKey, model, opts...)
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	o.BaseURL = strings.TrimSuffix(baseURL, "/v1")
+	return o
+}
+
 // OpenAIResponse represents the structure of the response received from the OpenAI API.
 // It contains information about the generated content, model details, and usage statistics.
 type OpenAIResponse struct {
@@ -60,8 +152,9 @@ type OpenAIResponse struct {
 	Choices []struct {
 		Index   int `json:"index"`
 		Message struct {
-			Role    string `json:"role"`
-			Content string `json:"content"`
+			Role      string           `json:"role"`
+			Content   string           `json:"content"`
+			ToolCalls []openAIToolCall `json:"tool_calls,omitempty"`
 		} `json:"message"`
 		FinishReason string `json:"finish_reason"`
 	} `json:"choices"`
@@ -72,57 +165,499 @@ type OpenAIResponse struct {
 	} `json:"usage"`
 }
 
-// Generate produces a response from the OpenAI API based on the given prompt.
-// It sends a request to the OpenAI chat completions endpoint and returns the response.
+// openAIMessage is a chat message in the wire format of the chat completions API.
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    string           `json:"content"`
+	Name       string           `json:"name,omitempty"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+// openAIToolCall is a tool call in the wire format of the chat completions API.
+// Unlike Ollama, OpenAI encodes the function arguments as a JSON string.
+type openAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// toOpenAIMessages translates messages into the chat completions wire format.
+func toOpenAIMessages(messages []Message) ([]openAIMessage, error) {
+	out := make([]openAIMessage, 0, len(messages))
+	for _, msg := range messages {
+		oaMsg := openAIMessage{
+			Role:       msg.Role,
+			Content:    msg.Content,
+			ToolCallID: msg.ToolCallID,
+		}
+		if msg.Role != RoleTool {
+			// Tool results are identified by ToolCallID instead
+			oaMsg.Name = openAIName(msg.Name)
+		}
+		for _, call := range msg.ToolCalls {
+			args, err := json.Marshal(call.Function.Arguments)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal arguments of tool call %s: %w", call.Function.Name, err)
+			}
+			oaCall := openAIToolCall{ID: call.ID, Type: "function"}
+			oaCall.Function.Name = call.Function.Name
+			oaCall.Function.Arguments = string(args)
+			oaMsg.ToolCalls = append(oaMsg.ToolCalls, oaCall)
+		}
+		out = append(out, oaMsg)
+	}
+	return out, nil
+}
+
+// openAIName returns name in the form OpenAI accepts for the name of a
+// participant: at most 64 letters, digits, underscores and hyphens. Other
+// characters, such as spaces, are replaced with underscores.
+func openAIName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if b.Len() == 64 {
+			break
+		}
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-') {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// fromOpenAIToolCalls translates tool calls from the chat completions wire format.
+func fromOpenAIToolCalls(calls []openAIToolCall) ([]ToolCall, error) {
+	var out []ToolCall
+	for _, call := range calls {
+		var args map[string]any
+		if call.Function.Arguments != "" {
+			if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
+				return nil, fmt.Errorf("failed to decode arguments of tool call %s: %w", call.Function.Name, err)
+			}
+		}
+		out = append(out, ToolCall{
+			ID: call.ID,
+			Function: FunctionCall{
+				Name:      call.Function.Name,
+				Arguments: args,
+			},
+		})
+	}
+	return out, nil
+}
+
+// Chat sends the conversation in messages to the OpenAI chat completions endpoint and returns the reply.
+// Tools use the same definitions as for Ollama and the model is free to decide whether to call them.
+// Tool calls in the reply are available in the ToolCalls of the returned Message.
 //
 // Parameters:
 //   - ctx: A context.Context for handling timeouts and cancellations.
-//   - prompt: A string containing the user's input prompt.
+//   - messages: The conversation so far.
+//   - tools: The tools the model may call, or nil.
 //
 // Returns:
-//   - *OpenAIResponse: A pointer to the OpenAIResponse struct containing the API's response.
+//   - *Response: A pointer to the Response struct containing the API's reply.
 //   - error: An error if the request fails or if there's an issue processing the response.
-func (o *OpenAIBackend) Generate(ctx context.Context, prompt string) (*OpenAIResponse, error) {
-	url := o.BaseURL + "/v1/chat/completions"
-	reqBody := map[string]interface{}{
-		"model": o.Model,
-		"messages": []map[string]string{
-			{"role": "user", "content": prompt},
-		},
-	}
+func (o *OpenAIBackend) Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	ctx, cancel := withRequestTimeout(ctx, o.RequestTimeout)
+	defer cancel()
 
-	reqBodyBytes, err := json.Marshal(reqBody)
+	callOpts, err := newModelCallOptions(o.Model, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+		return nil, err
+	}
+	if err := callOpts.checkSupported("OpenAI", o.UnsupportedOptions, ollamaOnlyOptions...); err != nil {
+		return nil, err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBodyBytes))
+	result, err := o.chatCompletion(ctx, messages, tools, callOpts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return dryRunResponse(o.Model, err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+o.APIKey)
+	return result.toResponse(openAIFinishReasons)
+}
 
-	resp, err := o.HTTPClient.Do(req)
+// chatCompletion sends messages and tools to the chat completions endpoint and
+// returns the unmodified OpenAI response.
+func (o *OpenAIBackend) chatCompletion(ctx context.Context, messages []Message, tools []Tool, opts *Options) (*OpenAIResponse, error) {
+	reqBody, err := openAIChatRequest(o.Model, o.SystemPrompt, o.Tokenizer, messages, tools, opts)
 	if err != nil {
-		return nil, fmt.Errorf("HTTP request failed: %w", err)
+		return nil, err
+	}
+	if err := opts.dryRun(reqBody); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to generate response from OpenAI: status code %d, response: %s", resp.StatusCode, string(bodyBytes))
+	resp, err := o.post(ctx, openAIChatEndpoint, o.header(opts.Headers), reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate response from OpenAI: %w", err)
 	}
 
 	var result OpenAIResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	if err := decodeResponse(ctx, resp, &result, opts); err != nil {
+		return nil, err
 	}
 
 	return &result, nil
 }
 
+// openAIChatRequest builds the body of a request to the chat completions endpoint,
+// which is shared by OpenAI and OpenAI-compatible APIs such as Mistral's.
+func openAIChatRequest(model, systemPrompt string, tokenizer Tokenizer, messages []Message, tools []Tool, opts *Options) (map[string]interface{}, error) {
+	messages, err := opts.withContextDocuments(model, tokenizer, withSystemPrompt(systemPrompt, messages))
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.checkContext(model, tokenizer, messages); err != nil {
+		return nil, err
+	}
+	oaMessages, err := toOpenAIMessages(messages)
+	if err != nil {
+		return nil, err
+	}
+
+	reqBody := map[string]interface{}{
+		"model":    model,
+		"messages": oaMessages,
+	}
+	if err := opts.checkTools(tools); err != nil {
+		return nil, err
+	}
+	if len(tools) > 0 {
+		reqBody["tools"] = tools
+		reqBody["tool_choice"] = openAIToolChoice(opts.ToolChoice)
+	}
+	if opts.JSONFormat {
+		reqBody["response_format"] = map[string]string{"type": "json_object"}
+	}
+	if opts.ResponseSchema != nil {
+		reqBody["response_format"] = map[string]any{
+			"type": "json_schema",
+			"json_schema": map[string]any{
+				"name":   "response",
+				"schema": opts.ResponseSchema,
+				"strict": strictSchema(opts.ResponseSchema),
+			},
+		}
+	}
+	if opts.Temperature != nil {
+		reqBody["temperature"] = *opts.Temperature
+	}
+	if opts.TopP != nil {
+		reqBody["top_p"] = *opts.TopP
+	}
+	if len(opts.StopSequences) > 0 {
+		reqBody["stop"] = opts.StopSequences
+	}
+	if opts.Seed != nil {
+		reqBody["seed"] = *opts.Seed
+	}
+	if opts.MaxTokens != nil {
+		reqBody["max_tokens"] = *opts.MaxTokens
+	}
+	return reqBody, nil
+}
+
+// openAIToolChoice translates choice into the tool_choice of a chat completion request.
+func openAIToolChoice(choice *ToolChoice) any {
+	switch {
+	case choice == nil:
+		return "auto"
+	case choice.Name == "":
+		return "none"
+	}
+	return map[string]any{"type": "function", "function": map[string]string{"name": choice.Name}}
+}
+
+// strictSchema reports whether schema can be enforced in strict mode: every object
+// in it must set additionalProperties to false and require all its properties.
+func strictSchema(schema map[string]any) bool {
+	if schema["type"] == "object" {
+		properties, _ := schema["properties"].(map[string]any)
+		required := stringList(schema["required"])
+		if schema["additionalProperties"] != false || len(required) != len(properties) {
+			return false
+		}
+		for _, name := range required {
+			property, ok := properties[name].(map[string]any)
+			if !ok || !strictSchema(property) {
+				return false
+			}
+		}
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		return strictSchema(items)
+	}
+	return true
+}
+
+// openAIStreamChunk is a server-sent event of a streamed chat completion.
+type openAIStreamChunk struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Delta struct {
+			Content   string `json:"content"`
+			ToolCalls []struct {
+				Index    int    `json:"index"`
+				ID       string `json:"id"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// ChatStream works like Chat but streams the reply as it is generated.
+// The returned channel receives the content deltas in order and is closed when
+// the stream completes, fails or ctx is cancelled. A failure while reading the
+// stream is delivered as a final chunk with Err set.
+//
+// OpenAI streams the arguments of tool calls in fragments. They are assembled
+// and delivered with the final chunk once complete.
+//
+// As for Ollama, the Timeout of the HTTP client is not applied to streams; use
+// ctx to bound the duration of a stream.
+func (o *OpenAIBackend) ChatStream(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (<-chan StreamChunk, error) {
+	callOpts, err := newModelCallOptions(o.Model, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := callOpts.checkSupported("OpenAI", o.UnsupportedOptions, ollamaOnlyOptions...); err != nil {
+		return nil, err
+	}
+	reqBody, err := openAIChatRequest(o.Model, o.SystemPrompt, o.Tokenizer, messages, tools, callOpts)
+	if err != nil {
+		return nil, err
+	}
+	reqBody["stream"] = true
+	// Without this OpenAI does not report usage for streams
+	reqBody["stream_options"] = map[string]bool{"include_usage": true}
+	if err := callOpts.dryRun(reqBody); err != nil {
+		return dryRunStream(o.Model, err)
+	}
+
+	streamClient := *o.HTTPClient
+	streamClient.Timeout = 0
+
+	resp, err := postJSON(ctx, &streamClient, o.BaseURL+openAIChatEndpoint, o.header(callOpts.Headers), reqBody, o.MaxRequestBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate response from OpenAI: %w", err)
+	}
+
+	resp.Body = idleTimeoutBody(resp.Body, o.StreamIdleTimeout)
+	return streamChunks(ctx, resp.Body, callOpts.StopOnDelta, func(send func(StreamChunk) bool) {
+		var assembler toolCallAssembler
+		// The usage arrives in a chunk of its own after the last choice
+		var usage Usage
+		var usageAvailable bool
+		final := &Response{Model: o.Model}
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxSSELineSize)
+
+		// sendReady delivers the tool calls with an index below upTo that are complete
+		sendReady := func(upTo int) bool {
+			calls, err := assembler.ready(upTo)
+			if err != nil {
+				send(StreamChunk{Err: err})
+				return false
+			}
+			for _, call := range calls {
+				if !send(StreamChunk{ToolCallReady: &call}) {
+					return false
+				}
+			}
+			return true
+		}
+
+		// Every event is a "data: " line holding a chunk, the last one holds [DONE]
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data:")
+			if !ok {
+				continue
+			}
+			data = strings.TrimSpace(data)
+			if data == "[DONE]" {
+				if !sendReady(math.MaxInt) {
+					return
+				}
+				toolCalls, err := assembler.toolCalls()
+				if err != nil {
+					send(StreamChunk{Err: err})
+					return
+				}
+				send(StreamChunk{Done: true, ToolCalls: toolCalls, Usage: usage, UsageAvailable: usageAvailable, Response: final})
+				return
+			}
+
+			var chunk openAIStreamChunk
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				send(StreamChunk{Err: fmt.Errorf("failed to decode stream: %w", err)})
+				return
+			}
+			if chunk.Model != "" {
+				final.Model = chunk.Model
+			}
+			if chunk.Usage != nil {
+				usage = Usage{PromptTokens: chunk.Usage.PromptTokens, CompletionTokens: chunk.Usage.CompletionTokens}
+				usageAvailable = true
+				final.PromptEvalCount, final.EvalCount = usage.PromptTokens, usage.CompletionTokens
+			}
+			if len(chunk.Choices) == 0 {
+				continue
+			}
+			delta := chunk.Choices[0].Delta
+			for _, call := range delta.ToolCalls {
+				// A fragment of a call completes the calls before it
+				if !sendReady(call.Index) {
+					return
+				}
+				assembler.add(call.Index, call.ID, call.Function.Name, call.Function.Arguments)
+			}
+			if delta.Content != "" && !send(StreamChunk{Content: delta.Content}) {
+				return
+			}
+
+			if reason := chunk.Choices[0].FinishReason; reason != "" {
+				final.DoneReason = reason
+				final.setFinishReason(reason, openAIFinishReasons)
+				final.Truncated = final.FinishReason == FinishLength
+				if !sendReady(math.MaxInt) {
+					return
+				}
+			}
+		}
+
+		err := scanner.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		send(StreamChunk{Err: contextError(ctx, fmt.Errorf("failed to decode stream: %w", err))})
+	}), nil
+}
+
+// ChatToWriter streams the reply to the conversation in messages and writes the content
+// to w as it arrives. It returns the complete reply once the stream ends; see the
+// package-level ChatToWriter for details.
+func (o *OpenAIBackend) ChatToWriter(ctx context.Context, messages []Message, tools []Tool, w io.Writer, opts ...CallOption) (*Response, error) {
+	return ChatToWriter(ctx, o, messages, tools, w, opts...)
+}
+
+// toResponse converts the OpenAI specific response into the backend-neutral Response,
+// normalizing the finish reason with reasons. Some OpenAI-compatible servers omit
+// fields such as created and usage, which are then left unset.
+func (r *OpenAIResponse) toResponse(reasons map[string]string) (*Response, error) {
+	out := &Response{
+		Model:           r.Model,
+		Done:            true,
+		PromptEvalCount: r.Usage.PromptTokens,
+		EvalCount:       r.Usage.CompletionTokens,
+	}
+	if r.Created != 0 {
+		out.CreatedAt = time.Unix(r.Created, 0).UTC().Format(time.RFC3339)
+	}
+	if r.Usage.PromptTokens != 0 || r.Usage.CompletionTokens != 0 {
+		out.setUsage(r.Usage.PromptTokens, r.Usage.CompletionTokens, 0)
+	}
+	if len(r.Choices) == 0 {
+		return out, nil
+	}
+
+	choice := r.Choices[0]
+	toolCalls, err := fromOpenAIToolCalls(choice.Message.ToolCalls)
+	if err != nil {
+		return nil, err
+	}
+
+	out.Message = Message{
+		Role:      choice.Message.Role,
+		Content:   choice.Message.Content,
+		ToolCalls: toolCalls,
+	}
+	if out.Message.Role == "" {
+		out.Message.Role = RoleAssistant
+	}
+	out.Response = choice.Message.Content
+	out.separateReasoning()
+	out.DoneReason = choice.FinishReason
+	out.setFinishReason(choice.FinishReason, reasons)
+	out.Truncated = out.FinishReason == FinishLength
+	return out, nil
+}
+
+// openAIFinishReasons maps the finish reasons of OpenAI to the Finish constants.
+var openAIFinishReasons = map[string]string{
+	"stop":           FinishStop,
+	"length":         FinishLength,
+	"tool_calls":     FinishToolCalls,
+	"function_call":  FinishToolCalls,
+	"content_filter": FinishContentFilter,
+}
+
+// Generate produces a response from the OpenAI API based on the given prompt.
+// The prompt is sent as a single user message to the chat completions endpoint.
+//
+// Generate returns the backend-neutral Response so that OpenAIBackend implements
+// Backend. Callers that need OpenAI specific fields such as ID, Choices or
+// Usage.TotalTokens should use GenerateRaw.
+//
+// Parameters:
+//   - ctx: A context.Context for handling timeouts and cancellations.
+//   - prompt: A string containing the user's input prompt.
+//
+// Returns:
+//   - *Response: A pointer to the Response struct; the generated text is in its Response field.
+//   - error: An error if the request fails or if there's an issue processing the response.
+func (o *OpenAIBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	return o.Chat(ctx, []Message{UserMessage(prompt)}, nil, opts...)
+}
+
+// Close implements Backend. It closes the idle connections of the pool created for
+// WithConnectionPool, if any. Other HTTP clients and transports may be shared with
+// other backends and are left open.
+func (o *OpenAIBackend) Close() error {
+	return closeTransport(o.transport)
+}
+
+// GenerateRaw works like Generate but returns the unmodified OpenAI response.
+//
+// Parameters:
+//   - ctx: A context.Context for handling timeouts and cancellations.
+//   - prompt: A string containing the user's input prompt.
+//
+// Returns:
+//   - *OpenAIResponse: A pointer to the OpenAIResponse struct containing the API's response.
+//   - error: An error if the request fails or if there's an issue processing the response.
+func (o *OpenAIBackend) GenerateRaw(ctx context.Context, prompt string, opts ...CallOption) (*OpenAIResponse, error) {
+	ctx, cancel := withRequestTimeout(ctx, o.RequestTimeout)
+	defer cancel()
+
+	callOpts, err := newModelCallOptions(o.Model, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := callOpts.checkSupported("OpenAI", o.UnsupportedOptions, ollamaOnlyOptions...); err != nil {
+		return nil, err
+	}
+	if callOpts.DryRun {
+		return nil, fmt.Errorf("%w: dry run is not supported by GenerateRaw", ErrInvalidOption)
+	}
+	return o.chatCompletion(ctx, []Message{UserMessage(prompt)}, nil, callOpts)
+}
+
 // OpenAIEmbeddingResponse represents the structure of the response received from OpenAI's embedding API.
 // It contains information about the generated embeddings, including the model used and usage statistics.
 type OpenAIEmbeddingResponse struct {
@@ -143,41 +678,86 @@ type OpenAIEmbeddingResponse struct {
 // It takes a context for cancellation and timeout, and the text to be embedded.
 // The function returns an EmbeddingResponse containing the embedding vector and related information,
 // or an error if the API request fails or the response cannot be processed.
+//
+// The embedding is generated with the EmbeddingModel, if set.
 func (o *OpenAIBackend) Embed(ctx context.Context, text string) (*OpenAIEmbeddingResponse, error) {
-	url := o.BaseURL + "/v1/embeddings"
+	ctx, cancel := withRequestTimeout(ctx, o.RequestTimeout)
+	defer cancel()
+
+	model, err := o.embeddingModel(ctx)
+	if err != nil {
+		return nil, err
+	}
 	reqBody := map[string]interface{}{
-		"model": "text-embedding-ada-002",
+		"model": model,
 		"input": text,
 	}
 
-	reqBodyBytes, err := json.Marshal(reqBody)
+	resp, err := o.post(ctx, openAIEmbeddingEndpoint, o.header(nil), reqBody)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+		return nil, fmt.Errorf("failed to generate embedding from OpenAI: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBodyBytes))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+	var result OpenAIEmbeddingResponse
+	if err := decodeJSON(ctx, resp, &result); err != nil {
+		return nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+o.APIKey)
+	return &result, nil
+}
 
-	resp, err := o.HTTPClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("HTTP request failed: %w", err)
+// embeddingModel returns the model that generates embeddings. The first time
+// EmbeddingModel is used, it is looked up and fails with an error matching
+// ErrModelNotFound if the API does not serve it.
+func (o *OpenAIBackend) embeddingModel(ctx context.Context) (string, error) {
+	model := o.EmbeddingModel
+	if model == "" {
+		return defaultOpenAIEmbeddingModel, nil
+	}
+	if verified := o.verifiedEmbeddingModel.Load(); verified != nil && *verified == model {
+		return model, nil
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to generate embedding from OpenAI: status code %d, response: %s", resp.StatusCode, string(bodyBytes))
+	resp, err := getJSON(ctx, o.HTTPClient, o.BaseURL+openAIModelsEndpoint+"/"+url.PathEscape(model), o.header(nil))
+	if err != nil {
+		return "", fmt.Errorf("failed to check embedding model %s: %w", model, err)
 	}
+	resp.Body.Close()
+	o.verifiedEmbeddingModel.Store(&model)
+	return model, nil
+}
 
-	var result OpenAIEmbeddingResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+// Ping checks that the OpenAI API is reachable and accepts the API key by listing
+// the available models, which costs no tokens. It returns an error matching
+// ErrUnreachable if the server cannot be reached.
+func (o *OpenAIBackend) Ping(ctx context.Context) error {
+	ctx, cancel := withRequestTimeout(ctx, o.RequestTimeout)
+	defer cancel()
+
+	resp, err := getJSON(ctx, o.HTTPClient, o.BaseURL+openAIModelsEndpoint, o.header(nil))
+	if err != nil {
+		return fmt.Errorf("failed to ping OpenAI: %w", unreachableError(o.BaseURL, err))
 	}
+	resp.Body.Close()
+	return nil
+}
 
-	return &result, nil
+// post sends body to the given OpenAI API endpoint with the given headers.
+func (o *OpenAIBackend) post(ctx context.Context, endpoint string, header http.Header, body any) (*http.Response, error) {
+	return postJSON(ctx, o.HTTPClient, o.BaseURL+endpoint, header, body, o.MaxRequestBytes)
+}
+
+// header returns the headers that authenticate a request with the API key, on top
+// of the custom headers, including callHeaders set for the call.
+func (o *OpenAIBackend) header(callHeaders map[string]string) http.Header {
+	header := http.Header{}
+	switch {
+	case o.APIKey == "":
+		// Local servers such as vLLM often run without authentication
+	case o.APIKeyHeader != "":
+		header.Set(o.APIKeyHeader, o.APIKey)
+	default:
+		header.Set("Authorization", "Bearer "+o.APIKey)
+	}
+	return requestHeader(header, o.UserAgent, o.Headers, callHeaders)
 }
@@ -16,8 +16,10 @@ package backend
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -32,16 +34,18 @@ func TestGenerate(t *testing.T) {
 		Choices: []struct {
 			Index   int `json:"index"`
 			Message struct {
-				Role    string `json:"role"`
-				Content string `json:"content"`
+				Role      string           `json:"role"`
+				Content   string           `json:"content"`
+				ToolCalls []openAIToolCall `json:"tool_calls,omitempty"`
 			} `json:"message"`
 			FinishReason string `json:"finish_reason"`
 		}{
 			{
 				Index: 0,
 				Message: struct {
-					Role    string `json:"role"`
-					Content string `json:"content"`
+					Role      string           `json:"role"`
+					Content   string           `json:"content"`
+					ToolCalls []openAIToolCall `json:"tool_calls,omitempty"`
 				}{
 					Role:    "assistant",
 					Content: "This is a test response.",
@@ -97,11 +101,117 @@ func TestGenerate(t *testing.T) {
 	}
 
 	// Validate the response
-	if response.ID != mockResponse.ID {
-		t.Errorf("Expected ID %s, got %s", mockResponse.ID, response.ID)
+	if response.Model != mockResponse.Model {
+		t.Errorf("Expected model %s, got %s", mockResponse.Model, response.Model)
+	}
+	if response.Response != mockResponse.Choices[0].Message.Content {
+		t.Errorf("Expected content %s, got %s", mockResponse.Choices[0].Message.Content, response.Response)
+	}
+	if response.Message.Content != mockResponse.Choices[0].Message.Content {
+		t.Errorf("Expected message content %s, got %s", mockResponse.Choices[0].Message.Content, response.Message.Content)
+	}
+	if response.DoneReason != "stop" {
+		t.Errorf("Expected done reason stop, got %s", response.DoneReason)
+	}
+	if response.PromptEvalCount != 5 || response.EvalCount != 5 {
+		t.Errorf("Expected 5 prompt and 5 completion tokens, got %d and %d", response.PromptEvalCount, response.EvalCount)
+	}
+	if !response.UsageAvailable || response.Usage.PromptTokens != 5 || response.Usage.CompletionTokens != 5 {
+		t.Errorf("Unexpected usage: %+v", response.Usage)
+	}
+}
+
+func TestOpenAIChatWithTools(t *testing.T) {
+	// The request body is checked on the test goroutine once Chat returns
+	type chatRequest struct {
+		Messages   []openAIMessage `json:"messages"`
+		Tools      []Tool          `json:"tools"`
+		ToolChoice string          `json:"tool_choice"`
+	}
+	received := make(chan chatRequest, 1)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != openAIChatEndpoint {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+
+		var reqBody chatRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+
+		// Write a response with a tool call, as the API does
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"model": "gpt-4o-mini",
+			"choices": [{
+				"index": 0,
+				"message": {
+					"role": "assistant",
+					"tool_calls": [{
+						"id": "call_2",
+						"type": "function",
+						"function": {"name": "get_weather", "arguments": "{\"city\":\"Brno\"}"}
+					}]
+				},
+				"finish_reason": "tool_calls"
+			}]
+		}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOpenAIBackend("test-api-key", "gpt-4o-mini", WithBaseURL(mockServer.URL))
+	if backend.BaseURL != mockServer.URL {
+		t.Fatalf("Expected base URL %s, got %s", mockServer.URL, backend.BaseURL)
+	}
+
+	messages := []Message{
+		{Role: "user", Content: "What's the weather in Prague?"},
+		{Role: "assistant", ToolCalls: []ToolCall{{
+			ID:       "call_1",
+			Function: FunctionCall{Name: "get_weather", Arguments: map[string]any{"city": "Prague"}},
+		}}},
+		{Role: "tool", Content: "sunny", ToolCallID: "call_1"},
+	}
+	tools := []Tool{{"type": "function", "function": map[string]any{"name": "get_weather"}}}
+
+	response, err := backend.Chat(context.Background(), messages, tools)
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+
+	reqBody := <-received
+	if len(reqBody.Tools) != 1 {
+		t.Errorf("Expected 1 tool, got %d", len(reqBody.Tools))
+	}
+	if reqBody.ToolChoice != "auto" {
+		t.Errorf("Expected tool_choice auto, got %s", reqBody.ToolChoice)
+	}
+	// The previous assistant tool call must be sent with string arguments
+	if len(reqBody.Messages) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(reqBody.Messages))
+	}
+	if len(reqBody.Messages[1].ToolCalls) != 1 {
+		t.Fatalf("Expected 1 tool call in the assistant message, got %d", len(reqBody.Messages[1].ToolCalls))
+	}
+	prevCall := reqBody.Messages[1].ToolCalls[0]
+	if prevCall.Type != "function" || prevCall.Function.Arguments != `{"city":"Prague"}` {
+		t.Errorf("Unexpected tool call in request: %+v", prevCall)
 	}
-	if response.Choices[0].Message.Content != mockResponse.Choices[0].Message.Content {
-		t.Errorf("Expected content %s, got %s", mockResponse.Choices[0].Message.Content, response.Choices[0].Message.Content)
+	if reqBody.Messages[2].ToolCallID != "call_1" {
+		t.Errorf("Expected tool_call_id call_1, got %s", reqBody.Messages[2].ToolCallID)
+	}
+
+	if len(response.Message.ToolCalls) != 1 {
+		t.Fatalf("Expected 1 tool call, got %d", len(response.Message.ToolCalls))
+	}
+	call := response.Message.ToolCalls[0]
+	if call.ID != "call_2" || call.Function.Name != "get_weather" {
+		t.Errorf("Unexpected tool call: %+v", call)
+	}
+	if call.Function.Arguments["city"] != "Brno" {
+		t.Errorf("Expected city argument Brno, got %v", call.Function.Arguments["city"])
 	}
 }
 
@@ -173,3 +283,421 @@ func TestGenerateEmbedding(t *testing.T) {
 		t.Errorf("Expected model %s, got %s", mockResponse.Model, response.Model)
 	}
 }
+
+func TestOpenAIGenerateRaw(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Azure OpenAI authenticates with the api-key header rather than a bearer token
+		if r.Header.Get("api-key") != "test-api-key" {
+			t.Errorf("Expected api-key test-api-key, got %s", r.Header.Get("api-key"))
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("Expected no Authorization header, got %s", r.Header.Get("Authorization"))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"id": "test-id",
+			"model": "gpt-4o-mini",
+			"choices": [{"index": 0, "message": {"role": "assistant", "content": "Hi!"}, "finish_reason": "stop"}],
+			"usage": {"prompt_tokens": 3, "completion_tokens": 2, "total_tokens": 5}
+		}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOpenAIBackend("test-api-key", "gpt-4o-mini", WithBaseURL(mockServer.URL), WithAPIKeyHeader("api-key"))
+
+	response, err := backend.GenerateRaw(context.Background(), "Hello")
+	if err != nil {
+		t.Fatalf("GenerateRaw returned error: %v", err)
+	}
+
+	if response.ID != "test-id" {
+		t.Errorf("Expected ID test-id, got %s", response.ID)
+	}
+	if len(response.Choices) != 1 || response.Choices[0].Message.Content != "Hi!" {
+		t.Errorf("Unexpected choices: %+v", response.Choices)
+	}
+	if response.Usage.TotalTokens != 5 {
+		t.Errorf("Expected 5 total tokens, got %d", response.Usage.TotalTokens)
+	}
+}
+
+func TestOpenAIPing(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != openAIModelsEndpoint {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer test-api-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"object": "list", "data": []}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOpenAIBackend("test-api-key", "gpt-4o-mini", WithBaseURL(mockServer.URL))
+	if err := backend.Ping(context.Background()); err != nil {
+		t.Errorf("Ping returned error: %v", err)
+	}
+
+	backend = NewOpenAIBackend("wrong-key", "gpt-4o-mini", WithBaseURL(mockServer.URL))
+	var backendErr *BackendError
+	if err := backend.Ping(context.Background()); !errors.As(err, &backendErr) || backendErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a 401 BackendError, got %v", err)
+	}
+}
+
+func TestOpenAIChatStream(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if reqBody["stream"] != true {
+			t.Errorf("Expected stream true, got %v", reqBody["stream"])
+		}
+		if options, _ := reqBody["stream_options"].(map[string]any); options["include_usage"] != true {
+			t.Errorf("Expected the stream to include usage, got %v", reqBody["stream_options"])
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(`data: {"choices": [{"delta": {"role": "assistant", "content": "Let me "}}]}
+
+data: {"choices": [{"delta": {"content": "check."}}]}
+
+data: {"choices": [{"delta": {"tool_calls": [{"index": 0, "id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": ""}}]}}]}
+
+data: {"choices": [{"delta": {"tool_calls": [{"index": 0, "function": {"arguments": "{\"city\": "}}]}}]}
+
+data: {"choices": [{"delta": {"tool_calls": [{"index": 0, "function": {"arguments": "\"Brno\"}"}}]}}]}
+
+data: {"choices": [{"delta": {}, "finish_reason": "tool_calls"}]}
+
+data: {"choices": [], "usage": {"prompt_tokens": 15, "completion_tokens": 6, "total_tokens": 21}}
+
+data: [DONE]
+
+`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOpenAIBackend("test-api-key", "gpt-4o-mini", WithBaseURL(mockServer.URL))
+	chunks, err := backend.ChatStream(context.Background(), []Message{UserMessage("Weather in Brno?")}, nil)
+	if err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+
+	var content string
+	var last StreamChunk
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			t.Fatalf("Unexpected stream error: %v", chunk.Err)
+		}
+		content += chunk.Content
+		last = chunk
+	}
+
+	if content != "Let me check." {
+		t.Errorf("Expected 'Let me check.', got %q", content)
+	}
+	if !last.Done {
+		t.Fatalf("Expected the last chunk to be done")
+	}
+	if len(last.ToolCalls) != 1 || last.ToolCalls[0].ID != "call_1" || last.ToolCalls[0].Function.Arguments["city"] != "Brno" {
+		t.Errorf("Unexpected tool calls: %+v", last.ToolCalls)
+	}
+	if !last.UsageAvailable || last.Usage.PromptTokens != 15 || last.Usage.CompletionTokens != 6 {
+		t.Errorf("Expected the usage on the last chunk, got %+v", last.Usage)
+	}
+
+	resp := last.Response
+	if resp == nil {
+		t.Fatalf("Expected the complete reply on the last chunk")
+	}
+	if resp.Model != "gpt-4o-mini" || resp.Message.Content != "Let me check." || len(resp.Message.ToolCalls) != 1 {
+		t.Errorf("Unexpected reply: %+v", resp)
+	}
+	if resp.FinishReason != FinishToolCalls || resp.DoneReason != "tool_calls" || resp.Usage.CompletionTokens != 6 {
+		t.Errorf("Expected the finish reason and usage in the reply, got %+v", resp)
+	}
+}
+
+func TestOpenAIChatStreamToolCallReady(t *testing.T) {
+	firstReady := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(`data: {"choices": [{"delta": {"role": "assistant", "tool_calls": [{"index": 0, "id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\": \"Brno\"}"}}]}}]}
+
+data: {"choices": [{"delta": {"tool_calls": [{"index": 1, "id": "call_2", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\": "}}]}}]}
+
+`))
+		w.(http.Flusher).Flush()
+
+		// The first call must be delivered before the second one is complete
+		select {
+		case <-firstReady:
+		case <-time.After(5 * time.Second):
+			t.Errorf("The first tool call was not delivered while the second was streamed")
+		}
+		w.Write([]byte(`data: {"choices": [{"delta": {"tool_calls": [{"index": 1, "function": {"arguments": "\"Prague\"}"}}]}}]}
+
+data: {"choices": [{"delta": {}, "finish_reason": "tool_calls"}]}
+
+data: [DONE]
+
+`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOpenAIBackend("test-api-key", "gpt-4o-mini", WithBaseURL(mockServer.URL))
+	chunks, err := backend.ChatStream(context.Background(), []Message{UserMessage("Weather in Brno and Prague?")}, nil)
+	if err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+
+	var ready []ToolCall
+	var last StreamChunk
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			t.Fatalf("Unexpected stream error: %v", chunk.Err)
+		}
+		if chunk.ToolCallReady != nil {
+			if chunk.Done || chunk.Content != "" {
+				t.Errorf("Expected a chunk of its own for the tool call, got %+v", chunk)
+			}
+			ready = append(ready, *chunk.ToolCallReady)
+			if len(ready) == 1 {
+				close(firstReady)
+			}
+		}
+		last = chunk
+	}
+
+	if len(ready) != 2 || ready[0].ID != "call_1" || ready[0].Function.Arguments["city"] != "Brno" ||
+		ready[1].ID != "call_2" || ready[1].Function.Arguments["city"] != "Prague" {
+		t.Errorf("Expected both tool calls in order, got %+v", ready)
+	}
+	if !last.Done || len(last.ToolCalls) != 2 {
+		t.Errorf("Expected the tool calls on the last chunk too, got %+v", last)
+	}
+}
+
+func TestOpenAIChatStreamTruncated(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`data: {"choices": [{"delta": {"content": "Hi"}}]}
+
+`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOpenAIBackend("test-api-key", "gpt-4o-mini", WithBaseURL(mockServer.URL))
+	chunks, err := backend.ChatStream(context.Background(), []Message{UserMessage("Hi")}, nil)
+	if err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+
+	var last StreamChunk
+	for chunk := range chunks {
+		last = chunk
+	}
+	if last.Err == nil {
+		t.Errorf("Expected an error for a stream without [DONE]")
+	}
+}
+
+func TestOpenAIMaxTokens(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+		w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "Once upon a"}, "finish_reason": "length"}]}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOpenAIBackend("test-api-key", "gpt-4o-mini", WithBaseURL(mockServer.URL))
+	response, err := backend.Generate(context.Background(), "Tell me a story.", WithMaxTokens(3))
+	if err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+
+	if maxTokens := (<-received)["max_tokens"]; maxTokens != float64(3) {
+		t.Errorf("Expected max_tokens 3, got %v", maxTokens)
+	}
+	if !response.Truncated {
+		t.Errorf("Expected the response to be truncated")
+	}
+	if response.FinishReason != FinishLength {
+		t.Errorf("Expected finish reason %s, got %s", FinishLength, response.FinishReason)
+	}
+}
+
+func TestOpenAIToolChoice(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+		w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "Hi"}}]}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOpenAIBackend("test-api-key", "gpt-4o-mini", WithBaseURL(mockServer.URL))
+	tools := []Tool{{"type": "function", "function": map[string]any{"name": "get_weather"}}}
+	messages := []Message{UserMessage("Weather?")}
+
+	if _, err := backend.Chat(context.Background(), messages, tools, WithToolChoice("get_weather")); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	choice, _ := (<-received)["tool_choice"].(map[string]any)
+	if function, _ := choice["function"].(map[string]any); choice["type"] != "function" || function["name"] != "get_weather" {
+		t.Errorf("Expected get_weather to be forced, got %v", choice)
+	}
+
+	if _, err := backend.Chat(context.Background(), messages, tools, WithToolChoiceNone()); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if choice := (<-received)["tool_choice"]; choice != "none" {
+		t.Errorf("Expected tool_choice none, got %v", choice)
+	}
+
+	_, err := backend.Chat(context.Background(), messages, tools, WithToolChoice("get_time"))
+	if !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Expected ErrInvalidOption for an unknown tool, got %v", err)
+	}
+}
+
+func TestOpenAIHeadersKeepAPIKey(t *testing.T) {
+	received := make(chan http.Header, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+		w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "Hi"}}]}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOpenAIBackend("test-api-key", "gpt-4o-mini", WithBaseURL(mockServer.URL),
+		WithHeaders(map[string]string{"Authorization": "Bearer other", "X-Tenant-ID": "acme"}))
+	if _, err := backend.Generate(context.Background(), "Hi"); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+
+	header := <-received
+	if header.Get("Authorization") != "Bearer test-api-key" {
+		t.Errorf("Expected the API key not to be replaced, got %s", header.Get("Authorization"))
+	}
+	if header.Get("X-Tenant-ID") != "acme" {
+		t.Errorf("Expected X-Tenant-ID acme, got %s", header.Get("X-Tenant-ID"))
+	}
+}
+
+func TestOpenAICompatibleBackend(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != openAIChatEndpoint {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			t.Errorf("Expected no authorization without an API key, got %s", auth)
+		}
+		// vLLM and similar servers may leave out fields such as usage and created
+		w.Write([]byte(`{"choices": [{"message": {"content": "Hello!"}, "finish_reason": "stop"}]}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOpenAICompatibleBackend(mockServer.URL+"/v1/", "", "meta-llama/Llama-3.1-8B-Instruct")
+	if backend.BaseURL != mockServer.URL {
+		t.Errorf("Expected the /v1 suffix to be trimmed, got %s", backend.BaseURL)
+	}
+
+	response, err := backend.Chat(context.Background(), []Message{UserMessage("Hi")}, nil)
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if response.Message.Content != "Hello!" || response.Message.Role != RoleAssistant {
+		t.Errorf("Unexpected message: %+v", response.Message)
+	}
+	if response.UsageAvailable || response.CreatedAt != "" {
+		t.Errorf("Expected no usage or creation time, got %+v", response)
+	}
+}
+
+func TestOpenAIEmbeddingModel(t *testing.T) {
+	var embedModel any
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case openAIModelsEndpoint + "/text-embedding-3-small":
+			w.Write([]byte(`{"id": "text-embedding-3-small", "object": "model"}`))
+		case openAIModelsEndpoint + "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"code": "model_not_found"}}`))
+		case openAIEmbeddingEndpoint:
+			var reqBody map[string]any
+			if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+				t.Errorf("Failed to decode request body: %v", err)
+			}
+			embedModel = reqBody["model"]
+			w.Write([]byte(`{"data": [{"embedding": [0.1, 0.2], "index": 0}], "model": "text-embedding-3-small"}`))
+		default:
+			t.Errorf("Unexpected request: %s", r.URL.Path)
+		}
+	}))
+	defer mockServer.Close()
+
+	backend := NewOpenAIBackend("test-api-key", "gpt-4o-mini", WithBaseURL(mockServer.URL), WithEmbeddingModel("text-embedding-3-small"))
+	if _, err := backend.Embed(context.Background(), "text"); err != nil {
+		t.Fatalf("Embed returned error: %v", err)
+	}
+	if embedModel != "text-embedding-3-small" {
+		t.Errorf("Expected the embedding model in the request, got %v", embedModel)
+	}
+
+	backend.EmbeddingModel = "missing"
+	if _, err := backend.Embed(context.Background(), "text"); !errors.Is(err, ErrModelNotFound) {
+		t.Errorf("Expected ErrModelNotFound, got %v", err)
+	}
+}
+
+func TestOpenAIMessageNames(t *testing.T) {
+	backend := NewOpenAIBackend("test-api-key", "gpt-4o-mini")
+	messages := []Message{
+		NamedUserMessage("alice", "Where shall we eat?"),
+		NamedUserMessage("Bob Smith", "Somewhere cheap"),
+		{Role: RoleAssistant, ToolCalls: []ToolCall{{ID: "call_1", Function: FunctionCall{Name: "find_restaurants"}}}},
+		ToolResultMessage("call_1", "find_restaurants", "Pizzeria"),
+	}
+
+	resp, err := backend.Chat(context.Background(), messages, nil, WithDryRun())
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	var reqBody struct {
+		Messages []map[string]any `json:"messages"`
+	}
+	if err := json.Unmarshal(resp.DryRunRequest, &reqBody); err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+
+	expected := []any{"alice", "Bob_Smith", nil, nil}
+	for i, name := range expected {
+		if reqBody.Messages[i]["name"] != name {
+			t.Errorf("Expected message %d to have name %v, got %v", i, name, reqBody.Messages[i]["name"])
+		}
+	}
+}
+
+func TestOpenAIName(t *testing.T) {
+	cases := map[string]string{
+		"alice":                 "alice",
+		"Bob Smith":             "Bob_Smith",
+		"zoë@example.com":       "zo__example_com",
+		strings.Repeat("a", 70): strings.Repeat("a", 64),
+	}
+	for name, want := range cases {
+		if got := openAIName(name); got != want {
+			t.Errorf("openAIName(%q) = %q, expected %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Option configures optional behaviour of a backend at construction time.
+// Options are shared by all backends; a backend ignores options that do not apply to it.
+type Option func(*backendOptions)
+
+// backendOptions holds the settings that can be changed with an Option.
+type backendOptions struct {
+	baseURL      string
+	httpClient   *http.Client
+	apiKeyHeader string
+	systemPrompt string
+	timeout      time.Duration
+	headers      map[string]string
+	basePath     string
+	embedModel   string
+	unsupported  UnsupportedOptionPolicy
+	userAgent    string
+	maxBodyBytes int
+	tokenizer    Tokenizer
+	pool         *PoolConfig
+	// connectTimeout bounds establishing a connection, zero for the default.
+	connectTimeout time.Duration
+	// streamIdleTimeout aborts streams that stay silent that long, zero for none.
+	streamIdleTimeout time.Duration
+}
+
+// newOptions applies opts on top of the defaults and returns the result.
+func newOptions(opts []Option) *backendOptions {
+	o := &backendOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithBaseURL overrides the base URL the backend sends its requests to.
+// This is useful for OpenAI-compatible gateways and proxies, or for Azure
+// OpenAI's v1 API (https://<resource>.openai.azure.com/openai), which also
+// needs WithAPIKeyHeader("api-key") for key based authentication.
+func WithBaseURL(baseURL string) Option {
+	return func(o *backendOptions) {
+		o.baseURL = baseURL
+	}
+}
+
+// WithBasePath sets the path under the base URL at which Ollama serves its API,
+// "/api" by default, for reverse proxies that expose it elsewhere, e.g. under
+// "/ollama/api". Other backends ignore it.
+func WithBasePath(path string) Option {
+	return func(o *backendOptions) {
+		o.basePath = path
+	}
+}
+
+// WithEmbeddingModel makes the backend generate embeddings with the named model
+// instead of the chat model, e.g. a dedicated embedding model such as
+// nomic-embed-text, so that a single backend serves both chat and embeddings.
+// Backends without embeddings ignore it.
+func WithEmbeddingModel(name string) Option {
+	return func(o *backendOptions) {
+		o.embedModel = name
+	}
+}
+
+// WithUnsupportedOptions sets what the backend does with a CallOption it cannot
+// honour, such as WithSeed for Anthropic or WithKeepAlive for anything but
+// Ollama. By default such options are ignored silently.
+func WithUnsupportedOptions(policy UnsupportedOptionPolicy) Option {
+	return func(o *backendOptions) {
+		o.unsupported = policy
+	}
+}
+
+// WithHTTPClient makes the backend send its requests with client instead of
+// the default one. Use it to configure timeouts, proxies or custom transports,
+// e.g. one that adds tracing headers.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *backendOptions) {
+		o.httpClient = client
+	}
+}
+
+// WithConnectionPool makes the backend send its requests over a pool of HTTP
+// connections of its own, tuned with cfg, e.g. to bound the connections opened to
+// a busy Ollama server with MaxConnsPerHost. Close closes its idle connections.
+// It is ignored if WithHTTPClient is given.
+func WithConnectionPool(cfg PoolConfig) Option {
+	return func(o *backendOptions) {
+		o.pool = &cfg
+	}
+}
+
+// WithAPIKeyHeader makes the backend send its API key as the plain value of the
+// named header instead of as a bearer token in the Authorization header.
+// Azure OpenAI expects the key in the "api-key" header.
+func WithAPIKeyHeader(name string) Option {
+	return func(o *backendOptions) {
+		o.apiKeyHeader = name
+	}
+}
+
+// WithSystemPrompt makes the backend start every Chat with a system message
+// containing prompt, unless the caller's messages already contain a system message.
+// For Ollama's Generate the prompt is sent as the system prompt of the request.
+func WithSystemPrompt(prompt string) Option {
+	return func(o *backendOptions) {
+		o.systemPrompt = prompt
+	}
+}
+
+// WithTimeout bounds the duration of every request the backend sends, so that
+// callers do not need to wrap each call in context.WithTimeout. A deadline of the
+// context passed to a call still applies if it is earlier. Streams, such as
+// ChatStream, are not bounded by the timeout; use their context instead.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *backendOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithConnectTimeout bounds the time it takes to connect to the server separately
+// from the time the model takes to reply. The timeout applies to the TCP connection
+// and to the TLS handshake each, so connecting to an HTTPS server may take up to
+// twice timeout. A request to a server that does not accept the connection then
+// fails fast, while a slow model generating a long reply is bounded only by
+// WithTimeout, the deadline of the context and, for streams, WithStreamIdleTimeout.
+// By default, as with http.DefaultTransport, the TCP connection may take up to
+// 30 seconds and the TLS handshake up to 10 more.
+// It is ignored if WithHTTPClient is given; configure the DialContext of its
+// transport instead.
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(o *backendOptions) {
+		o.connectTimeout = timeout
+	}
+}
+
+// WithStreamIdleTimeout aborts a stream, such as one of ChatStream, if no data
+// arrives from the server for timeout, e.g. because the connection hung. The
+// stream then ends with a chunk whose Err matches ErrStreamIdle. A model that
+// keeps generating, however slowly, is not interrupted. By default streams may
+// stay silent for as long as their context allows.
+func WithStreamIdleTimeout(timeout time.Duration) Option {
+	return func(o *backendOptions) {
+		o.streamIdleTimeout = timeout
+	}
+}
+
+// WithHeaders adds headers to every request the backend sends, e.g. to route
+// requests through a multi-tenant gateway. They cannot replace the headers the
+// backend sets itself, such as Content-Type and the API key; to change those,
+// use a custom transport with WithHTTPClient.
+func WithHeaders(headers map[string]string) Option {
+	return func(o *backendOptions) {
+		o.headers = headers
+	}
+}
+
+// WithUserAgent makes the backend send userAgent in the User-Agent header of its
+// requests instead of DefaultUserAgent, e.g. to attribute the requests to an
+// application in the analytics of the provider. A User-Agent set with WithHeaders
+// takes precedence.
+func WithUserAgent(userAgent string) Option {
+	return func(o *backendOptions) {
+		o.userAgent = userAgent
+	}
+}
+
+// WithMaxRequestBytes makes the backend fail requests whose JSON body is larger
+// than n bytes with a *RequestTooLargeError instead of sending them, as a safety
+// valve against a runaway conversation growing without bounds.
+func WithMaxRequestBytes(n int) Option {
+	return func(o *backendOptions) {
+		o.maxBodyBytes = n
+	}
+}
+
+// WithTokenizer makes the backend count tokens with t, e.g. for WithContextGuard
+// and WithMaxToolResultTokens, instead of the counter EstimateTokens uses for its
+// model. It lets a model family with a tokenizer of its own be counted exactly.
+func WithTokenizer(t Tokenizer) Option {
+	return func(o *backendOptions) {
+		o.tokenizer = t
+	}
+}
+
+// withRequestTimeout returns ctx bounded by timeout, unless timeout is not positive.
+// The returned cancel function must always be called.
+func withRequestTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,57 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import "sync"
+
+var (
+	modelProfilesMu sync.RWMutex
+	// modelProfiles maps model name prefixes to their default call options.
+	modelProfiles = map[string][]CallOption{}
+)
+
+// RegisterModelProfile makes every backend apply opts to the requests it sends to
+// a model whose name starts with prefix, e.g. a low temperature for code models.
+// The options of a request are applied on top, so they override the profile, and
+// if several profiles match, the one with the longest prefix is used. Tags such as
+// ":7b" are ignored, as for ModelContextLimit. Registering a profile for a prefix
+// again replaces it, and registering one without options removes it.
+func RegisterModelProfile(prefix string, opts ...CallOption) {
+	modelProfilesMu.Lock()
+	defer modelProfilesMu.Unlock()
+	if len(opts) == 0 {
+		delete(modelProfiles, prefix)
+		return
+	}
+	modelProfiles[prefix] = opts
+}
+
+// modelProfile returns the default call options registered for model.
+func modelProfile(model string) []CallOption {
+	modelProfilesMu.RLock()
+	defer modelProfilesMu.RUnlock()
+	profile, _ := longestPrefixMatch(modelProfiles, baseModelName(model))
+	return profile
+}
+
+// newModelCallOptions works like newCallOptions but applies the profile of model
+// first, see RegisterModelProfile.
+func newModelCallOptions(model string, opts []CallOption) (*Options, error) {
+	profile := modelProfile(model)
+	if len(profile) == 0 {
+		return newCallOptions(opts)
+	}
+	return newCallOptions(append(profile[:len(profile):len(profile)], opts...))
+}
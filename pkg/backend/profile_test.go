@@ -0,0 +1,77 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegisterModelProfile(t *testing.T) {
+	RegisterModelProfile("codellama", WithTemperature(0.1), WithStopSequences("```"))
+	RegisterModelProfile("qwen2.5", WithTemperature(0.5))
+	RegisterModelProfile("qwen2.5-coder", WithTemperature(0))
+	t.Cleanup(func() {
+		RegisterModelProfile("codellama")
+		RegisterModelProfile("qwen2.5")
+		RegisterModelProfile("qwen2.5-coder")
+	})
+
+	received := make(chan map[string]any, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		received <- reqBody
+		json.NewEncoder(w).Encode(Response{Message: AssistantMessage("ok"), Done: true})
+	}))
+	defer mockServer.Close()
+
+	options := func(model string, opts ...CallOption) map[string]any {
+		t.Helper()
+		backend := NewOllamaBackend(mockServer.URL, model)
+		if _, err := backend.Chat(context.Background(), []Message{UserMessage("Write a function")}, nil, opts...); err != nil {
+			t.Fatalf("Chat returned error: %v", err)
+		}
+		options, _ := (<-received)["options"].(map[string]any)
+		return options
+	}
+
+	if got := options("codellama:7b"); got["temperature"] != 0.1 || got["stop"] == nil {
+		t.Errorf("Expected the profile to apply, got %v", got)
+	}
+	if got := options("codellama:13b", WithTemperature(0.7)); got["temperature"] != 0.7 || got["stop"] == nil {
+		t.Errorf("Expected the call options to override the profile, got %v", got)
+	}
+	if got := options("llama3"); got != nil {
+		t.Errorf("Expected no options for a model without a profile, got %v", got)
+	}
+
+	if got := options("qwen2.5-coder:7b"); got["temperature"] != 0.0 {
+		t.Errorf("Expected the profile with the longest prefix to apply, got %v", got)
+	}
+}
+
+func TestRegisterModelProfileInvalid(t *testing.T) {
+	RegisterModelProfile("broken", WithTemperature(3))
+	t.Cleanup(func() { RegisterModelProfile("broken") })
+
+	if _, err := newModelCallOptions("broken-model", nil); err == nil {
+		t.Errorf("Expected an invalid profile to be rejected")
+	}
+}
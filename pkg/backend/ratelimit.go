@@ -0,0 +1,93 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitedBackend is a Backend that throttles the requests of the wrapped one.
+type rateLimitedBackend struct {
+	be      Backend
+	limiter *rate.Limiter
+}
+
+// WithRateLimit wraps be so that Chat, Generate and ChatStream send at most rps
+// requests per second on average, with bursts of up to burst requests. Callers
+// block until the request is allowed, or fail with ErrContextCanceled if ctx is
+// done first or its deadline would pass before then. The limit is shared by all
+// goroutines using the returned backend.
+func WithRateLimit(be Backend, rps float64, burst int) Backend {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimitedBackend{
+		be:      be,
+		limiter: rate.NewLimiter(rate.Limit(rps), burst),
+	}
+}
+
+// Chat implements Backend.
+func (r *rateLimitedBackend) Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	if err := r.wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.be.Chat(ctx, messages, tools, opts...)
+}
+
+// Generate implements Backend.
+func (r *rateLimitedBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	if err := r.wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.be.Generate(ctx, prompt, opts...)
+}
+
+// Close implements Backend by closing the wrapped backend.
+func (r *rateLimitedBackend) Close() error {
+	return r.be.Close()
+}
+
+// ChatStream passes the request to the wrapped backend once the rate limit allows it.
+func (r *rateLimitedBackend) ChatStream(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (<-chan StreamChunk, error) {
+	streamer, ok := r.be.(Streamer)
+	if !ok {
+		return nil, errors.New("backend does not support streaming")
+	}
+	if err := r.wait(ctx); err != nil {
+		return nil, err
+	}
+	return streamer.ChatStream(ctx, messages, tools, opts...)
+}
+
+// wait blocks until the limiter allows a request.
+func (r *rateLimitedBackend) wait(ctx context.Context) error {
+	err := r.limiter.Wait(ctx)
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %w", ErrContextCanceled, ctx.Err())
+	}
+	if _, ok := ctx.Deadline(); ok {
+		// The limiter gives up early if the wait would exceed the deadline
+		return fmt.Errorf("%w: %w", ErrContextCanceled, context.DeadlineExceeded)
+	}
+	return fmt.Errorf("rate limit: %w", err)
+}
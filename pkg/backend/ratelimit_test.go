@@ -0,0 +1,88 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingBackend is a Backend that counts the calls made to it and is safe for concurrent use.
+type countingBackend struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (c *countingBackend) Chat(context.Context, []Message, []Tool, ...CallOption) (*Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return &Response{}, nil
+}
+
+func (c *countingBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	return c.Chat(ctx, nil, nil, opts...)
+}
+
+func (c *countingBackend) Close() error {
+	return nil
+}
+
+func TestWithRateLimit(t *testing.T) {
+	be := &countingBackend{}
+	limited := WithRateLimit(be, 20, 2)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := limited.Generate(context.Background(), "Hi"); err != nil {
+				t.Errorf("Generate returned error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The burst of 2 passes at once, the other 4 are spaced 50ms apart
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected the requests to be throttled, took %s", elapsed)
+	}
+	if be.calls != 6 {
+		t.Errorf("Expected 6 calls, got %d", be.calls)
+	}
+}
+
+func TestWithRateLimitContextDeadline(t *testing.T) {
+	be := &countingBackend{}
+	limited := WithRateLimit(be, 0.1, 1)
+
+	if _, err := limited.Chat(context.Background(), nil, nil); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := limited.Chat(ctx, nil, nil)
+	if !errors.Is(err, ErrContextCanceled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected ErrContextCanceled and context.DeadlineExceeded, got %v", err)
+	}
+	if be.calls != 1 {
+		t.Errorf("Expected the throttled request not to reach the backend, got %d calls", be.calls)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"strings"
+	"unicode"
+)
+
+// The tags reasoning models such as DeepSeek-R1 and Qwen3 wrap their reasoning in.
+const (
+	thinkOpenTag  = "<think>"
+	thinkCloseTag = "</think>"
+)
+
+// splitReasoning splits the reasoning at the start of text, wrapped in <think>
+// tags, from the answer that follows it. Text that does not start with a <think>
+// tag is all answer. If the closing tag is missing, e.g. because the reply was
+// truncated, the whole text after the opening tag is reasoning.
+func splitReasoning(text string) (reasoning, answer string) {
+	rest, ok := strings.CutPrefix(strings.TrimLeftFunc(text, unicode.IsSpace), thinkOpenTag)
+	if !ok {
+		return "", text
+	}
+	reasoning, answer, _ = strings.Cut(rest, thinkCloseTag)
+	return strings.TrimSpace(reasoning), strings.TrimLeftFunc(answer, unicode.IsSpace)
+}
+
+// separateReasoning moves the reasoning at the start of the reply in r to
+// r.Reasoning, leaving only the answer in r.Message.Content and r.Response.
+func (r *Response) separateReasoning() {
+	var fromMessage, fromResponse string
+	fromMessage, r.Message.Content = splitReasoning(r.Message.Content)
+	fromResponse, r.Response = splitReasoning(r.Response)
+	switch {
+	case fromMessage != "":
+		r.Reasoning = fromMessage
+	case fromResponse != "":
+		r.Reasoning = fromResponse
+	}
+}
+
+// Content returns the answer of the reply, without any reasoning: the content
+// of the message for Chat and the response for Generate.
+func (r *Response) Content() string {
+	if r.Message.Content != "" {
+		return r.Message.Content
+	}
+	return r.Response
+}
+
+// Where a reasoningSplitter is in the streamed reply.
+const (
+	beforeReasoning = iota
+	inReasoning
+	inAnswer
+)
+
+// reasoningSplitter does what splitReasoning does for a streamed reply, where a
+// tag may be split across chunks. Text that may be the start of a tag is held
+// back until the next chunk tells.
+type reasoningSplitter struct {
+	state int
+	// pending is the text held back.
+	pending string
+	// trimLeft is set while the whitespace at the start of the reasoning
+	// or the answer is dropped.
+	trimLeft bool
+}
+
+// split returns the chunks to deliver for content, with Reasoning set on the
+// chunks of reasoning. If last is set, no more content follows and nothing is
+// held back.
+func (s *reasoningSplitter) split(content string, last bool) []StreamChunk {
+	var out []StreamChunk
+	emit := func(text string, reasoning bool) {
+		if s.trimLeft {
+			text = strings.TrimLeftFunc(text, unicode.IsSpace)
+		}
+		if text != "" {
+			s.trimLeft = false
+			out = append(out, StreamChunk{Content: text, Reasoning: reasoning})
+		}
+	}
+
+	text := s.pending + content
+	s.pending = ""
+	if s.state == beforeReasoning {
+		trimmed := strings.TrimLeftFunc(text, unicode.IsSpace)
+		switch {
+		case strings.HasPrefix(trimmed, thinkOpenTag):
+			s.state, s.trimLeft = inReasoning, true
+			text = trimmed[len(thinkOpenTag):]
+		case !last && strings.HasPrefix(thinkOpenTag, trimmed):
+			s.pending = text
+			return nil
+		default:
+			s.state = inAnswer
+		}
+	}
+
+	if s.state == inReasoning {
+		reasoning, answer, closed := strings.Cut(text, thinkCloseTag)
+		if !closed {
+			held := 0
+			if !last {
+				held = partialSuffix(text, thinkCloseTag)
+			}
+			s.pending = text[len(text)-held:]
+			emit(text[:len(text)-held], true)
+			return out
+		}
+		emit(reasoning, true)
+		s.state, s.trimLeft = inAnswer, true
+		text = answer
+	}
+
+	emit(text, false)
+	return out
+}
+
+// partialSuffix returns the length of the longest suffix of text that is a
+// proper prefix of tag.
+func partialSuffix(text, tag string) int {
+	for n := min(len(tag)-1, len(text)); n > 0; n-- {
+		if strings.HasSuffix(text, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
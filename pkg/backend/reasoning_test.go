@@ -0,0 +1,108 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSplitReasoning(t *testing.T) {
+	tests := []struct {
+		name          string
+		text          string
+		wantReasoning string
+		wantAnswer    string
+	}{
+		{"reasoning and answer", "<think>\n6 times 7 is 42.\n</think>\n\nThe answer is 42.", "6 times 7 is 42.", "The answer is 42."},
+		{"no reasoning", "The answer is 42.", "", "The answer is 42."},
+		{"tag not at the start", "Use <think> tags.", "", "Use <think> tags."},
+		{"truncated reasoning", "<think>Let me see", "Let me see", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reasoning, answer := splitReasoning(tt.text)
+			if reasoning != tt.wantReasoning || answer != tt.wantAnswer {
+				t.Errorf("Expected %q and %q, got %q and %q", tt.wantReasoning, tt.wantAnswer, reasoning, answer)
+			}
+		})
+	}
+}
+
+func TestReasoningSplitter(t *testing.T) {
+	text := "<think>\n6 times 7 is 42.\n</think>\n\nThe answer is 42."
+	// Split the text at every position to cover tags spread over two chunks
+	for i := 0; i <= len(text); i++ {
+		var splitter reasoningSplitter
+		parts := splitter.split(text[:i], false)
+		parts = append(parts, splitter.split(text[i:], true)...)
+
+		var reasoning, answer string
+		for _, part := range parts {
+			if part.Reasoning {
+				reasoning += part.Content
+			} else {
+				answer += part.Content
+			}
+		}
+		if reasoning != "6 times 7 is 42.\n" || answer != "The answer is 42." {
+			t.Errorf("Split at %d: got reasoning %q and answer %q", i, reasoning, answer)
+		}
+	}
+}
+
+func TestOllamaChatReasoning(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message": {"role": "assistant", "content": "<think>6 times 7 is 42.</think>\n\nThe answer is 42."}, "done": true}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "deepseek-r1")
+	response, err := backend.Chat(context.Background(), []Message{UserMessage("What is 6 times 7?")}, nil)
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if response.Reasoning != "6 times 7 is 42." {
+		t.Errorf("Expected the reasoning to be separated, got %q", response.Reasoning)
+	}
+	if response.Message.Content != "The answer is 42." || response.Content() != "The answer is 42." {
+		t.Errorf("Expected only the answer in the content, got %q", response.Message.Content)
+	}
+}
+
+func TestOllamaChatStreamReasoning(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, content := range []string{"<thi", "nk>6 times 7", " is 42.</th", "ink>\n\nThe answer", " is 42."} {
+			w.Write([]byte(`{"message": {"role": "assistant", "content": "` + strings.ReplaceAll(content, "\n", `\n`) + `"}, "done": false}` + "\n"))
+		}
+		w.Write([]byte(`{"message": {"role": "assistant", "content": ""}, "done": true}` + "\n"))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "deepseek-r1")
+	var out strings.Builder
+	response, err := backend.ChatToWriter(context.Background(), []Message{UserMessage("What is 6 times 7?")}, nil, &out)
+	if err != nil {
+		t.Fatalf("ChatToWriter returned error: %v", err)
+	}
+	if out.String() != "The answer is 42." {
+		t.Errorf("Expected only the answer to be written, got %q", out.String())
+	}
+	if response.Reasoning != "6 times 7 is 42." || response.Message.Content != "The answer is 42." {
+		t.Errorf("Unexpected reply: reasoning %q, content %q", response.Reasoning, response.Message.Content)
+	}
+}
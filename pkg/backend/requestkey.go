@@ -0,0 +1,74 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// requestKeyInput is hashed by RequestKey.
+type requestKeyInput struct {
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages,omitempty"`
+	Tools    []Tool    `json:"tools,omitempty"`
+	Options  Options   `json:"options"`
+}
+
+// RequestKey returns a stable key identifying a chat request, the hex encoded
+// SHA-256 of its canonical JSON form, e.g. to cache its reply or to send it only
+// once. Requests that are logically identical have the same key: the keys of
+// JSON objects, including those nested in tools or in json.RawMessage values,
+// are sorted, so neither map iteration order nor the order of keys in hand
+// written schemas matters. The functions in opts, such as the TokenCounter, are
+// not part of the key.
+//
+// It returns an empty string if the request cannot be encoded as JSON, e.g.
+// because a tool holds a channel, in which case no backend could send it either.
+func RequestKey(model string, messages []Message, tools []map[string]any, opts Options) string {
+	key, err := hashCanonical(requestKeyInput{Model: model, Messages: messages, Tools: tools, Options: opts})
+	if err != nil {
+		return ""
+	}
+	return key
+}
+
+// hashCanonical returns the hex encoded SHA-256 of the canonical JSON form of v,
+// in which the keys of all objects are sorted and numbers are kept as written.
+func hashCanonical(v any) (string, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute request key: %w", err)
+	}
+
+	// Decoding into generic values and encoding again sorts the keys of objects
+	// that were marshaled as they are, such as json.RawMessage
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var generic any
+	if err := decoder.Decode(&generic); err != nil {
+		return "", fmt.Errorf("failed to compute request key: %w", err)
+	}
+	canonical, err := json.Marshal(generic)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute request key: %w", err)
+	}
+
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRequestKey(t *testing.T) {
+	messages := []Message{SystemMessage("Be brief."), UserMessage("What is the weather in Brno?")}
+	tool := func(parameters string) map[string]any {
+		return map[string]any{
+			"type": "function",
+			"function": map[string]any{
+				"name":       "get_weather",
+				"parameters": json.RawMessage(parameters),
+			},
+		}
+	}
+	temperature := 0.2
+	opts := Options{Temperature: &temperature}
+
+	key := RequestKey("llama3", messages, []map[string]any{tool(`{"type": "object", "required": ["city"]}`)}, opts)
+	if len(key) != 64 {
+		t.Fatalf("Expected a hex encoded SHA-256, got %q", key)
+	}
+
+	// The order of the keys of JSON objects does not matter
+	reordered := RequestKey("llama3", messages, []map[string]any{tool(`{"required":["city"],"type":"object"}`)}, opts)
+	if reordered != key {
+		t.Errorf("Expected logically identical requests to have the same key")
+	}
+
+	// Functions are not part of the key
+	opts.TokenCounter = HeuristicTokenCount
+	if RequestKey("llama3", messages, []map[string]any{tool(`{"type": "object", "required": ["city"]}`)}, opts) != key {
+		t.Errorf("Expected the token counter to be ignored")
+	}
+
+	otherTemperature := 0.3
+	changes := map[string]string{
+		"model":    RequestKey("qwen2.5", messages, []map[string]any{tool(`{"type": "object", "required": ["city"]}`)}, opts),
+		"messages": RequestKey("llama3", messages[1:], []map[string]any{tool(`{"type": "object", "required": ["city"]}`)}, opts),
+		"tools":    RequestKey("llama3", messages, []map[string]any{tool(`{"type": "object"}`)}, opts),
+		"options":  RequestKey("llama3", messages, []map[string]any{tool(`{"type": "object", "required": ["city"]}`)}, Options{Temperature: &otherTemperature}),
+	}
+	for name, changed := range changes {
+		if changed == key {
+			t.Errorf("Expected a different key when the %s change", name)
+		}
+	}
+
+	if key := RequestKey("llama3", messages, []map[string]any{{"type": make(chan int)}}, Options{}); key != "" {
+		t.Errorf("Expected no key for a request that cannot be encoded, got %q", key)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// RetryConfig controls how a backend wrapped with WithRetry retries failed requests.
+type RetryConfig struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry. It doubles with every further retry.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between two attempts.
+	MaxDelay time.Duration
+	// Jitter is the fraction, between 0 and 1, by which each delay is randomly shortened
+	// so that many clients failing at once do not retry in lockstep.
+	Jitter float64
+}
+
+// DefaultRetryConfig returns a RetryConfig suitable for most backends.
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts: 3,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    10 * time.Second,
+		Jitter:      0.2,
+	}
+}
+
+// retryBackend is a Backend that retries the requests of the wrapped one.
+type retryBackend struct {
+	be  Backend
+	cfg RetryConfig
+}
+
+// WithRetry wraps be so that Chat and Generate are retried with exponential backoff
+// when they fail with a retryable error, see IsRetryable. Other errors are returned
+// immediately. ChatStream is not retried. Retrying stops early when the context is done or its deadline would
+// pass before the next attempt.
+//
+// If the server said how long to wait, in the Retry-After header of a 429 or 503
+// response, the next attempt is made after exactly that delay instead, without
+// jitter and regardless of MaxDelay; see BackendError.RetryAfter.
+func WithRetry(be Backend, cfg RetryConfig) Backend {
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+	return &retryBackend{be: be, cfg: cfg}
+}
+
+// Chat implements Backend.
+func (r *retryBackend) Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	return r.do(ctx, func() (*Response, error) {
+		return r.be.Chat(ctx, messages, tools, opts...)
+	})
+}
+
+// Generate implements Backend.
+func (r *retryBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	return r.do(ctx, func() (*Response, error) {
+		return r.be.Generate(ctx, prompt, opts...)
+	})
+}
+
+// Close implements Backend by closing the wrapped backend.
+func (r *retryBackend) Close() error {
+	return r.be.Close()
+}
+
+// ChatStream passes the request to the wrapped backend without retrying it, as
+// the chunks delivered before a failure cannot be taken back.
+func (r *retryBackend) ChatStream(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (<-chan StreamChunk, error) {
+	streamer, ok := r.be.(Streamer)
+	if !ok {
+		return nil, errors.New("backend does not support streaming")
+	}
+	return streamer.ChatStream(ctx, messages, tools, opts...)
+}
+
+// do calls fn until it succeeds, fails with a non-retryable error or runs out of attempts.
+func (r *retryBackend) do(ctx context.Context, fn func() (*Response, error)) (*Response, error) {
+	var resp *Response
+	var err error
+	for attempt := 1; ; attempt++ {
+		resp, err = fn()
+		if err == nil || !IsRetryable(err) || attempt >= r.cfg.MaxAttempts {
+			return resp, err
+		}
+
+		delay := r.delay(attempt)
+		var backendErr *BackendError
+		if errors.As(err, &backendErr) && backendErr.RetryAfter > 0 {
+			delay = backendErr.RetryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return resp, err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return resp, err
+		case <-timer.C:
+		}
+	}
+}
+
+// delay returns how long to wait after the given failed attempt.
+func (r *retryBackend) delay(attempt int) time.Duration {
+	delay := r.cfg.BaseDelay << (attempt - 1)
+	if attempt-1 >= 63 || delay < r.cfg.BaseDelay {
+		// The shift overflowed
+		delay = math.MaxInt64
+		if r.cfg.BaseDelay == 0 {
+			delay = 0
+		}
+	}
+	if r.cfg.MaxDelay > 0 && delay > r.cfg.MaxDelay {
+		delay = r.cfg.MaxDelay
+	}
+	if r.cfg.Jitter > 0 {
+		delay -= time.Duration(rand.Float64() * r.cfg.Jitter * float64(delay))
+	}
+	return delay
+}
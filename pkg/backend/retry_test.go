@@ -0,0 +1,245 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWithRetryRetriesRetryableErrors(t *testing.T) {
+	calls := 0
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			calls++
+			if calls < 3 {
+				return nil, newBackendError(http.StatusServiceUnavailable, "overloaded")
+			}
+			return &Response{Message: Message{Content: "ok"}}, nil
+		},
+	}
+
+	retrying := WithRetry(be, RetryConfig{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond})
+
+	resp, err := retrying.Chat(context.Background(), []Message{{Role: "user", Content: "Hi"}}, nil)
+	if err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if resp.Message.Content != "ok" {
+		t.Errorf("Expected content ok, got %s", resp.Message.Content)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", calls)
+	}
+}
+
+func TestWithRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	calls := 0
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			calls++
+			return nil, newBackendError(http.StatusTooManyRequests, "slow down")
+		},
+	}
+
+	retrying := WithRetry(be, RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond})
+
+	_, err := retrying.Generate(context.Background(), "Hi")
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Expected the last error to be returned, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", calls)
+	}
+}
+
+func TestWithRetryDoesNotRetryPermanentErrors(t *testing.T) {
+	calls := 0
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			calls++
+			return nil, newBackendError(http.StatusBadRequest, "bad request")
+		},
+	}
+
+	retrying := WithRetry(be, RetryConfig{MaxAttempts: 5, BaseDelay: time.Millisecond})
+
+	if _, err := retrying.Generate(context.Background(), "Hi"); err == nil {
+		t.Fatalf("Expected an error")
+	}
+	if calls != 1 {
+		t.Errorf("Expected a single attempt for a 400, got %d", calls)
+	}
+}
+
+func TestWithRetryRespectsDeadline(t *testing.T) {
+	calls := 0
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			calls++
+			return nil, newBackendError(http.StatusBadGateway, "bad gateway")
+		},
+	}
+
+	// The first retry would only happen after the deadline, so it is not attempted
+	retrying := WithRetry(be, RetryConfig{MaxAttempts: 5, BaseDelay: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := retrying.Generate(ctx, "Hi"); err == nil {
+		t.Fatalf("Expected an error")
+	}
+	if calls != 1 {
+		t.Errorf("Expected a single attempt, got %d", calls)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected to give up immediately, took %v", elapsed)
+	}
+}
+
+func TestWithRetryHonorsRetryAfter(t *testing.T) {
+	calls := 0
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			calls++
+			if calls == 1 {
+				err := newBackendError(http.StatusTooManyRequests, "slow down")
+				err.RetryAfter = 100 * time.Millisecond
+				return nil, err
+			}
+			return &Response{Message: Message{Content: "ok"}}, nil
+		},
+	}
+
+	// The server asks for longer than MaxDelay, which does not apply
+	retrying := WithRetry(be, RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+
+	start := time.Now()
+	if _, err := retrying.Generate(context.Background(), "Hi"); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected to wait for Retry-After, took %v", elapsed)
+	}
+	if calls != 2 {
+		t.Errorf("Expected 2 attempts, got %d", calls)
+	}
+}
+
+func TestWithRetryRetryAfterPastDeadline(t *testing.T) {
+	calls := 0
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			calls++
+			err := newBackendError(http.StatusTooManyRequests, "slow down")
+			err.RetryAfter = time.Minute
+			return nil, err
+		},
+	}
+
+	retrying := WithRetry(be, RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err := retrying.Generate(ctx, "Hi")
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Expected ErrRateLimited, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected a single attempt, got %d", calls)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected to give up immediately, took %v", elapsed)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	r := &retryBackend{cfg: RetryConfig{BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}}
+
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	for i, want := range expected {
+		if got := r.delay(i + 1); got != want {
+			t.Errorf("Expected delay %v after attempt %d, got %v", want, i+1, got)
+		}
+	}
+
+	r.cfg.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := r.delay(1); got < 50*time.Millisecond || got > 100*time.Millisecond {
+			t.Fatalf("Expected jittered delay between 50ms and 100ms, got %v", got)
+		}
+	}
+
+	// Without a base delay retries are immediate, and overflows are capped
+	r.cfg = RetryConfig{MaxDelay: time.Second}
+	if got := r.delay(3); got != 0 {
+		t.Errorf("Expected no delay without a base delay, got %v", got)
+	}
+	r.cfg.BaseDelay = time.Second
+	for _, attempt := range []int{40, 64, 100} {
+		if got := r.delay(attempt); got != time.Second {
+			t.Errorf("Expected the delay after attempt %d capped at 1s, got %v", attempt, got)
+		}
+	}
+	r.cfg.MaxDelay = 0
+	if got := r.delay(2); got != 2*time.Second {
+		t.Errorf("Expected an uncapped delay of 2s, got %v", got)
+	}
+}
+
+func TestWithRetryChatStream(t *testing.T) {
+	be := &streamingFakeBackend{
+		stream: func(messages []Message) ([]StreamChunk, bool) {
+			return []StreamChunk{{Content: "Hi"}, {Done: true}}, false
+		},
+	}
+
+	streamer, ok := WithRetry(be, DefaultRetryConfig()).(Streamer)
+	if !ok {
+		t.Fatalf("Expected the wrapped backend to support streaming")
+	}
+	chunks, err := streamer.ChatStream(context.Background(), []Message{UserMessage("Hi")}, nil)
+	if err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+	var content string
+	for chunk := range chunks {
+		content += chunk.Content
+	}
+	if content != "Hi" {
+		t.Errorf("Expected the streamed content, got %q", content)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	if IsRetryable(nil) {
+		t.Errorf("Expected nil not to be retryable")
+	}
+	if IsRetryable(ErrContextCanceled) {
+		t.Errorf("Expected ErrContextCanceled not to be retryable")
+	}
+	if !IsRetryable(newBackendError(http.StatusInternalServerError, "")) {
+		t.Errorf("Expected a 500 to be retryable")
+	}
+	if IsRetryable(errors.New("failed to marshal request body")) {
+		t.Errorf("Expected an arbitrary error not to be retryable")
+	}
+}
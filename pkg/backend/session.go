@@ -0,0 +1,360 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Session is a conversation with a model that keeps track of its history, so
+// that every Send includes the previous turns. It is safe for concurrent use,
+// but concurrent Sends and SendStreams are processed one after the other.
+type Session struct {
+	be           Backend
+	systemPrompt string
+	tools        []Tool
+	dispatcher   *ToolDispatcher
+	callOpts     []CallOption
+
+	mu      sync.Mutex
+	history []Message
+
+	streamMu sync.Mutex
+	stream   *sessionStream
+}
+
+// sessionStream is a reply that is being streamed by SendStream.
+type sessionStream struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	// resp is the reply added to the history, set before done is closed.
+	resp *Response
+
+	mu      sync.Mutex
+	stopped bool
+}
+
+// SessionOption configures a Session.
+type SessionOption func(*Session)
+
+// WithSessionSystemPrompt starts the conversation with a system message containing prompt.
+// The system message is kept when the session is Reset.
+func WithSessionSystemPrompt(prompt string) SessionOption {
+	return func(s *Session) {
+		s.systemPrompt = prompt
+	}
+}
+
+// WithSessionTools advertises tools to the model. Tool calls in a reply are run
+// with dispatcher and their results sent back to the model before Send returns.
+func WithSessionTools(tools []Tool, dispatcher *ToolDispatcher) SessionOption {
+	return func(s *Session) {
+		s.tools = tools
+		s.dispatcher = dispatcher
+	}
+}
+
+// WithSessionCallOptions applies opts to every request sent by the session.
+func WithSessionCallOptions(opts ...CallOption) SessionOption {
+	return func(s *Session) {
+		s.callOpts = opts
+	}
+}
+
+// NewSession creates and returns a new Session that chats with be.
+func NewSession(be Backend, opts ...SessionOption) *Session {
+	s := &Session{be: be}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.history = s.initialHistory()
+	return s
+}
+
+// Send adds userInput to the conversation, sends it to the model and returns the reply.
+// The reply is added to the history. If the model requests tool calls, they are run,
+// their results are sent back and the reply to them is returned instead. If the request
+// fails the history is left unchanged, so Send can simply be called again.
+func (s *Session) Send(ctx context.Context, userInput string) (*Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := append(s.copyHistory(), UserMessage(userInput))
+	resp, err := s.be.Chat(ctx, messages, s.tools, s.callOpts...)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, errors.New("backend returned no response")
+	}
+
+	if s.dispatcher != nil && len(resp.Message.ToolCalls) > 0 {
+		out, final, err := s.dispatcher.RunToolCalls(ctx, s.be, messages, resp, s.tools, s.callOpts...)
+		if err != nil {
+			return nil, err
+		}
+		s.history = out
+		return final, nil
+	}
+
+	s.history = append(messages, resp.Message)
+	return resp, nil
+}
+
+// SendStream works like Send but streams the reply. The returned channel delivers the
+// chunks of the reply and is closed when the stream ends; the reply is added to the
+// history once it is complete, or when the stream is ended early with Stop. If the
+// model requests tool calls, they are run and the reply to them is delivered as the
+// last chunk. The session's backend must implement Streamer.
+//
+// Until the channel is closed, other calls that use the history wait for the stream.
+// A canceled ctx or a failed stream leaves the history unchanged.
+func (s *Session) SendStream(ctx context.Context, userInput string) (<-chan StreamChunk, error) {
+	streamer, ok := s.be.(Streamer)
+	if !ok {
+		return nil, errors.New("backend does not support streaming")
+	}
+
+	s.mu.Lock()
+	ctx, cancel := context.WithCancel(ctx)
+	messages := append(s.copyHistory(), UserMessage(userInput))
+	chunks, err := streamer.ChatStream(ctx, messages, s.tools, s.callOpts...)
+	if err != nil {
+		cancel()
+		s.mu.Unlock()
+		return nil, err
+	}
+
+	stream := &sessionStream{cancel: cancel, done: make(chan struct{})}
+	s.streamMu.Lock()
+	s.stream = stream
+	s.streamMu.Unlock()
+
+	out := make(chan StreamChunk)
+	go s.runStream(ctx, stream, messages, chunks, out)
+	return out, nil
+}
+
+// Stop ends the reply that is being streamed by SendStream and waits for the
+// stream to end, like the "stop generating" button of a chat UI. The content
+// generated so far is added to the history as the assistant's reply, so the
+// conversation can go on from there, and returned. If nothing was generated
+// yet, the history is left unchanged.
+//
+// If the reply was completed before it could be stopped, the complete reply is
+// returned. Stop returns nil if no reply is being streamed.
+func (s *Session) Stop() *Response {
+	s.streamMu.Lock()
+	stream := s.stream
+	s.streamMu.Unlock()
+	if stream == nil {
+		return nil
+	}
+
+	stream.mu.Lock()
+	stream.stopped = true
+	stream.mu.Unlock()
+	stream.cancel()
+
+	<-stream.done
+	return stream.resp
+}
+
+// runStream forwards the chunks of a reply streamed by SendStream to out and
+// updates the history once the stream ends. It releases mu, which SendStream
+// acquired, when it returns.
+func (s *Session) runStream(ctx context.Context, stream *sessionStream, messages []Message, chunks <-chan StreamChunk, out chan<- StreamChunk) {
+	defer close(stream.done)
+	defer close(out)
+	defer stream.cancel()
+	defer s.mu.Unlock()
+	defer func() {
+		s.streamMu.Lock()
+		s.stream = nil
+		s.streamMu.Unlock()
+	}()
+
+	send := func(chunk StreamChunk) bool {
+		select {
+		case out <- chunk:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	var content, reasoning strings.Builder
+	err := func() error {
+		for chunk := range chunks {
+			if chunk.Err != nil {
+				return chunk.Err
+			}
+			if chunk.Reasoning {
+				reasoning.WriteString(chunk.Content)
+			} else {
+				content.WriteString(chunk.Content)
+			}
+			if !chunk.Done {
+				if !send(chunk) {
+					return contextError(ctx, ctx.Err())
+				}
+				continue
+			}
+
+			resp := chunk.Response
+			if resp == nil {
+				resp = assembleResponse(chunk, content.String(), reasoning.String())
+			}
+			if resp.Model == "" {
+				resp.Model = backendModel(s.be)
+			}
+			if s.dispatcher == nil || len(resp.Message.ToolCalls) == 0 {
+				s.history = append(messages, resp.Message)
+				stream.resp = resp
+				chunk.Response = resp
+				send(chunk)
+				return nil
+			}
+
+			if chunk.Content != "" && !send(StreamChunk{Content: chunk.Content, Reasoning: chunk.Reasoning}) {
+				return contextError(ctx, ctx.Err())
+			}
+			history, final, err := s.dispatcher.RunToolCalls(ctx, s.be, messages, resp, s.tools, s.callOpts...)
+			if err != nil {
+				return err
+			}
+			s.history = history
+			stream.resp = final
+			send(StreamChunk{
+				Content:        final.Message.Content,
+				Done:           true,
+				ToolCalls:      final.Message.ToolCalls,
+				Usage:          final.Usage,
+				UsageAvailable: final.UsageAvailable,
+				Response:       final,
+			})
+			return nil
+		}
+		return contextError(ctx, fmt.Errorf("failed to read stream: %w", io.ErrUnexpectedEOF))
+	}()
+	if err == nil {
+		return
+	}
+
+	stream.mu.Lock()
+	stopped := stream.stopped
+	stream.mu.Unlock()
+	if !stopped {
+		send(StreamChunk{Err: err})
+		return
+	}
+
+	partial := AssistantMessage(content.String())
+	if partial.Content != "" {
+		s.history = append(messages, partial)
+	}
+	stream.resp = &Response{Model: backendModel(s.be), Message: partial, Reasoning: reasoning.String()}
+}
+
+// History returns a copy of the messages exchanged so far, including the system
+// message, tool calls and tool results.
+func (s *Session) History() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.copyHistory()
+}
+
+// copyHistory returns a copy of the history. The caller must hold mu.
+func (s *Session) copyHistory() []Message {
+	return append([]Message(nil), s.history...)
+}
+
+// Fork returns a new session with the same backend and settings whose history is
+// that of s up to, but not including, the message at upToIndex in History. The
+// history of s is left intact, so the two conversations go on independently, e.g.
+// to let the user edit a past message and regenerate the reply from there:
+//
+//	fork := session.Fork(i)
+//	resp, err := fork.Send(ctx, editedMessage)
+//
+// An index beyond the end of the history keeps all of it. If the index falls
+// between an assistant message with tool calls and their results, the fork ends
+// before that assistant message, so that no tool call is kept without its result.
+func (s *Session) Fork(upToIndex int) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := max(0, min(upToIndex, len(s.history)))
+	for n > 0 && n < len(s.history) && s.history[n].Role == RoleTool {
+		n--
+	}
+	if n > 0 && len(s.history[n-1].ToolCalls) > 0 {
+		n--
+	}
+
+	return &Session{
+		be:           s.be,
+		systemPrompt: s.systemPrompt,
+		tools:        s.tools,
+		dispatcher:   s.dispatcher,
+		callOpts:     s.callOpts,
+		history:      append([]Message(nil), s.history[:n]...),
+	}
+}
+
+// AddSystem layers another system message on top of the system prompt, e.g. the
+// preferences of the user of this conversation. System messages are kept at the
+// start of the history in the order they were added, after the prompt set with
+// WithSessionSystemPrompt, so they apply to the whole conversation whenever they
+// are added.
+//
+// How the layers reach the model depends on the backend: they are combined into
+// a single system message for Ollama, joined into the single system prompt of
+// Anthropic, Gemini and Cohere, and sent as separate system messages to OpenAI
+// and Mistral. In every case their contents keep their order and, when joined,
+// are separated by a blank line. Reset removes the added layers.
+func (s *Session) AddSystem(prompt string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for n < len(s.history) && s.history[n].Role == RoleSystem {
+		n++
+	}
+	history := make([]Message, 0, len(s.history)+1)
+	history = append(history, s.history[:n]...)
+	history = append(history, SystemMessage(prompt))
+	s.history = append(history, s.history[n:]...)
+}
+
+// Reset forgets the conversation, keeping only the system prompt.
+func (s *Session) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = s.initialHistory()
+}
+
+// initialHistory returns the history of a new conversation.
+func (s *Session) initialHistory() []Message {
+	if s.systemPrompt == "" {
+		return nil
+	}
+	return []Message{SystemMessage(s.systemPrompt)}
+}
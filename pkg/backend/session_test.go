@@ -0,0 +1,348 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSessionKeepsHistory(t *testing.T) {
+	replies := []string{"Hello!", "You said hi."}
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			reply := replies[0]
+			replies = replies[1:]
+			return &Response{Message: AssistantMessage(reply)}, nil
+		},
+	}
+
+	session := NewSession(be, WithSessionSystemPrompt("Be brief."), WithSessionCallOptions(WithTemperature(0)))
+
+	if _, err := session.Send(context.Background(), "Hi"); err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	resp, err := session.Send(context.Background(), "What did I say?")
+	if err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	if resp.Message.Content != "You said hi." {
+		t.Errorf("Unexpected reply: %s", resp.Message.Content)
+	}
+
+	// The second request must include the first turn
+	if len(be.received[1]) != 4 || be.received[1][1].Content != "Hi" || be.received[1][2].Content != "Hello!" {
+		t.Errorf("Expected the previous turn in the second request, got %+v", be.received[1])
+	}
+	if be.options[1].Temperature == nil || *be.options[1].Temperature != 0 {
+		t.Errorf("Expected the session call options to be applied")
+	}
+
+	history := session.History()
+	if len(history) != 5 || history[0].Role != RoleSystem || history[4].Content != "You said hi." {
+		t.Errorf("Unexpected history: %+v", history)
+	}
+
+	session.Reset()
+	history = session.History()
+	if len(history) != 1 || history[0].Role != RoleSystem {
+		t.Errorf("Expected only the system prompt after Reset, got %+v", history)
+	}
+}
+
+func TestSessionAddSystem(t *testing.T) {
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return &Response{Message: AssistantMessage("Hello!")}, nil
+		},
+	}
+
+	session := NewSession(be, WithSessionSystemPrompt("You are a travel agent."))
+	if _, err := session.Send(context.Background(), "Hi"); err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	session.AddSystem("The user prefers trains.")
+	session.AddSystem("Answer in Czech.")
+	if _, err := session.Send(context.Background(), "Book a trip"); err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+
+	// The layers follow the system prompt, before the first turn
+	sent := be.received[1]
+	want := []string{"You are a travel agent.", "The user prefers trains.", "Answer in Czech.", "Hi", "Hello!", "Book a trip"}
+	if len(sent) != len(want) {
+		t.Fatalf("Expected %d messages, got %+v", len(want), sent)
+	}
+	for i, content := range want {
+		if sent[i].Content != content || (i < 3) != (sent[i].Role == RoleSystem) {
+			t.Errorf("Unexpected message %d: %+v", i, sent[i])
+		}
+	}
+
+	session.Reset()
+	if history := session.History(); len(history) != 1 || history[0].Content != "You are a travel agent." {
+		t.Errorf("Expected only the system prompt after Reset, got %+v", history)
+	}
+}
+
+func TestSessionToolCalls(t *testing.T) {
+	dispatcher := NewToolDispatcher()
+	dispatcher.Register("weather", func(args map[string]any) (string, error) {
+		return "sunny", nil
+	})
+
+	calls := 0
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			calls++
+			if calls == 1 {
+				return &Response{Message: Message{
+					Role:      RoleAssistant,
+					ToolCalls: []ToolCall{{ID: "1", Function: FunctionCall{Name: "weather"}}},
+				}}, nil
+			}
+			return &Response{Message: AssistantMessage("It is sunny.")}, nil
+		},
+	}
+
+	tools := []Tool{{"type": "function", "function": map[string]any{"name": "weather"}}}
+	session := NewSession(be, WithSessionTools(tools, dispatcher), WithSessionCallOptions(WithTemperature(0.3)))
+
+	resp, err := session.Send(context.Background(), "Weather?")
+	if err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	if resp.Message.Content != "It is sunny." {
+		t.Errorf("Unexpected reply: %s", resp.Message.Content)
+	}
+
+	// user, assistant with the call, tool result, final reply
+	history := session.History()
+	if len(history) != 4 || history[2].Role != RoleTool || history[2].Content != "sunny" {
+		t.Errorf("Unexpected history: %+v", history)
+	}
+
+	// The request with the tool results is sent like the first one
+	if len(be.options) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(be.options))
+	}
+	if temp := be.options[1].Temperature; temp == nil || *temp != 0.3 {
+		t.Errorf("Expected the session call options on the follow-up, got %v", temp)
+	}
+	if len(be.tools[1]) != 1 {
+		t.Errorf("Expected the session tools on the follow-up, got %v", be.tools[1])
+	}
+}
+
+func TestSessionFork(t *testing.T) {
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return &Response{Message: AssistantMessage("Reply to " + messages[len(messages)-1].Content)}, nil
+		},
+	}
+	session := NewSession(be, WithSessionSystemPrompt("Be brief."), WithSessionCallOptions(WithTemperature(0)))
+	for _, input := range []string{"first", "second"} {
+		if _, err := session.Send(context.Background(), input); err != nil {
+			t.Fatalf("Send returned error: %v", err)
+		}
+	}
+
+	// Edit the second user message and regenerate
+	fork := session.Fork(3)
+	if history := fork.History(); len(history) != 3 || history[2].Content != "Reply to first" {
+		t.Fatalf("Unexpected history of the fork: %+v", history)
+	}
+	resp, err := fork.Send(context.Background(), "edited")
+	if err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	if resp.Message.Content != "Reply to edited" {
+		t.Errorf("Unexpected reply: %s", resp.Message.Content)
+	}
+	if be.options[2].Temperature == nil || *be.options[2].Temperature != 0 {
+		t.Errorf("Expected the fork to keep the session call options")
+	}
+
+	if history := session.History(); len(history) != 5 || history[3].Content != "second" || history[4].Content != "Reply to second" {
+		t.Errorf("Expected the original history to be left intact, got %+v", history)
+	}
+	if history := fork.History(); len(history) != 5 || history[3].Content != "edited" {
+		t.Errorf("Unexpected history of the fork: %+v", history)
+	}
+
+	if history := session.Fork(100).History(); len(history) != 5 {
+		t.Errorf("Expected an index beyond the end to keep the whole history, got %+v", history)
+	}
+	if history := session.Fork(-1).History(); len(history) != 0 {
+		t.Errorf("Expected a negative index to keep nothing, got %+v", history)
+	}
+}
+
+func TestSessionForkKeepsToolResults(t *testing.T) {
+	dispatcher := NewToolDispatcher()
+	dispatcher.Register("weather", func(args map[string]any) (string, error) {
+		return "sunny", nil
+	})
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			if messages[len(messages)-1].Role == RoleTool {
+				return &Response{Message: AssistantMessage("It is sunny.")}, nil
+			}
+			return &Response{Message: Message{
+				Role: RoleAssistant,
+				ToolCalls: []ToolCall{
+					{ID: "1", Function: FunctionCall{Name: "weather"}},
+					{ID: "2", Function: FunctionCall{Name: "weather"}},
+				},
+			}}, nil
+		},
+	}
+	session := NewSession(be, WithSessionTools(nil, dispatcher))
+	if _, err := session.Send(context.Background(), "Weather?"); err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+
+	// user, assistant with the calls, two tool results, final reply
+	for index, want := range map[int]int{1: 1, 2: 1, 3: 1, 4: 4, 5: 5} {
+		if got := len(session.Fork(index).History()); got != want {
+			t.Errorf("Fork(%d): expected %d messages, got %d", index, want, got)
+		}
+	}
+}
+
+func TestSessionFailedSendKeepsHistory(t *testing.T) {
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return nil, ErrRateLimited
+		},
+	}
+
+	session := NewSession(be)
+	if _, err := session.Send(context.Background(), "Hi"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Expected ErrRateLimited, got %v", err)
+	}
+	if history := session.History(); len(history) != 0 {
+		t.Errorf("Expected an empty history after a failed Send, got %+v", history)
+	}
+}
+
+// streamingFakeBackend is a fakeBackend whose ChatStream sends the chunks returned
+// by stream and then, if more is true, keeps the stream open until ctx is done.
+type streamingFakeBackend struct {
+	fakeBackend
+	stream func(messages []Message) (chunks []StreamChunk, more bool)
+}
+
+func (f *streamingFakeBackend) ChatStream(ctx context.Context, messages []Message, _ []Tool, _ ...CallOption) (<-chan StreamChunk, error) {
+	chunks, more := f.stream(messages)
+	out := make(chan StreamChunk)
+	go func() {
+		defer close(out)
+		for _, chunk := range chunks {
+			select {
+			case out <- chunk:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if more {
+			<-ctx.Done()
+		}
+	}()
+	return out, nil
+}
+
+func TestSessionSendStream(t *testing.T) {
+	be := &streamingFakeBackend{
+		stream: func(messages []Message) ([]StreamChunk, bool) {
+			return []StreamChunk{{Content: "Hel"}, {Content: "lo"}, {Done: true}}, false
+		},
+	}
+
+	session := NewSession(be)
+	chunks, err := session.SendStream(context.Background(), "Hi")
+	if err != nil {
+		t.Fatalf("SendStream returned error: %v", err)
+	}
+	var content string
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			t.Fatalf("Unexpected stream error: %v", chunk.Err)
+		}
+		content += chunk.Content
+	}
+	if content != "Hello" {
+		t.Errorf("Expected the streamed content, got %q", content)
+	}
+
+	history := session.History()
+	if len(history) != 2 || history[0].Content != "Hi" || history[1].Content != "Hello" {
+		t.Errorf("Expected the streamed reply in the history, got %+v", history)
+	}
+	if resp := session.Stop(); resp != nil {
+		t.Errorf("Expected Stop to return nil without a stream, got %+v", resp)
+	}
+}
+
+func TestSessionStopKeepsPartialReply(t *testing.T) {
+	be := &streamingFakeBackend{
+		stream: func(messages []Message) ([]StreamChunk, bool) {
+			return []StreamChunk{{Content: "Once upon"}, {Content: " a time"}}, true
+		},
+		fakeBackend: fakeBackend{
+			chat: func(messages []Message) (*Response, error) {
+				return &Response{Message: AssistantMessage("The end.")}, nil
+			},
+		},
+	}
+
+	session := NewSession(be, WithSessionSystemPrompt("Tell stories."))
+	chunks, err := session.SendStream(context.Background(), "Tell me a story.")
+	if err != nil {
+		t.Fatalf("SendStream returned error: %v", err)
+	}
+	<-chunks
+	<-chunks
+
+	resp := session.Stop()
+	if resp == nil || resp.Message.Content != "Once upon a time" || resp.Done {
+		t.Fatalf("Expected the partial reply, got %+v", resp)
+	}
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			t.Errorf("Expected no error after Stop, got %v", chunk.Err)
+		}
+	}
+
+	history := session.History()
+	if len(history) != 3 || history[2].Role != RoleAssistant || history[2].Content != "Once upon a time" {
+		t.Fatalf("Expected the partial reply in the history, got %+v", history)
+	}
+
+	// The conversation goes on from the partial reply
+	if _, err := session.Send(context.Background(), "Finish it."); err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	if sent := be.received[0]; len(sent) != 4 || sent[2].Content != "Once upon a time" {
+		t.Errorf("Expected the partial reply in the next request, got %+v", sent)
+	}
+}
+
+func TestSessionSendStreamNotSupported(t *testing.T) {
+	session := NewSession(&fakeBackend{})
+	if _, err := session.SendStream(context.Background(), "Hi"); err == nil {
+		t.Error("Expected an error for a backend that does not stream")
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// flight is a request the wrapped backend is answering for one or more callers.
+type flight struct {
+	// done is closed once resp and err are set.
+	done chan struct{}
+	resp *Response
+	err  error
+
+	// waiters is the number of callers waiting for the reply; the request is
+	// canceled once they have all given up. It is guarded by the mutex of the
+	// singleFlightBackend.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// singleFlightBackend is a Backend that sends identical concurrent requests to
+// the wrapped one only once.
+type singleFlightBackend struct {
+	be Backend
+
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// WithSingleFlight wraps be so that concurrent identical Chat or Generate calls,
+// those with the same RequestKey, are coalesced into a single call of be whose
+// reply or error is shared by all of them, e.g. to spare the model server a
+// burst of repeated prompts. A call only joins a request that is still in flight:
+// once it completes, successfully or not, the next identical call is sent again.
+// Use WithCache to reuse replies beyond that.
+//
+// Every caller gets its own copy of the reply. A caller that gives up, because
+// its context is done, stops waiting without affecting the others; the shared
+// request is canceled only once all of its callers have given up. Calls with a
+// raw response capture, see WithRawResponseCapture, are never coalesced, as the
+// capture would only see the body of its own request. ChatStream, if supported
+// by be, is passed through.
+func WithSingleFlight(be Backend) Backend {
+	return &singleFlightBackend{be: be, flights: make(map[string]*flight)}
+}
+
+// Chat implements Backend.
+func (s *singleFlightBackend) Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	callOpts, err := newCallOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	key := RequestKey(backendModel(s.be), messages, tools, *callOpts)
+	return s.do(ctx, "chat", key, callOpts, func(ctx context.Context) (*Response, error) {
+		return s.be.Chat(ctx, messages, tools, opts...)
+	})
+}
+
+// Generate implements Backend.
+func (s *singleFlightBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	callOpts, err := newCallOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	key := RequestKey(backendModel(s.be), []Message{UserMessage(prompt)}, nil, *callOpts)
+	return s.do(ctx, "generate", key, callOpts, func(ctx context.Context) (*Response, error) {
+		return s.be.Generate(ctx, prompt, opts...)
+	})
+}
+
+// Close implements Backend by closing the wrapped backend.
+func (s *singleFlightBackend) Close() error {
+	return s.be.Close()
+}
+
+// ChatStream passes the request to the wrapped backend without coalescing it.
+func (s *singleFlightBackend) ChatStream(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (<-chan StreamChunk, error) {
+	streamer, ok := s.be.(Streamer)
+	if !ok {
+		return nil, errors.New("backend does not support streaming")
+	}
+	return streamer.ChatStream(ctx, messages, tools, opts...)
+}
+
+// do joins the request of method in flight for key, or sends one with fn, and
+// waits for its reply. Requests without a key are sent on their own.
+func (s *singleFlightBackend) do(ctx context.Context, method, key string, opts *Options, fn func(ctx context.Context) (*Response, error)) (*Response, error) {
+	if key == "" || opts.RawResponse != nil {
+		return fn(ctx)
+	}
+	key = method + ":" + key
+
+	s.mu.Lock()
+	f, ok := s.flights[key]
+	if !ok {
+		// The request outlives the caller that sent it if others still wait
+		flightCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		s.flights[key] = f
+		go func() {
+			f.resp, f.err = fn(flightCtx)
+			cancel()
+			s.mu.Lock()
+			if s.flights[key] == f {
+				delete(s.flights, key)
+			}
+			s.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	s.mu.Unlock()
+
+	select {
+	case <-f.done:
+		if f.err != nil {
+			return nil, f.err
+		}
+		if f.resp == nil {
+			return nil, nil
+		}
+		resp := *f.resp
+		return &resp, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// Nobody is left to wait, so the next identical call starts afresh
+			f.cancel()
+			if s.flights[key] == f {
+				delete(s.flights, key)
+			}
+		}
+		s.mu.Unlock()
+		return nil, contextError(ctx, ctx.Err())
+	}
+}
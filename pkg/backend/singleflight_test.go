@@ -0,0 +1,179 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingBackend returns a fakeBackend whose replies wait for release, along
+// with the number of calls it received.
+func blockingBackend(release <-chan struct{}, reply func() (*Response, error)) (*fakeBackend, *atomic.Int32) {
+	var calls atomic.Int32
+	return &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			calls.Add(1)
+			<-release
+			return reply()
+		},
+	}, &calls
+}
+
+// waitForWaiters waits until n callers wait for the single request in flight of be.
+func waitForWaiters(t *testing.T, be Backend, n int) {
+	t.Helper()
+	s := be.(*singleFlightBackend)
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		waiting := 0
+		for _, f := range s.flights {
+			waiting += f.waiters
+		}
+		s.mu.Unlock()
+		if waiting == n {
+			return
+		}
+	}
+	t.Fatalf("Timed out waiting for %d callers", n)
+}
+
+func TestWithSingleFlightCoalescesRequests(t *testing.T) {
+	release := make(chan struct{})
+	fake, calls := blockingBackend(release, func() (*Response, error) {
+		return &Response{Message: AssistantMessage("Hello!")}, nil
+	})
+	be := WithSingleFlight(fake)
+
+	const callers = 5
+	var wg sync.WaitGroup
+	responses := make([]*Response, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i], errs[i] = be.Chat(context.Background(), []Message{UserMessage("Hi")}, nil)
+		}()
+	}
+	waitForWaiters(t, be, callers)
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("Expected a single upstream call, got %d", got)
+	}
+	for i := 0; i < callers; i++ {
+		if errs[i] != nil || responses[i].Message.Content != "Hello!" {
+			t.Errorf("Unexpected reply %d: %+v, %v", i, responses[i], errs[i])
+		}
+	}
+	if responses[0] == responses[1] {
+		t.Errorf("Expected every caller to get its own copy of the reply")
+	}
+}
+
+func TestWithSingleFlightSharesErrors(t *testing.T) {
+	release := make(chan struct{})
+	fail := true
+	fake, calls := blockingBackend(release, func() (*Response, error) {
+		if fail {
+			return nil, ErrUnreachable
+		}
+		return &Response{Message: AssistantMessage("Hello!")}, nil
+	})
+	be := WithSingleFlight(fake)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = be.Generate(context.Background(), "Hi")
+		}()
+	}
+	waitForWaiters(t, be, 2)
+	close(release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if !errors.Is(err, ErrUnreachable) {
+			t.Errorf("Expected caller %d to get ErrUnreachable, got %v", i, err)
+		}
+	}
+
+	// The failure is not remembered
+	fail = false
+	resp, err := be.Generate(context.Background(), "Hi")
+	if err != nil || resp.Message.Content != "Hello!" {
+		t.Errorf("Expected the next call to be sent again, got %+v, %v", resp, err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("Expected 2 upstream calls, got %d", got)
+	}
+}
+
+func TestWithSingleFlightCallerGivesUp(t *testing.T) {
+	release := make(chan struct{})
+	fake, calls := blockingBackend(release, func() (*Response, error) {
+		return &Response{Message: AssistantMessage("Hello!")}, nil
+	})
+	be := WithSingleFlight(fake)
+
+	// The first caller gives up, the second still gets the reply
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := be.Chat(ctx, []Message{UserMessage("Hi")}, nil)
+		first <- err
+	}()
+	second := make(chan *Response, 1)
+	go func() {
+		resp, _ := be.Chat(context.Background(), []Message{UserMessage("Hi")}, nil)
+		second <- resp
+	}()
+	waitForWaiters(t, be, 2)
+
+	cancel()
+	if err := <-first; !errors.Is(err, ErrContextCanceled) {
+		t.Errorf("Expected ErrContextCanceled, got %v", err)
+	}
+	close(release)
+	if resp := <-second; resp == nil || resp.Message.Content != "Hello!" {
+		t.Errorf("Expected the reply for the remaining caller, got %+v", resp)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("Expected a single upstream call, got %d", got)
+	}
+}
+
+func TestWithSingleFlightDifferentRequests(t *testing.T) {
+	be := WithSingleFlight(&fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return &Response{Message: AssistantMessage("You said " + messages[0].Content)}, nil
+		},
+	})
+
+	for _, prompt := range []string{"Hi", "Bye"} {
+		resp, err := be.Chat(context.Background(), []Message{UserMessage(prompt)}, nil)
+		if err != nil || resp.Message.Content != "You said "+prompt {
+			t.Errorf("Unexpected reply to %s: %+v, %v", prompt, resp, err)
+		}
+	}
+}
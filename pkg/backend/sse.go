@@ -0,0 +1,123 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// sseDone is the data of the last event of a successful stream, as in the
+// streaming API of OpenAI.
+const sseDone = "[DONE]"
+
+// sseEvent is the JSON data of an event written by WriteSSE.
+type sseEvent struct {
+	Content       string     `json:"content"`
+	Reasoning     bool       `json:"reasoning,omitempty"`
+	Done          bool       `json:"done,omitempty"`
+	ToolCalls     []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallReady *ToolCall  `json:"tool_call_ready,omitempty"`
+	FinishReason  string     `json:"finish_reason,omitempty"`
+	Usage         *sseUsage  `json:"usage,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// sseUsage is the usage reported in the last event of a stream.
+type sseUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+// newSSEEvent returns the event for chunk.
+func newSSEEvent(chunk StreamChunk) sseEvent {
+	event := sseEvent{
+		Content:       chunk.Content,
+		Reasoning:     chunk.Reasoning,
+		Done:          chunk.Done,
+		ToolCalls:     chunk.ToolCalls,
+		ToolCallReady: chunk.ToolCallReady,
+	}
+	if chunk.Response != nil {
+		event.FinishReason = chunk.Response.FinishReason
+	}
+	if chunk.UsageAvailable {
+		event.Usage = &sseUsage{
+			PromptTokens:     chunk.Usage.PromptTokens,
+			CompletionTokens: chunk.Usage.CompletionTokens,
+		}
+	}
+	if chunk.Err != nil {
+		event.Error = chunk.Err.Error()
+	}
+	return event
+}
+
+// WriteSSE writes the chunks of a stream to w as Server-Sent Events, e.g. to
+// proxy a ChatStream to a browser, and flushes w after every event. Each chunk
+// is written as a frame of the form
+//
+//	data: {"content": "...", "reasoning": true, "done": true, "tool_calls": [...], "finish_reason": "stop", "usage": {...}}
+//
+// with the fields that do not apply to the chunk left out. A successful stream
+// ends with a "data: [DONE]" frame, as in the streaming API of OpenAI; a failed
+// one ends with a frame whose "error" field holds the error, which WriteSSE
+// returns as well.
+//
+// WriteSSE returns when the stream ends or ctx is done, e.g. because the client
+// disconnected. Pass the context of the HTTP request both to ChatStream and to
+// WriteSSE, so that the stream is stopped as well.
+func WriteSSE(ctx context.Context, w http.ResponseWriter, chunks <-chan StreamChunk) error {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	for {
+		var chunk StreamChunk
+		select {
+		case <-ctx.Done():
+			return contextError(ctx, ctx.Err())
+		case c, ok := <-chunks:
+			if !ok {
+				return contextError(ctx, fmt.Errorf("failed to read stream: %w", io.ErrUnexpectedEOF))
+			}
+			chunk = c
+		}
+
+		data, err := json.Marshal(newSSEEvent(chunk))
+		if err != nil {
+			return fmt.Errorf("failed to encode event: %w", err)
+		}
+		if err := writeSSEFrame(w, string(data)); err != nil {
+			return err
+		}
+		if chunk.Err != nil {
+			return chunk.Err
+		}
+		if chunk.Done {
+			return writeSSEFrame(w, sseDone)
+		}
+	}
+}
+
+// writeSSEFrame writes an event with the given data to w and flushes it.
+func writeSSEFrame(w io.Writer, data string) error {
+	if err := writeAndFlush(w, "data: "+data+"\n\n"); err != nil {
+		return fmt.Errorf("failed to write event: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+// sendChunks returns a closed channel holding chunks.
+func sendChunks(chunks ...StreamChunk) <-chan StreamChunk {
+	out := make(chan StreamChunk, len(chunks))
+	for _, chunk := range chunks {
+		out <- chunk
+	}
+	close(out)
+	return out
+}
+
+func TestWriteSSE(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	chunks := sendChunks(
+		StreamChunk{Content: "Hmm", Reasoning: true},
+		StreamChunk{Content: "Hello"},
+		StreamChunk{
+			Content:        " world",
+			Done:           true,
+			ToolCalls:      []ToolCall{{Function: FunctionCall{Name: "get_weather", Arguments: map[string]any{"city": "Brno"}}}},
+			Usage:          Usage{PromptTokens: 3, CompletionTokens: 2},
+			UsageAvailable: true,
+			Response:       &Response{FinishReason: FinishToolCalls},
+		},
+	)
+
+	if err := WriteSSE(context.Background(), recorder, chunks); err != nil {
+		t.Fatalf("WriteSSE returned error: %v", err)
+	}
+	if got := recorder.Header().Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Expected Content-Type text/event-stream, got %s", got)
+	}
+	if !recorder.Flushed {
+		t.Errorf("Expected the events to be flushed")
+	}
+	expected := `data: {"content":"Hmm","reasoning":true}
+
+data: {"content":"Hello"}
+
+data: {"content":" world","done":true,"tool_calls":[{"function":{"name":"get_weather","arguments":{"city":"Brno"}}}],"finish_reason":"tool_calls","usage":{"prompt_tokens":3,"completion_tokens":2}}
+
+data: [DONE]
+
+`
+	if got := recorder.Body.String(); got != expected {
+		t.Errorf("Unexpected events:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestWriteSSEError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	streamErr := errors.New("connection reset")
+	chunks := sendChunks(StreamChunk{Content: "Hello"}, StreamChunk{Err: streamErr})
+
+	if err := WriteSSE(context.Background(), recorder, chunks); !errors.Is(err, streamErr) {
+		t.Errorf("Expected the stream error, got %v", err)
+	}
+	expected := "data: {\"content\":\"Hello\"}\n\ndata: {\"content\":\"\",\"error\":\"connection reset\"}\n\n"
+	if got := recorder.Body.String(); got != expected {
+		t.Errorf("Unexpected events: %q", got)
+	}
+}
+
+func TestWriteSSEClientGone(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	ctx, cancel := context.WithCancel(context.Background())
+	chunks := make(chan StreamChunk)
+	go func() {
+		chunks <- StreamChunk{Content: "Hello"}
+		cancel()
+	}()
+
+	err := WriteSSE(ctx, recorder, chunks)
+	if !errors.Is(err, ErrContextCanceled) || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected ErrContextCanceled, got %v", err)
+	}
+	if got := recorder.Body.String(); got != "data: {\"content\":\"Hello\"}\n\n" {
+		t.Errorf("Unexpected events: %q", got)
+	}
+}
+
+func TestWriteSSEUnexpectedEnd(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	if err := WriteSSE(context.Background(), recorder, sendChunks(StreamChunk{Content: "Hello"})); err == nil {
+		t.Errorf("Expected an error for a stream that ended without Done")
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// streamChunks runs produce in a goroutine that feeds the returned channel and
+// closes both the channel and body when produce returns. The send function passed
+// to produce reports false once ctx is done, in which case produce should return.
+//
+// If stopOnDelta is not nil, it is called with the content streamed so far after
+// every chunk with content. Once it returns true, that chunk is delivered as the
+// last one, with Done set, and send reports false so that produce returns and the
+// request is aborted by closing body.
+//
+// Reasoning wrapped in <think> tags at the start of the reply is delivered in
+// chunks of its own with Reasoning set, see Response.Reasoning.
+//
+// The last chunk carries the complete reply in its Response. Produce may set the
+// Response of the chunk it sends with Done to report the model, usage and finish
+// reason; the content, reasoning and tool calls are filled in from the stream.
+func streamChunks(ctx context.Context, body io.ReadCloser, stopOnDelta func(accumulated string) bool, produce func(send func(StreamChunk) bool)) <-chan StreamChunk {
+	chunks := make(chan StreamChunk)
+	go func() {
+		defer close(chunks)
+		defer body.Close()
+
+		// Closing the body unblocks a pending read as soon as ctx is done,
+		// even with transports that do not watch the request context.
+		stop := context.AfterFunc(ctx, func() { body.Close() })
+		defer stop()
+
+		var accumulated, content, reasoningContent strings.Builder
+		deliver := func(chunk StreamChunk) bool {
+			stopped := false
+			if stopOnDelta != nil && chunk.Content != "" && !chunk.Done && chunk.Err == nil {
+				accumulated.WriteString(chunk.Content)
+				if stopped = stopOnDelta(accumulated.String()); stopped {
+					chunk.Done = true
+					chunk.Response = &Response{FinishReason: FinishStop}
+				}
+			}
+			if chunk.Err == nil {
+				if chunk.Reasoning {
+					reasoningContent.WriteString(chunk.Content)
+				} else {
+					content.WriteString(chunk.Content)
+				}
+				if chunk.Done {
+					chunk.Response = assembleResponse(chunk, content.String(), reasoningContent.String())
+				}
+			}
+			select {
+			case chunks <- chunk:
+				return !stopped
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		var reasoning reasoningSplitter
+		produce(func(chunk StreamChunk) bool {
+			if chunk.Err != nil || (chunk.Content == "" && !chunk.Done) {
+				return deliver(chunk)
+			}
+
+			parts := reasoning.split(chunk.Content, chunk.Done)
+			if chunk.Done {
+				// The end of the stream goes with the last part
+				var last StreamChunk
+				if len(parts) > 0 {
+					last, parts = parts[len(parts)-1], parts[:len(parts)-1]
+				}
+				chunk.Content, chunk.Reasoning = last.Content, last.Reasoning
+				parts = append(parts, chunk)
+			}
+			for _, part := range parts {
+				if !deliver(part) {
+					return false
+				}
+			}
+			return true
+		})
+	}()
+	return chunks
+}
+
+// idleReader is a response body that is closed once no data arrived for timeout.
+type idleReader struct {
+	body     io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+// idleTimeoutBody returns body closed once no data arrived for timeout, after
+// which reading fails with an error matching ErrStreamIdle. A timeout of zero or
+// less returns body unchanged.
+func idleTimeoutBody(body io.ReadCloser, timeout time.Duration) io.ReadCloser {
+	if timeout <= 0 {
+		return body
+	}
+	r := &idleReader{body: body, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		r.timedOut.Store(true)
+		body.Close()
+	})
+	return r
+}
+
+// Read implements io.Reader.
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if r.timedOut.Load() {
+		return n, fmt.Errorf("%w: no data for %s", ErrStreamIdle, r.timeout)
+	}
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// Close implements io.Closer.
+func (r *idleReader) Close() error {
+	r.timer.Stop()
+	return r.body.Close()
+}
+
+// observeStream returns a channel that delivers the chunks of in and calls done
+// once the stream ends, with the Response of its last chunk or the error it failed
+// with. If the caller stops reading and ctx is done first, the error is that of ctx.
+func observeStream(ctx context.Context, in <-chan StreamChunk, done func(resp *Response, err error)) <-chan StreamChunk {
+	out := make(chan StreamChunk)
+	go func() {
+		defer close(out)
+		var resp *Response
+		var err error
+		defer func() {
+			// The wrapped stream ends as well once ctx is done, as it watches ctx
+			for range in {
+			}
+			if resp == nil && err == nil && ctx.Err() != nil {
+				err = contextError(ctx, ctx.Err())
+			}
+			done(resp, err)
+		}()
+
+		for chunk := range in {
+			if chunk.Done {
+				resp = chunk.Response
+			}
+			if chunk.Err != nil {
+				err = chunk.Err
+			}
+			select {
+			case out <- chunk:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// assembleResponse returns the complete reply of a stream from its last chunk
+// and the content and reasoning streamed, including those of the last chunk.
+// The details the producer set in the Response of the chunk are kept.
+func assembleResponse(last StreamChunk, content, reasoning string) *Response {
+	var resp Response
+	if last.Response != nil {
+		resp = *last.Response
+	}
+	resp.Message = Message{
+		Role:      RoleAssistant,
+		Content:   content,
+		ToolCalls: last.ToolCalls,
+	}
+	resp.Done = true
+	resp.Reasoning = reasoning
+	resp.Usage, resp.UsageAvailable = last.Usage, last.UsageAvailable
+	if resp.FinishReason == FinishStop && len(last.ToolCalls) > 0 {
+		resp.FinishReason = FinishToolCalls
+	}
+	return &resp
+}
+
+// ChatToWriter streams the reply to the conversation in messages from s and writes
+// the content to w as it arrives, e.g. to os.Stdout in an interactive tool. If w is
+// buffered, it is flushed after every write when it has a Flush method, such as a
+// bufio.Writer or an http.ResponseWriter that implements http.Flusher.
+//
+// Only the answer is written to w. The reasoning of the model, see
+// StreamChunk.Reasoning, is returned in the Reasoning of the reply.
+//
+// It returns the complete reply once the stream ends, with any tool calls in the
+// ToolCalls of its Message. If writing to w fails, the stream is stopped and the
+// write error returned.
+func ChatToWriter(ctx context.Context, s Streamer, messages []Message, tools []Tool, w io.Writer, opts ...CallOption) (*Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chunks, err := s.ChatStream(ctx, messages, tools, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var content, reasoning strings.Builder
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			return nil, chunk.Err
+		}
+		if chunk.Reasoning {
+			reasoning.WriteString(chunk.Content)
+		} else if chunk.Content != "" {
+			content.WriteString(chunk.Content)
+			if err := writeAndFlush(w, chunk.Content); err != nil {
+				return nil, fmt.Errorf("failed to write stream: %w", err)
+			}
+		}
+		if chunk.Done {
+			resp := chunk.Response
+			if resp == nil {
+				// Streamers outside this package may not assemble the reply
+				resp = assembleResponse(chunk, content.String(), reasoning.String())
+			}
+			if be, ok := s.(Backend); ok && resp.Model == "" {
+				resp.Model = backendModel(be)
+			}
+			return resp, nil
+		}
+	}
+	return nil, contextError(ctx, fmt.Errorf("failed to read stream: %w", io.ErrUnexpectedEOF))
+}
+
+// writeAndFlush writes content to w and flushes w if it is buffered.
+func writeAndFlush(w io.Writer, content string) error {
+	if _, err := io.WriteString(w, content); err != nil {
+		return err
+	}
+	switch f := w.(type) {
+	case interface{ Flush() error }:
+		return f.Flush()
+	case http.Flusher:
+		f.Flush()
+	}
+	return nil
+}
+
+// partialToolCall is a tool call whose arguments are still being streamed.
+type partialToolCall struct {
+	id   string
+	name string
+	args strings.Builder
+}
+
+// toolCallAssembler collects tool calls that arrive in fragments while streaming.
+// Each fragment carries the index of the call it belongs to; the ID and name
+// usually come with the first fragment and the JSON arguments are spread over
+// the following ones.
+type toolCallAssembler struct {
+	calls map[int]*partialToolCall
+	// returned holds the indexes of the calls returned by ready.
+	returned map[int]bool
+}
+
+// add records a fragment of the tool call with the given index. Empty id and
+// name leave the values of earlier fragments unchanged.
+func (a *toolCallAssembler) add(index int, id, name, arguments string) {
+	if a.calls == nil {
+		a.calls = make(map[int]*partialToolCall)
+	}
+	call, ok := a.calls[index]
+	if !ok {
+		call = &partialToolCall{}
+		a.calls[index] = call
+	}
+	if id != "" {
+		call.id = id
+	}
+	if name != "" {
+		call.name = name
+	}
+	call.args.WriteString(arguments)
+}
+
+// toolCalls returns the assembled tool calls in the order of their index.
+// It fails if the arguments of a call are not valid JSON, which means the
+// stream ended before the call was complete.
+func (a *toolCallAssembler) toolCalls() ([]ToolCall, error) {
+	var out []ToolCall
+	for _, index := range a.indexes() {
+		call, err := a.calls[index].toolCall()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, call)
+	}
+	return out, nil
+}
+
+// ready returns the assembled tool calls with an index below upTo that it did not
+// return before, in the order of their index. Calls are streamed one after the
+// other, so a call is complete once a fragment of a later one arrives or the
+// model finishes its reply.
+func (a *toolCallAssembler) ready(upTo int) ([]ToolCall, error) {
+	var out []ToolCall
+	for _, index := range a.indexes() {
+		if index >= upTo || a.returned[index] {
+			continue
+		}
+		call, err := a.calls[index].toolCall()
+		if err != nil {
+			return nil, err
+		}
+		if a.returned == nil {
+			a.returned = make(map[int]bool)
+		}
+		a.returned[index] = true
+		out = append(out, call)
+	}
+	return out, nil
+}
+
+// indexes returns the indexes of the calls in ascending order.
+func (a *toolCallAssembler) indexes() []int {
+	indexes := make([]int, 0, len(a.calls))
+	for index := range a.calls {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// toolCall returns the call with its arguments decoded.
+func (c *partialToolCall) toolCall() (ToolCall, error) {
+	var args map[string]any
+	if raw := c.args.String(); strings.TrimSpace(raw) != "" {
+		if err := json.Unmarshal([]byte(raw), &args); err != nil {
+			return ToolCall{}, fmt.Errorf("incomplete arguments of streamed tool call %s: %w", c.name, err)
+		}
+	}
+	return ToolCall{
+		ID: c.id,
+		Function: FunctionCall{
+			Name:      c.name,
+			Arguments: args,
+		},
+	}, nil
+}
@@ -0,0 +1,241 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newOllamaStreamServer returns a server that streams the given lines as the reply to a chat.
+func newOllamaStreamServer(t *testing.T, lines ...string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, line := range lines {
+			w.Write([]byte(line + "\n"))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestChatToWriter(t *testing.T) {
+	server := newOllamaStreamServer(t,
+		`{"message": {"role": "assistant", "content": "Hello"}, "done": false}`,
+		`{"message": {"role": "assistant", "content": " world", "tool_calls": [{"function": {"name": "wave"}}]}, "done": false}`,
+		`{"message": {"role": "assistant", "content": "!"}, "done": true}`,
+	)
+
+	var out bytes.Buffer
+	buffered := bufio.NewWriter(&out)
+	backend := NewOllamaBackend(server.URL, "test-model")
+	resp, err := backend.ChatToWriter(context.Background(), []Message{UserMessage("Hi")}, nil, buffered)
+	if err != nil {
+		t.Fatalf("ChatToWriter returned error: %v", err)
+	}
+
+	// The buffered writer must have been flushed without calling Flush
+	if out.String() != "Hello world!" {
+		t.Errorf("Expected Hello world! to be written, got %q", out.String())
+	}
+	if resp.Message.Content != "Hello world!" || resp.Message.Role != RoleAssistant || !resp.Done {
+		t.Errorf("Unexpected response: %+v", resp)
+	}
+	if resp.Model != "test-model" {
+		t.Errorf("Expected model test-model, got %s", resp.Model)
+	}
+	if len(resp.Message.ToolCalls) != 1 || resp.Message.ToolCalls[0].Function.Name != "wave" {
+		t.Errorf("Expected the wave tool call, got %+v", resp.Message.ToolCalls)
+	}
+}
+
+// failingWriter is an io.Writer that fails after the first write.
+type failingWriter struct {
+	writes int
+}
+
+var errWriteFailed = errors.New("disk full")
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	f.writes++
+	if f.writes > 1 {
+		return 0, errWriteFailed
+	}
+	return len(p), nil
+}
+
+func TestChatToWriterWriteError(t *testing.T) {
+	server := newOllamaStreamServer(t,
+		`{"message": {"role": "assistant", "content": "Hello"}, "done": false}`,
+		`{"message": {"role": "assistant", "content": " world"}, "done": false}`,
+		`{"message": {"role": "assistant", "content": "!"}, "done": true}`,
+	)
+
+	w := &failingWriter{}
+	backend := NewOllamaBackend(server.URL, "test-model")
+	_, err := backend.ChatToWriter(context.Background(), []Message{UserMessage("Hi")}, nil, w)
+	if !errors.Is(err, errWriteFailed) {
+		t.Errorf("Expected the write error, got %v", err)
+	}
+	if w.writes != 2 {
+		t.Errorf("Expected the stream to stop at the failed write, got %d writes", w.writes)
+	}
+}
+
+func TestChatToWriterIncompleteStream(t *testing.T) {
+	server := newOllamaStreamServer(t, `{"message": {"role": "assistant", "content": "Hello"}, "done": false}`)
+
+	var out bytes.Buffer
+	backend := NewOllamaBackend(server.URL, "test-model")
+	if _, err := backend.ChatToWriter(context.Background(), []Message{UserMessage("Hi")}, nil, &out); err == nil {
+		t.Errorf("Expected an error for a stream that ends early")
+	}
+	if out.String() != "Hello" {
+		t.Errorf("Expected the partial reply to be written, got %q", out.String())
+	}
+}
+
+func TestToolCallAssembler(t *testing.T) {
+	var assembler toolCallAssembler
+	// Fragments of two calls arrive interleaved and the second index first
+	assembler.add(1, "call_2", "get_time", "")
+	assembler.add(0, "call_1", "get_weather", `{"ci`)
+	assembler.add(1, "", "", `{"zone": "CET"}`)
+	assembler.add(0, "", "", `ty": "Brno"}`)
+
+	calls, err := assembler.toolCalls()
+	if err != nil {
+		t.Fatalf("toolCalls returned error: %v", err)
+	}
+	if len(calls) != 2 {
+		t.Fatalf("Expected 2 tool calls, got %d", len(calls))
+	}
+	if calls[0].ID != "call_1" || calls[0].Function.Name != "get_weather" || calls[0].Function.Arguments["city"] != "Brno" {
+		t.Errorf("Unexpected first call: %+v", calls[0])
+	}
+	if calls[1].ID != "call_2" || calls[1].Function.Arguments["zone"] != "CET" {
+		t.Errorf("Unexpected second call: %+v", calls[1])
+	}
+}
+
+func TestToolCallAssemblerIncomplete(t *testing.T) {
+	var assembler toolCallAssembler
+	assembler.add(0, "call_1", "get_weather", `{"city": "Br`)
+
+	if _, err := assembler.toolCalls(); err == nil {
+		t.Errorf("Expected an error for incomplete arguments")
+	}
+}
+
+func TestToolCallAssemblerEmpty(t *testing.T) {
+	var assembler toolCallAssembler
+	calls, err := assembler.toolCalls()
+	if err != nil || calls != nil {
+		t.Errorf("Expected no tool calls and no error, got %v and %v", calls, err)
+	}
+}
+
+func TestChatStreamStopOnDelta(t *testing.T) {
+	aborted := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, content := range []string{"<answer>4", "2</ans", "wer> and", " more"} {
+			w.Write([]byte(`{"message": {"role": "assistant", "content": "` + content + `"}, "done": false}` + "\n"))
+			w.(http.Flusher).Flush()
+		}
+		// Keep generating until the client goes away
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer server.Close()
+
+	backend := NewOllamaBackend(server.URL, "test-model")
+	chunks, err := backend.ChatStream(context.Background(), []Message{UserMessage("What is 6 times 7?")}, nil,
+		WithStopOnDelta(func(accumulated string) bool {
+			return strings.Contains(accumulated, "</answer>")
+		}))
+	if err != nil {
+		t.Fatalf("ChatStream returned error: %v", err)
+	}
+
+	var content string
+	var last StreamChunk
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			t.Fatalf("Unexpected stream error: %v", chunk.Err)
+		}
+		content += chunk.Content
+		last = chunk
+	}
+	if content != "<answer>42</answer> and" || !last.Done {
+		t.Errorf("Expected the stream to end with the marker, got %q (done %v)", content, last.Done)
+	}
+	if last.Response == nil || last.Response.Message.Content != content || last.Response.FinishReason != FinishStop {
+		t.Errorf("Expected the reply streamed so far on the last chunk, got %+v", last.Response)
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the HTTP request to be aborted")
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	var requests atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		// A slow but steady model, then a hung connection
+		for i := 0; i < 4; i++ {
+			w.Write([]byte(`{"message": {"role": "assistant", "content": "word "}}` + "\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+		if requests.Add(1) > 1 {
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte(`{"done": true, "done_reason": "stop"}` + "\n"))
+	}))
+	defer mockServer.Close()
+
+	be := NewOllamaBackend(mockServer.URL, "test-model", WithStreamIdleTimeout(200*time.Millisecond))
+	if be.StreamIdleTimeout != 200*time.Millisecond {
+		t.Fatalf("Expected the idle timeout to be set, got %s", be.StreamIdleTimeout)
+	}
+	resp, err := ChatToWriter(context.Background(), be, []Message{UserMessage("Hi")}, nil, io.Discard)
+	if err != nil {
+		t.Fatalf("Expected a slow stream to complete, got %v", err)
+	}
+	if resp.Message.Content != "word word word word " {
+		t.Errorf("Unexpected content %q", resp.Message.Content)
+	}
+
+	start := time.Now()
+	_, err = ChatToWriter(context.Background(), be, []Message{UserMessage("Hi")}, nil, io.Discard)
+	if !errors.Is(err, ErrStreamIdle) {
+		t.Errorf("Expected ErrStreamIdle, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the hung stream to be aborted, took %s", elapsed)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ChatStructured sends messages to be with JSON mode enabled and unmarshals the reply into a T.
+// If the reply cannot be unmarshaled, or does not match the schema set with
+// WithResponseSchema, the model is told what went wrong and asked once more
+// before giving up.
+//
+// It returns the parsed value together with the raw content of the last reply,
+// which is useful for debugging replies that failed to parse.
+func ChatStructured[T any](ctx context.Context, be Backend, messages []Message, opts ...CallOption) (T, string, error) {
+	var value T
+	opts = append(opts[:len(opts):len(opts)], WithJSONFormat())
+	var schema map[string]any
+	if o, err := newCallOptions(opts); err == nil {
+		schema = o.ResponseSchema
+	}
+
+	resp, err := be.Chat(ctx, messages, nil, opts...)
+	if err != nil {
+		return value, "", err
+	}
+	content := resp.Message.Content
+
+	decodeErr := decodeStructured(content, schema, &value)
+	if decodeErr == nil {
+		return value, content, nil
+	}
+
+	correction := fmt.Sprintf("Your reply could not be parsed as JSON: %v. Reply again with valid JSON only.", decodeErr)
+	if errors.Is(decodeErr, ErrSchemaMismatch) {
+		correction = fmt.Sprintf("Your reply does not match the JSON schema: %v. Reply again with JSON matching the schema only.", decodeErr)
+	}
+	retry := make([]Message, 0, len(messages)+2)
+	retry = append(retry, messages...)
+	retry = append(retry, AssistantMessage(content), UserMessage(correction))
+
+	resp, err = be.Chat(ctx, retry, nil, opts...)
+	if err != nil {
+		return value, content, err
+	}
+	content = resp.Message.Content
+
+	value = *new(T)
+	if err := decodeStructured(content, schema, &value); err != nil {
+		return value, content, fmt.Errorf("failed to parse structured reply: %w", err)
+	}
+	return value, content, nil
+}
+
+// decodeStructured checks that content matches schema, if it is not nil, and
+// unmarshals it into value. A reply that does not match is reported with an
+// error matching ErrSchemaMismatch.
+func decodeStructured(content string, schema map[string]any, value any) error {
+	if schema != nil {
+		var decoded any
+		if err := json.Unmarshal([]byte(content), &decoded); err != nil {
+			return err
+		}
+		if problems := schemaProblems(decoded, schema, ""); len(problems) > 0 {
+			return fmt.Errorf("%w: %s", ErrSchemaMismatch, strings.Join(problems, "; "))
+		}
+	}
+	return json.Unmarshal([]byte(content), value)
+}
+
+// schemaProblems returns what is wrong with value, as decoded from JSON, at
+// path in the reply, given the JSON schema it must match. The type, enum,
+// properties, required, additionalProperties and items keywords are checked.
+// Null values are only reported if they are required.
+func schemaProblems(value any, schema map[string]any, path string) []string {
+	at := func(format string, args ...any) string {
+		if path == "" {
+			return fmt.Sprintf(format, args...)
+		}
+		return path + ": " + fmt.Sprintf(format, args...)
+	}
+	if value == nil {
+		return nil
+	}
+
+	if t, ok := schema["type"]; ok {
+		types := []any{t}
+		if list, ok := t.([]any); ok {
+			types = list
+		}
+		matched := false
+		names := make([]string, 0, len(types))
+		for _, t := range types {
+			name, _ := t.(string)
+			names = append(names, name)
+			matched = matched || hasJSONType(value, name)
+		}
+		if !matched {
+			return []string{at("expected %s, got %s", strings.Join(names, " or "), jsonTypeName(value))}
+		}
+	}
+	if enum := stringList(schema["enum"]); len(enum) > 0 && !slices.Contains(enum, fmt.Sprint(value)) {
+		return []string{at("expected one of %s, got %v", strings.Join(enum, ", "), value)}
+	}
+
+	var problems []string
+	switch v := value.(type) {
+	case map[string]any:
+		properties, _ := schema["properties"].(map[string]any)
+		for _, name := range stringList(schema["required"]) {
+			if v[name] == nil {
+				problems = append(problems, at("missing required field %s", name))
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := properties[name].(map[string]any)
+			if !ok {
+				if schema["additionalProperties"] == false {
+					problems = append(problems, at("unexpected field %s", name))
+				}
+				continue
+			}
+			problems = append(problems, schemaProblems(v[name], property, joinSchemaPath(path, name))...)
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				problems = append(problems, schemaProblems(item, items, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	}
+	return problems
+}
+
+// joinSchemaPath returns the path of the field name of the object at path.
+func joinSchemaPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// jsonTypeName returns the JSON type of value, as decoded from JSON.
+func jsonTypeName(value any) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
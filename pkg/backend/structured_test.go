@@ -0,0 +1,264 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type weather struct {
+	City        string  `json:"city"`
+	Temperature float64 `json:"temperature"`
+}
+
+func TestChatStructured(t *testing.T) {
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return &Response{Message: Message{Content: `{"city":"Brno","temperature":21.5}`}}, nil
+		},
+	}
+
+	value, raw, err := ChatStructured[weather](context.Background(), be, []Message{UserMessage("Weather in Brno as JSON")})
+	if err != nil {
+		t.Fatalf("ChatStructured returned error: %v", err)
+	}
+	if value.City != "Brno" || value.Temperature != 21.5 {
+		t.Errorf("Unexpected value: %+v", value)
+	}
+	if raw != `{"city":"Brno","temperature":21.5}` {
+		t.Errorf("Unexpected raw content: %s", raw)
+	}
+	if !be.options[0].JSONFormat {
+		t.Errorf("Expected JSON format to be requested")
+	}
+}
+
+func TestChatStructuredRepromptsOnce(t *testing.T) {
+	replies := []string{"Sure! Here it is: {", `{"city":"Brno","temperature":20}`}
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			reply := replies[0]
+			replies = replies[1:]
+			return &Response{Message: Message{Content: reply}}, nil
+		},
+	}
+
+	value, _, err := ChatStructured[weather](context.Background(), be, []Message{UserMessage("Weather?")})
+	if err != nil {
+		t.Fatalf("ChatStructured returned error: %v", err)
+	}
+	if value.City != "Brno" {
+		t.Errorf("Unexpected value: %+v", value)
+	}
+
+	// The re-prompt contains the malformed reply and a correction request
+	if len(be.received) != 2 || len(be.received[1]) != 3 {
+		t.Fatalf("Expected a second request with 3 messages, got %v", be.received)
+	}
+	if be.received[1][1].Content != "Sure! Here it is: {" {
+		t.Errorf("Expected the malformed reply in the re-prompt, got %+v", be.received[1][1])
+	}
+}
+
+func TestChatStructuredGivesUp(t *testing.T) {
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return &Response{Message: Message{Content: "not json"}}, nil
+		},
+	}
+
+	_, raw, err := ChatStructured[weather](context.Background(), be, []Message{UserMessage("Weather?")})
+	if err == nil {
+		t.Fatalf("Expected an error after the re-prompt failed")
+	}
+	if raw != "not json" {
+		t.Errorf("Expected the raw content to be returned, got %s", raw)
+	}
+	if len(be.received) != 2 {
+		t.Errorf("Expected exactly one re-prompt, got %d requests", len(be.received))
+	}
+}
+
+func TestJSONFormatOnTheWire(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if reqBody["format"] != "json" {
+			t.Errorf("Expected format json, got %v", reqBody["format"])
+		}
+		json.NewEncoder(w).Encode(Response{Message: Message{Content: "{}"}, Done: true})
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+	if _, err := backend.Chat(context.Background(), []Message{UserMessage("Hi")}, nil, WithJSONFormat()); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	if _, err := backend.Generate(context.Background(), "Hi", WithJSONFormat()); err != nil {
+		t.Fatalf("Generate returned error: %v", err)
+	}
+}
+
+func TestChatStructuredSchemaMismatch(t *testing.T) {
+	replies := []string{`{"city": 42}`, `{"city": "Brno", "temperature": 20}`}
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			reply := replies[0]
+			replies = replies[1:]
+			return &Response{Message: Message{Content: reply}}, nil
+		},
+	}
+
+	value, _, err := ChatStructured[weather](context.Background(), be, []Message{UserMessage("Weather?")}, WithResponseSchema(weather{}))
+	if err != nil {
+		t.Fatalf("ChatStructured returned error: %v", err)
+	}
+	if value.City != "Brno" || value.Temperature != 20 {
+		t.Errorf("Unexpected value: %+v", value)
+	}
+	if len(be.received) != 2 {
+		t.Fatalf("Expected a re-prompt, got %d requests", len(be.received))
+	}
+	correction := be.received[1][2].Content
+	if !strings.Contains(correction, "city: expected string, got number") || !strings.Contains(correction, "missing required field temperature") {
+		t.Errorf("Expected the mismatches in the re-prompt, got %s", correction)
+	}
+	if be.options[0].ResponseSchema["type"] != "object" {
+		t.Errorf("Expected the schema to be requested, got %v", be.options[0].ResponseSchema)
+	}
+}
+
+func TestSchemaProblems(t *testing.T) {
+	schema := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"name":  map[string]any{"type": "string"},
+			"units": map[string]any{"type": "string", "enum": []any{"celsius", "fahrenheit"}},
+			"days": map[string]any{"type": "array", "items": map[string]any{
+				"type":     "object",
+				"required": []any{"temperature"},
+				"properties": map[string]any{
+					"temperature": map[string]any{"type": "number"},
+				},
+			}},
+		},
+		"required":             []any{"name"},
+		"additionalProperties": false,
+	}
+
+	cases := []struct {
+		reply string
+		want  []string
+	}{
+		{`{"name": "Brno", "units": "celsius", "days": [{"temperature": 20}]}`, nil},
+		{`{"name": null}`, []string{"missing required field name"}},
+		{`[]`, []string{"expected object, got array"}},
+		{`{"name": "Brno", "units": "kelvin", "wind": 3}`, []string{
+			"units: expected one of celsius, fahrenheit, got kelvin",
+			"unexpected field wind",
+		}},
+		{`{"name": "Brno", "days": [{"temperature": 20}, {"temperature": "hot"}, {}]}`, []string{
+			"days[1].temperature: expected number, got string",
+			"days[2]: missing required field temperature",
+		}},
+	}
+	for _, tc := range cases {
+		var value any
+		json.Unmarshal([]byte(tc.reply), &value)
+		if got := schemaProblems(value, schema, ""); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: expected %q, got %q", tc.reply, tc.want, got)
+		}
+	}
+}
+
+func TestResponseSchemaOnTheWire(t *testing.T) {
+	var received map[string]any
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = nil
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer mockServer.Close()
+
+	want := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"city":        map[string]any{"type": "string"},
+			"temperature": map[string]any{"type": "number"},
+		},
+		"required": []any{"city", "temperature"},
+	}
+	messages := []Message{UserMessage("Weather?")}
+
+	ollama := NewOllamaBackend(mockServer.URL, "test-model")
+	ollama.Chat(context.Background(), messages, nil, WithResponseSchema(&weather{}))
+	if !reflect.DeepEqual(received["format"], want) {
+		t.Errorf("Expected the schema as the format for Ollama, got %v", received["format"])
+	}
+
+	openai := NewOpenAIBackend("key", "gpt-4o-mini", WithBaseURL(mockServer.URL))
+	openai.Chat(context.Background(), messages, nil, WithResponseSchema(weather{}), WithJSONFormat())
+	format, _ := received["response_format"].(map[string]any)
+	jsonSchema, _ := format["json_schema"].(map[string]any)
+	if format["type"] != "json_schema" || !reflect.DeepEqual(jsonSchema["schema"], want) {
+		t.Errorf("Expected a json_schema response format for OpenAI, got %v", received["response_format"])
+	}
+	if jsonSchema["strict"] != false {
+		t.Errorf("Expected no strict mode for a schema allowing other fields, got %v", jsonSchema["strict"])
+	}
+
+	strict := map[string]any{
+		"type":                 "object",
+		"properties":           map[string]any{"city": map[string]any{"type": "string"}},
+		"required":             []any{"city"},
+		"additionalProperties": false,
+	}
+	openai.Chat(context.Background(), messages, nil, WithResponseSchema(strict))
+	format, _ = received["response_format"].(map[string]any)
+	jsonSchema, _ = format["json_schema"].(map[string]any)
+	if jsonSchema["strict"] != true {
+		t.Errorf("Expected strict mode for a closed schema, got %v", received["response_format"])
+	}
+
+	gemini := NewGeminiBackend("key", "gemini-1.5-flash", WithBaseURL(mockServer.URL))
+	gemini.Chat(context.Background(), messages, nil, WithResponseSchema(strict))
+	config, _ := received["generationConfig"].(map[string]any)
+	delete(strict, "additionalProperties")
+	if config["responseMimeType"] != "application/json" || !reflect.DeepEqual(config["responseSchema"], strict) {
+		t.Errorf("Expected the schema without additionalProperties for Gemini, got %v", config)
+	}
+
+	anthropic := NewAnthropicBackend("key", "claude-3-5-haiku-latest", WithBaseURL(mockServer.URL))
+	anthropic.Chat(context.Background(), messages, nil, WithResponseSchema(weather{}))
+	if system, _ := received["system"].(string); !strings.Contains(system, anthropicJSONInstruction) {
+		t.Errorf("Expected JSON mode for Anthropic, got system prompt %q", system)
+	}
+
+	_, err := ollama.Chat(context.Background(), messages, nil, WithResponseSchema(map[string]any{"type": "struct"}))
+	if !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Expected ErrInvalidOption for a malformed schema, got %v", err)
+	}
+}
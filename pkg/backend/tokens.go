@@ -0,0 +1,223 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"errors"
+	"hash/fnv"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// defaultContextLimit is the context window assumed for unknown models.
+// It matches the num_ctx Ollama uses unless told otherwise.
+const defaultContextLimit = 2048
+
+// messageOverheadTokens approximates the tokens a chat template adds around each message.
+const messageOverheadTokens = 4
+
+// TokenCounter estimates the number of tokens text is split into by a model's tokenizer.
+type TokenCounter func(text string) int
+
+// Tokenizer splits text into the tokens of a model family. Set one for a backend
+// with WithTokenizer to count its requests with the tokenizer of its models, e.g.
+// one backed by a BPE vocabulary such as tiktoken's for OpenAI models.
+type Tokenizer interface {
+	// Count returns the number of tokens in text, len(Encode(text)).
+	Count(text string) int
+	// Encode returns the IDs of the tokens of text.
+	Encode(text string) []int
+}
+
+// HeuristicTokenizer is a Tokenizer for models whose tokenizer is not known. It
+// counts tokens as HeuristicTokenCount does and encodes every four characters as
+// a token whose ID is a hash of them, so the IDs only tell equal pieces apart
+// and do not match those of any model.
+type HeuristicTokenizer struct{}
+
+var _ Tokenizer = HeuristicTokenizer{}
+
+// Count implements Tokenizer.
+func (HeuristicTokenizer) Count(text string) int {
+	return HeuristicTokenCount(text)
+}
+
+// Encode implements Tokenizer.
+func (HeuristicTokenizer) Encode(text string) []int {
+	runes := []rune(text)
+	ids := make([]int, 0, (len(runes)+3)/4)
+	for start := 0; start < len(runes); start += 4 {
+		h := fnv.New32a()
+		h.Write([]byte(string(runes[start:min(start+4, len(runes))])))
+		ids = append(ids, int(h.Sum32()))
+	}
+	return ids
+}
+
+var (
+	tokenCountersMu sync.RWMutex
+	// tokenCounters maps model name prefixes to the counter used for them.
+	tokenCounters = map[string]TokenCounter{
+		"gpt-":             ApproxOpenAITokenCount,
+		"o1":               ApproxOpenAITokenCount,
+		"o3":               ApproxOpenAITokenCount,
+		"text-embedding-3": ApproxOpenAITokenCount,
+		"text-embedding-a": ApproxOpenAITokenCount,
+	}
+
+	// contextLimits maps model name prefixes to their context window in tokens.
+	contextLimits = map[string]int{
+		"gpt-4o":        128000,
+		"gpt-4-turbo":   128000,
+		"gpt-4":         8192,
+		"gpt-3.5-turbo": 16385,
+		"o1":            200000,
+		"o3":            200000,
+		"claude":        200000,
+		"gemini-1.5":    1048576,
+		"llama3.1":      131072,
+		"llama3.2":      131072,
+		"llama3":        8192,
+		"qwen2.5":       32768,
+		"mistral":       32768,
+		"codellama":     16384,
+	}
+)
+
+// RegisterTokenCounter makes EstimateTokens use counter for every model whose name
+// starts with prefix, replacing the built-in estimate for that model family.
+func RegisterTokenCounter(prefix string, counter TokenCounter) {
+	tokenCountersMu.Lock()
+	defer tokenCountersMu.Unlock()
+	tokenCounters[prefix] = counter
+}
+
+// EstimateTokens estimates how many tokens messages take up in the context window
+// of model, including a small per-message overhead for the chat template.
+//
+// OpenAI models are estimated with ApproxOpenAITokenCount. Other models, including those
+// served by Ollama, use HeuristicTokenCount unless a counter was registered for
+// them with RegisterTokenCounter.
+func EstimateTokens(messages []Message, model string) (int, error) {
+	if model == "" {
+		return 0, errors.New("model name is required to estimate tokens")
+	}
+
+	return countMessageTokens(lookupTokenCounter(model), messages), nil
+}
+
+// countMessageTokens estimates the tokens of messages using count for their text.
+func countMessageTokens(count TokenCounter, messages []Message) int {
+	total := 0
+	for _, msg := range messages {
+		total += messageTokens(count, msg)
+	}
+	return total
+}
+
+// messageTokens estimates the tokens of msg using count for its text.
+func messageTokens(count TokenCounter, msg Message) int {
+	total := messageOverheadTokens + count(msg.Content)
+	for _, call := range msg.ToolCalls {
+		total += count(call.Function.Name)
+		for key, value := range call.Function.Arguments {
+			total += count(key)
+			if s, ok := value.(string); ok {
+				total += count(s)
+			} else {
+				total++
+			}
+		}
+	}
+	return total
+}
+
+// ModelContextLimit returns the context window of model in tokens. Tags such as
+// ":7b" are ignored. Unknown models are assumed to have Ollama's default context
+// window of 2048 tokens.
+func ModelContextLimit(model string) int {
+	if limit, ok := longestPrefixMatch(contextLimits, baseModelName(model)); ok {
+		return limit
+	}
+	return defaultContextLimit
+}
+
+// HeuristicTokenCount estimates the number of tokens in text as one token per
+// four characters, which is a reasonable average for English text.
+func HeuristicTokenCount(text string) int {
+	n := utf8.RuneCountInString(text)
+	return (n + 3) / 4
+}
+
+// cl100kPreTokenizer splits text into pieces similarly to the pre-tokenizer of
+// OpenAI's cl100k_base encoding. Byte pair merges never cross piece boundaries.
+var cl100kPreTokenizer = regexp.MustCompile(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\pL\pN]?\pL+|\pN{1,3}| ?[^\s\pL\pN]+[\r\n]*|\s*[\r\n]+|\s+`)
+
+// ApproxOpenAITokenCount estimates the number of tokens in text for OpenAI models.
+// It splits text the way the cl100k_base pre-tokenizer does and then assumes short
+// pieces are a single token while longer pieces are split every six characters.
+// No byte pair merges are applied, as the vocabulary is not shipped, so the count
+// is an approximation; set an exact Tokenizer with WithTokenizer where that matters.
+func ApproxOpenAITokenCount(text string) int {
+	total := 0
+	for _, piece := range cl100kPreTokenizer.FindAllString(text, -1) {
+		n := utf8.RuneCountInString(strings.TrimSpace(piece))
+		if n <= 6 {
+			total++
+			continue
+		}
+		total += (n + 5) / 6
+	}
+	return total
+}
+
+// lookupTokenCounter returns the counter used for model.
+func lookupTokenCounter(model string) TokenCounter {
+	tokenCountersMu.RLock()
+	defer tokenCountersMu.RUnlock()
+	if counter, ok := longestPrefixMatch(tokenCounters, baseModelName(model)); ok {
+		return counter
+	}
+	return HeuristicTokenCount
+}
+
+// tokenCounter returns the Count method of tokenizer, or the counter used for
+// model if tokenizer is nil.
+func tokenCounter(model string, tokenizer Tokenizer) TokenCounter {
+	if tokenizer != nil {
+		return tokenizer.Count
+	}
+	return lookupTokenCounter(model)
+}
+
+// baseModelName strips the tag, e.g. ":7b", from an Ollama model name.
+func baseModelName(model string) string {
+	name, _, _ := strings.Cut(model, ":")
+	return name
+}
+
+// longestPrefixMatch returns the value of the longest key in m that is a prefix of name.
+func longestPrefixMatch[V any](m map[string]V, name string) (V, bool) {
+	var best V
+	bestLen := -1
+	for prefix, value := range m {
+		if strings.HasPrefix(name, prefix) && len(prefix) > bestLen {
+			best, bestLen = value, len(prefix)
+		}
+	}
+	return best, bestLen >= 0
+}
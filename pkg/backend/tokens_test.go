@@ -0,0 +1,139 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokensHeuristic(t *testing.T) {
+	messages := []Message{
+		{Role: "system", Content: "12345678"},
+		{Role: "user", Content: "1234"},
+	}
+
+	// 2 + 1 tokens of content and the per-message overhead
+	tokens, err := EstimateTokens(messages, "qwen2.5:7b")
+	if err != nil {
+		t.Fatalf("EstimateTokens returned error: %v", err)
+	}
+	if expected := 3 + 2*messageOverheadTokens; tokens != expected {
+		t.Errorf("Expected %d tokens, got %d", expected, tokens)
+	}
+
+	if _, err := EstimateTokens(messages, ""); err == nil {
+		t.Errorf("Expected an error without a model")
+	}
+}
+
+func TestApproxOpenAITokenCount(t *testing.T) {
+	// cl100k_base encodes this sentence as 9 tokens
+	if got := ApproxOpenAITokenCount("Hello, world! How are you doing today?"); got < 8 || got > 10 {
+		t.Errorf("Expected about 9 tokens, got %d", got)
+	}
+	if got := ApproxOpenAITokenCount(""); got != 0 {
+		t.Errorf("Expected 0 tokens for empty text, got %d", got)
+	}
+	// Long words are split into several tokens
+	if got := ApproxOpenAITokenCount("antidisestablishmentarianism"); got < 3 {
+		t.Errorf("Expected a long word to count as several tokens, got %d", got)
+	}
+}
+
+func TestRegisterTokenCounter(t *testing.T) {
+	RegisterTokenCounter("test-family", func(text string) int { return len(strings.Fields(text)) })
+	defer func() {
+		tokenCountersMu.Lock()
+		delete(tokenCounters, "test-family")
+		tokenCountersMu.Unlock()
+	}()
+
+	tokens, err := EstimateTokens([]Message{{Role: "user", Content: "one two three"}}, "test-family-7b")
+	if err != nil {
+		t.Fatalf("EstimateTokens returned error: %v", err)
+	}
+	if expected := 3 + messageOverheadTokens; tokens != expected {
+		t.Errorf("Expected %d tokens, got %d", expected, tokens)
+	}
+}
+
+func TestHeuristicTokenizer(t *testing.T) {
+	var tokenizer Tokenizer = HeuristicTokenizer{}
+	for _, text := range []string{"", "abc", "abcd", "abcdabcde", "žluťoučký kůň"} {
+		ids := tokenizer.Encode(text)
+		if len(ids) != tokenizer.Count(text) || len(ids) != HeuristicTokenCount(text) {
+			t.Errorf("%q: expected %d tokens, got %d encoded and %d counted", text, HeuristicTokenCount(text), len(ids), tokenizer.Count(text))
+		}
+	}
+	if ids := tokenizer.Encode("abcdabcdabc"); ids[0] != ids[1] || ids[1] == ids[2] {
+		t.Errorf("Expected equal pieces to have equal IDs, got %v", ids)
+	}
+	if !slices.Equal(tokenizer.Encode("hello world"), tokenizer.Encode("hello world")) {
+		t.Errorf("Expected the encoding to be deterministic")
+	}
+}
+
+// wordTokenizer counts every word as a token.
+type wordTokenizer struct{}
+
+func (wordTokenizer) Count(text string) int { return len(strings.Fields(text)) }
+
+func (wordTokenizer) Encode(text string) []int { return make([]int, len(strings.Fields(text))) }
+
+func TestWithTokenizer(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Response{Done: true})
+	}))
+	defer mockServer.Close()
+
+	// 100 words, which the default heuristic counts as 125 tokens
+	messages := []Message{UserMessage(strings.Repeat("word ", 100))}
+	be := NewOllamaBackend(mockServer.URL, "test-model", WithTokenizer(wordTokenizer{}))
+	if _, err := be.Chat(context.Background(), messages, nil, WithContextGuard(110)); err != nil {
+		t.Errorf("Expected the request to fit with the tokenizer of the backend, got %v", err)
+	}
+
+	_, err := be.Chat(context.Background(), messages, nil, WithContextGuard(100))
+	var overflow *ContextOverflowError
+	if !errors.As(err, &overflow) || overflow.Estimated != 100+messageOverheadTokens {
+		t.Errorf("Expected an estimate of %d tokens, got %v", 100+messageOverheadTokens, err)
+	}
+
+	// The counter of the call takes precedence
+	if _, err := be.Chat(context.Background(), messages, nil, WithContextGuard(110), WithTokenCounter(HeuristicTokenCount)); !errors.Is(err, ErrContextOverflow) {
+		t.Errorf("Expected the counter of the call to be used, got %v", err)
+	}
+}
+
+func TestModelContextLimit(t *testing.T) {
+	limits := map[string]int{
+		"gpt-4o-mini":   128000,
+		"gpt-4":         8192,
+		"llama3.1:70b":  131072,
+		"llama3:8b":     8192,
+		"unknown-model": defaultContextLimit,
+	}
+	for model, expected := range limits {
+		if got := ModelContextLimit(model); got != expected {
+			t.Errorf("Expected context limit %d for %s, got %d", expected, model, got)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LoadToolsFromFile reads tool definitions from the JSON or YAML file at path,
+// told apart by the extension: .json, or .yaml or .yml. The file holds either a
+// list of tools or a single tool, each in the layout of Tool, e.g.
+//
+//	type: function
+//	function:
+//	  name: get_weather
+//	  description: Get the current weather in a city
+//	  parameters:
+//	    type: object
+//	    properties:
+//	      city: {type: string}
+//	    required: [city]
+//
+// The tools are checked with ValidateTools, so a malformed definition fails the
+// load with an error matching ErrInvalidTool rather than the first request that
+// uses it.
+func LoadToolsFromFile(path string) ([]Tool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tools: %w", err)
+	}
+	tools, err := parseTools(data, filepath.Ext(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tools from %s: %w", path, err)
+	}
+	return tools, nil
+}
+
+// parseTools decodes and validates the tool definitions in data, in the format
+// given by the file extension ext.
+func parseTools(data []byte, ext string) ([]Tool, error) {
+	switch strings.ToLower(ext) {
+	case ".json":
+	case ".yaml", ".yml":
+		// Decode to JSON first so that the values have the types they would have in
+		// a JSON file, e.g. float64 rather than int for numbers
+		var doc any
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		var err error
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported file extension %q, expected .json, .yaml or .yml", ext)
+	}
+
+	var tools []Tool
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var tool Tool
+		if err := json.Unmarshal(data, &tool); err != nil {
+			return nil, err
+		}
+		tools = []Tool{tool}
+	} else if err := json.Unmarshal(data, &tools); err != nil {
+		return nil, err
+	}
+	if len(tools) == 0 {
+		return nil, fmt.Errorf("%w: no tools defined", ErrInvalidTool)
+	}
+	if err := ValidateTools(tools); err != nil {
+		return nil, err
+	}
+	return tools, nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadToolsFromFile(t *testing.T) {
+	const jsonTools = `[{
+		"type": "function",
+		"function": {
+			"name": "get_weather",
+			"description": "Get the current weather in a city",
+			"parameters": {
+				"type": "object",
+				"properties": {"city": {"type": "string"}, "days": {"type": "integer", "minimum": 1}},
+				"required": ["city"]
+			}
+		}
+	}]`
+	const yamlTools = `
+- type: function
+  function:
+    name: get_weather
+    description: Get the current weather in a city
+    parameters:
+      type: object
+      properties:
+        city: {type: string}
+        days: {type: integer, minimum: 1}
+      required: [city]
+`
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	fromJSON, err := LoadToolsFromFile(write("tools.json", jsonTools))
+	if err != nil {
+		t.Fatalf("Failed to load JSON tools: %v", err)
+	}
+	fromYAML, err := LoadToolsFromFile(write("tools.yml", yamlTools))
+	if err != nil {
+		t.Fatalf("Failed to load YAML tools: %v", err)
+	}
+	if len(fromJSON) != 1 || toolName(fromJSON[0]) != "get_weather" {
+		t.Fatalf("Unexpected tools: %v", fromJSON)
+	}
+	if !reflect.DeepEqual(fromJSON, fromYAML) {
+		t.Errorf("Expected the same tools from JSON and YAML, got %v and %v", fromJSON, fromYAML)
+	}
+
+	single, err := LoadToolsFromFile(write("single.json", jsonTools[1:len(jsonTools)-1]))
+	if err != nil || len(single) != 1 {
+		t.Errorf("Expected a single tool, got %v, %v", single, err)
+	}
+}
+
+func TestLoadToolsFromFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		target  error
+	}{
+		{name: "invalid schema", file: "bad.yaml", content: "- type: function\n  function:\n    name: x\n    parameters: {type: string}\n", target: ErrInvalidTool},
+		{name: "no tools", file: "empty.json", content: "[]", target: ErrInvalidTool},
+		{name: "malformed JSON", file: "broken.json", content: "[{"},
+		{name: "unsupported extension", file: "tools.txt", content: "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadToolsFromFile(path)
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if tt.target != nil && !errors.Is(err, tt.target) {
+				t.Errorf("Expected %v, got %v", tt.target, err)
+			}
+		})
+	}
+
+	if _, err := LoadToolsFromFile(filepath.Join(dir, "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected os.ErrNotExist, got %v", err)
+	}
+}
@@ -0,0 +1,688 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errorInterface = reflect.TypeOf((*error)(nil)).Elem()
+
+// RegisterTool registers fn as the handler of the tool with the given name and
+// generates the tool definition, which is returned by Tools, from its signature.
+//
+// fn must be a function taking a struct, or a pointer to one, that holds the
+// arguments, and returning a result and an error, e.g.
+//
+//	type WeatherArgs struct {
+//		City  string `json:"city" description:"Name of the city"`
+//		Units string `json:"units,omitempty" enum:"celsius,fahrenheit"`
+//	}
+//
+//	func weather(args WeatherArgs) (string, error)
+//
+// The JSON schema of the parameters is derived from the exported fields of the
+// struct. Fields are named after their json tag and are required unless the tag
+// has omitempty or the field is a pointer. The description and enum tags describe
+// a field to the model. When the model calls the tool, its arguments are decoded
+// into the struct and the result is sent back as is if it is a string or a
+// []byte, and as JSON otherwise, so structured results need no serializing.
+func (d *ToolDispatcher) RegisterTool(name, description string, fn any) error {
+	if name == "" {
+		return errors.New("tool name must not be empty")
+	}
+	fnValue := reflect.ValueOf(fn)
+	if !fnValue.IsValid() {
+		return fmt.Errorf("tool %s: handler must not be nil", name)
+	}
+	fnType := fnValue.Type()
+	if fnType.Kind() != reflect.Func || fnType.NumIn() != 1 || fnType.NumOut() != 2 || fnType.Out(1) != errorInterface {
+		return fmt.Errorf("tool %s: handler must have the form func(Args) (Result, error), got %s", name, fnType)
+	}
+
+	argsType := fnType.In(0)
+	structType := argsType
+	if structType.Kind() == reflect.Pointer {
+		structType = structType.Elem()
+	}
+	if structType.Kind() != reflect.Struct {
+		return fmt.Errorf("tool %s: arguments must be a struct, got %s", name, argsType)
+	}
+
+	d.handlers[name] = func(args map[string]any) (string, error) {
+		in, err := decodeToolArguments(args, argsType)
+		if err != nil {
+			return "", err
+		}
+		out := fnValue.Call([]reflect.Value{in})
+		if err, _ := out[1].Interface().(error); err != nil {
+			return "", err
+		}
+		return encodeToolResult(out[0].Interface())
+	}
+
+	definition := Tool{
+		"type": "function",
+		"function": map[string]any{
+			"name":        name,
+			"description": description,
+			"parameters":  structSchema(structType),
+		},
+	}
+	for i, existing := range d.definitions {
+		if toolName(existing) == name {
+			d.definitions[i] = definition
+			return nil
+		}
+	}
+	d.definitions = append(d.definitions, definition)
+	return nil
+}
+
+// ValidateToolCall checks the arguments of call against the parameters declared in
+// the definition of tool. It returns a *ToolCallValidationError listing the missing
+// required arguments and the arguments of the wrong type, or not among the allowed
+// values of an enum. Only the top-level arguments are checked.
+func ValidateToolCall(tool Tool, call ToolCall) error {
+	function, _ := tool["function"].(map[string]any)
+	schema, _ := function["parameters"].(map[string]any)
+	properties, _ := schema["properties"].(map[string]any)
+
+	verr := &ToolCallValidationError{Tool: call.Function.Name, Invalid: map[string]string{}}
+	for _, name := range stringList(schema["required"]) {
+		if call.Function.Arguments[name] == nil {
+			verr.Missing = append(verr.Missing, name)
+		}
+	}
+	for name, value := range call.Function.Arguments {
+		property, _ := properties[name].(map[string]any)
+		if property == nil || value == nil {
+			continue
+		}
+		if expected, _ := property["type"].(string); expected != "" && !hasJSONType(value, expected) {
+			verr.Invalid[name] = fmt.Sprintf("expected %s, got %T", expected, value)
+			continue
+		}
+		if enum := stringList(property["enum"]); len(enum) > 0 && !slices.Contains(enum, fmt.Sprint(value)) {
+			verr.Invalid[name] = fmt.Sprintf("expected one of %s, got %v", strings.Join(enum, ", "), value)
+		}
+	}
+
+	if len(verr.Missing) > 0 || len(verr.Invalid) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// CoerceToolArguments returns call with the arguments whose type does not match
+// the parameters declared in the definition of tool converted to the declared
+// type where the conversion is lossless, e.g. "3" to 3 for an integer or "true"
+// to true for a boolean. Strings, numbers and booleans are converted to each
+// other, other arguments and arguments that cannot be converted are left for
+// ValidateToolCall to report. Only the top-level arguments are converted; the
+// arguments of call are not modified.
+func CoerceToolArguments(tool Tool, call ToolCall) ToolCall {
+	function, _ := tool["function"].(map[string]any)
+	schema, _ := function["parameters"].(map[string]any)
+	properties, _ := schema["properties"].(map[string]any)
+
+	var coerced map[string]any
+	for name, value := range call.Function.Arguments {
+		property, _ := properties[name].(map[string]any)
+		expected, _ := property["type"].(string)
+		if value == nil || expected == "" || hasJSONType(value, expected) {
+			continue
+		}
+		if converted, ok := coerceJSONType(value, expected); ok {
+			if coerced == nil {
+				coerced = maps.Clone(call.Function.Arguments)
+			}
+			coerced[name] = converted
+		}
+	}
+	if coerced != nil {
+		call.Function.Arguments = coerced
+	}
+	return call
+}
+
+// coerceJSONType converts value, as decoded from JSON, to the JSON schema type
+// expected. It reports false if value is not a string, number or boolean or if
+// the conversion would lose information.
+func coerceJSONType(value any, expected string) (any, bool) {
+	v := reflect.ValueOf(value)
+	switch {
+	case v.Kind() == reflect.String:
+		s := strings.TrimSpace(v.String())
+		switch expected {
+		case "number", "integer":
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+				return nil, false
+			}
+			return f, expected == "number" || f == math.Trunc(f)
+		case "boolean":
+			b, err := strconv.ParseBool(s)
+			return b, err == nil
+		}
+	case v.Kind() == reflect.Bool:
+		switch expected {
+		case "string":
+			return strconv.FormatBool(v.Bool()), true
+		case "number", "integer":
+			if v.Bool() {
+				return float64(1), true
+			}
+			return float64(0), true
+		}
+	case v.CanFloat() || v.CanInt() || v.CanUint():
+		f := v.Convert(reflect.TypeOf(float64(0))).Float()
+		switch expected {
+		case "string":
+			return strconv.FormatFloat(f, 'f', -1, 64), true
+		case "boolean":
+			return f == 1, f == 0 || f == 1
+		}
+	}
+	return nil, false
+}
+
+// functionFields are the fields a function in a tool definition may have.
+var functionFields = []string{"name", "description", "parameters", "strict"}
+
+// jsonSchemaTypes are the types a JSON schema may declare.
+var jsonSchemaTypes = []string{"string", "number", "integer", "boolean", "array", "object", "null"}
+
+// ValidateTools checks that every tool in tools is a well-formed function tool:
+// its type is "function" and its function has a name and, if it declares
+// parameters, a JSON schema of type object whose properties declare known types
+// and whose required list only names declared properties. Unknown fields of the
+// function, such as a misspelled "parameter", and duplicate names are rejected
+// as well. Malformed definitions are otherwise dropped or ignored by some
+// backends without an error.
+//
+// It returns a *ToolDefinitionError naming the first offending tool and field.
+// Chat calls it before sending a request with tools, unless WithoutToolValidation
+// is given.
+func ValidateTools(tools []Tool) error {
+	seen := make(map[string]bool, len(tools))
+	for i, tool := range tools {
+		name := toolName(tool)
+		invalid := func(field, reason string) error {
+			return &ToolDefinitionError{Index: i, Tool: name, Field: field, Reason: reason}
+		}
+
+		if tool["type"] != "function" {
+			return invalid("type", fmt.Sprintf(`expected "function", got %#v`, tool["type"]))
+		}
+		function, ok := tool["function"].(map[string]any)
+		if !ok {
+			return invalid("function", "must be an object")
+		}
+		for field := range function {
+			if !slices.Contains(functionFields, field) {
+				return invalid("function."+field, "unknown field")
+			}
+		}
+		if name == "" {
+			return invalid("function.name", "must be a non-empty string")
+		}
+		if seen[name] {
+			return invalid("function.name", "another tool has the same name")
+		}
+		seen[name] = true
+
+		parameters, ok := function["parameters"]
+		if !ok {
+			continue
+		}
+		schema, ok := parameters.(map[string]any)
+		if !ok {
+			return invalid("function.parameters", "must be an object")
+		}
+		if schema["type"] != "object" {
+			return invalid("function.parameters.type", fmt.Sprintf(`expected "object", got %#v`, schema["type"]))
+		}
+		if field, reason := checkSchema(schema, "function.parameters"); field != "" {
+			return invalid(field, reason)
+		}
+	}
+	return nil
+}
+
+// checkSchema checks the JSON schema at path. It returns the path of the first
+// offending field and what is wrong with it, or empty strings if it is valid.
+func checkSchema(schema map[string]any, path string) (field, reason string) {
+	if t, ok := schema["type"]; ok {
+		types := []any{t}
+		if list, ok := t.([]any); ok {
+			types = list
+		}
+		for _, t := range types {
+			if name, _ := t.(string); !slices.Contains(jsonSchemaTypes, name) {
+				return path + ".type", fmt.Sprintf("unknown type %#v", t)
+			}
+		}
+	}
+
+	var properties map[string]any
+	if value, ok := schema["properties"]; ok {
+		if properties, ok = value.(map[string]any); !ok {
+			return path + ".properties", "must be an object"
+		}
+		names := make([]string, 0, len(properties))
+		for name := range properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := properties[name].(map[string]any)
+			if !ok {
+				return path + ".properties." + name, "must be an object"
+			}
+			if field, reason := checkSchema(property, path+".properties."+name); field != "" {
+				return field, reason
+			}
+		}
+	}
+
+	if value, ok := schema["required"]; ok {
+		if !isStringList(value) {
+			return path + ".required", "must be a list of strings"
+		}
+		for _, name := range stringList(value) {
+			if _, ok := properties[name]; !ok {
+				return path + ".required", fmt.Sprintf("names %s, which is not among the properties", name)
+			}
+		}
+	}
+
+	if value, ok := schema["items"]; ok {
+		items, ok := value.(map[string]any)
+		if !ok {
+			return path + ".items", "must be an object"
+		}
+		return checkSchema(items, path+".items")
+	}
+	return "", ""
+}
+
+// isStringList reports whether v is a list of strings, see stringList.
+func isStringList(v any) bool {
+	switch list := v.(type) {
+	case []string:
+		return true
+	case []any:
+		for _, item := range list {
+			if _, ok := item.(string); !ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// stringList returns the strings in a list of a schema, which is a []string when
+// generated by RegisterTool and a []any when decoded from JSON.
+func stringList(v any) []string {
+	switch list := v.(type) {
+	case []string:
+		return list
+	case []any:
+		out := make([]string, 0, len(list))
+		for _, item := range list {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// hasJSONType reports whether value, as decoded from JSON, has the JSON schema type expected.
+func hasJSONType(value any, expected string) bool {
+	v := reflect.ValueOf(value)
+	switch expected {
+	case "string":
+		return v.Kind() == reflect.String
+	case "boolean":
+		return v.Kind() == reflect.Bool
+	case "integer":
+		if v.CanFloat() {
+			return v.Float() == math.Trunc(v.Float())
+		}
+		return v.CanInt() || v.CanUint()
+	case "number":
+		return v.CanFloat() || v.CanInt() || v.CanUint()
+	case "array":
+		return v.Kind() == reflect.Slice || v.Kind() == reflect.Array
+	case "object":
+		return v.Kind() == reflect.Map || v.Kind() == reflect.Struct
+	}
+	// Unknown types, e.g. unions, are not checked
+	return true
+}
+
+// definition returns the definition of the tool registered with RegisterTool under name, if any.
+func (d *ToolDispatcher) definition(name string) (Tool, bool) {
+	for _, tool := range d.definitions {
+		if toolName(tool) == name {
+			return tool, true
+		}
+	}
+	return nil, false
+}
+
+// Tools returns the definitions of the tools added with RegisterTool, in the order
+// they were registered, ready to be passed to Chat.
+func (d *ToolDispatcher) Tools() []Tool {
+	out := make([]Tool, len(d.definitions))
+	copy(out, d.definitions)
+	return out
+}
+
+// ToolSpec describes a tool registered with a ToolDispatcher, e.g. to document it
+// or show it in a user interface.
+type ToolSpec struct {
+	// Name is the name the model calls the tool by.
+	Name string
+	// Description tells the model what the tool does.
+	Description string
+	// Parameters is the JSON schema of the arguments. It is nil for tools added
+	// with Register, which have no definition.
+	Parameters map[string]any
+	// Required lists the names of the arguments that must be given.
+	Required []string
+}
+
+// List returns the specs of the registered tools: first those added with
+// RegisterTool, in the order they were registered, then those added with
+// Register, sorted by name. Use Tools to advertise the tools to the model;
+// its definitions are the []map[string]any that Chat expects.
+func (d *ToolDispatcher) List() []ToolSpec {
+	out := make([]ToolSpec, 0, len(d.handlers))
+	for _, tool := range d.definitions {
+		out = append(out, toolSpec(tool))
+	}
+
+	var names []string
+	for name := range d.handlers {
+		if _, ok := d.definition(name); !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		out = append(out, ToolSpec{Name: name})
+	}
+	return out
+}
+
+// Describe returns the spec of the tool with the given name and reports whether
+// such a tool is registered.
+func (d *ToolDispatcher) Describe(name string) (ToolSpec, bool) {
+	if tool, ok := d.definition(name); ok {
+		return toolSpec(tool), true
+	}
+	if _, ok := d.handlers[name]; ok {
+		return ToolSpec{Name: name}, true
+	}
+	return ToolSpec{}, false
+}
+
+// toolSpec returns the spec of a tool definition.
+func toolSpec(tool Tool) ToolSpec {
+	function, _ := tool["function"].(map[string]any)
+	description, _ := function["description"].(string)
+	parameters, _ := function["parameters"].(map[string]any)
+	return ToolSpec{
+		Name:        toolName(tool),
+		Description: description,
+		Parameters:  parameters,
+		Required:    stringList(parameters["required"]),
+	}
+}
+
+// toolName returns the name in a tool definition.
+func toolName(tool Tool) string {
+	function, _ := tool["function"].(map[string]any)
+	name, _ := function["name"].(string)
+	return name
+}
+
+// chosenTools returns the tools that may be called according to choice: none if
+// no tool may be called, otherwise only the chosen one.
+func chosenTools(choice *ToolChoice, tools []Tool) []Tool {
+	var out []Tool
+	for _, tool := range tools {
+		if choice.Name != "" && toolName(tool) == choice.Name {
+			out = append(out, tool)
+		}
+	}
+	return out
+}
+
+// decodeToolArguments decodes the arguments chosen by the model into a value of type t.
+func decodeToolArguments(args map[string]any, t reflect.Type) (reflect.Value, error) {
+	raw, err := json.Marshal(args)
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("failed to marshal tool arguments: %w", err)
+	}
+	ptr := reflect.New(t)
+	if err := json.Unmarshal(raw, ptr.Interface()); err != nil {
+		return reflect.Value{}, fmt.Errorf("invalid tool arguments: %w", err)
+	}
+	return ptr.Elem(), nil
+}
+
+// encodeToolResult converts the result of a tool into the content sent to the model.
+func encodeToolResult(result any) (string, error) {
+	switch r := result.(type) {
+	case string:
+		return r, nil
+	case []byte:
+		// Already serialized, e.g. a JSON document read from a file
+		return string(r), nil
+	}
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal tool result: %w", err)
+	}
+	return string(raw), nil
+}
+
+// structSchema returns the JSON schema of an object with the fields of struct type t.
+func structSchema(t reflect.Type) map[string]any {
+	return (&schemaBuilder{}).structSchema(t)
+}
+
+// typeSchema returns the JSON schema of values of type t.
+func typeSchema(t reflect.Type) map[string]any {
+	return (&schemaBuilder{}).typeSchema(t)
+}
+
+// schemaBuilder derives JSON schemas from Go types.
+type schemaBuilder struct {
+	// expanding holds the struct types whose schema is being built. A type that
+	// refers to itself, such as a tree node, gets a plain object schema when it
+	// comes round again, as a schema cannot be infinitely deep.
+	expanding map[reflect.Type]bool
+}
+
+// schemaField is a field of a struct as encoding/json sees it, with the fields of
+// embedded structs promoted.
+type schemaField struct {
+	name     string
+	field    reflect.StructField
+	depth    int
+	tagged   bool
+	optional bool
+}
+
+// structSchema returns the JSON schema of an object with the fields of struct type t.
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]any {
+	if b.expanding[t] {
+		return map[string]any{"type": "object"}
+	}
+	if b.expanding == nil {
+		b.expanding = make(map[reflect.Type]bool)
+	}
+	b.expanding[t] = true
+	defer delete(b.expanding, t)
+
+	properties := map[string]any{}
+	required := []string{}
+	for _, f := range jsonFields(t) {
+		schema := b.typeSchema(f.field.Type)
+		if description := f.field.Tag.Get("description"); description != "" {
+			schema["description"] = description
+		}
+		if enum := f.field.Tag.Get("enum"); enum != "" {
+			schema["enum"] = strings.Split(enum, ",")
+		}
+		properties[f.name] = schema
+		if !f.optional {
+			required = append(required, f.name)
+		}
+	}
+
+	schema := map[string]any{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// jsonFields returns the fields of struct type t that encoding/json encodes, in
+// the order of their declaration. As with encoding/json, the fields of embedded
+// structs without a name in their json tag are promoted, and of several fields
+// with the same name the shallowest wins, or the tagged one among those equally
+// deep; if that does not decide, none is encoded.
+func jsonFields(t reflect.Type) []schemaField {
+	var all []schemaField
+	var collect func(t reflect.Type, depth int, optional bool, visited map[reflect.Type]bool)
+	collect = func(t reflect.Type, depth int, optional bool, visited map[reflect.Type]bool) {
+		if visited[t] {
+			return
+		}
+		visited[t] = true
+		defer delete(visited, t)
+
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, tagged, omitempty := field.Name, false, false
+			if tag, ok := field.Tag.Lookup("json"); ok {
+				parts := strings.Split(tag, ",")
+				if parts[0] == "-" && len(parts) == 1 {
+					continue
+				}
+				if parts[0] != "" {
+					name, tagged = parts[0], true
+				}
+				for _, opt := range parts[1:] {
+					omitempty = omitempty || opt == "omitempty"
+				}
+			}
+
+			if field.Anonymous && !tagged {
+				embedded := field.Type
+				if embedded.Kind() == reflect.Pointer {
+					embedded = embedded.Elem()
+				}
+				if embedded.Kind() == reflect.Struct {
+					// A nil embedded pointer leaves its fields out
+					collect(embedded, depth+1, optional || field.Type.Kind() == reflect.Pointer, visited)
+					continue
+				}
+			}
+			if !field.IsExported() {
+				continue
+			}
+			all = append(all, schemaField{
+				name:     name,
+				field:    field,
+				depth:    depth,
+				tagged:   tagged,
+				optional: optional || omitempty || field.Type.Kind() == reflect.Pointer,
+			})
+		}
+	}
+	collect(t, 0, false, map[reflect.Type]bool{})
+
+	var out []schemaField
+	for i, f := range all {
+		dominant, unique := true, true
+		for j, other := range all {
+			if other.name != f.name || i == j {
+				continue
+			}
+			switch {
+			case other.depth < f.depth, other.depth == f.depth && other.tagged && !f.tagged:
+				dominant = false
+			case other.depth == f.depth && other.tagged == f.tagged:
+				unique = false
+			}
+		}
+		if dominant && unique {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// typeSchema returns the JSON schema of values of type t.
+func (b *schemaBuilder) typeSchema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// encoding/json encodes a []byte as a base64 string
+			return map[string]any{"type": "string"}
+		}
+		return map[string]any{"type": "array", "items": b.typeSchema(t.Elem())}
+	case reflect.Array:
+		return map[string]any{"type": "array", "items": b.typeSchema(t.Elem())}
+	case reflect.Struct:
+		return b.structSchema(t)
+	case reflect.Map:
+		return map[string]any{"type": "object"}
+	}
+	return map[string]any{}
+}
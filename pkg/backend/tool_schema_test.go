@@ -0,0 +1,546 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type weatherArgs struct {
+	City   string   `json:"city" description:"Name of the city"`
+	Units  string   `json:"units,omitempty" enum:"celsius,fahrenheit"`
+	Days   *int     `json:"days"`
+	Tags   []string `json:"tags,omitempty"`
+	secret string
+}
+
+type forecast struct {
+	City        string  `json:"city"`
+	Temperature float64 `json:"temperature"`
+}
+
+func TestRegisterToolSchema(t *testing.T) {
+	dispatcher := NewToolDispatcher()
+	err := dispatcher.RegisterTool("weather", "Get the weather forecast", func(args weatherArgs) (forecast, error) {
+		return forecast{}, nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterTool returned error: %v", err)
+	}
+
+	tools := dispatcher.Tools()
+	if len(tools) != 1 {
+		t.Fatalf("Expected 1 tool, got %d", len(tools))
+	}
+	got, err := json.Marshal(tools[0])
+	if err != nil {
+		t.Fatalf("Failed to marshal tool: %v", err)
+	}
+
+	var gotValue, wantValue any
+	want := `{"type": "function", "function": {
+		"name": "weather",
+		"description": "Get the weather forecast",
+		"parameters": {
+			"type": "object",
+			"properties": {
+				"city": {"type": "string", "description": "Name of the city"},
+				"units": {"type": "string", "enum": ["celsius", "fahrenheit"]},
+				"days": {"type": "integer"},
+				"tags": {"type": "array", "items": {"type": "string"}}
+			},
+			"required": ["city"]
+		}
+	}}`
+	json.Unmarshal(got, &gotValue)
+	json.Unmarshal([]byte(want), &wantValue)
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("Unexpected tool definition:\n%s", got)
+	}
+}
+
+type treeNode struct {
+	Name     string      `json:"name"`
+	Children []*treeNode `json:"children,omitempty"`
+}
+
+type auditInfo struct {
+	Author string `json:"author"`
+	Note   string `json:"note"`
+}
+
+type document struct {
+	auditInfo
+	*treeNode
+	Note    string `json:"note"`
+	Payload []byte `json:"payload"`
+}
+
+func TestTypeSchema(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  reflect.Type
+		want string
+	}{
+		{
+			// The recursion stops at the type that comes round again
+			name: "recursive struct",
+			typ:  reflect.TypeOf(treeNode{}),
+			want: `{"type": "object", "properties": {
+				"name": {"type": "string"},
+				"children": {"type": "array", "items": {"type": "object"}}
+			}, "required": ["name"]}`,
+		},
+		{
+			// Embedded fields are promoted and shadowed as encoding/json does, and
+			// the fields of a nil embedded pointer may be missing
+			name: "embedded structs and bytes",
+			typ:  reflect.TypeOf(document{}),
+			want: `{"type": "object", "properties": {
+				"author": {"type": "string"},
+				"name": {"type": "string"},
+				"children": {"type": "array", "items": {"type": "object", "properties": {
+					"name": {"type": "string"},
+					"children": {"type": "array", "items": {"type": "object"}}
+				}, "required": ["name"]}},
+				"note": {"type": "string"},
+				"payload": {"type": "string"}
+			}, "required": ["author", "note", "payload"]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(typeSchema(tt.typ))
+			if err != nil {
+				t.Fatalf("Failed to marshal schema: %v", err)
+			}
+			var gotValue, wantValue any
+			json.Unmarshal(got, &gotValue)
+			json.Unmarshal([]byte(tt.want), &wantValue)
+			if !reflect.DeepEqual(gotValue, wantValue) {
+				t.Errorf("Unexpected schema:\n%s", got)
+			}
+		})
+	}
+
+	if _, err := newCallOptions([]CallOption{WithResponseSchema(treeNode{})}); err != nil {
+		t.Errorf("Expected the schema of a recursive type to be valid, got %v", err)
+	}
+}
+
+func TestRegisterToolCall(t *testing.T) {
+	dispatcher := NewToolDispatcher()
+	err := dispatcher.RegisterTool("weather", "Get the weather forecast", func(args *weatherArgs) (forecast, error) {
+		return forecast{City: args.City, Temperature: 21.5}, nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterTool returned error: %v", err)
+	}
+	err = dispatcher.RegisterTool("echo", "Repeat the input", func(args struct {
+		Text string `json:"text"`
+	}) (string, error) {
+		return args.Text, nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterTool returned error: %v", err)
+	}
+	err = dispatcher.RegisterTool("report", "Read the report", func(args struct{}) ([]byte, error) {
+		return []byte(`{"status": "ok"}`), nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterTool returned error: %v", err)
+	}
+
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return &Response{Message: AssistantMessage("Done.")}, nil
+		},
+	}
+	resp := &Response{Message: Message{
+		Role: RoleAssistant,
+		ToolCalls: []ToolCall{
+			{Function: FunctionCall{Name: "weather", Arguments: map[string]any{"city": "Brno"}}},
+			{Function: FunctionCall{Name: "echo", Arguments: map[string]any{"text": "hi"}}},
+			{Function: FunctionCall{Name: "report"}},
+		},
+	}}
+
+	out, _, err := dispatcher.RunToolCalls(context.Background(), be, nil, resp, nil)
+	if err != nil {
+		t.Fatalf("RunToolCalls returned error: %v", err)
+	}
+	if content := out[1].Content; content != `{"city":"Brno","temperature":21.5}` {
+		t.Errorf("Expected the result as JSON, got %s", content)
+	}
+	if content := out[2].Content; content != "hi" {
+		t.Errorf("Expected the string result as is, got %s", content)
+	}
+	if content := out[3].Content; content != `{"status": "ok"}` {
+		t.Errorf("Expected the []byte result as is, got %s", content)
+	}
+}
+
+func TestRegisterToolErrors(t *testing.T) {
+	dispatcher := NewToolDispatcher()
+	failure := errors.New("no forecast")
+	if err := dispatcher.RegisterTool("weather", "", func(args weatherArgs) (string, error) {
+		return "", failure
+	}); err != nil {
+		t.Fatalf("RegisterTool returned error: %v", err)
+	}
+
+	if _, err := dispatcher.call(ToolCall{Function: FunctionCall{Name: "weather", Arguments: map[string]any{"city": "Brno"}}}); !errors.Is(err, failure) {
+		t.Errorf("Expected the handler error, got %v", err)
+	}
+	if _, err := dispatcher.call(ToolCall{Function: FunctionCall{Name: "weather", Arguments: map[string]any{"city": 42}}}); err == nil {
+		t.Errorf("Expected an error for arguments of the wrong type")
+	}
+
+	invalid := []any{
+		nil,
+		"not a function",
+		func(string) (string, error) { return "", nil },
+		func(weatherArgs) string { return "" },
+		func(weatherArgs, weatherArgs) (string, error) { return "", nil },
+	}
+	for _, fn := range invalid {
+		if err := dispatcher.RegisterTool("invalid", "", fn); err == nil {
+			t.Errorf("Expected an error for handler %T", fn)
+		}
+	}
+	if len(dispatcher.Tools()) != 1 {
+		t.Errorf("Expected invalid handlers not to be registered")
+	}
+}
+
+func TestRegisterToolReplaces(t *testing.T) {
+	dispatcher := NewToolDispatcher()
+	for _, description := range []string{"old", "new"} {
+		if err := dispatcher.RegisterTool("weather", description, func(weatherArgs) (string, error) { return "", nil }); err != nil {
+			t.Fatalf("RegisterTool returned error: %v", err)
+		}
+	}
+	tools := dispatcher.Tools()
+	if len(tools) != 1 {
+		t.Fatalf("Expected 1 tool, got %d", len(tools))
+	}
+	if function := tools[0]["function"].(map[string]any); function["description"] != "new" {
+		t.Errorf("Expected the definition to be replaced, got %v", function)
+	}
+}
+
+func TestValidateToolCall(t *testing.T) {
+	// A hand-written definition, as decoded from JSON
+	var tool Tool
+	json.Unmarshal([]byte(`{"type": "function", "function": {"name": "weather", "parameters": {
+		"type": "object",
+		"properties": {
+			"city": {"type": "string"},
+			"days": {"type": "integer"},
+			"units": {"type": "string", "enum": ["celsius", "fahrenheit"]}
+		},
+		"required": ["city", "days"]
+	}}}`), &tool)
+
+	call := func(args map[string]any) ToolCall {
+		return ToolCall{Function: FunctionCall{Name: "weather", Arguments: args}}
+	}
+
+	if err := ValidateToolCall(tool, call(map[string]any{"city": "Brno", "days": float64(3), "units": "celsius"})); err != nil {
+		t.Errorf("Expected valid arguments, got %v", err)
+	}
+
+	err := ValidateToolCall(tool, call(map[string]any{"days": 2.5, "units": "kelvin"}))
+	var verr *ToolCallValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected a ToolCallValidationError, got %v", err)
+	}
+	if verr.Tool != "weather" || len(verr.Missing) != 1 || verr.Missing[0] != "city" {
+		t.Errorf("Expected city to be missing, got %+v", verr)
+	}
+	if _, ok := verr.Invalid["days"]; !ok {
+		t.Errorf("Expected days to be reported as mistyped, got %+v", verr.Invalid)
+	}
+	if _, ok := verr.Invalid["units"]; !ok {
+		t.Errorf("Expected units to be reported as not in the enum, got %+v", verr.Invalid)
+	}
+	want := "invalid arguments for tool weather: missing required argument city; " +
+		"argument days: expected integer, got float64; " +
+		"argument units: expected one of celsius, fahrenheit, got kelvin"
+	if err.Error() != want {
+		t.Errorf("Unexpected error message:\n%s", err)
+	}
+}
+
+func TestRunToolCallsValidatesArguments(t *testing.T) {
+	dispatcher := NewToolDispatcher()
+	err := dispatcher.RegisterTool("weather", "", func(args weatherArgs) (string, error) {
+		t.Errorf("The tool must not run with invalid arguments")
+		return "", nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterTool returned error: %v", err)
+	}
+
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			t.Errorf("Chat must not be called with invalid arguments")
+			return &Response{}, nil
+		},
+	}
+	resp := &Response{Message: Message{
+		Role:      RoleAssistant,
+		ToolCalls: []ToolCall{{Function: FunctionCall{Name: "weather", Arguments: map[string]any{"units": "celsius"}}}},
+	}}
+
+	_, _, err = dispatcher.RunToolCalls(context.Background(), be, nil, resp, nil)
+	var verr *ToolCallValidationError
+	if !errors.As(err, &verr) || len(verr.Missing) != 1 || verr.Missing[0] != "city" {
+		t.Errorf("Expected a ToolCallValidationError for the missing city, got %v", err)
+	}
+}
+
+func TestCoerceToolArguments(t *testing.T) {
+	var tool Tool
+	json.Unmarshal([]byte(`{"type": "function", "function": {"name": "search", "parameters": {
+		"type": "object",
+		"properties": {
+			"query": {"type": "string"},
+			"limit": {"type": "integer"},
+			"score": {"type": "number"},
+			"exact": {"type": "boolean"},
+			"tags": {"type": "array"}
+		}
+	}}}`), &tool)
+
+	cases := []struct {
+		name  string
+		value any
+		want  any
+	}{
+		{"query", float64(42), "42"},
+		{"query", 1.5, "1.5"},
+		{"query", true, "true"},
+		{"limit", "3", float64(3)},
+		{"limit", " 10 ", float64(10)},
+		{"limit", "2.5", "2.5"},
+		{"limit", "ten", "ten"},
+		{"limit", true, float64(1)},
+		{"score", "0.75", 0.75},
+		{"score", "NaN", "NaN"},
+		{"exact", "true", true},
+		{"exact", "False", false},
+		{"exact", "yes", "yes"},
+		{"exact", float64(0), false},
+		{"exact", float64(2), float64(2)},
+		{"tags", "a,b", "a,b"},
+		{"unknown", "3", "3"},
+	}
+	for _, tc := range cases {
+		args := map[string]any{tc.name: tc.value}
+		call := CoerceToolArguments(tool, ToolCall{Function: FunctionCall{Name: "search", Arguments: args}})
+		if got := call.Function.Arguments[tc.name]; got != tc.want {
+			t.Errorf("%s = %#v: expected %#v, got %#v", tc.name, tc.value, tc.want, got)
+		}
+		if args[tc.name] != tc.value {
+			t.Errorf("%s = %#v: the arguments of the call must not be modified", tc.name, tc.value)
+		}
+	}
+}
+
+func TestRunToolCallsCoercesArguments(t *testing.T) {
+	resp := &Response{Message: Message{
+		Role: RoleAssistant,
+		ToolCalls: []ToolCall{{Function: FunctionCall{Name: "weather", Arguments: map[string]any{
+			"city": "Brno",
+			"days": "3",
+		}}}},
+	}}
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return &Response{Message: Message{Role: RoleAssistant, Content: "Sunny"}}, nil
+		},
+	}
+
+	var days int
+	newDispatcher := func(opts ...ToolDispatcherOption) *ToolDispatcher {
+		dispatcher := NewToolDispatcher(opts...)
+		err := dispatcher.RegisterTool("weather", "", func(args weatherArgs) (string, error) {
+			days = *args.Days
+			return "sunny", nil
+		})
+		if err != nil {
+			t.Fatalf("RegisterTool returned error: %v", err)
+		}
+		return dispatcher
+	}
+
+	_, _, err := newDispatcher().RunToolCalls(context.Background(), be, nil, resp, nil)
+	var verr *ToolCallValidationError
+	if !errors.As(err, &verr) || verr.Invalid["days"] == "" {
+		t.Errorf("Expected days to be rejected without coercion, got %v", err)
+	}
+
+	_, _, err = newDispatcher(WithArgumentCoercion()).RunToolCalls(context.Background(), be, nil, resp, nil)
+	if err != nil {
+		t.Fatalf("RunToolCalls returned error: %v", err)
+	}
+	if days != 3 {
+		t.Errorf("Expected the tool to be called with 3 days, got %d", days)
+	}
+	if resp.Message.ToolCalls[0].Function.Arguments["days"] != "3" {
+		t.Errorf("The tool calls of the response must not be modified")
+	}
+}
+
+func TestToolDispatcherListAndDescribe(t *testing.T) {
+	dispatcher := NewToolDispatcher()
+	dispatcher.Register("time", func(map[string]any) (string, error) { return "noon", nil })
+	if err := dispatcher.RegisterTool("weather", "Get the weather", func(args weatherArgs) (string, error) {
+		return "sunny", nil
+	}); err != nil {
+		t.Fatalf("RegisterTool returned error: %v", err)
+	}
+	dispatcher.Register("date", func(map[string]any) (string, error) { return "today", nil })
+
+	specs := dispatcher.List()
+	var names []string
+	for _, spec := range specs {
+		names = append(names, spec.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"weather", "date", "time"}) {
+		t.Errorf("Unexpected tools: %v", names)
+	}
+
+	spec, ok := dispatcher.Describe("weather")
+	if !ok || spec.Description != "Get the weather" || !reflect.DeepEqual(spec.Required, []string{"city"}) {
+		t.Errorf("Unexpected spec: %+v", spec)
+	}
+	if properties, _ := spec.Parameters["properties"].(map[string]any); len(properties) != 4 {
+		t.Errorf("Expected the parameters of the tool, got %+v", spec.Parameters)
+	}
+	if spec, ok := dispatcher.Describe("time"); !ok || spec.Parameters != nil {
+		t.Errorf("Expected a spec without parameters for a tool without definition, got %+v", spec)
+	}
+	if _, ok := dispatcher.Describe("missing"); ok {
+		t.Error("Expected no spec for an unknown tool")
+	}
+}
+
+func TestValidateTools(t *testing.T) {
+	function := func(fields map[string]any) Tool {
+		return Tool{"type": "function", "function": fields}
+	}
+	weather := func(parameters any) Tool {
+		return function(map[string]any{"name": "get_weather", "parameters": parameters})
+	}
+
+	dispatcher := NewToolDispatcher()
+	if err := dispatcher.RegisterTool("weather", "Get the weather forecast", func(args weatherArgs) (forecast, error) {
+		return forecast{}, nil
+	}); err != nil {
+		t.Fatalf("RegisterTool returned error: %v", err)
+	}
+	if err := ValidateTools(dispatcher.Tools()); err != nil {
+		t.Errorf("Expected generated definitions to be valid, got %v", err)
+	}
+	if err := ValidateTools([]Tool{function(map[string]any{"name": "get_time"})}); err != nil {
+		t.Errorf("Expected a tool without parameters to be valid, got %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		tool  Tool
+		field string
+	}{
+		{"wrong type", Tool{"type": "fucntion", "function": map[string]any{"name": "get_weather"}}, "type"},
+		{"no function", Tool{"type": "function"}, "function"},
+		{"no name", function(map[string]any{"description": "Get the weather"}), "function.name"},
+		{"misspelled field", function(map[string]any{"name": "get_weather", "parameter": map[string]any{}}), "function.parameter"},
+		{"parameters not an object", weather("city"), "function.parameters"},
+		{"parameters not of type object", weather(map[string]any{"type": "array"}), "function.parameters.type"},
+		{"unknown property type", weather(map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"city": map[string]any{"type": "str"}},
+		}), "function.parameters.properties.city.type"},
+		{"nested items", weather(map[string]any{
+			"type": "object",
+			"properties": map[string]any{"days": map[string]any{
+				"type": "array", "items": map[string]any{"type": "int"},
+			}},
+		}), "function.parameters.properties.days.items.type"},
+		{"required not declared", weather(map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"city": map[string]any{"type": "string"}},
+			"required":   []any{"town"},
+		}), "function.parameters.required"},
+		{"required not a list", weather(map[string]any{
+			"type":     "object",
+			"required": "city",
+		}), "function.parameters.required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTools([]Tool{tt.tool})
+			var defErr *ToolDefinitionError
+			if !errors.As(err, &defErr) || !errors.Is(err, ErrInvalidTool) {
+				t.Fatalf("Expected a ToolDefinitionError, got %v", err)
+			}
+			if defErr.Field != tt.field {
+				t.Errorf("Expected field %s, got %s (%v)", tt.field, defErr.Field, err)
+			}
+		})
+	}
+
+	err := ValidateTools([]Tool{function(map[string]any{"name": "get_time"}), function(map[string]any{"name": "get_time"})})
+	var defErr *ToolDefinitionError
+	if !errors.As(err, &defErr) || defErr.Index != 1 || defErr.Tool != "get_time" {
+		t.Errorf("Expected the duplicate to be reported, got %v", err)
+	}
+}
+
+func TestChatValidatesTools(t *testing.T) {
+	var requests atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(`{"message": {"role": "assistant", "content": "Hi"}, "done": true}`))
+	}))
+	defer mockServer.Close()
+
+	backend := NewOllamaBackend(mockServer.URL, "test-model")
+	tools := []Tool{{"type": "function", "function": map[string]any{"name": "get_weather", "paramters": map[string]any{}}}}
+
+	_, err := backend.Chat(context.Background(), []Message{UserMessage("Weather?")}, tools)
+	if !errors.Is(err, ErrInvalidTool) || !strings.Contains(err.Error(), "get_weather") || !strings.Contains(err.Error(), "function.paramters") {
+		t.Errorf("Expected an error naming the tool and field, got %v", err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("Expected no request to be sent, got %d", n)
+	}
+
+	if _, err := backend.Chat(context.Background(), []Message{UserMessage("Weather?")}, tools, WithoutToolValidation()); err != nil {
+		t.Errorf("Expected the request to be sent without validation, got %v", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("Expected one request to be sent, got %d", n)
+	}
+}
@@ -0,0 +1,377 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ToolHandler executes a tool call with the arguments chosen by the model
+// and returns the result that is sent back to the model.
+type ToolHandler func(args map[string]any) (string, error)
+
+// ToolDispatcher routes the tool calls requested by a model to registered handlers.
+type ToolDispatcher struct {
+	handlers map[string]ToolHandler
+	// definitions holds the definitions of the tools added with RegisterTool,
+	// in the order they were registered.
+	definitions []Tool
+	// maxResultTokens is the size tool results are truncated to, zero for no limit.
+	maxResultTokens int
+	// tracer records a span for every tool call, if set.
+	tracer trace.Tracer
+	// coerceArguments is set if the arguments of tools added with RegisterTool
+	// are converted to the declared types before they are validated.
+	coerceArguments bool
+	// dedupLogger logs the duplicate tool calls that were not run, if the
+	// dispatcher deduplicates calls.
+	dedupLogger *slog.Logger
+}
+
+// ToolDispatcherOption configures a ToolDispatcher created with NewToolDispatcher.
+type ToolDispatcherOption func(*ToolDispatcher)
+
+// WithMaxToolResultTokens truncates the result of every tool call to about n tokens
+// before it is sent back to the model, so that a single large result, such as a
+// big JSON report, cannot fill the context window. A truncated result ends with a
+// marker telling the model how much was cut off. Tokens are estimated with the
+// tokenizer of the backend, see WithTokenizer, or the counter of its model, see
+// EstimateTokens.
+func WithMaxToolResultTokens(n int) ToolDispatcherOption {
+	return func(d *ToolDispatcher) {
+		d.maxResultTokens = n
+	}
+}
+
+// WithToolTracing records every tool call as an OpenTelemetry span of tracer, a
+// child of the span in the context passed to RunToolCalls, e.g. that of the HTTP
+// request being served. The spans are named "execute_tool" followed by the name
+// of the tool and record the error of failed calls.
+func WithToolTracing(tracer trace.Tracer) ToolDispatcherOption {
+	return func(d *ToolDispatcher) {
+		d.tracer = tracer
+	}
+}
+
+// WithArgumentCoercion makes the dispatcher convert the arguments of calls to tools
+// added with RegisterTool to the types declared in their definition before they are
+// validated, see CoerceToolArguments. Models often pass numbers and booleans as
+// strings, e.g. "3" or "true", which would otherwise fail the call. Without this
+// option, such arguments are rejected with a *ToolCallValidationError.
+func WithArgumentCoercion() ToolDispatcherOption {
+	return func(d *ToolDispatcher) {
+		d.coerceArguments = true
+	}
+}
+
+// WithToolCallDeduplication makes the dispatcher run identical tool calls of a
+// single reply, with the same name and arguments, only once. Some models request
+// the same call twice in one turn; every call still gets a result, the one of
+// the first call, so that the model sees an answer to each. Each call that is
+// not run is logged to logger, or to slog.Default if logger is nil.
+//
+// Without this option every call is run, as duplicates are sometimes intended,
+// e.g. for a tool that rolls a die.
+func WithToolCallDeduplication(logger *slog.Logger) ToolDispatcherOption {
+	return func(d *ToolDispatcher) {
+		if logger == nil {
+			logger = slog.Default()
+		}
+		d.dedupLogger = logger
+	}
+}
+
+// NewToolDispatcher creates and returns an empty ToolDispatcher.
+func NewToolDispatcher(opts ...ToolDispatcherOption) *ToolDispatcher {
+	d := &ToolDispatcher{
+		handlers: make(map[string]ToolHandler),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Register adds the handler for the tool with the given name, replacing any previous one.
+// The tool must be advertised to the model separately; see RegisterTool for a way
+// to derive the definition from the handler.
+func (d *ToolDispatcher) Register(name string, fn ToolHandler) {
+	d.handlers[name] = fn
+}
+
+// RunToolCalls executes every tool call in resp, in the order the model requested them,
+// and sends the results back to the model in a follow-up Chat with tools and opts,
+// usually the tools and options of the request that produced resp. Some backends,
+// such as Anthropic, reject a conversation with tool calls unless the tools are
+// sent as well; to make the model answer without calling tools again, pass
+// WithToolChoiceNone in opts rather than leaving the tools out.
+//
+// If the arguments of a call to a tool added with RegisterTool do not match its
+// definition, a *ToolCallValidationError is returned without running the tool. Its
+// message can be sent back to the model to ask for a corrected call.
+//
+// The returned messages are the input messages followed by the assistant message that
+// requested the calls, one "tool" message per call and the final assistant reply, so
+// they can be used to continue the conversation. If resp contains no tool calls,
+// no follow-up is sent and the input messages followed by resp.Message are returned
+// together with resp.
+func (d *ToolDispatcher) RunToolCalls(ctx context.Context, be Backend, messages []Message, resp *Response, tools []Tool, opts ...CallOption) ([]Message, *Response, error) {
+	return d.RunToolCallsConcurrent(ctx, be, messages, resp, 1, tools, opts...)
+}
+
+// RunToolCallsConcurrent works like RunToolCalls but runs up to concurrency handlers
+// in parallel, e.g. for tools that wait on the network. The results are still sent
+// back in the order of the tool calls of resp, whichever handler finishes first, as
+// some backends pair calls and results by position. Once a call fails no further
+// calls are started; if several calls running at the same time fail, the error of
+// the earliest of them in that order is returned. A concurrency below one is
+// treated as one.
+//
+// Handlers that share state must be safe for concurrent use.
+func (d *ToolDispatcher) RunToolCallsConcurrent(ctx context.Context, be Backend, messages []Message, resp *Response, concurrency int, tools []Tool, opts ...CallOption) ([]Message, *Response, error) {
+	if resp == nil {
+		return nil, nil, errors.New("no response to run tool calls for")
+	}
+	if len(resp.Message.ToolCalls) == 0 {
+		out := make([]Message, 0, len(messages)+1)
+		out = append(out, messages...)
+		return append(out, resp.Message), resp, nil
+	}
+
+	out := make([]Message, 0, len(messages)+len(resp.Message.ToolCalls)+2)
+	out = append(out, messages...)
+	out = append(out, resp.Message)
+
+	results, err := d.toolResults(ctx, be, resp.Message.ToolCalls, concurrency)
+	if err != nil {
+		return nil, nil, err
+	}
+	out = append(out, results...)
+
+	final, err := be.Chat(ctx, out, tools, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to send tool results: %w", err)
+	}
+
+	return append(out, final.Message), final, nil
+}
+
+// toolResults runs the handlers of calls, at most concurrency at a time, and
+// returns the messages carrying their results, truncated for the model of be if
+// the dispatcher limits the size of results.
+func (d *ToolDispatcher) toolResults(ctx context.Context, be Backend, calls []ToolCall, concurrency int) ([]Message, error) {
+	unique, sources := d.deduplicate(ctx, calls)
+	uniqueResults, err := d.runCalls(ctx, unique, concurrency)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]string, len(calls))
+	for i := range calls {
+		results[i] = uniqueResults[sources[i]]
+	}
+	var count TokenCounter
+	if d.maxResultTokens > 0 {
+		count = tokenCounter(backendModel(be), backendTokenizer(be))
+	}
+	out := make([]Message, 0, len(calls))
+	for i, call := range calls {
+		result := results[i]
+		if count != nil {
+			result = truncateToolResult(result, d.maxResultTokens, count)
+		}
+		out = append(out, ToolResultMessage(call.ID, call.Function.Name, result))
+	}
+	return out, nil
+}
+
+// deduplicate returns the calls to run and, for every call, the index of the call
+// to run whose result it gets. Unless the dispatcher deduplicates calls, every call
+// is run.
+func (d *ToolDispatcher) deduplicate(ctx context.Context, calls []ToolCall) ([]ToolCall, []int) {
+	sources := make([]int, len(calls))
+	if d.dedupLogger == nil {
+		for i := range calls {
+			sources[i] = i
+		}
+		return calls, sources
+	}
+
+	var unique []ToolCall
+	seen := make(map[string]int, len(calls))
+	for i, call := range calls {
+		// Encoding sorts the keys of the arguments, so equal arguments encode equally
+		args, err := json.Marshal(call.Function.Arguments)
+		key := call.Function.Name + "\x00" + string(args)
+		if first, ok := seen[key]; ok && err == nil {
+			d.dedupLogger.InfoContext(ctx, "skipped duplicate tool call",
+				slog.String("tool", call.Function.Name),
+				slog.String("call_id", call.ID),
+				slog.String("duplicate_of", unique[first].ID))
+			sources[i] = first
+			continue
+		}
+		seen[key] = len(unique)
+		sources[i] = len(unique)
+		unique = append(unique, call)
+	}
+	return unique, sources
+}
+
+// runCalls runs the handlers of calls, at most concurrency at a time, and returns
+// their results in the order of calls. Once a call fails or ctx is done, no further
+// calls are started.
+func (d *ToolDispatcher) runCalls(ctx context.Context, calls []ToolCall, concurrency int) ([]string, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]string, len(calls))
+	errs := make([]error, len(calls))
+	var failed atomic.Bool
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(concurrency, len(calls)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if failed.Load() {
+					continue
+				}
+				results[i], errs[i] = d.tracedCall(ctx, calls[i])
+				if errs[i] != nil {
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+
+	var ctxErr error
+dispatch:
+	for i := range calls {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			ctxErr = fmt.Errorf("%w: %w", ErrContextCanceled, ctx.Err())
+			break dispatch
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ctxErr != nil {
+		return nil, ctxErr
+	}
+	return results, nil
+}
+
+// tracedCall runs call, in a span of its own if the dispatcher traces tool calls.
+func (d *ToolDispatcher) tracedCall(ctx context.Context, call ToolCall) (string, error) {
+	if d.tracer == nil {
+		return d.call(call)
+	}
+
+	attrs := []attribute.KeyValue{
+		attribute.String("gen_ai.operation.name", "execute_tool"),
+		attribute.String("gen_ai.tool.name", call.Function.Name),
+	}
+	if call.ID != "" {
+		attrs = append(attrs, attribute.String("gen_ai.tool.call.id", call.ID))
+	}
+	_, span := d.tracer.Start(ctx, "execute_tool "+call.Function.Name, trace.WithAttributes(attrs...))
+	defer span.End()
+
+	result, err := d.call(call)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return result, err
+}
+
+// call runs the handler registered for the tool call. The arguments of tools added
+// with RegisterTool are coerced, if enabled, and validated against their definition first.
+func (d *ToolDispatcher) call(call ToolCall) (string, error) {
+	handler, ok := d.handlers[call.Function.Name]
+	if !ok {
+		return "", fmt.Errorf("no handler registered for tool %s", call.Function.Name)
+	}
+	if tool, ok := d.definition(call.Function.Name); ok {
+		if d.coerceArguments {
+			call = CoerceToolArguments(tool, call)
+		}
+		if err := ValidateToolCall(tool, call); err != nil {
+			return "", err
+		}
+	}
+
+	result, err := handler(call.Function.Arguments)
+	if err != nil {
+		return "", fmt.Errorf("tool %s failed: %w", call.Function.Name, err)
+	}
+	return result, nil
+}
+
+// truncateToolResult cuts result down to maxTokens, as estimated with count,
+// including the marker appended to say how much was cut off. Results that fit
+// are returned unchanged.
+func truncateToolResult(result string, maxTokens int, count TokenCounter) string {
+	total := count(result)
+	if total <= maxTokens {
+		return result
+	}
+
+	// The marker is at most this long, as fewer tokens than total are cut off
+	budget := maxTokens - count(truncatedMarker(total))
+	if budget <= 0 {
+		return truncatedMarker(total)
+	}
+
+	// Find the longest prefix, cut at a rune boundary, that fits in the budget
+	cut := func(i int) int {
+		for i > 0 && i < len(result) && !utf8.RuneStart(result[i]) {
+			i--
+		}
+		return i
+	}
+	n := sort.Search(len(result)+1, func(i int) bool {
+		return count(result[:cut(i)]) > budget
+	}) - 1
+	prefix := result[:cut(n)]
+	return prefix + truncatedMarker(total-count(prefix))
+}
+
+// truncatedMarker returns the marker appended to a tool result with n tokens cut off.
+func truncatedMarker(n int) string {
+	return fmt.Sprintf("\n... [%d tokens truncated]", n)
+}
@@ -0,0 +1,389 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// fakeBackend is a Backend that records the messages and options it receives
+// and replies using the chat function.
+type fakeBackend struct {
+	chat     func(messages []Message) (*Response, error)
+	received [][]Message
+	tools    [][]Tool
+	options  []*Options
+	closed   int
+}
+
+func (f *fakeBackend) Chat(_ context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	f.received = append(f.received, messages)
+	f.tools = append(f.tools, tools)
+	callOpts, err := newCallOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	f.options = append(f.options, callOpts)
+	return f.chat(messages)
+}
+
+func (f *fakeBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	return f.Chat(ctx, []Message{{Role: "user", Content: prompt}}, nil, opts...)
+}
+
+func (f *fakeBackend) Close() error {
+	f.closed++
+	return nil
+}
+
+func TestRunToolCalls(t *testing.T) {
+	dispatcher := NewToolDispatcher()
+	dispatcher.Register("weather", func(args map[string]any) (string, error) {
+		return fmt.Sprintf("sunny in %s", args["city"]), nil
+	})
+	dispatcher.Register("time", func(args map[string]any) (string, error) {
+		return "noon", nil
+	})
+
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return &Response{Message: Message{Role: "assistant", Content: "It is sunny at noon."}}, nil
+		},
+	}
+
+	messages := []Message{{Role: "user", Content: "Weather and time?"}}
+	resp := &Response{Message: Message{
+		Role: "assistant",
+		ToolCalls: []ToolCall{
+			{ID: "1", Function: FunctionCall{Name: "weather", Arguments: map[string]any{"city": "Brno"}}},
+			{ID: "2", Function: FunctionCall{Name: "time"}},
+			{ID: "3", Function: FunctionCall{Name: "weather", Arguments: map[string]any{"city": "Prague"}}},
+		},
+	}}
+
+	out, final, err := dispatcher.RunToolCalls(context.Background(), be, messages, resp, nil)
+	if err != nil {
+		t.Fatalf("RunToolCalls returned error: %v", err)
+	}
+
+	if final.Message.Content != "It is sunny at noon." {
+		t.Errorf("Unexpected final reply: %s", final.Message.Content)
+	}
+
+	// user, assistant with calls, three tool results, final reply
+	if len(out) != 6 {
+		t.Fatalf("Expected 6 messages, got %d", len(out))
+	}
+	expected := []string{"sunny in Brno", "noon", "sunny in Prague"}
+	for i, content := range expected {
+		msg := out[2+i]
+		if msg.Role != "tool" || msg.Content != content {
+			t.Errorf("Expected tool message %q at %d, got %+v", content, 2+i, msg)
+		}
+		if msg.ToolCallID != resp.Message.ToolCalls[i].ID {
+			t.Errorf("Expected tool call ID %s, got %s", resp.Message.ToolCalls[i].ID, msg.ToolCallID)
+		}
+	}
+
+	// The follow-up chat must have seen everything but the final reply
+	if len(be.received) != 1 || len(be.received[0]) != 5 {
+		t.Errorf("Expected one follow-up chat with 5 messages, got %v", be.received)
+	}
+}
+
+func TestRunToolCallsForwardsToolsAndOptions(t *testing.T) {
+	dispatcher := NewToolDispatcher()
+	dispatcher.Register("weather", func(args map[string]any) (string, error) {
+		return "sunny", nil
+	})
+
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return &Response{Message: Message{Role: "assistant", Content: "It is sunny."}}, nil
+		},
+	}
+
+	tools := []Tool{{"type": "function", "function": map[string]any{"name": "weather"}}}
+	resp := &Response{Message: Message{
+		Role:      "assistant",
+		ToolCalls: []ToolCall{{ID: "1", Function: FunctionCall{Name: "weather"}}},
+	}}
+
+	_, _, err := dispatcher.RunToolCalls(context.Background(), be, []Message{UserMessage("Weather?")}, resp,
+		tools, WithTemperature(0.2), WithToolChoiceNone())
+	if err != nil {
+		t.Fatalf("RunToolCalls returned error: %v", err)
+	}
+
+	if len(be.tools) != 1 || len(be.tools[0]) != 1 {
+		t.Fatalf("Expected the follow-up to carry the tools, got %v", be.tools)
+	}
+	opts := be.options[0]
+	if opts.Temperature == nil || *opts.Temperature != 0.2 {
+		t.Errorf("Expected the follow-up to carry the temperature, got %v", opts.Temperature)
+	}
+	if opts.ToolChoice == nil || opts.ToolChoice.Name != "" {
+		t.Errorf("Expected the follow-up to disable tool calls, got %+v", opts.ToolChoice)
+	}
+}
+
+func TestRunToolCallsUnknownTool(t *testing.T) {
+	dispatcher := NewToolDispatcher()
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			t.Errorf("Chat must not be called when a tool is missing")
+			return &Response{}, nil
+		},
+	}
+
+	resp := &Response{Message: Message{
+		Role:      "assistant",
+		ToolCalls: []ToolCall{{Function: FunctionCall{Name: "missing"}}},
+	}}
+
+	if _, _, err := dispatcher.RunToolCalls(context.Background(), be, nil, resp, nil); err == nil {
+		t.Errorf("Expected an error for an unregistered tool")
+	}
+}
+
+func TestRunToolCallsNilResponse(t *testing.T) {
+	dispatcher := NewToolDispatcher()
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			t.Errorf("Chat must not be called without a response")
+			return &Response{}, nil
+		},
+	}
+
+	if _, _, err := dispatcher.RunToolCalls(context.Background(), be, nil, nil, nil); err == nil {
+		t.Errorf("Expected an error for a nil response")
+	}
+}
+
+func TestRunToolCallsNoToolCalls(t *testing.T) {
+	dispatcher := NewToolDispatcher()
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			t.Errorf("Chat must not be called when there are no tool calls")
+			return &Response{}, nil
+		},
+	}
+
+	messages := []Message{{Role: "user", Content: "Hi"}}
+	resp := &Response{Message: Message{Role: "assistant", Content: "Hello!"}}
+
+	out, final, err := dispatcher.RunToolCalls(context.Background(), be, messages, resp, nil)
+	if err != nil {
+		t.Fatalf("RunToolCalls returned error: %v", err)
+	}
+	if final != resp {
+		t.Errorf("Expected the original response to be returned")
+	}
+	if len(out) != 2 || out[1].Content != "Hello!" {
+		t.Errorf("Expected the input messages plus the reply, got %+v", out)
+	}
+}
+
+func TestRunToolCallsConcurrentKeepsOrder(t *testing.T) {
+	// The first calls only finish once the last one has, so they finish in reverse order
+	lastDone := make(chan struct{})
+	waitForLast := func(args map[string]any) (string, error) {
+		select {
+		case <-lastDone:
+		case <-time.After(5 * time.Second):
+			return "", errors.New("handlers did not run concurrently")
+		}
+		return fmt.Sprintf("result %v", args["n"]), nil
+	}
+
+	dispatcher := NewToolDispatcher()
+	dispatcher.Register("slow", waitForLast)
+	dispatcher.Register("fast", func(args map[string]any) (string, error) {
+		close(lastDone)
+		return fmt.Sprintf("result %v", args["n"]), nil
+	})
+
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return &Response{Message: AssistantMessage("done")}, nil
+		},
+	}
+	resp := &Response{Message: Message{Role: RoleAssistant, ToolCalls: []ToolCall{
+		{ID: "call_1", Function: FunctionCall{Name: "slow", Arguments: map[string]any{"n": 1}}},
+		{ID: "call_2", Function: FunctionCall{Name: "slow", Arguments: map[string]any{"n": 2}}},
+		{ID: "call_3", Function: FunctionCall{Name: "fast", Arguments: map[string]any{"n": 3}}},
+	}}}
+
+	out, _, err := dispatcher.RunToolCallsConcurrent(context.Background(), be, []Message{UserMessage("Go")}, resp, 3, nil)
+	if err != nil {
+		t.Fatalf("RunToolCallsConcurrent returned error: %v", err)
+	}
+
+	sent := be.received[0]
+	if len(sent) != 5 {
+		t.Fatalf("Expected the user message, the tool calls and 3 results, got %+v", sent)
+	}
+	for i, msg := range sent[2:] {
+		wantID, wantContent := fmt.Sprintf("call_%d", i+1), fmt.Sprintf("result %d", i+1)
+		if msg.ToolCallID != wantID || msg.Content != wantContent {
+			t.Errorf("Expected result %d to be %s %q, got %+v", i, wantID, wantContent, msg)
+		}
+	}
+	if len(out) != 6 || out[5].Content != "done" {
+		t.Errorf("Unexpected returned messages: %+v", out)
+	}
+}
+
+func TestRunToolCallsConcurrentFirstError(t *testing.T) {
+	dispatcher := NewToolDispatcher()
+	dispatcher.Register("ok", func(map[string]any) (string, error) {
+		return "ok", nil
+	})
+	dispatcher.Register("broken", func(map[string]any) (string, error) {
+		return "", errors.New("boom")
+	})
+
+	be := &fakeBackend{}
+	resp := &Response{Message: Message{Role: RoleAssistant, ToolCalls: []ToolCall{
+		{Function: FunctionCall{Name: "ok"}},
+		{Function: FunctionCall{Name: "broken"}},
+		{Function: FunctionCall{Name: "ok"}},
+	}}}
+
+	_, _, err := dispatcher.RunToolCallsConcurrent(context.Background(), be, nil, resp, 3, nil)
+	if err == nil || err.Error() != "tool broken failed: boom" {
+		t.Errorf("Expected the error of the failed call, got %v", err)
+	}
+	if len(be.received) != 0 {
+		t.Errorf("Expected no follow-up request after a failed call")
+	}
+}
+
+func TestRunToolCallsMaxToolResultTokens(t *testing.T) {
+	report := strings.Repeat(`{"finding": "ok"},`, 1000)
+	dispatcher := NewToolDispatcher(WithMaxToolResultTokens(100))
+	dispatcher.Register("report", func(args map[string]any) (string, error) {
+		return report, nil
+	})
+	dispatcher.Register("time", func(args map[string]any) (string, error) {
+		return "noon", nil
+	})
+
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return &Response{Message: AssistantMessage("All findings are ok.")}, nil
+		},
+	}
+	resp := &Response{Message: Message{Role: RoleAssistant, ToolCalls: []ToolCall{
+		{ID: "1", Function: FunctionCall{Name: "report"}},
+		{ID: "2", Function: FunctionCall{Name: "time"}},
+	}}}
+
+	out, _, err := dispatcher.RunToolCalls(context.Background(), be, []Message{UserMessage("Summarize the report")}, resp, nil)
+	if err != nil {
+		t.Fatalf("RunToolCalls returned error: %v", err)
+	}
+
+	truncated := out[2].Content
+	if tokens := HeuristicTokenCount(truncated); tokens > 100 {
+		t.Errorf("Expected at most 100 tokens, got %d", tokens)
+	}
+	prefix, _, ok := strings.Cut(truncated, "\n... [")
+	if !ok || !strings.HasSuffix(truncated, " tokens truncated]") || !strings.HasPrefix(report, prefix) {
+		t.Errorf("Expected a prefix of the report followed by the marker, got %q", truncated)
+	}
+	if out[3].Content != "noon" {
+		t.Errorf("Expected a short result to be left alone, got %q", out[3].Content)
+	}
+}
+
+func TestRunToolCallsDeduplicates(t *testing.T) {
+	var runs []string
+	handler := func(args map[string]any) (string, error) {
+		runs = append(runs, fmt.Sprint(args["city"]))
+		return fmt.Sprintf("sunny in %s", args["city"]), nil
+	}
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return &Response{Message: Message{Role: "assistant", Content: "It is sunny."}}, nil
+		},
+	}
+	resp := &Response{Message: Message{
+		Role: "assistant",
+		ToolCalls: []ToolCall{
+			{ID: "1", Function: FunctionCall{Name: "weather", Arguments: map[string]any{"city": "Brno", "unit": "C"}}},
+			{ID: "2", Function: FunctionCall{Name: "weather", Arguments: map[string]any{"city": "Prague"}}},
+			{ID: "3", Function: FunctionCall{Name: "weather", Arguments: map[string]any{"unit": "C", "city": "Brno"}}},
+		},
+	}}
+	messages := []Message{{Role: "user", Content: "Weather?"}}
+
+	var logs bytes.Buffer
+	dispatcher := NewToolDispatcher(WithToolCallDeduplication(slog.New(slog.NewTextHandler(&logs, nil))))
+	dispatcher.Register("weather", handler)
+	out, _, err := dispatcher.RunToolCalls(context.Background(), be, messages, resp, nil)
+	if err != nil {
+		t.Fatalf("RunToolCalls returned error: %v", err)
+	}
+	if strings.Join(runs, ",") != "Brno,Prague" {
+		t.Errorf("Expected the duplicate call to be skipped, ran %v", runs)
+	}
+	// Every call still gets a result of its own
+	for i, want := range []string{"sunny in Brno", "sunny in Prague", "sunny in Brno"} {
+		msg := out[2+i]
+		if msg.Content != want || msg.ToolCallID != resp.Message.ToolCalls[i].ID {
+			t.Errorf("Expected %q for call %s, got %+v", want, resp.Message.ToolCalls[i].ID, msg)
+		}
+	}
+	if log := logs.String(); !strings.Contains(log, "skipped duplicate tool call") || !strings.Contains(log, "call_id=3") || !strings.Contains(log, "duplicate_of=1") {
+		t.Errorf("Expected the duplicate to be logged, got %q", log)
+	}
+
+	// Without the option, duplicates are intended
+	runs = nil
+	dispatcher = NewToolDispatcher()
+	dispatcher.Register("weather", handler)
+	if _, _, err := dispatcher.RunToolCalls(context.Background(), be, messages, resp, nil); err != nil {
+		t.Fatalf("RunToolCalls returned error: %v", err)
+	}
+	if len(runs) != 3 {
+		t.Errorf("Expected every call to run, ran %v", runs)
+	}
+}
+
+func TestTruncateToolResult(t *testing.T) {
+	result := strings.Repeat("žluťoučký kůň ", 200)
+	truncated := truncateToolResult(result, 50, ApproxOpenAITokenCount)
+	if tokens := ApproxOpenAITokenCount(truncated); tokens > 50 {
+		t.Errorf("Expected at most 50 tokens, got %d", tokens)
+	}
+	if !strings.HasSuffix(truncated, " tokens truncated]") {
+		t.Errorf("Expected the truncation marker, got %q", truncated)
+	}
+	if !utf8.ValidString(truncated) {
+		t.Errorf("Expected the result to be cut at a rune boundary, got %q", truncated)
+	}
+
+	if got := truncateToolResult("short", 50, ApproxOpenAITokenCount); got != "short" {
+		t.Errorf("Expected a result that fits to be unchanged, got %q", got)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingBackend is a Backend that records a span for every request of the wrapped one.
+type tracingBackend struct {
+	be     Backend
+	tracer trace.Tracer
+}
+
+// WithTracing wraps be so that every Chat and Generate request is recorded as an
+// OpenTelemetry span of tracer, a child of the span in the context of the call.
+// The spans follow the semantic conventions for generative AI: they are named
+// after the operation and the model, e.g. "chat llama3", and carry the model,
+// the token usage and the finish reason, or the error the request failed with.
+//
+// The context passed to be carries the span, so that spans of an instrumented
+// HTTP client, e.g. one using otelhttp with WithHTTPClient, become its children.
+// ChatStream, if supported by be, is passed through without a span. To trace tool
+// calls as well, see WithToolTracing.
+func WithTracing(be Backend, tracer trace.Tracer) Backend {
+	return &tracingBackend{be: be, tracer: tracer}
+}
+
+// Chat implements Backend.
+func (t *tracingBackend) Chat(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (*Response, error) {
+	ctx, span := t.start(ctx, "chat")
+	defer span.End()
+
+	resp, err := t.be.Chat(ctx, messages, tools, opts...)
+	endLLMSpan(span, resp, err)
+	return resp, err
+}
+
+// Generate implements Backend.
+func (t *tracingBackend) Generate(ctx context.Context, prompt string, opts ...CallOption) (*Response, error) {
+	ctx, span := t.start(ctx, "text_completion")
+	defer span.End()
+
+	resp, err := t.be.Generate(ctx, prompt, opts...)
+	endLLMSpan(span, resp, err)
+	return resp, err
+}
+
+// Close implements Backend by closing the wrapped backend.
+func (t *tracingBackend) Close() error {
+	return t.be.Close()
+}
+
+// ChatStream passes the request to the wrapped backend without recording a span.
+func (t *tracingBackend) ChatStream(ctx context.Context, messages []Message, tools []Tool, opts ...CallOption) (<-chan StreamChunk, error) {
+	streamer, ok := t.be.(Streamer)
+	if !ok {
+		return nil, errors.New("backend does not support streaming")
+	}
+	return streamer.ChatStream(ctx, messages, tools, opts...)
+}
+
+// start starts the span of a request for operation.
+func (t *tracingBackend) start(ctx context.Context, operation string) (context.Context, trace.Span) {
+	name := operation
+	attrs := []attribute.KeyValue{attribute.String("gen_ai.operation.name", operation)}
+	if model := backendModel(t.be); model != "" {
+		name += " " + model
+		attrs = append(attrs, attribute.String("gen_ai.request.model", model))
+	}
+	return t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// endLLMSpan records the outcome of a request on its span.
+func endLLMSpan(span trace.Span, resp *Response, err error) {
+	if err != nil {
+		if status := statusCode(err); status != 0 {
+			span.SetAttributes(attribute.Int("http.response.status_code", status))
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	if resp == nil {
+		return
+	}
+
+	if resp.Model != "" {
+		span.SetAttributes(attribute.String("gen_ai.response.model", resp.Model))
+	}
+	if resp.UsageAvailable {
+		span.SetAttributes(
+			attribute.Int("gen_ai.usage.input_tokens", resp.Usage.PromptTokens),
+			attribute.Int("gen_ai.usage.output_tokens", resp.Usage.CompletionTokens),
+		)
+	}
+	if resp.FinishReason != "" {
+		span.SetAttributes(attribute.StringSlice("gen_ai.response.finish_reasons", []string{resp.FinishReason}))
+	}
+}
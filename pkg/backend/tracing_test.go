@@ -0,0 +1,145 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newRecordingTracer returns a tracer whose finished spans are kept by the returned recorder.
+func newRecordingTracer() (*sdktrace.TracerProvider, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	return sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)), recorder
+}
+
+// spanAttributes returns the attributes of span by key.
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, attr := range span.Attributes() {
+		attrs[attr.Key] = attr.Value
+	}
+	return attrs
+}
+
+func TestWithTracing(t *testing.T) {
+	provider, recorder := newRecordingTracer()
+	tracer := provider.Tracer("test")
+
+	be := WithTracing(&fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			resp := &Response{Model: "llama3", Message: AssistantMessage("Hello!"), FinishReason: FinishStop}
+			resp.setUsage(12, 3, 0)
+			return resp, nil
+		},
+	}, tracer)
+
+	ctx, parent := tracer.Start(context.Background(), "handler")
+	if _, err := be.Chat(ctx, []Message{UserMessage("Hi")}, nil); err != nil {
+		t.Fatalf("Chat returned error: %v", err)
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "chat" || span.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("Expected a chat span under the handler, got %s under %s", span.Name(), span.Parent().SpanID())
+	}
+	attrs := spanAttributes(span)
+	if attrs["gen_ai.usage.input_tokens"].AsInt64() != 12 || attrs["gen_ai.usage.output_tokens"].AsInt64() != 3 {
+		t.Errorf("Expected the token usage, got %v", attrs)
+	}
+	if attrs["gen_ai.response.model"].AsString() != "llama3" || attrs["gen_ai.response.finish_reasons"].AsStringSlice()[0] != FinishStop {
+		t.Errorf("Expected the model and finish reason, got %v", attrs)
+	}
+}
+
+func TestWithTracingRecordsErrors(t *testing.T) {
+	provider, recorder := newRecordingTracer()
+	be := WithTracing(&failingBackend{err: newBackendError(http.StatusTooManyRequests, "slow down")}, provider.Tracer("test"))
+
+	if _, err := be.Generate(context.Background(), "Hi"); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Expected ErrRateLimited, got %v", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected a single span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "text_completion" || span.Status().Code != codes.Error {
+		t.Errorf("Expected a failed text_completion span, got %s with status %v", span.Name(), span.Status())
+	}
+	if status := spanAttributes(span)["http.response.status_code"].AsInt64(); status != http.StatusTooManyRequests {
+		t.Errorf("Expected status code 429, got %d", status)
+	}
+	if len(span.Events()) != 1 || span.Events()[0].Name != "exception" {
+		t.Errorf("Expected the error to be recorded, got %v", span.Events())
+	}
+}
+
+func TestWithToolTracing(t *testing.T) {
+	provider, recorder := newRecordingTracer()
+	tracer := provider.Tracer("test")
+
+	dispatcher := NewToolDispatcher(WithToolTracing(tracer))
+	dispatcher.Register("weather", func(args map[string]any) (string, error) {
+		return "sunny", nil
+	})
+	dispatcher.Register("broken", func(args map[string]any) (string, error) {
+		return "", errors.New("out of order")
+	})
+	be := &fakeBackend{
+		chat: func(messages []Message) (*Response, error) {
+			return &Response{Message: AssistantMessage("It is sunny.")}, nil
+		},
+	}
+	call := func(name string) *Response {
+		return &Response{Message: Message{Role: RoleAssistant, ToolCalls: []ToolCall{{ID: "call_1", Function: FunctionCall{Name: name}}}}}
+	}
+
+	ctx, parent := tracer.Start(context.Background(), "handler")
+	if _, _, err := dispatcher.RunToolCalls(ctx, be, []Message{UserMessage("Weather?")}, call("weather"), nil); err != nil {
+		t.Fatalf("RunToolCalls returned error: %v", err)
+	}
+	if _, _, err := dispatcher.RunToolCalls(ctx, be, []Message{UserMessage("Weather?")}, call("broken"), nil); err == nil {
+		t.Fatalf("Expected the failing tool to return an error")
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans, got %d", len(spans))
+	}
+	ok, failed := spans[0], spans[1]
+	if ok.Name() != "execute_tool weather" || ok.Parent().SpanID() != parent.SpanContext().SpanID() || ok.Status().Code == codes.Error {
+		t.Errorf("Unexpected span of a successful call: %s, %v", ok.Name(), ok.Status())
+	}
+	if spanAttributes(ok)["gen_ai.tool.call.id"].AsString() != "call_1" {
+		t.Errorf("Expected the ID of the call, got %v", spanAttributes(ok))
+	}
+	if failed.Name() != "execute_tool broken" || failed.Status().Code != codes.Error {
+		t.Errorf("Unexpected span of a failed call: %s, %v", failed.Name(), failed.Status())
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+// TruncateMessages drops the oldest messages until the conversation fits in maxTokens,
+// as estimated with estimator; a nil estimator uses HeuristicTokenCount.
+//
+// System messages and the most recent user message are never dropped. When an
+// assistant message requesting tool calls is dropped, the tool results that follow
+// it are dropped with it so that no orphaned results are left behind. If the
+// conversation still does not fit once nothing else can be dropped, the remaining
+// messages are returned as they are.
+//
+// It returns the truncated messages and the number of messages that were removed.
+// The input slice is not modified.
+func TruncateMessages(messages []Message, maxTokens int, estimator TokenCounter) ([]Message, int) {
+	if estimator == nil {
+		estimator = HeuristicTokenCount
+	}
+
+	lastUser := -1
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == RoleUser {
+			lastUser = i
+			break
+		}
+	}
+
+	dropped := make([]bool, len(messages))
+	total := countMessageTokens(estimator, messages)
+	removed := 0
+
+	for i := 0; i < len(messages) && total > maxTokens; i++ {
+		if dropped[i] || i == lastUser || messages[i].Role == RoleSystem {
+			continue
+		}
+
+		dropped[i] = true
+		total -= messageTokens(estimator, messages[i])
+		removed++
+
+		if len(messages[i].ToolCalls) == 0 {
+			continue
+		}
+		for j := i + 1; j < len(messages) && messages[j].Role == RoleTool; j++ {
+			dropped[j] = true
+			total -= messageTokens(estimator, messages[j])
+			removed++
+		}
+	}
+
+	out := make([]Message, 0, len(messages)-removed)
+	for i, msg := range messages {
+		if !dropped[i] {
+			out = append(out, msg)
+		}
+	}
+	return out, removed
+}
@@ -0,0 +1,90 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package backend
+
+import "testing"
+
+// oneTokenPerMessage makes every message cost exactly the per-message overhead.
+func oneTokenPerMessage(string) int { return 0 }
+
+func TestTruncateMessages(t *testing.T) {
+	messages := []Message{
+		{Role: "system", Content: "be nice"},
+		{Role: "user", Content: "first"},
+		{Role: "assistant", Content: "reply"},
+		{Role: "user", Content: "second"},
+		{Role: "assistant", Content: "reply"},
+		{Role: "user", Content: "latest"},
+	}
+
+	// Room for three messages
+	out, removed := TruncateMessages(messages, 3*messageOverheadTokens, oneTokenPerMessage)
+	if removed != 3 {
+		t.Fatalf("Expected 3 removed messages, got %d", removed)
+	}
+	expected := []string{"be nice", "reply", "latest"}
+	for i, content := range expected {
+		if out[i].Content != content {
+			t.Errorf("Expected %q at %d, got %q", content, i, out[i].Content)
+		}
+	}
+	if len(messages) != 6 {
+		t.Errorf("Expected the input to be left untouched")
+	}
+}
+
+func TestTruncateMessagesKeepsSystemAndLatestUser(t *testing.T) {
+	messages := []Message{
+		{Role: "system", Content: "be nice"},
+		{Role: "user", Content: "first"},
+		{Role: "user", Content: "latest"},
+	}
+
+	out, removed := TruncateMessages(messages, 0, oneTokenPerMessage)
+	if removed != 1 || len(out) != 2 {
+		t.Fatalf("Expected only one message to be removed, got %d removed: %+v", removed, out)
+	}
+	if out[0].Role != "system" || out[1].Content != "latest" {
+		t.Errorf("Unexpected messages left: %+v", out)
+	}
+}
+
+func TestTruncateMessagesDropsToolResultsWithCall(t *testing.T) {
+	messages := []Message{
+		{Role: "user", Content: "weather?"},
+		{Role: "assistant", ToolCalls: []ToolCall{{Function: FunctionCall{Name: "weather"}}}},
+		{Role: "tool", Content: "sunny"},
+		{Role: "assistant", Content: "It is sunny."},
+		{Role: "user", Content: "thanks"},
+	}
+
+	out, removed := TruncateMessages(messages, 2*messageOverheadTokens, oneTokenPerMessage)
+	if removed != 3 {
+		t.Fatalf("Expected 3 removed messages, got %d", removed)
+	}
+	for _, msg := range out {
+		if msg.Role == "tool" {
+			t.Errorf("Expected the tool result to be removed with its call")
+		}
+	}
+}
+
+func TestTruncateMessagesFits(t *testing.T) {
+	messages := []Message{{Role: "user", Content: "Hi"}}
+
+	out, removed := TruncateMessages(messages, 1000, nil)
+	if removed != 0 || len(out) != 1 {
+		t.Errorf("Expected nothing to be removed, got %d", removed)
+	}
+}
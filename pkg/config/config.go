@@ -15,14 +15,60 @@
 package config
 
 import (
-	"github.com/spf13/viper"
+	"fmt"
 	"log"
+	"net/url"
+	"strings"
+
+	"github.com/spf13/viper"
 )
 
+// envBindings maps the well-known configuration keys to the environment
+// variables that override them.
+var envBindings = map[string]string{
+	"ollama.host":    "OLLAMA_HOST",
+	"ollama.model":   "OLLAMA_MODEL",
+	"openai.api_key": "OPENAI_API_KEY",
+	"openai.model":   "OPENAI_MODEL",
+}
+
 type Config interface {
 	Get(key string) string
 	GetInt(key string) int
 	GetBool(key string) bool
+	Validate(required ...string) error
+}
+
+// urlKeys are the keys whose values, if set, must be well-formed URLs.
+var urlKeys = []string{"ollama.host"}
+
+// hostKeys are the URL keys that may also be given as a bare host and port, as
+// Ollama accepts for OLLAMA_HOST, e.g. "ollama:11434" or ":11434".
+var hostKeys = map[string]bool{"ollama.host": true}
+
+// withScheme returns host as an http URL if it has no scheme, using localhost
+// if it has no host name either.
+func withScheme(host string) string {
+	if host == "" || strings.Contains(host, "://") {
+		return host
+	}
+	if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+	return "http://" + host
+}
+
+// ConfigError is returned by Validate for a missing or malformed configuration value.
+type ConfigError struct {
+	// Key is the configuration key with the offending value, e.g. "ollama.host".
+	Key string
+	// Reason describes what is wrong with the value.
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid configuration for %s: %s", e.Key, e.Reason)
 }
 
 // ViperConfig implements the Config interface using Viper.
@@ -35,9 +81,14 @@ func NewViperConfig(v *viper.Viper) *ViperConfig {
 	return &ViperConfig{viper: v}
 }
 
-// Get returns a string value for the given key.
+// Get returns a string value for the given key. A value of ollama.host without
+// a scheme, such as "localhost:11434", is returned as an http URL.
 func (vc *ViperConfig) Get(key string) string {
-	return vc.viper.GetString(key)
+	value := vc.viper.GetString(key)
+	if hostKeys[key] {
+		return withScheme(value)
+	}
+	return value
 }
 
 // GetInt returns an integer value for the given key.
@@ -50,10 +101,39 @@ func (vc *ViperConfig) GetBool(key string) bool {
 	return vc.viper.GetBool(key)
 }
 
+// Validate checks that every key in required is set and that the URLs in the
+// configuration, such as ollama.host, are well-formed. It returns a *ConfigError
+// naming the first offending key, so that misconfiguration is caught at startup
+// rather than by the first request.
+func (vc *ViperConfig) Validate(required ...string) error {
+	for _, key := range required {
+		if strings.TrimSpace(vc.Get(key)) == "" {
+			return &ConfigError{Key: key, Reason: "required value is not set"}
+		}
+	}
+
+	for _, key := range urlKeys {
+		value := vc.Get(key)
+		if value == "" {
+			continue
+		}
+		if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return &ConfigError{Key: key, Reason: fmt.Sprintf("%q is not a URL such as http://localhost:11434 or a host and port such as localhost:11434", value)}
+		}
+	}
+	return nil
+}
+
 // InitializeViperConfig initializes and returns a Config implementation using Viper.
 // It reads the configuration from the specified config file and paths.
+//
+// Environment variables take precedence over the file. Every key can be set
+// with the upper-cased key with dots replaced by underscores, e.g. OLLAMA_HOST
+// for ollama.host and OPENAI_API_KEY for openai.api_key. As with Ollama itself,
+// OLLAMA_HOST may be a URL or a bare host and port, see Get.
 func InitializeViperConfig(configName, configType, configPath string) Config {
 	v := viper.New()
+	bindEnv(v)
 	v.SetConfigName(configName)
 	v.SetConfigType(configType)
 	v.AddConfigPath(configPath)
@@ -66,3 +146,23 @@ func InitializeViperConfig(configName, configType, configPath string) Config {
 	// Wrap Viper with ViperConfig and return as Config
 	return NewViperConfig(v)
 }
+
+// FromEnv returns a Config that reads its values from environment variables only,
+// using the same names as InitializeViperConfig, without needing a config file.
+func FromEnv() Config {
+	v := viper.New()
+	bindEnv(v)
+	return NewViperConfig(v)
+}
+
+// bindEnv makes v look up every key in the environment before falling back to
+// the config file. The well-known keys are bound explicitly so that they are
+// also known to Viper when no config file sets them.
+func bindEnv(v *viper.Viper) {
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	for key, env := range envBindings {
+		// BindEnv only fails without arguments
+		_ = v.BindEnv(key, env)
+	}
+}
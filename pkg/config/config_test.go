@@ -2,6 +2,7 @@
 package config
 
 import (
+	"errors"
 	"github.com/spf13/viper"
 	"os"
 	"testing"
@@ -94,3 +95,124 @@ func writeTempConfigFile(filename, content string) error {
 func removeTempConfigFile(filename string) {
 	os.Remove(filename)
 }
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("OLLAMA_HOST", "http://ollama:11434")
+	t.Setenv("OLLAMA_MODEL", "qwen2.5")
+	t.Setenv("CUSTOM_SETTING", "custom")
+
+	cfg := FromEnv()
+	if cfg.Get("ollama.host") != "http://ollama:11434" {
+		t.Errorf("Expected 'http://ollama:11434', got '%s'", cfg.Get("ollama.host"))
+	}
+	if cfg.Get("ollama.model") != "qwen2.5" {
+		t.Errorf("Expected 'qwen2.5', got '%s'", cfg.Get("ollama.model"))
+	}
+	if cfg.Get("custom.setting") != "custom" {
+		t.Errorf("Expected 'custom', got '%s'", cfg.Get("custom.setting"))
+	}
+}
+
+func TestFromEnvHostWithoutScheme(t *testing.T) {
+	for value, want := range map[string]string{
+		"ollama:11434":           "http://ollama:11434",
+		":11434":                 "http://localhost:11434",
+		"https://ollama.example": "https://ollama.example",
+	} {
+		t.Setenv("OLLAMA_HOST", value)
+		if got := FromEnv().Get("ollama.host"); got != want {
+			t.Errorf("OLLAMA_HOST=%s: expected '%s', got '%s'", value, want, got)
+		}
+	}
+}
+
+func TestInitializeViperConfig_EnvOverridesFile(t *testing.T) {
+	configName := "envconfig"
+	configType := "yaml"
+	configFileName := configName + "." + configType
+	err := writeTempConfigFile(configFileName, `
+ollama:
+  host: "http://localhost:11434"
+  model: "llama3"
+`)
+	if err != nil {
+		t.Fatalf("Failed to write temp config file: %v", err)
+	}
+	defer removeTempConfigFile(configFileName)
+
+	t.Setenv("OLLAMA_MODEL", "qwen2.5")
+
+	cfg := InitializeViperConfig(configName, configType, ".")
+	if cfg.Get("ollama.model") != "qwen2.5" {
+		t.Errorf("Expected the environment to override the file, got '%s'", cfg.Get("ollama.model"))
+	}
+	if cfg.Get("ollama.host") != "http://localhost:11434" {
+		t.Errorf("Expected 'http://localhost:11434' from the file, got '%s'", cfg.Get("ollama.host"))
+	}
+}
+
+func TestViperConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   map[string]string
+		required []string
+		badKey   string
+	}{
+		{
+			name:     "valid",
+			values:   map[string]string{"ollama.host": "http://localhost:11434", "ollama.model": "qwen2.5"},
+			required: []string{"ollama.host", "ollama.model"},
+		},
+		{
+			name:     "missing host",
+			values:   map[string]string{"ollama.model": "qwen2.5"},
+			required: []string{"ollama.host", "ollama.model"},
+			badKey:   "ollama.host",
+		},
+		{
+			name:     "blank model",
+			values:   map[string]string{"ollama.host": "http://localhost:11434", "ollama.model": "  "},
+			required: []string{"ollama.host", "ollama.model"},
+			badKey:   "ollama.model",
+		},
+		{
+			name:   "host without scheme",
+			values: map[string]string{"ollama.host": "localhost:11434"},
+		},
+		{
+			name:   "host with another scheme",
+			values: map[string]string{"ollama.host": "ftp://localhost:11434"},
+			badKey: "ollama.host",
+		},
+		{
+			name:   "host that is not a URL",
+			values: map[string]string{"ollama.host": "not a url"},
+			badKey: "ollama.host",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			for key, value := range tt.values {
+				v.Set(key, value)
+			}
+
+			err := NewViperConfig(v).Validate(tt.required...)
+			if tt.badKey == "" {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) {
+				t.Fatalf("Expected a ConfigError, got %v", err)
+			}
+			if configErr.Key != tt.badKey {
+				t.Errorf("Expected the error to name %s, got %s", tt.badKey, configErr.Key)
+			}
+		})
+	}
+}
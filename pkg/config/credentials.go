@@ -0,0 +1,105 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrAPIKeyNotFound is returned by ResolveAPIKey when no source provides an API key.
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// ResolveAPIKey returns the API key for a hosted backend, looking in order at:
+//
+//  1. explicit, typically a command line flag or a value from the config file;
+//  2. the environment variable envVar, e.g. OPENAI_API_KEY;
+//  3. the credentials file at credentialsPath.
+//
+// Empty sources are skipped, so pass "" for any source that does not apply.
+// The credentials file either holds the key alone, or lines such as
+// OPENAI_API_KEY=sk-... with one key per backend, in which case the line named
+// after envVar is used. Blank lines and lines starting with # are ignored.
+//
+// If none of the sources provides a key, the returned error wraps
+// ErrAPIKeyNotFound and lists the sources that were tried.
+func ResolveAPIKey(explicit, envVar, credentialsPath string) (string, error) {
+	if key := strings.TrimSpace(explicit); key != "" {
+		return key, nil
+	}
+
+	tried := []string{"explicit argument"}
+	if envVar != "" {
+		if key := strings.TrimSpace(os.Getenv(envVar)); key != "" {
+			return key, nil
+		}
+		tried = append(tried, "environment variable "+envVar)
+	}
+
+	if credentialsPath != "" {
+		key, err := readCredentialsFile(credentialsPath, envVar)
+		if err != nil {
+			return "", err
+		}
+		if key != "" {
+			return key, nil
+		}
+		tried = append(tried, "credentials file "+credentialsPath)
+	}
+
+	return "", fmt.Errorf("%w: tried %s", ErrAPIKeyNotFound, strings.Join(tried, ", "))
+}
+
+// readCredentialsFile returns the key for name from the credentials file at path,
+// or "" if the file does not exist or holds no such key.
+func readCredentialsFile(path, name string) (string, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to open credentials file: %w", err)
+	}
+	defer f.Close()
+
+	var bare []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			bare = append(bare, line)
+			continue
+		}
+		if name != "" && strings.TrimSpace(k) == name {
+			return strings.Trim(strings.TrimSpace(v), `"'`), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read credentials file: %w", err)
+	}
+
+	// A file holding nothing but the key
+	if len(bare) == 1 {
+		return bare[0], nil
+	}
+	return "", nil
+}
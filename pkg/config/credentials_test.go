@@ -0,0 +1,69 @@
+// credentials_test.go
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveAPIKey(t *testing.T) {
+	dir := t.TempDir()
+	bareFile := filepath.Join(dir, "bare")
+	if err := os.WriteFile(bareFile, []byte("sk-from-file\n"), 0600); err != nil {
+		t.Fatalf("Failed to write credentials file: %v", err)
+	}
+	namedFile := filepath.Join(dir, "named")
+	named := "# gollm credentials\nANTHROPIC_API_KEY=sk-ant\n\nOPENAI_API_KEY = \"sk-openai\"\n"
+	if err := os.WriteFile(namedFile, []byte(named), 0600); err != nil {
+		t.Fatalf("Failed to write credentials file: %v", err)
+	}
+
+	t.Setenv("GOLLM_TEST_API_KEY", "sk-from-env")
+	t.Setenv("OPENAI_API_KEY", "")
+
+	tests := []struct {
+		name     string
+		explicit string
+		envVar   string
+		path     string
+		want     string
+	}{
+		{"explicit wins", "sk-explicit", "GOLLM_TEST_API_KEY", bareFile, "sk-explicit"},
+		{"environment before file", "", "GOLLM_TEST_API_KEY", bareFile, "sk-from-env"},
+		{"bare credentials file", "", "OPENAI_API_KEY", bareFile, "sk-from-file"},
+		{"named credentials file", "", "OPENAI_API_KEY", namedFile, "sk-openai"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ResolveAPIKey(tt.explicit, tt.envVar, tt.path)
+			if err != nil {
+				t.Fatalf("ResolveAPIKey returned error: %v", err)
+			}
+			if key != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, key)
+			}
+		})
+	}
+}
+
+func TestResolveAPIKeyNotFound(t *testing.T) {
+	dir := t.TempDir()
+	namedFile := filepath.Join(dir, "named")
+	if err := os.WriteFile(namedFile, []byte("ANTHROPIC_API_KEY=sk-ant\n"), 0600); err != nil {
+		t.Fatalf("Failed to write credentials file: %v", err)
+	}
+	t.Setenv("OPENAI_API_KEY", "")
+
+	for _, path := range []string{namedFile, filepath.Join(dir, "missing")} {
+		_, err := ResolveAPIKey("", "OPENAI_API_KEY", path)
+		if !errors.Is(err, ErrAPIKeyNotFound) {
+			t.Fatalf("Expected ErrAPIKeyNotFound, got %v", err)
+		}
+		if !strings.Contains(err.Error(), "OPENAI_API_KEY") || !strings.Contains(err.Error(), path) {
+			t.Errorf("Expected the error to name the sources tried, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package prompt renders prompts from text/template templates, so that prompts
+// with a repetitive structure can be kept in one place, or in files, and filled
+// in with variables.
+package prompt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/stackloklabs/gollm/pkg/backend"
+)
+
+// Template is a prompt template using the text/template syntax, e.g.
+//
+//	Summarize the package {{.name}} in {{.sentences}} sentences.
+//
+// It is safe for concurrent use.
+type Template struct {
+	tmpl *template.Template
+}
+
+// Option configures a Template.
+type Option func(*options)
+
+// options holds the settings that can be changed with an Option.
+type options struct {
+	strict bool
+	funcs  template.FuncMap
+}
+
+// WithStrict makes Render fail if the template refers to a variable that is not
+// given. By default a missing variable is rendered as "<no value>".
+func WithStrict() Option {
+	return func(o *options) {
+		o.strict = true
+	}
+}
+
+// WithFuncs makes the functions in funcs available to the template.
+func WithFuncs(funcs template.FuncMap) Option {
+	return func(o *options) {
+		o.funcs = funcs
+	}
+}
+
+// New parses text and returns the template. The name is used in error messages.
+func New(name, text string, opts ...Option) (*Template, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	tmpl := template.New(name)
+	if o.strict {
+		tmpl = tmpl.Option("missingkey=error")
+	}
+	if o.funcs != nil {
+		tmpl = tmpl.Funcs(o.funcs)
+	}
+
+	tmpl, err := tmpl.Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse prompt template %s: %w", name, err)
+	}
+	return &Template{tmpl: tmpl}, nil
+}
+
+// Must returns t and panics if err is not nil. It is meant for templates defined
+// in package variables, e.g. var summary = prompt.Must(prompt.New(...)).
+func Must(t *Template, err error) *Template {
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// ParseFile reads the template in the file at path. The base name of the file is
+// used as the name of the template.
+func ParseFile(path string, opts ...Option) (*Template, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prompt template: %w", err)
+	}
+	return New(filepath.Base(path), string(text), opts...)
+}
+
+// Name returns the name of the template.
+func (t *Template) Name() string {
+	return t.tmpl.Name()
+}
+
+// Render fills in the template with vars and returns the prompt.
+func (t *Template) Render(vars map[string]any) (string, error) {
+	var out strings.Builder
+	if err := t.tmpl.Execute(&out, vars); err != nil {
+		return "", fmt.Errorf("failed to render prompt template %s: %w", t.Name(), err)
+	}
+	return out.String(), nil
+}
+
+// Message renders the template with vars and returns it as a message with the given role.
+func (t *Template) Message(role string, vars map[string]any) (backend.Message, error) {
+	content, err := t.Render(vars)
+	if err != nil {
+		return backend.Message{}, err
+	}
+	return backend.Message{Role: role, Content: content}, nil
+}
+
+// Messages renders a conversation starting with a system message rendered from
+// system, followed by a user message rendered from user, both with the same vars.
+// A nil system template leaves out the system message.
+func Messages(system, user *Template, vars map[string]any) ([]backend.Message, error) {
+	var messages []backend.Message
+	if system != nil {
+		msg, err := system.Message(backend.RoleSystem, vars)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	msg, err := user.Message(backend.RoleUser, vars)
+	if err != nil {
+		return nil, err
+	}
+	return append(messages, msg), nil
+}
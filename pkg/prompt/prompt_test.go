@@ -0,0 +1,115 @@
+// Copyright 2024 Stacklok, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package prompt
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/stackloklabs/gollm/pkg/backend"
+)
+
+func TestRender(t *testing.T) {
+	tmpl, err := New("summary", "Summarize {{.name}} in {{.sentences}} sentences.")
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	got, err := tmpl.Render(map[string]any{"name": "gollm", "sentences": 2})
+	if err != nil {
+		t.Fatalf("Render returned error: %v", err)
+	}
+	if got != "Summarize gollm in 2 sentences." {
+		t.Errorf("Unexpected prompt: %s", got)
+	}
+}
+
+func TestRenderStrict(t *testing.T) {
+	text := "Summarize {{.name}}."
+
+	lenient := Must(New("summary", text))
+	if got, err := lenient.Render(nil); err != nil || got != "Summarize <no value>." {
+		t.Errorf("Expected a placeholder for the missing variable, got %q and %v", got, err)
+	}
+
+	strict := Must(New("summary", text, WithStrict()))
+	_, err := strict.Render(map[string]any{"other": "x"})
+	if err == nil || !strings.Contains(err.Error(), "name") {
+		t.Errorf("Expected an error naming the missing variable, got %v", err)
+	}
+}
+
+func TestNewParseError(t *testing.T) {
+	if _, err := New("broken", "{{.name"); err == nil {
+		t.Errorf("Expected an error for an invalid template")
+	}
+}
+
+func TestWithFuncs(t *testing.T) {
+	tmpl := Must(New("upper", "{{upper .name}}", WithFuncs(template.FuncMap{"upper": strings.ToUpper})))
+	if got, err := tmpl.Render(map[string]any{"name": "gollm"}); err != nil || got != "GOLLM" {
+		t.Errorf("Expected GOLLM, got %q and %v", got, err)
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "summary.tmpl")
+	if err := os.WriteFile(path, []byte("Summarize {{.name}}."), 0o600); err != nil {
+		t.Fatalf("Failed to write template: %v", err)
+	}
+
+	tmpl, err := ParseFile(path, WithStrict())
+	if err != nil {
+		t.Fatalf("ParseFile returned error: %v", err)
+	}
+	if tmpl.Name() != "summary.tmpl" {
+		t.Errorf("Expected the file name as template name, got %s", tmpl.Name())
+	}
+	if got, err := tmpl.Render(map[string]any{"name": "gollm"}); err != nil || got != "Summarize gollm." {
+		t.Errorf("Unexpected prompt %q and error %v", got, err)
+	}
+
+	if _, err := ParseFile(filepath.Join(t.TempDir(), "missing.tmpl")); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
+
+func TestMessages(t *testing.T) {
+	system := Must(New("system", "You are an expert on {{.topic}}."))
+	user := Must(New("user", "Tell me about {{.name}}."))
+
+	messages, err := Messages(system, user, map[string]any{"topic": "Go", "name": "gollm"})
+	if err != nil {
+		t.Fatalf("Messages returned error: %v", err)
+	}
+	want := []backend.Message{
+		backend.SystemMessage("You are an expert on Go."),
+		backend.UserMessage("Tell me about gollm."),
+	}
+	if len(messages) != len(want) {
+		t.Fatalf("Expected %d messages, got %d", len(want), len(messages))
+	}
+	for i := range want {
+		if messages[i].Role != want[i].Role || messages[i].Content != want[i].Content {
+			t.Errorf("Expected %+v at %d, got %+v", want[i], i, messages[i])
+		}
+	}
+
+	if messages, err := Messages(nil, user, map[string]any{"name": "gollm"}); err != nil || len(messages) != 1 {
+		t.Errorf("Expected only the user message, got %+v and %v", messages, err)
+	}
+}